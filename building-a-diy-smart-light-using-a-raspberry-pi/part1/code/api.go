@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTelemetry is how many recent events each light keeps for the API.
+	maxTelemetry   = 100
+	maxAPIBody     = 64 << 10
+	minAPITokenLen = 16
+)
+
+// apiServer is the LAN API, for controlling the lights when the cloud can't
+// be reached:
+//
+//	GET       /api/lights                  every light's state
+//	GET       /api/lights/{id}             the light's state
+//	PUT|PATCH /api/lights/{id}             change the light, body as lightChange
+//	POST      /api/lights/{id}/toggle      toggle the light
+//	GET       /api/lights/{id}/connection  the broker connection
+//	GET       /api/lights/{id}/health      the latest health checks
+//	GET       /api/lights/{id}/telemetry   recent events, ?limit=n
+//
+// Every request needs "Authorization: Bearer <token>". Changes are local
+// changes to the light, like the wall button's: they are reported upstream
+// and hold off remote configs as the conflict policy says.
+type apiServer struct {
+	server *http.Server
+	token  [sha256.Size]byte
+
+	mu      sync.Mutex
+	devices map[string]*device
+}
+
+// startAPI listens on addr and serves the API until Close is called. It uses
+// TLS when certFile and keyFile are set.
+func startAPI(addr, token, certFile, keyFile string) (*apiServer, error) {
+	a := &apiServer{
+		token:   sha256.Sum256([]byte(token)),
+		devices: map[string]*device{},
+	}
+	a.server = &http.Server{
+		Handler:      a,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		var err error
+		if certFile != "" {
+			err = a.server.ServeTLS(l, certFile, keyFile)
+		} else {
+			err = a.server.Serve(l)
+		}
+		if err != http.ErrServerClosed {
+			fmt.Printf("api: %s\n", err)
+		}
+	}()
+	return a, nil
+}
+
+// Close stops the server.
+func (a *apiServer) Close() error {
+	return a.server.Close()
+}
+
+// Add makes d available through the API.
+func (a *apiServer) Add(d *device) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.devices[d.cfg.DeviceID] = d
+}
+
+func (a *apiServer) device(id string) *device {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.devices[id]
+}
+
+// apiError is the body of every error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// connectionStatus is the body of /connection.
+type connectionStatus struct {
+	Connected bool         `json:"connected"`
+	Broker    string       `json:"broker"`
+	Outbox    *outboxStats `json:"outbox,omitempty"`
+	LastError string       `json:"last_error,omitempty"`
+}
+
+func (a *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="iot-client"`)
+		writeJSON(w, http.StatusUnauthorized, apiError{"missing or wrong token"})
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "api" || path[1] != "lights" {
+		writeJSON(w, http.StatusNotFound, apiError{"not found"})
+		return
+	}
+	if len(path) == 2 {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		a.mu.Lock()
+		states := map[string]stateReport{}
+		for id, d := range a.devices {
+			states[id] = d.reporter.report()
+		}
+		a.mu.Unlock()
+		writeJSON(w, http.StatusOK, states)
+		return
+	}
+
+	d := a.device(path[2])
+	if d == nil || len(path) > 4 {
+		writeJSON(w, http.StatusNotFound, apiError{"not found"})
+		return
+	}
+	action := ""
+	if len(path) == 4 {
+		action = path[3]
+	}
+
+	switch action {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, d.reporter.report())
+		case http.MethodPut, http.MethodPatch:
+			a.change(w, r, d)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPatch)
+		}
+	case "toggle":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if err := d.light.Toggle(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, d.reporter.report())
+	case "connection":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, d.connection())
+	case "health":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, d.health.Summary())
+	case "telemetry":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		limit := maxTelemetry
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				writeJSON(w, http.StatusBadRequest, apiError{"limit must be a positive number"})
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, http.StatusOK, d.telemetry.Recent(limit))
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{"not found"})
+	}
+}
+
+// connection reports the device's broker connection.
+func (d *device) connection() connectionStatus {
+	status := connectionStatus{
+		Connected: d.client.IsConnected(),
+		Broker:    d.cfg.brokerURL(),
+		LastError: d.reporter.report().LastError,
+	}
+	if d.box != nil {
+		stats := d.box.Stats()
+		status.Outbox = &stats
+	}
+	return status
+}
+
+func (a *apiServer) change(w http.ResponseWriter, r *http.Request, d *device) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAPIBody))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, apiError{err.Error()})
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	var ch lightChange
+	if err := dec.Decode(&ch); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{fmt.Sprintf("malformed body: %s", err)})
+		return
+	}
+
+	switch err := d.light.Local(&ch).(type) {
+	case nil:
+	case *invalidChangeError:
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	default:
+		writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, d.reporter.report())
+}
+
+// authorized checks the bearer token. Both sides are hashed first so the
+// comparison takes the same time whatever the token's length.
+func (a *apiServer) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return false
+	}
+	got := sha256.Sum256([]byte(strings.TrimPrefix(h, prefix)))
+	return subtle.ConstantTimeCompare(got[:], a.token[:]) == 1
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		code = http.StatusInternalServerError
+		b = []byte(`{"error": "failed to encode the response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
+
+// telemetryEntry is an event the device published.
+type telemetryEntry struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+	At      time.Time       `json:"at"`
+}
+
+// telemetryLog keeps the most recent events published, for the API. It is a
+// publisher that records messages for its topic and passes everything on.
+type telemetryLog struct {
+	pub   publisher
+	topic string
+	clock clock
+	max   int
+
+	mu      sync.Mutex
+	entries []telemetryEntry
+}
+
+func newTelemetryLog(pub publisher, topic string, clk clock, max int) *telemetryLog {
+	return &telemetryLog{pub: pub, topic: topic, clock: clk, max: max}
+}
+
+func (t *telemetryLog) Publish(msg, topic string) error {
+	if topic == t.topic {
+		payload := json.RawMessage(msg)
+		if !json.Valid(payload) {
+			payload, _ = json.Marshal(msg)
+		}
+		t.mu.Lock()
+		t.entries = append(t.entries, telemetryEntry{topic, payload, t.clock.Now()})
+		if len(t.entries) > t.max {
+			t.entries = t.entries[len(t.entries)-t.max:]
+		}
+		t.mu.Unlock()
+	}
+	return t.pub.Publish(msg, topic)
+}
+
+// Recent returns up to n of the latest events, newest first.
+func (t *telemetryLog) Recent(n int) []telemetryEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n > len(t.entries) {
+		n = len(t.entries)
+	}
+	recent := make([]telemetryEntry, n)
+	for i := range recent {
+		recent[i] = t.entries[len(t.entries)-1-i]
+	}
+	return recent
+}
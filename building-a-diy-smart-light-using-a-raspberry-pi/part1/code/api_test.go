@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const testAPIToken = "0123456789abcdef"
+
+// apiRequest sends a request straight to the API's handler and decodes the
+// JSON response into v, if given.
+func apiRequest(t *testing.T, a *apiServer, method, path, token, body string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s %s: content type is %q", method, path, ct)
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: malformed response %q: %s", method, path, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+func TestAPI(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	b := startTestBroker(t)
+	defer b.Close()
+
+	d, err := startDevice(simConfig(t, b, dir, "lamp"), &shared{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	eventually(t, "the light to connect", d.client.IsConnected)
+
+	a, err := startAPI("127.0.0.1:0", testAPIToken, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Add(d)
+
+	for _, token := range []string{"", "wrong-token-of-some-length"} {
+		w := apiRequest(t, a, "GET", "/api/lights", token, "", nil)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q gave %d", token, w.Code)
+		}
+	}
+
+	var all map[string]stateReport
+	if w := apiRequest(t, a, "GET", "/api/lights", testAPIToken, "", &all); w.Code != http.StatusOK {
+		t.Fatalf("list gave %d", w.Code)
+	}
+	if s, ok := all["lamp"]; !ok || s.Power != powerOff {
+		t.Errorf("list is %+v", all)
+	}
+
+	var s stateReport
+	w := apiRequest(t, a, "PATCH", "/api/lights/lamp", testAPIToken, `{"power": "on", "brightness": 30}`, &s)
+	if w.Code != http.StatusOK || s.Power != powerOn || s.Brightness != 30 || s.Source != sourceLocal {
+		t.Errorf("patch gave %d %+v", w.Code, s)
+	}
+
+	var e apiError
+	cases := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"PATCH", "/api/lights/lamp", `{"brightness": 300}`, http.StatusBadRequest},
+		{"PATCH", "/api/lights/lamp", `{"power": "on", "colour": "#ffffff"}`, http.StatusBadRequest},
+		{"PUT", "/api/lights/lamp", `{"power":`, http.StatusBadRequest},
+		{"PATCH", "/api/lights/lamp", `{"power": "` + strings.Repeat("x", maxAPIBody) + `"}`, http.StatusRequestEntityTooLarge},
+		{"DELETE", "/api/lights/lamp", "", http.StatusMethodNotAllowed},
+		{"GET", "/api/lights/lamp/toggle", "", http.StatusMethodNotAllowed},
+		{"GET", "/api/lights/desk", "", http.StatusNotFound},
+		{"GET", "/api/lights/lamp/nothing", "", http.StatusNotFound},
+		{"GET", "/api/other", "", http.StatusNotFound},
+		{"GET", "/api/lights/lamp/telemetry?limit=0", "", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		e = apiError{}
+		w := apiRequest(t, a, c.method, c.path, testAPIToken, c.body, &e)
+		if w.Code != c.code || e.Error == "" {
+			t.Errorf("%s %s gave %d %q, want %d", c.method, c.path, w.Code, e.Error, c.code)
+		}
+	}
+	if w := apiRequest(t, a, "DELETE", "/api/lights/lamp", testAPIToken, "", nil); w.Header().Get("Allow") != "GET, PUT, PATCH" {
+		t.Errorf("Allow is %q", w.Header().Get("Allow"))
+	}
+	// Rejected changes leave the light alone.
+	if c, _ := d.light.Current(); c.Power != powerOn || c.brightness() != 30 {
+		t.Errorf("after rejected changes the light is %+v", c)
+	}
+
+	w = apiRequest(t, a, "POST", "/api/lights/lamp/toggle", testAPIToken, "", &s)
+	if w.Code != http.StatusOK || s.Power != powerOff {
+		t.Errorf("toggle gave %d %+v", w.Code, s)
+	}
+
+	var conn connectionStatus
+	apiRequest(t, a, "GET", "/api/lights/lamp/connection", testAPIToken, "", &conn)
+	if !conn.Connected || conn.Broker != "tcp://"+b.Addr() || conn.Outbox == nil {
+		t.Errorf("connection is %+v", conn)
+	}
+
+	var health healthSummary
+	if w := apiRequest(t, a, "GET", "/api/lights/lamp/health", testAPIToken, "", &health); w.Code != http.StatusOK {
+		t.Errorf("health gave %d", w.Code)
+	}
+
+	d.telemetry.Publish(`{"type":"first"}`, d.client.Topic(topicEvents))
+	d.telemetry.Publish(`not json`, d.client.Topic(topicEvents))
+	var recent []telemetryEntry
+	apiRequest(t, a, "GET", "/api/lights/lamp/telemetry?limit=2", testAPIToken, "", &recent)
+	if len(recent) != 2 {
+		t.Fatalf("telemetry is %+v", recent)
+	}
+	var text string
+	var event struct{ Type string }
+	if json.Unmarshal(recent[0].Payload, &text) != nil || text != "not json" {
+		t.Errorf("newest event is %s", recent[0].Payload)
+	}
+	if json.Unmarshal(recent[1].Payload, &event) != nil || event.Type != "first" {
+		t.Errorf("oldest event is %s", recent[1].Payload)
+	}
+}
+
+func TestAPIConnectionReportsDefaultBroker(t *testing.T) {
+	clk := newFakeClock(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+	l, _ := testLight(clk)
+	d := &device{
+		cfg:      &config{Connector: "iotcore"},
+		client:   &client{mqttClient: MQTT.NewClient(MQTT.NewClientOptions())},
+		reporter: newStateReporter(&recordingPublisher{}, "state", l, clk, 0, 0),
+	}
+	conn := d.connection()
+	if conn.Connected || conn.Broker != iotCoreBroker || conn.Outbox != nil {
+		t.Errorf("connection is %+v", conn)
+	}
+}
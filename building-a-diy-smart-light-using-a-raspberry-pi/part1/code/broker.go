@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// broker is a small in-process MQTT 3.1.1 broker, enough to run the client
+// end to end on a machine with no broker or cloud account: QoS 0 and 1 (QoS 2
+// publishes are accepted and delivered at QoS 1), + and # wildcards, retained
+// messages and wills. Sessions are not kept between connections. Code in the
+// same process can publish and watch topics with Publish and Watch.
+type broker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	sessions map[string]*brokerSession
+	retained map[string]*packets.PublishPacket
+	watchers []brokerWatcher
+}
+
+type brokerWatcher struct {
+	filter string
+	f      func(topic string, payload []byte)
+}
+
+// brokerSession is one connected client.
+type brokerSession struct {
+	conn net.Conn
+	id   string
+	will *packets.PublishPacket
+
+	mu     sync.Mutex
+	subs   map[string]byte
+	nextID uint16
+}
+
+// startBroker listens on addr, e.g. "localhost:1883", and serves clients
+// until Close is called.
+func startBroker(addr string) (*broker, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &broker{
+		listener: l,
+		sessions: map[string]*brokerSession{},
+		retained: map[string]*packets.PublishPacket{},
+	}
+	go b.accept()
+	return b, nil
+}
+
+// Addr returns the address the broker listens on.
+func (b *broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Close stops listening and drops every client.
+func (b *broker) Close() error {
+	err := b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.sessions {
+		s.conn.Close()
+	}
+	return err
+}
+
+// Publish sends a message to every subscriber as if a client had published
+// it at QoS 1.
+func (b *broker) Publish(topic string, payload []byte, retain bool) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+	p.Qos = 1
+	p.Retain = retain
+	b.route(p)
+}
+
+// Watch calls f with every message published on a topic matching filter,
+// including retained ones already held.
+func (b *broker) Watch(filter string, f func(topic string, payload []byte)) error {
+	if !validTopicFilter(filter) {
+		return fmt.Errorf("invalid topic filter %q", filter)
+	}
+	b.mu.Lock()
+	b.watchers = append(b.watchers, brokerWatcher{filter, f})
+	var held []*packets.PublishPacket
+	for topic, p := range b.retained {
+		if topicMatches(filter, topic) {
+			held = append(held, p)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, p := range held {
+		f(p.TopicName, p.Payload)
+	}
+	return nil
+}
+
+func (b *broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+// serve runs one client connection from CONNECT until it closes.
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	pkt, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	cp, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.ReturnCode = cp.Validate()
+	if ack.ReturnCode != packets.Accepted {
+		ack.Write(conn)
+		return
+	}
+
+	s := &brokerSession{conn: conn, id: cp.ClientIdentifier, subs: map[string]byte{}}
+	if s.id == "" {
+		s.id = conn.RemoteAddr().String()
+	}
+	if cp.WillFlag {
+		s.will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		s.will.TopicName = cp.WillTopic
+		s.will.Payload = cp.WillMessage
+		s.will.Qos = cp.WillQos
+		s.will.Retain = cp.WillRetain
+	}
+
+	// A client connecting again with the same id takes over the session.
+	b.mu.Lock()
+	if old, ok := b.sessions[s.id]; ok {
+		old.conn.Close()
+	}
+	b.sessions[s.id] = s
+	b.mu.Unlock()
+	fmt.Printf("broker: %s connected\n", s.id)
+
+	clean := false
+	defer func() {
+		b.mu.Lock()
+		if b.sessions[s.id] == s {
+			delete(b.sessions, s.id)
+		}
+		b.mu.Unlock()
+		fmt.Printf("broker: %s disconnected\n", s.id)
+		if !clean && s.will != nil {
+			b.route(s.will)
+		}
+	}()
+
+	if err := s.write(ack); err != nil {
+		return
+	}
+
+	// The client must send something within one and a half keepalives.
+	timeout := time.Duration(cp.Keepalive) * 1500 * time.Millisecond
+	for {
+		if timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		pkt, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch p := pkt.(type) {
+		case *packets.PublishPacket:
+			if !validTopicName(p.TopicName) {
+				return
+			}
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				err = s.write(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				err = s.write(rec)
+			}
+			b.route(p)
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			err = s.write(comp)
+		case *packets.SubscribePacket:
+			err = b.subscribe(s, p)
+		case *packets.UnsubscribePacket:
+			s.mu.Lock()
+			for _, filter := range p.Topics {
+				delete(s.subs, filter)
+			}
+			s.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			err = s.write(ack)
+		case *packets.PingreqPacket:
+			err = s.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			clean = true
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// subscribe adds the filters in p to s, acknowledges them and then sends the
+// retained messages they match.
+func (b *broker) subscribe(s *brokerSession, p *packets.SubscribePacket) error {
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+
+	s.mu.Lock()
+	for i, filter := range p.Topics {
+		if !validTopicFilter(filter) {
+			ack.ReturnCodes = append(ack.ReturnCodes, 0x80)
+			continue
+		}
+		qos := p.Qoss[i]
+		if qos > 1 {
+			qos = 1
+		}
+		s.subs[filter] = qos
+		ack.ReturnCodes = append(ack.ReturnCodes, qos)
+	}
+	s.mu.Unlock()
+	if err := s.write(ack); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	var held []*packets.PublishPacket
+	for topic, r := range b.retained {
+		for i, filter := range p.Topics {
+			if ack.ReturnCodes[i] != 0x80 && topicMatches(filter, topic) {
+				held = append(held, r)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	for _, r := range held {
+		if err := s.deliver(r, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// route keeps p if it is retained and hands it to every matching subscriber.
+// A retained message with an empty payload clears the topic's retained
+// message instead.
+func (b *broker) route(p *packets.PublishPacket) {
+	b.mu.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			b.retained[p.TopicName] = p.Copy()
+		}
+	}
+	sessions := make([]*brokerSession, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	watchers := append([]brokerWatcher(nil), b.watchers...)
+	b.mu.Unlock()
+
+	for _, s := range sessions {
+		if err := s.deliver(p, false); err != nil {
+			s.conn.Close()
+		}
+	}
+	for _, w := range watchers {
+		if topicMatches(w.filter, p.TopicName) {
+			w.f(p.TopicName, p.Payload)
+		}
+	}
+}
+
+// deliver sends p to the session if one of its filters matches, at the
+// lower of the publish and subscription QoS.
+func (s *brokerSession) deliver(p *packets.PublishPacket, retained bool) error {
+	s.mu.Lock()
+	matched := false
+	var qos byte
+	for filter, q := range s.subs {
+		if topicMatches(filter, p.TopicName) {
+			matched = true
+			if q > qos {
+				qos = q
+			}
+		}
+	}
+	if !matched {
+		s.mu.Unlock()
+		return nil
+	}
+	if p.Qos < qos {
+		qos = p.Qos
+	}
+
+	out := p.Copy()
+	out.Qos = qos
+	out.Retain = retained
+	if qos > 0 {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID++
+		}
+		out.MessageID = s.nextID
+	}
+	err := out.Write(s.conn)
+	s.mu.Unlock()
+	return err
+}
+
+func (s *brokerSession) write(p packets.ControlPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return p.Write(s.conn)
+}
+
+// validTopicName reports whether topic can be published to: not empty and
+// without wildcards.
+func validTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// validTopicFilter reports whether filter can be subscribed to. Wildcards must
+// fill a whole level and # must be the last level.
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatches reports whether topic matches filter. Wildcards at the start
+// of a filter do not match topics starting with $.
+func topicMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/drivers/gpio"
+)
+
+const (
+	defaultDebounce    = 50 * time.Millisecond
+	buttonPollInterval = 5 * time.Millisecond
+)
+
+// debouncer filters contact bounce. A press counts only when the contacts
+// have been quiet for at least the interval, so the burst of edges a bouncing
+// switch makes gives a single press.
+type debouncer struct {
+	interval time.Duration
+	clock    clock
+
+	mu     sync.Mutex
+	last   time.Time
+	pushed bool
+}
+
+// Edge records a change of the contacts and reports whether it is a press
+// that should be acted on.
+func (d *debouncer) Edge(pushed bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	quiet := d.last.IsZero() || now.Sub(d.last) >= d.interval
+	d.last = now
+	d.pushed = pushed
+	return pushed && quiet
+}
+
+// Pushed reports whether the contacts were last seen pushed.
+func (d *debouncer) Pushed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pushed
+}
+
+// watchButton feeds the pushes and releases of b to d and calls onPress for
+// every debounced press, until stop is closed. Pushes and releases come
+// through one subscription so their order is kept. It subscribes before
+// returning, so a press straight after the robot starts is not missed.
+func watchButton(b *gpio.ButtonDriver, d *debouncer, onPress func(), stop <-chan struct{}) {
+	events := b.Subscribe()
+	go func() {
+		defer b.Unsubscribe(events)
+		for {
+			select {
+			case <-stop:
+				return
+			case e := <-events:
+				switch e.Name {
+				case gpio.ButtonPush:
+					if d.Edge(true) {
+						onPress()
+					}
+				case gpio.ButtonRelease:
+					d.Edge(false)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebouncer(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	d := &debouncer{interval: 50 * time.Millisecond, clock: clk}
+
+	// Each step moves the clock on by after and then feeds an edge.
+	steps := []struct {
+		after  time.Duration
+		pushed bool
+		press  bool
+	}{
+		// The first push counts, and the bounce after it does not.
+		{0, true, true},
+		{time.Millisecond, false, false},
+		{2 * time.Millisecond, true, false},
+		{time.Millisecond, false, false},
+		{3 * time.Millisecond, true, false},
+		// A release and a push each quiet for the interval.
+		{50 * time.Millisecond, false, false},
+		{50 * time.Millisecond, true, true},
+		// Chatter keeps the contacts from ever going quiet.
+		{50 * time.Millisecond, false, false},
+		{49 * time.Millisecond, true, false},
+		{49 * time.Millisecond, false, false},
+		{49 * time.Millisecond, true, false},
+		// Releases never count, however quiet.
+		{200 * time.Millisecond, false, false},
+		{60 * time.Millisecond, true, true},
+	}
+	for i, s := range steps {
+		clk.Advance(s.after)
+		if got := d.Edge(s.pushed); got != s.press {
+			t.Errorf("step %d: edge to pushed %v gave a press %v", i, s.pushed, got)
+		}
+		if d.Pushed() != s.pushed {
+			t.Errorf("step %d: pushed is %v", i, d.Pushed())
+		}
+	}
+
+	// With no interval every push is a press.
+	d = &debouncer{clock: clk}
+	for i := 0; i < 3; i++ {
+		if !d.Edge(true) || d.Edge(false) {
+			t.Fatalf("press %d was filtered without an interval", i)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "time"
+
+// clock is the source of time for anything that waits or stamps times, so a
+// fake can be swapped in where time needs to be controlled.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
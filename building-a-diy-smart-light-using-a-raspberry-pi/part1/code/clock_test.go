@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to. Channels from After
+// fire once Advance reaches their time.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	return ch
+}
+
+// Advance moves the clock on and fires every After that has come due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to t, which may be earlier, as when NTP corrects it.
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+	var left []fakeWaiter
+	for _, w := range c.waiters {
+		if t.Before(w.at) {
+			left = append(left, w)
+			continue
+		}
+		w.ch <- t
+	}
+	c.waiters = left
+}
+
+// Waiters returns how many Afters have not fired yet.
+func (c *fakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// waitForWaiters blocks until a goroutine is waiting on the clock n times,
+// so the test knows it has got as far as sleeping.
+func waitForWaiters(t *testing.T, c *fakeClock, n int) {
+	t.Helper()
+	eventually(t, "goroutines to wait on the clock", func() bool { return c.Waiters() >= n })
+}
+
+// eventually waits for cond to hold, for work done on other goroutines.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := newFakeClock(start)
+	soon, later := c.After(time.Second), c.After(time.Minute)
+
+	c.Advance(30 * time.Second)
+	select {
+	case at := <-soon:
+		if !at.Equal(start.Add(30 * time.Second)) {
+			t.Errorf("fired at %s", at)
+		}
+	default:
+		t.Fatal("After(1s) did not fire after 30s")
+	}
+	select {
+	case <-later:
+		t.Fatal("After(1m) fired after 30s")
+	default:
+	}
+	if c.Waiters() != 1 {
+		t.Errorf("%d waiters left, want 1", c.Waiters())
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSeenCommands is how many command ids are remembered to drop
+	// repeated deliveries.
+	maxSeenCommands = 64
+
+	defaultIdentifyBlinks = 5
+	defaultIdentifyPeriod = 500 * time.Millisecond
+
+	// rebootDelay gives the reboot command's result time to go out before
+	// the client shuts down.
+	rebootDelay = time.Second
+
+	diagnosticsTelemetry = 10
+)
+
+// command is a one-shot request to the device, unlike a config which says
+// what state it should be in. It is published on a subfolder of the commands
+// topic naming the command, e.g. /devices/light1/commands/identify, with a
+// body such as
+//
+//	{"id": "7d3f", "args": {"blinks": 3}}
+//
+// The id is echoed in the result so the sender can match the two up.
+type command struct {
+	ID   string          `json:"id"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// commandResult is published on the results topic for every command
+// received, including the ones that are rejected.
+type commandResult struct {
+	ID      string      `json:"id"`
+	Command string      `json:"command"`
+	OK      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	At      time.Time   `json:"at"`
+}
+
+// commandHandler runs a command with its args, which may be empty, and
+// returns data for the result.
+type commandHandler func(args json.RawMessage) (interface{}, error)
+
+// commandRegistry runs the commands arriving for one device and publishes
+// their results. Commands without a handler are rejected.
+type commandRegistry struct {
+	pub     publisher
+	topic   string
+	results string
+	clock   clock
+
+	mu       sync.Mutex
+	handlers map[string]commandHandler
+	seen     []string
+}
+
+func newCommandRegistry(pub publisher, topic, results string, clk clock) *commandRegistry {
+	return &commandRegistry{
+		pub:      pub,
+		topic:    topic,
+		results:  results,
+		clock:    clk,
+		handlers: map[string]commandHandler{},
+	}
+}
+
+// Handle registers h to run the command called name.
+func (r *commandRegistry) Handle(name string, h commandHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[name] = h
+}
+
+// Filter is the topic filter to subscribe to for commands.
+func (r *commandRegistry) Filter() string {
+	return r.topic + "/#"
+}
+
+// Names returns the registered commands, sorted.
+func (r *commandRegistry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Dispatch runs the command in a message received on topic and publishes its
+// result. Retained messages are refused, so a command left on the broker is
+// not run again on every connect, and an id seen recently is dropped as a
+// repeated delivery.
+func (r *commandRegistry) Dispatch(topic string, payload []byte, retained bool) {
+	name := strings.TrimPrefix(topic, r.topic+"/")
+	if name == topic {
+		name = ""
+	}
+	res := commandResult{Command: name}
+
+	var cmd command
+	err := json.Unmarshal(payload, &cmd)
+	res.ID = cmd.ID
+	switch {
+	case err != nil:
+		err = fmt.Errorf("malformed command: %s", err)
+	case cmd.ID == "":
+		err = fmt.Errorf("command has no id")
+	case name == "":
+		err = fmt.Errorf("command has no name, publish it to %s/<command>", r.topic)
+	case retained:
+		err = fmt.Errorf("retained commands are not run")
+	case !r.firstSeen(cmd.ID):
+		fmt.Printf("ignoring command %s %s, it was already received\n", name, cmd.ID)
+		return
+	}
+
+	if err == nil {
+		r.mu.Lock()
+		h, ok := r.handlers[name]
+		r.mu.Unlock()
+		if ok {
+			res.Data, err = h(cmd.Args)
+		} else {
+			err = fmt.Errorf("unknown command %q, known commands are %s", name, strings.Join(r.Names(), ", "))
+		}
+	}
+
+	res.OK = err == nil
+	if err != nil {
+		res.Error = err.Error()
+		fmt.Printf("command %s %s failed: %s\n", name, cmd.ID, err)
+	}
+	res.At = r.clock.Now()
+	b, err := json.Marshal(res)
+	if err != nil {
+		fmt.Printf("failed to encode the result of command %s %s: %s\n", name, cmd.ID, err)
+		return
+	}
+	if err := r.pub.Publish(string(b), r.results); err != nil {
+		fmt.Printf("failed to publish the result of command %s %s: %s\n", name, cmd.ID, err)
+	}
+}
+
+// firstSeen records id and reports whether it is new.
+func (r *commandRegistry) firstSeen(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, seen := range r.seen {
+		if seen == id {
+			return false
+		}
+	}
+	r.seen = append(r.seen, id)
+	if len(r.seen) > maxSeenCommands {
+		r.seen = r.seen[len(r.seen)-maxSeenCommands:]
+	}
+	return true
+}
+
+// decodeArgs decodes a command's args into v, leaving v alone when there are
+// none.
+func decodeArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 || string(args) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return fmt.Errorf("malformed args: %s", err)
+	}
+	return nil
+}
+
+// registerCommands adds the built-in commands:
+//
+//	identify          blink the light, args {"blinks": n, "period_ms": n}
+//	reboot            restart the client
+//	resync            republish the state, send the outbox and fetch the config again
+//	dump-diagnostics  return the device's state, connection and recent events
+func (d *device) registerCommands() {
+	d.commands.Handle("identify", d.identify)
+	d.commands.Handle("reboot", d.reboot)
+	d.commands.Handle("resync", d.resync)
+	d.commands.Handle("dump-diagnostics", d.diagnostics)
+}
+
+func (d *device) identify(args json.RawMessage) (interface{}, error) {
+	a := struct {
+		Blinks   int   `json:"blinks"`
+		PeriodMS int64 `json:"period_ms"`
+	}{defaultIdentifyBlinks, int64(defaultIdentifyPeriod / time.Millisecond)}
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Blinks < 1 || a.Blinks > 50 {
+		return nil, fmt.Errorf("blinks must be between 1 and 50, not %d", a.Blinks)
+	}
+	if a.PeriodMS < 100 || a.PeriodMS > 5000 {
+		return nil, fmt.Errorf("period_ms must be between 100 and 5000, not %d", a.PeriodMS)
+	}
+	return nil, d.light.Identify(a.Blinks, time.Duration(a.PeriodMS)*time.Millisecond)
+}
+
+func (d *device) reboot(args json.RawMessage) (interface{}, error) {
+	if d.shared.restart == nil {
+		return nil, fmt.Errorf("this client cannot restart itself")
+	}
+	go func() {
+		<-time.After(rebootDelay)
+		d.shared.restart(restartCommand)
+	}()
+	return nil, nil
+}
+
+func (d *device) resync(args json.RawMessage) (interface{}, error) {
+	if !d.client.IsConnected() {
+		return nil, fmt.Errorf("not connected")
+	}
+	d.reporter.publish()
+	// The queued publisher drains the outbox; draining it here as well
+	// could send the same message twice.
+	if d.queued != nil {
+		d.queued.Wake()
+	}
+	// Subscribing again makes the broker send the retained config.
+	if err := d.client.Subsribe(d.client.Topic(topicConfig), d.onConfig); err != nil {
+		return nil, fmt.Errorf("failed to fetch the config: %s", err)
+	}
+	return d.reporter.report(), nil
+}
+
+// deviceDiagnostics is the result of dump-diagnostics.
+type deviceDiagnostics struct {
+	Device     string            `json:"device"`
+	Hardware   string            `json:"hardware"`
+	State      stateReport       `json:"state"`
+	Connection connectionStatus  `json:"connection"`
+	Commands   []string          `json:"commands"`
+	Goroutines int               `json:"goroutines"`
+	HeapBytes  uint64            `json:"heap_bytes"`
+	Events     []telemetryEntry  `json:"recent_events"`
+	Boards     map[string]string `json:"boards,omitempty"`
+	Health     healthSummary     `json:"health"`
+}
+
+func (d *device) diagnostics(args json.RawMessage) (interface{}, error) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var boards map[string]string
+	if d.gateway != nil {
+		boards = d.gateway.Boards()
+	}
+	return deviceDiagnostics{
+		Device:     d.cfg.DeviceID,
+		Hardware:   d.cfg.Hardware,
+		State:      d.reporter.report(),
+		Connection: d.connection(),
+		Commands:   d.commands.Names(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  mem.HeapAlloc,
+		Events:     d.telemetry.Recent(diagnosticsTelemetry),
+		Boards:     boards,
+		Health:     d.health.Summary(),
+	}, nil
+}
+
+// Identify blinks the light fully on and off blinks times, period apart, so
+// it can be picked out, then puts it back as it was. The blinking runs in
+// the background; changes meanwhile are recorded as usual and shown once it
+// ends. SafeState ends it early.
+func (l *light) Identify(blinks int, period time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.identifying {
+		return fmt.Errorf("already identifying")
+	}
+	l.identifying = true
+	l.identifyRun++
+	run := l.identifyRun
+
+	go func() {
+		for i := 0; i < 2*blinks; i++ {
+			level := 1.0
+			if i%2 == 1 {
+				level = 0
+			}
+			l.mu.Lock()
+			if !l.identifying || l.identifyRun != run {
+				l.mu.Unlock()
+				return
+			}
+			err := l.fader.FadeTo(level, 0, nil)
+			l.mu.Unlock()
+			if err != nil {
+				fmt.Printf("identify: %s\n", err)
+				break
+			}
+			<-l.clock.After(period / 2)
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.identifyRun != run {
+			return
+		}
+		if err := l.endIdentify(); err != nil {
+			fmt.Printf("identify: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// endIdentify stops the blinking, if any, and shows the current config
+// again. l.mu must be held.
+func (l *light) endIdentify() error {
+	if !l.identifying {
+		return nil
+	}
+	l.identifying = false
+	restore := l.current
+	restore.TransitionMS = 0
+	return l.drive(&restore)
+}
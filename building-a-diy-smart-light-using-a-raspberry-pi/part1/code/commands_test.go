@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func identifying(l *light) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.identifying
+}
+
+func TestIdentifyRestartedAfterSafeState(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	l, led := testLight(clk)
+	const period = 100 * time.Millisecond
+
+	if err := l.Identify(2, period); err != nil {
+		t.Fatal(err)
+	}
+	waitForWaiters(t, clk, 1)
+	if err := l.SafeState(safeKeep); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Identify(5, period); err != nil {
+		t.Fatal(err)
+	}
+	waitForWaiters(t, clk, 2)
+
+	// The first run's blinker wakes with the second and must leave it be,
+	// neither blinking along nor ending it when its own blinks are done.
+	for i := 0; i < 6; i++ {
+		eventually(t, "the blinker to wait", func() bool { return clk.Waiters() > 0 || !identifying(l) })
+		if !identifying(l) {
+			t.Fatalf("the second run was cut short by the first after %d blinks", i/2)
+		}
+		clk.Advance(period / 2)
+	}
+	for i := 0; i < 4; i++ {
+		waitForWaiters(t, clk, 1)
+		clk.Advance(period / 2)
+	}
+	eventually(t, "the second run to end", func() bool { return !identifying(l) })
+
+	levels := led.Levels()
+	if len(levels) != 12 {
+		t.Fatalf("LED was written %v", levels)
+	}
+	for i, level := range levels {
+		want := byte(255)
+		if i%2 == 1 {
+			want = 0
+		}
+		if level != want {
+			t.Fatalf("LED was written %v", levels)
+		}
+	}
+	if clk.Waiters() != 0 {
+		t.Errorf("%d blinkers still waiting", clk.Waiters())
+	}
+}
+
+func TestResyncSendsOutboxOnce(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	b := startTestBroker(t)
+	defer b.Close()
+	const n = 50
+	got := make(chan string, 2*n)
+	if err := b.Watch("/devices/lamp/backlog", func(_ string, payload []byte) { got <- string(payload) }); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := startDevice(simConfig(t, b, dir, "lamp"), &shared{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	eventually(t, "the light to connect", d.client.IsConnected)
+
+	for i := 0; i < n; i++ {
+		if err := d.box.Enqueue("/devices/lamp/backlog", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Resyncs racing the publisher's own drain must not send anything twice.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.resync(nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	d.queued.Wake()
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if msg := receive(t, got, "queued message"); msg != fmt.Sprint(i) {
+			t.Fatalf("message %d was %q", i, msg)
+		}
+	}
+	eventually(t, "the outbox to empty", func() bool { return d.box.Len() == 0 })
+	select {
+	case msg := <-got:
+		t.Errorf("%q was sent again", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// config is everything that differs between devices. It is built in layers:
+// defaults, then the config file, then environment variables, then command
+// line flags, each overriding the one before.
+type config struct {
+	DeviceID string
+	LEDPin   string
+
+	// Hardware is "raspi" to drive the Pi's pins or "sim" to run on any
+	// machine against a simulated adaptor. SimView draws the simulated
+	// lights on the terminal and SimBroker, when set, is the address an
+	// in-process MQTT broker listens on.
+	Hardware  string
+	SimView   bool
+	SimBroker string
+
+	// LEDMode is "pwm" to dim the LED or "digital" to only switch it.
+	LEDMode string
+	Gamma   float64
+
+	// StripPixels is the length of an APA102 strip used as the light
+	// instead of the LED, 0 when there is none.
+	StripPixels int64
+	StripBus    int64
+	StripChip   int64
+	StripFPS    int64
+	FakeStrip   bool
+
+	// ButtonPin is the header pin of a wall button that toggles the light,
+	// empty when there is none.
+	ButtonPin       string
+	ButtonActiveLow bool
+	ButtonDebounce  time.Duration
+
+	// ConflictPolicy decides between local changes and remote configs.
+	ConflictPolicy string
+	ConflictWindow time.Duration
+
+	// OccupancyPin is the header pin of a PIR motion sensor. Motion turns
+	// the light on when it is set.
+	OccupancyPin     string
+	OccupancyTimeout time.Duration
+	OccupancyHold    time.Duration
+	OccupancyInhibit string
+
+	// ScheduleFile keeps the schedules from the last config. The location
+	// is used for solar schedules and the timezone for cron ones.
+	ScheduleFile string
+	Latitude     float64
+	Longitude    float64
+	Timezone     string
+
+	// RulesFile keeps the rules from the last config, and may be edited
+	// by hand.
+	RulesFile string
+
+	// Connector is "iotcore" or "mqtt". When empty, "mqtt" is used if a
+	// broker is set and "iotcore" otherwise.
+	Connector   string
+	Broker      string
+	ClientID    string
+	Username    string
+	Password    string
+	Token       string
+	ConfigTopic string
+	StateTopic  string
+	EventsTopic string
+	StatusTopic string
+	// CommandsTopic is where one-shot commands arrive, each under a
+	// subfolder naming it; their results go to ResultsTopic.
+	CommandsTopic string
+	ResultsTopic  string
+
+	// SafeState is what the light is left as when the client stops: "off",
+	// "on" or "keep". ShutdownTimeout bounds flushing queued messages.
+	SafeState       string
+	ShutdownTimeout time.Duration
+
+	ProjectID  string
+	Region     string
+	RegistryID string
+
+	CertPath      string
+	KeyFile       string
+	JWTAlgorithm  string
+	TokenLifetime time.Duration
+
+	// NextKeyFile is the key that replaces KeyFile during a rotation, from
+	// NextKeyFrom on. PassphraseFile unlocks encrypted keys.
+	NextKeyFile    string
+	NextKeyFrom    string
+	PassphraseFile string
+
+	CAFile     string
+	ClientAuth bool
+	ClientCert string
+	ClientKey  string
+	Pins       []string
+
+	StateHeartbeat   time.Duration
+	StateMinInterval time.Duration
+
+	// APIListen is the address of the LAN API, empty to turn it off. It
+	// serves TLS when APICert and APIKey are set.
+	APIListen string
+	APIToken  string
+	APICert   string
+	APIKey    string
+
+	// UpdateKey is the base64 ed25519 public key update directives must be
+	// signed with. Updates are turned off when it is empty. UpdateBinary is
+	// the binary replaced, the running one when empty.
+	UpdateKey      string
+	UpdateDir      string
+	UpdateBinary   string
+	UpdateDeadline time.Duration
+
+	// OutboxDir holds messages queued while offline. Queueing is off when
+	// it is empty.
+	OutboxDir        string
+	OutboxMaxBytes   int64
+	OutboxMaxAge     time.Duration
+	OutboxDropPolicy string
+
+	// Sensors come from [[sensor]] tables in the config file.
+	Sensors     []sensorConfig
+	FakeSensors bool
+
+	// GatewayPorts are serial ports with boards bridged through this
+	// device's connection, each as its own device. A port "sim:<id>" is a
+	// simulated board on a pseudo-terminal.
+	GatewayPorts     []string
+	GatewayBaud      int64
+	GatewayKeepalive time.Duration
+
+	// HealthInterval is how often the broker, message handlers and the
+	// light are checked, and HealthTimeout how long each may take to answer.
+	// After HealthMaxFailures failed rounds in a row the client restarts
+	// itself; 0 leaves that to systemd's watchdog.
+	HealthInterval    time.Duration
+	HealthTimeout     time.Duration
+	HealthMaxFailures int64
+
+	// Lights come from [[light]] tables, each a full config for one logical
+	// light built from this one and the settings in its table. Without any
+	// tables this config is the only light.
+	Lights      []*config
+	lightTables []lightTable
+}
+
+// lightTable is a [[light]] table and the file it came from.
+type lightTable struct {
+	path   string
+	values map[string]fileValue
+}
+
+const (
+	defaultConfigFile = "iot-client.toml"
+	iotCoreBroker     = "ssl://mqtt.googleapis.com:8883"
+)
+
+func defaultConfig() *config {
+	return &config{
+		DeviceID: "test-device",
+		LEDPin:   "10",
+		Hardware: hardwareRaspi,
+		LEDMode:  "digital",
+		Gamma:    defaultGamma,
+		StripFPS: defaultStripFPS,
+
+		ButtonDebounce: defaultDebounce,
+		ConflictPolicy: policyLocalOverride,
+		ConflictWindow: defaultOverrideWindow,
+
+		SafeState:       safeOff,
+		ShutdownTimeout: defaultShutdownTimeout,
+
+		ScheduleFile:  defaultScheduleFile,
+		RulesFile:     defaultRulesFile,
+		Region:        "us-central1",
+		RegistryID:    "devices",
+		CertPath:      "certs/",
+		KeyFile:       "rsa_private.pem",
+		TokenLifetime: defaultTokenLifetime,
+
+		UpdateDir:      defaultUpdateDir,
+		UpdateDeadline: defaultUpdateDeadline,
+
+		StateHeartbeat:   defaultHeartbeat,
+		StateMinInterval: defaultMinStateInterval,
+
+		OutboxDir:        defaultOutboxDir,
+		OutboxMaxBytes:   defaultOutboxMaxBytes,
+		OutboxMaxAge:     defaultOutboxMaxAge,
+		OutboxDropPolicy: dropOldest,
+
+		GatewayBaud:      defaultGatewayBaud,
+		GatewayKeepalive: defaultGatewayKeepalive,
+
+		HealthInterval:    defaultHealthInterval,
+		HealthTimeout:     defaultHealthTimeout,
+		HealthMaxFailures: defaultHealthMaxFailures,
+	}
+}
+
+// configField is one setting. The key names it in the config file and, with
+// underscores turned into dashes, on the command line.
+type configField struct {
+	key     string
+	env     string
+	usage   string
+	set     func(c *config, v string) error
+	boolean bool
+}
+
+func stringField(key, env, usage string, field func(c *config) *string) configField {
+	return configField{key, env, usage, func(c *config, v string) error {
+		*field(c) = v
+		return nil
+	}, false}
+}
+
+func boolField(key, env, usage string, field func(c *config) *bool) configField {
+	return configField{key, env, usage, func(c *config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", v)
+		}
+		*field(c) = b
+		return nil
+	}, true}
+}
+
+func int64Field(key, env, usage string, field func(c *config) *int64) configField {
+	return configField{key, env, usage, func(c *config, v string) error {
+		n, err := strconv.ParseInt(v, 0, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", v)
+		}
+		*field(c) = n
+		return nil
+	}, false}
+}
+
+func floatField(key, env, usage string, field func(c *config) *float64) configField {
+	return configField{key, env, usage, func(c *config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+		*field(c) = f
+		return nil
+	}, false}
+}
+
+func durationField(key, env, usage string, field func(c *config) *time.Duration) configField {
+	return configField{key, env, usage, func(c *config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", v)
+		}
+		*field(c) = d
+		return nil
+	}, false}
+}
+
+func listField(key, env, usage string, field func(c *config) *[]string) configField {
+	return configField{key, env, usage, func(c *config, v string) error {
+		var items []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*field(c) = items
+		return nil
+	}, false}
+}
+
+var configFields = []configField{
+	stringField("device_id", "DEVICE_ID", "device id used in the client id and topics", func(c *config) *string { return &c.DeviceID }),
+	stringField("led_pin", "LED_PIN", "raspberry pi header pin driving the light", func(c *config) *string { return &c.LEDPin }),
+	stringField("led_mode", "LED_MODE", `"pwm" to dim the light (needs pi-blaster) or "digital" to only switch it`, func(c *config) *string { return &c.LEDMode }),
+	floatField("gamma", "LED_GAMMA", "gamma correction applied to brightness levels", func(c *config) *float64 { return &c.Gamma }),
+	stringField("hardware", "HARDWARE", `"raspi" for the pi's pins or "sim" for a simulated adaptor that runs anywhere`, func(c *config) *string { return &c.Hardware }),
+	boolField("sim.view", "SIM_VIEW", "draw the simulated lights on the terminal", func(c *config) *bool { return &c.SimView }),
+	stringField("sim.broker", "SIM_BROKER", "listen address of an in-process mqtt broker to start, e.g. localhost:1883; broker defaults to it", func(c *config) *string { return &c.SimBroker }),
+
+	int64Field("strip.pixels", "STRIP_PIXELS", "number of pixels on an apa102 strip driven instead of the led, 0 for none", func(c *config) *int64 { return &c.StripPixels }),
+	int64Field("strip.bus", "STRIP_SPI_BUS", "spi bus the strip is on", func(c *config) *int64 { return &c.StripBus }),
+	int64Field("strip.chip", "STRIP_SPI_CHIP", "spi chip select the strip is on", func(c *config) *int64 { return &c.StripChip }),
+	int64Field("strip.fps", "STRIP_FPS", "frames per second drawn on the strip", func(c *config) *int64 { return &c.StripFPS }),
+	boolField("strip.fake", "FAKE_STRIP", "send strip frames to an in-memory spi sink instead of the pi's spi bus", func(c *config) *bool { return &c.FakeStrip }),
+
+	stringField("button.pin", "BUTTON_PIN", "raspberry pi header pin of a button that toggles the light, empty for none", func(c *config) *string { return &c.ButtonPin }),
+	boolField("button.active_low", "BUTTON_ACTIVE_LOW", "the button pulls the pin low when pressed", func(c *config) *bool { return &c.ButtonActiveLow }),
+	durationField("button.debounce", "BUTTON_DEBOUNCE", "how long the button contacts must be quiet before a press counts", func(c *config) *time.Duration { return &c.ButtonDebounce }),
+	stringField("conflict.policy", "CONFLICT_POLICY", `how remote configs meet local changes, "local-override" or "last-writer-wins"`, func(c *config) *string { return &c.ConflictPolicy }),
+	durationField("conflict.window", "CONFLICT_WINDOW", "how long a local change holds off remote configs under local-override", func(c *config) *time.Duration { return &c.ConflictWindow }),
+
+	stringField("occupancy.pin", "OCCUPANCY_PIN", "raspberry pi header pin of a pir motion sensor that turns the light on, empty for none", func(c *config) *string { return &c.OccupancyPin }),
+	durationField("occupancy.timeout", "OCCUPANCY_TIMEOUT", "how long after the last motion the light turns off", func(c *config) *time.Duration { return &c.OccupancyTimeout }),
+	durationField("occupancy.hold", "OCCUPANCY_HOLD", "how long the motion sensor leaves the light alone after the wall button is used", func(c *config) *time.Duration { return &c.OccupancyHold }),
+	stringField("occupancy.inhibit", "OCCUPANCY_INHIBIT", `when motion must not turn the light on: "daylight" or a window like "08:00-17:30"`, func(c *config) *string { return &c.OccupancyInhibit }),
+
+	stringField("schedule.file", "SCHEDULE_FILE", "where schedules from the cloud are kept between restarts", func(c *config) *string { return &c.ScheduleFile }),
+	stringField("rules.file", "RULES_FILE", "where rules from the cloud are kept; edits to it are picked up while running", func(c *config) *string { return &c.RulesFile }),
+	floatField("location.latitude", "LOCATION_LATITUDE", "latitude of the device for sunrise and sunset, north positive", func(c *config) *float64 { return &c.Latitude }),
+	floatField("location.longitude", "LOCATION_LONGITUDE", "longitude of the device for sunrise and sunset, east positive", func(c *config) *float64 { return &c.Longitude }),
+	stringField("location.timezone", "LOCATION_TIMEZONE", "IANA timezone cron schedules run in, e.g. Europe/London; the system's when empty", func(c *config) *string { return &c.Timezone }),
+
+	stringField("connector", "CONNECTOR", `broker style, "iotcore" or "mqtt"`, func(c *config) *string { return &c.Connector }),
+	stringField("broker", "MQTT_BROKER", "broker url, e.g. ssl://broker.local:8883", func(c *config) *string { return &c.Broker }),
+	stringField("client_id", "MQTT_CLIENT_ID", "mqtt client id, defaults to the device id", func(c *config) *string { return &c.ClientID }),
+	stringField("username", "MQTT_USERNAME", "mqtt username", func(c *config) *string { return &c.Username }),
+	stringField("password", "MQTT_PASSWORD", "mqtt password", func(c *config) *string { return &c.Password }),
+	stringField("token", "MQTT_TOKEN", "token sent as the mqtt password", func(c *config) *string { return &c.Token }),
+	stringField("topics.config", "MQTT_CONFIG_TOPIC", "config topic template, {device} is replaced by the device id", func(c *config) *string { return &c.ConfigTopic }),
+	stringField("topics.state", "MQTT_STATE_TOPIC", "state topic template, {device} is replaced by the device id", func(c *config) *string { return &c.StateTopic }),
+	stringField("topics.events", "MQTT_EVENTS_TOPIC", "telemetry events topic template, {device} is replaced by the device id", func(c *config) *string { return &c.EventsTopic }),
+	stringField("topics.status", "MQTT_STATUS_TOPIC", "retained online/offline status topic template, {device} is replaced by the device id", func(c *config) *string { return &c.StatusTopic }),
+	stringField("topics.commands", "MQTT_COMMANDS_TOPIC", "commands topic template, commands arrive on its subfolders; {device} is replaced by the device id", func(c *config) *string { return &c.CommandsTopic }),
+	stringField("topics.results", "MQTT_RESULTS_TOPIC", "command results topic template, {device} is replaced by the device id", func(c *config) *string { return &c.ResultsTopic }),
+
+	stringField("shutdown.safe_state", "SHUTDOWN_SAFE_STATE", `what the light is left as when the client stops, "off", "on" or "keep"`, func(c *config) *string { return &c.SafeState }),
+	durationField("shutdown.timeout", "SHUTDOWN_TIMEOUT", "how long stopping may spend sending queued messages", func(c *config) *time.Duration { return &c.ShutdownTimeout }),
+
+	stringField("iotcore.project_id", "PROJECT_ID", "google cloud project id", func(c *config) *string { return &c.ProjectID }),
+	stringField("iotcore.region", "IOTCORE_REGION", "iot core region", func(c *config) *string { return &c.Region }),
+	stringField("iotcore.registry_id", "IOTCORE_REGISTRY_ID", "iot core registry id", func(c *config) *string { return &c.RegistryID }),
+
+	stringField("cert_path", "CERT_PATH", "directory holding the device key and certificates", func(c *config) *string { return &c.CertPath }),
+	stringField("jwt.key_file", "DEVICE_KEY", "device private key, relative to cert_path", func(c *config) *string { return &c.KeyFile }),
+	stringField("jwt.algorithm", "JWT_ALGORITHM", `jwt signing algorithm, "RS256" or "ES256"; worked out from the key when empty`, func(c *config) *string { return &c.JWTAlgorithm }),
+	stringField("jwt.next_key_file", "NEXT_DEVICE_KEY", "key to rotate to, relative to cert_path; registered alongside key_file", func(c *config) *string { return &c.NextKeyFile }),
+	stringField("jwt.next_key_from", "NEXT_DEVICE_KEY_FROM", "RFC 3339 time to start signing with next_key_file, straight away when empty", func(c *config) *string { return &c.NextKeyFrom }),
+	stringField("jwt.passphrase_file", "DEVICE_KEY_PASSPHRASE_FILE", "file with the passphrase of encrypted keys, relative to cert_path; "+passphraseEnv+" is used when empty", func(c *config) *string { return &c.PassphraseFile }),
+	durationField("jwt.lifetime", "JWT_LIFETIME", "how long each device jwt is valid", func(c *config) *time.Duration { return &c.TokenLifetime }),
+
+	stringField("tls.ca_file", "MQTT_CA_FILE", "trusted roots for the broker; iotcore defaults to roots.pem in cert_path", func(c *config) *string { return &c.CAFile }),
+	boolField("tls.client_auth", "TLS_CLIENT_AUTH", "present a client certificate (mutual tls)", func(c *config) *bool { return &c.ClientAuth }),
+	stringField("tls.client_cert", "TLS_CLIENT_CERT", "client certificate, defaults to client_cert.pem in cert_path", func(c *config) *string { return &c.ClientCert }),
+	stringField("tls.client_key", "TLS_CLIENT_KEY", "client certificate key, defaults to client_key.pem in cert_path", func(c *config) *string { return &c.ClientKey }),
+	listField("tls.pins", "TLS_PINS", "comma separated base64 sha256 spki pins", func(c *config) *[]string { return &c.Pins }),
+
+	durationField("state.heartbeat", "STATE_HEARTBEAT", "how often state is reported when nothing changes", func(c *config) *time.Duration { return &c.StateHeartbeat }),
+	durationField("state.min_interval", "STATE_MIN_INTERVAL", "shortest time between two state reports", func(c *config) *time.Duration { return &c.StateMinInterval }),
+
+	stringField("api.listen", "API_LISTEN", "address of the lan api, e.g. :8443, empty to turn it off", func(c *config) *string { return &c.APIListen }),
+	stringField("api.token", "API_TOKEN", "bearer token lan api requests must carry", func(c *config) *string { return &c.APIToken }),
+	stringField("api.tls_cert", "API_TLS_CERT", "certificate to serve the lan api over tls with", func(c *config) *string { return &c.APICert }),
+	stringField("api.tls_key", "API_TLS_KEY", "key for api.tls_cert", func(c *config) *string { return &c.APIKey }),
+
+	stringField("update.public_key", "UPDATE_PUBLIC_KEY", "base64 ed25519 key updates must be signed with, empty to turn updates off", func(c *config) *string { return &c.UpdateKey }),
+	stringField("update.dir", "UPDATE_DIR", "directory keeping update state across restarts", func(c *config) *string { return &c.UpdateDir }),
+	stringField("update.binary", "UPDATE_BINARY", "binary replaced by updates, the running one when empty", func(c *config) *string { return &c.UpdateBinary }),
+	durationField("update.deadline", "UPDATE_DEADLINE", "how long a new build has to reach the broker before it is rolled back", func(c *config) *time.Duration { return &c.UpdateDeadline }),
+
+	stringField("outbox.dir", "OUTBOX_DIR", "directory for messages queued while offline, empty to disable queueing", func(c *config) *string { return &c.OutboxDir }),
+	int64Field("outbox.max_bytes", "OUTBOX_MAX_BYTES", "largest size of the queue on disk", func(c *config) *int64 { return &c.OutboxMaxBytes }),
+	durationField("outbox.max_age", "OUTBOX_MAX_AGE", "queued messages older than this are dropped instead of sent, 0 to keep them", func(c *config) *time.Duration { return &c.OutboxMaxAge }),
+	stringField("outbox.drop_policy", "OUTBOX_DROP_POLICY", `which messages to drop when the queue is full, "oldest" or "newest"`, func(c *config) *string { return &c.OutboxDropPolicy }),
+
+	boolField("fake_sensors", "FAKE_SENSORS", "attach sensors to an in-memory bus instead of the pi's i2c and spi buses", func(c *config) *bool { return &c.FakeSensors }),
+
+	listField("gateway.ports", "GATEWAY_PORTS", `comma separated serial ports of boards to bridge, e.g. /dev/ttyUSB0, or "sim:<id>" for a simulated board`, func(c *config) *[]string { return &c.GatewayPorts }),
+	int64Field("gateway.baud", "GATEWAY_BAUD", "baud rate of the gateway's serial ports", func(c *config) *int64 { return &c.GatewayBaud }),
+	durationField("gateway.keepalive", "GATEWAY_KEEPALIVE", "how often bridged boards are pinged; one silent for three is detached", func(c *config) *time.Duration { return &c.GatewayKeepalive }),
+	durationField("health.interval", "HEALTH_INTERVAL", "how often the broker, message handlers and light are checked", func(c *config) *time.Duration { return &c.HealthInterval }),
+	durationField("health.timeout", "HEALTH_TIMEOUT", "how long each health check may take to answer", func(c *config) *time.Duration { return &c.HealthTimeout }),
+	int64Field("health.max_failures", "HEALTH_MAX_FAILURES", "failed health rounds in a row before the client restarts itself, 0 to leave it to systemd", func(c *config) *int64 { return &c.HealthMaxFailures }),
+}
+
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// configErrors collects every problem found while loading the config so they
+// can be reported together.
+type configErrors []error
+
+func (e configErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "  " + err.Error()
+	}
+	return "invalid configuration:\n" + strings.Join(lines, "\n")
+}
+
+// loadConfig builds the config from defaults, the config file, the
+// environment and the command line arguments in args.
+func loadConfig(name string, args []string) (*config, error) {
+	c, _, errs, err := parseConfig(name, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// parseConfig is loadConfig that returns the config even when it is invalid,
+// along with what is wrong with it and the config file read, if any. err is
+// only set when args cannot be parsed.
+func parseConfig(name string, args []string) (c *config, file string, errs configErrors, err error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", "", "config file, defaults to "+defaultConfigFile+" when it exists (env IOT_CONFIG)")
+
+	var flags []flagValue
+	for i := range configFields {
+		f := &configFields[i]
+		fs.Var(&recordingFlag{field: f, values: &flags}, flagName(f.key), f.usage+" (env "+f.env+")")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, "", nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, "", nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	c = defaultConfig()
+	file = *path
+	if file == "" {
+		file = os.Getenv("IOT_CONFIG")
+	}
+	if file == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			file = defaultConfigFile
+		}
+	}
+	if file != "" {
+		errs = append(errs, c.applyFile(file)...)
+	}
+	// Lights start from the file layer, with their tables on top, before
+	// the environment and flags.
+	fileLayer := *c
+	errs = append(errs, c.applyOverrides(flags)...)
+
+	if len(c.lightTables) == 0 {
+		errs = append(errs, c.validate()...)
+	} else {
+		errs = append(errs, c.buildLights(&fileLayer, flags)...)
+	}
+	return c, file, errs, nil
+}
+
+// applyOverrides applies the environment and then the flags given.
+func (c *config) applyOverrides(flags []flagValue) configErrors {
+	var errs configErrors
+	for _, f := range configFields {
+		if v, ok := os.LookupEnv(f.env); ok {
+			if err := f.set(c, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", f.env, err))
+			}
+		}
+	}
+
+	for _, v := range flags {
+		if err := v.field.set(c, v.value); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %s", flagName(v.field.key), err))
+		}
+	}
+
+	if c.Broker == "" && c.SimBroker != "" {
+		c.Broker = "tcp://" + c.SimBroker
+	}
+	return errs
+}
+
+// devices returns the config of every light to run.
+func (c *config) devices() []*config {
+	if len(c.Lights) == 0 {
+		return []*config{c}
+	}
+	return c.Lights
+}
+
+// buildLights makes a config for each [[light]] table. Each starts from
+// fileLayer, the defaults and config file settings, with the table's
+// settings on top and then the environment and flags, so a table overrides
+// the file but not the command line. Outbox directories, schedule files and
+// rules files not set in a table get the device id added so lights don't
+// share them, and sensors are read and boards bridged by the first light
+// only.
+func (c *config) buildLights(fileLayer *config, flags []flagValue) configErrors {
+	var errs configErrors
+	known := map[string]configField{}
+	overridden := map[string]bool{}
+	for _, field := range configFields {
+		known[field.key] = field
+		if _, ok := os.LookupEnv(field.env); ok {
+			overridden[field.key] = true
+		}
+	}
+	for _, v := range flags {
+		overridden[v.field.key] = true
+	}
+
+	for i, table := range c.lightTables {
+		l := *fileLayer
+		l.Lights, l.lightTables = nil, nil
+
+		for key, v := range table.values {
+			field, ok := known[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s:%d: unknown setting %s", table.path, v.line, key))
+				continue
+			}
+			if strings.HasPrefix(key, "api.") || strings.HasPrefix(key, "update.") || key == "sim.broker" {
+				errs = append(errs, fmt.Errorf("%s:%d: %s is shared by all lights and cannot be set in a [[light]] table", table.path, v.line, key))
+				continue
+			}
+			if err := field.set(&l, v.value); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: %s: %s", table.path, v.line, key, err))
+			}
+		}
+		// Their errors were reported for the shared config.
+		l.applyOverrides(flags)
+		if i > 0 {
+			l.Sensors = nil
+			l.GatewayPorts = nil
+		}
+
+		fromTable := func(key string) bool {
+			_, ok := table.values[key]
+			return ok && !overridden[key]
+		}
+		if !fromTable("outbox.dir") && l.OutboxDir != "" {
+			l.OutboxDir = filepath.Join(c.OutboxDir, l.DeviceID)
+		}
+		if !fromTable("schedule.file") {
+			ext := filepath.Ext(c.ScheduleFile)
+			l.ScheduleFile = strings.TrimSuffix(c.ScheduleFile, ext) + "-" + l.DeviceID + ext
+		}
+		if !fromTable("rules.file") {
+			ext := filepath.Ext(c.RulesFile)
+			l.RulesFile = strings.TrimSuffix(c.RulesFile, ext) + "-" + l.DeviceID + ext
+		}
+
+		for _, err := range l.validate() {
+			errs = append(errs, fmt.Errorf("light %d (%s): %s", i+1, l.DeviceID, err))
+		}
+		c.Lights = append(c.Lights, &l)
+	}
+
+	// Lights must not share anything that would make them fight.
+	seen := map[string]int{}
+	claim := func(i int, what, value string) {
+		if value == "" {
+			return
+		}
+		key := what + "=" + value
+		if j, ok := seen[key]; ok {
+			errs = append(errs, fmt.Errorf("light %d and light %d both use %s %s", j+1, i+1, what, value))
+			return
+		}
+		seen[key] = i
+	}
+	for i, l := range c.Lights {
+		claim(i, "device_id", l.DeviceID)
+		if l.StripPixels > 0 {
+			claim(i, "spi", fmt.Sprintf("%d.%d", l.StripBus, l.StripChip))
+		} else {
+			claim(i, "pin", l.LEDPin)
+		}
+		claim(i, "pin", l.ButtonPin)
+		claim(i, "pin", l.OccupancyPin)
+		claim(i, "outbox.dir", l.OutboxDir)
+		claim(i, "schedule.file", l.ScheduleFile)
+		claim(i, "rules.file", l.RulesFile)
+		for _, port := range l.GatewayPorts {
+			claim(i, "gateway port", port)
+		}
+	}
+	return errs
+}
+
+func (c *config) applyFile(path string) configErrors {
+	r, err := os.Open(path)
+	if err != nil {
+		return configErrors{err}
+	}
+	defer r.Close()
+
+	f, err := parseConfigFile(r)
+	if err != nil {
+		return configErrors{fmt.Errorf("%s: %s", path, err)}
+	}
+
+	var errs configErrors
+	known := map[string]configField{}
+	for _, field := range configFields {
+		known[field.key] = field
+	}
+
+	for key, v := range f.values {
+		field, ok := known[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown setting %s", path, v.line, key))
+			continue
+		}
+		if err := field.set(c, v.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: %s", path, v.line, key, err))
+		}
+	}
+
+	for name, entries := range f.tables {
+		switch name {
+		case "sensor":
+			for _, table := range entries {
+				s, sensorErrs := parseSensorConfig(table)
+				for _, err := range sensorErrs {
+					errs = append(errs, fmt.Errorf("%s:%s", path, err))
+				}
+				c.Sensors = append(c.Sensors, s)
+			}
+		case "light":
+			for _, table := range entries {
+				c.lightTables = append(c.lightTables, lightTable{path, table})
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown table [[%s]]", path, name))
+		}
+	}
+	return errs
+}
+
+// validate checks every field and returns all the problems it finds.
+func (c *config) validate() configErrors {
+	var errs configErrors
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.DeviceID == "" {
+		fail("device_id is required")
+	}
+	if c.LEDPin == "" {
+		fail("led_pin is required")
+	}
+	if c.LEDMode != "pwm" && c.LEDMode != "digital" {
+		fail("led_mode must be \"pwm\" or \"digital\", not %q", c.LEDMode)
+	}
+	switch c.Hardware {
+	case hardwareRaspi, hardwareSim:
+	default:
+		fail("hardware must be %q or %q, not %q", hardwareRaspi, hardwareSim, c.Hardware)
+	}
+	if c.SimView && c.Hardware != hardwareSim {
+		fail("sim.view needs hardware = %q", hardwareSim)
+	}
+	if c.SimBroker != "" {
+		if _, _, err := net.SplitHostPort(c.SimBroker); err != nil {
+			fail("sim.broker: %s", err)
+		}
+	}
+	if strings.ContainsAny(c.CommandsTopic, "+#") {
+		fail("topics.commands must not contain wildcards, commands are read from its subfolders")
+	}
+	if c.Gamma < 1 || c.Gamma > 4 {
+		fail("gamma must be between 1 and 4, not %g", c.Gamma)
+	}
+	if c.StripPixels < 0 || c.StripPixels > 1024 {
+		fail("strip.pixels must be between 0 and 1024, not %d", c.StripPixels)
+	}
+	if c.StripPixels > 0 {
+		if c.StripBus < 0 || c.StripBus > 1 {
+			fail("strip.bus must be 0 or 1, not %d", c.StripBus)
+		}
+		if c.StripChip < 0 || c.StripChip > 1 {
+			fail("strip.chip must be 0 or 1, not %d", c.StripChip)
+		}
+		if c.StripFPS < 1 || c.StripFPS > 120 {
+			fail("strip.fps must be between 1 and 120, not %d", c.StripFPS)
+		}
+	}
+
+	if c.ButtonPin != "" && c.ButtonPin == c.LEDPin {
+		fail("button.pin and led_pin must be different pins")
+	}
+	if c.ButtonDebounce < 0 || c.ButtonDebounce > time.Second {
+		fail("button.debounce must be between 0 and 1s, not %s", c.ButtonDebounce)
+	}
+	switch c.ConflictPolicy {
+	case policyLocalOverride, policyLastWriterWins:
+	default:
+		fail("conflict.policy must be %q or %q, not %q", policyLocalOverride, policyLastWriterWins, c.ConflictPolicy)
+	}
+	if c.ConflictWindow < 0 {
+		fail("conflict.window must not be negative")
+	}
+
+	if c.OccupancyPin != "" {
+		if c.OccupancyPin == c.LEDPin || c.OccupancyPin == c.ButtonPin {
+			fail("occupancy.pin must not be the led or button pin")
+		}
+		if c.OccupancyTimeout <= 0 {
+			fail("occupancy.timeout must be positive")
+		}
+		if c.OccupancyHold < 0 {
+			fail("occupancy.hold must not be negative")
+		}
+		if _, err := parseInhibit(c.OccupancyInhibit, c.Latitude, c.Longitude, time.UTC); err != nil {
+			fail("occupancy.inhibit: %s", err)
+		}
+	}
+	switch c.SafeState {
+	case safeOff, safeOn, safeKeep:
+	default:
+		fail("shutdown.safe_state must be %q, %q or %q, not %q", safeOff, safeOn, safeKeep, c.SafeState)
+	}
+	if c.ShutdownTimeout < 0 || c.ShutdownTimeout > time.Minute {
+		fail("shutdown.timeout must be between 0 and 1m, not %s", c.ShutdownTimeout)
+	}
+	if c.ScheduleFile == "" {
+		fail("schedule.file is required")
+	}
+	if c.RulesFile == "" {
+		fail("rules.file is required")
+	}
+	if c.Latitude < -90 || c.Latitude > 90 {
+		fail("location.latitude must be between -90 and 90, not %g", c.Latitude)
+	}
+	if c.Longitude < -180 || c.Longitude > 180 {
+		fail("location.longitude must be between -180 and 180, not %g", c.Longitude)
+	}
+	if _, err := c.location(); err != nil {
+		fail("location.timezone: %s", err)
+	}
+
+	switch c.connectorName() {
+	case "mqtt":
+		if c.Broker == "" {
+			fail("broker is required for the mqtt connector")
+		}
+	case "iotcore":
+		if c.ProjectID == "" {
+			fail("iotcore.project_id is required for the iotcore connector. Set it in the config file, with -iotcore.project-id or with the PROJECT_ID environment variable")
+		}
+		if c.Region == "" {
+			fail("iotcore.region is required for the iotcore connector")
+		}
+		if c.RegistryID == "" {
+			fail("iotcore.registry_id is required for the iotcore connector")
+		}
+		if c.KeyFile == "" {
+			fail("jwt.key_file is required for the iotcore connector")
+		}
+	default:
+		fail("connector must be \"iotcore\" or \"mqtt\", not %q", c.Connector)
+	}
+
+	if c.Broker != "" {
+		if u, err := url.Parse(c.Broker); err != nil {
+			fail("broker: %s", err)
+		} else {
+			switch u.Scheme {
+			case "tcp", "ssl", "tls", "ws", "wss":
+			default:
+				fail("broker: scheme must be tcp, ssl, tls, ws or wss, not %q", u.Scheme)
+			}
+			if u.Host == "" {
+				fail("broker: %q has no host", c.Broker)
+			}
+		}
+	}
+
+	if c.Token != "" && c.Password != "" {
+		fail("only one of password and token can be set")
+	}
+
+	switch c.JWTAlgorithm {
+	case "", "RS256", "ES256":
+	default:
+		fail("jwt.algorithm must be RS256 or ES256, not %q", c.JWTAlgorithm)
+	}
+	if c.TokenLifetime <= 0 || c.TokenLifetime > 24*time.Hour {
+		fail("jwt.lifetime must be between 0 and 24h, not %s", c.TokenLifetime)
+	}
+	if c.NextKeyFile != "" && c.NextKeyFile == c.KeyFile {
+		fail("jwt.next_key_file must differ from jwt.key_file")
+	}
+	if c.NextKeyFrom != "" {
+		if c.NextKeyFile == "" {
+			fail("jwt.next_key_from needs jwt.next_key_file")
+		}
+		if _, err := time.Parse(time.RFC3339, c.NextKeyFrom); err != nil {
+			fail("jwt.next_key_from must be an RFC 3339 time, not %q", c.NextKeyFrom)
+		}
+	}
+
+	if !c.ClientAuth && (c.ClientCert != "" || c.ClientKey != "") {
+		fail("tls.client_cert and tls.client_key need tls.client_auth = true")
+	}
+	for _, p := range c.Pins {
+		if b, err := base64.StdEncoding.DecodeString(p); err != nil || len(b) != sha256.Size {
+			fail("tls.pins: %q is not a base64 encoded sha256 hash", p)
+		}
+	}
+
+	if c.OutboxDir != "" {
+		if c.OutboxMaxBytes < 64<<10 {
+			fail("outbox.max_bytes must be at least 64KiB, not %d", c.OutboxMaxBytes)
+		}
+		if c.OutboxMaxAge < 0 {
+			fail("outbox.max_age must not be negative")
+		}
+		if c.OutboxDropPolicy != dropOldest && c.OutboxDropPolicy != dropNewest {
+			fail("outbox.drop_policy must be %q or %q, not %q", dropOldest, dropNewest, c.OutboxDropPolicy)
+		}
+	}
+
+	names := map[string]bool{}
+	for i := range c.Sensors {
+		s := &c.Sensors[i]
+		errs = append(errs, s.validate()...)
+		if names[s.Name] {
+			fail("sensor %q is declared twice", s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	if c.APIListen != "" {
+		if _, _, err := net.SplitHostPort(c.APIListen); err != nil {
+			fail("api.listen: %s", err)
+		}
+		if len(c.APIToken) < minAPITokenLen {
+			fail("api.token must be at least %d characters when api.listen is set", minAPITokenLen)
+		}
+	}
+	if (c.APICert == "") != (c.APIKey == "") {
+		fail("api.tls_cert and api.tls_key must be set together")
+	}
+
+	if c.UpdateKey != "" {
+		if _, err := c.updateKey(); err != nil {
+			fail("update.public_key: %s", err)
+		}
+		if c.UpdateDir == "" {
+			fail("update.dir is required for updates")
+		}
+		if c.UpdateDeadline < 10*time.Second {
+			fail("update.deadline must be at least 10s, not %s", c.UpdateDeadline)
+		}
+	}
+
+	for _, port := range c.GatewayPorts {
+		if strings.HasPrefix(port, simPortPrefix) {
+			if c.Hardware != hardwareSim {
+				fail("gateway.ports: %s needs hardware = %q", port, hardwareSim)
+			}
+			if err := validDeviceID(strings.TrimPrefix(port, simPortPrefix)); err != nil {
+				fail("gateway.ports: %s: %s", port, err)
+			}
+		}
+	}
+	if len(c.GatewayPorts) > 0 {
+		if _, ok := serialBauds[c.GatewayBaud]; !ok {
+			fail("gateway.baud %d is not a supported rate", c.GatewayBaud)
+		}
+		if c.GatewayKeepalive < 100*time.Millisecond {
+			fail("gateway.keepalive must be at least 100ms, not %s", c.GatewayKeepalive)
+		}
+	}
+
+	if c.HealthInterval < time.Second {
+		fail("health.interval must be at least 1s, not %s", c.HealthInterval)
+	}
+	if c.HealthTimeout <= 0 || c.HealthTimeout > c.HealthInterval {
+		fail("health.timeout must be between 0 and health.interval, not %s", c.HealthTimeout)
+	}
+	if c.HealthMaxFailures < 0 {
+		fail("health.max_failures must not be negative, not %d", c.HealthMaxFailures)
+	}
+
+	if c.StateHeartbeat <= 0 {
+		fail("state.heartbeat must be positive, not %s", c.StateHeartbeat)
+	}
+	if c.StateMinInterval < 0 || c.StateMinInterval > c.StateHeartbeat {
+		fail("state.min_interval must be between 0 and state.heartbeat, not %s", c.StateMinInterval)
+	}
+
+	return errs
+}
+
+// updateKey decodes the release key.
+func (c *config) updateKey() (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(c.UpdateKey)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("must be a base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// location returns the timezone schedules run in.
+func (c *config) location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(c.Timezone)
+}
+
+func (c *config) connectorName() string {
+	if c.Connector != "" {
+		return c.Connector
+	}
+	if c.Broker != "" {
+		return "mqtt"
+	}
+	return "iotcore"
+}
+
+// brokerURL is the broker the connector connects to.
+func (c *config) brokerURL() string {
+	if c.Broker == "" && c.connectorName() == "iotcore" {
+		return iotCoreBroker
+	}
+	return c.Broker
+}
+
+// brokerTLS is how the connector sets up TLS to the broker. IoT Core's roots
+// default to roots.pem in the cert path.
+func (c *config) brokerTLS() tlsOptions {
+	if c.connectorName() == "iotcore" {
+		return c.tlsOptions(c.certFile("roots.pem"))
+	}
+	return c.tlsOptions("")
+}
+
+// tlsOptions resolves the tls settings, filling in the default file names.
+func (c *config) tlsOptions(defaultCA string) tlsOptions {
+	o := tlsOptions{
+		caFile: c.CAFile,
+		pins:   c.Pins,
+	}
+	if o.caFile == "" {
+		o.caFile = defaultCA
+	}
+
+	if c.ClientAuth {
+		o.certFile, o.keyFile = c.ClientCert, c.ClientKey
+		o.passphraseFile = c.passphraseFile()
+		if o.certFile == "" {
+			o.certFile = c.certFile("client_cert.pem")
+		}
+		if o.keyFile == "" {
+			o.keyFile = c.certFile("client_key.pem")
+		}
+	}
+	return o
+}
+
+// passphraseFile resolves the passphrase file, empty when none is set.
+func (c *config) passphraseFile() string {
+	if c.PassphraseFile == "" {
+		return ""
+	}
+	return c.certFile(c.PassphraseFile)
+}
+
+// certFile resolves a file name relative to the cert path.
+func (c *config) certFile(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(c.CertPath, name)
+}
+
+// flagValue is a flag given on the command line, kept until the file and
+// environment have been applied.
+type flagValue struct {
+	field *configField
+	value string
+}
+
+type recordingFlag struct {
+	field  *configField
+	values *[]flagValue
+}
+
+func (f *recordingFlag) String() string {
+	return ""
+}
+
+// IsBoolFlag lets boolean settings be given as just -name.
+func (f *recordingFlag) IsBoolFlag() bool {
+	return f.field.boolean
+}
+
+func (f *recordingFlag) Set(v string) error {
+	*f.values = append(*f.values, flagValue{f.field, v})
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// configFile is a parsed config file. The format is the subset of TOML the
+// client needs: "key = value" pairs with string, number, boolean or string
+// array values, [section] headers that prefix the keys below them, and
+// [[name]] headers that start a new entry in a list of tables.
+type configFile struct {
+	// values maps "section.key" to its value for keys outside [[...]]
+	// tables.
+	values map[string]fileValue
+
+	// tables maps the name of a [[name]] header to its entries in file
+	// order.
+	tables map[string][]map[string]fileValue
+}
+
+// fileValue is a value with the line it came from, for error messages.
+// Arrays are flattened into a comma separated list.
+type fileValue struct {
+	value string
+	line  int
+}
+
+func parseConfigFile(r io.Reader) (*configFile, error) {
+	f := &configFile{
+		values: map[string]fileValue{},
+		tables: map[string][]map[string]fileValue{},
+	}
+
+	section := ""
+	current := f.values
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[[") {
+			if !strings.HasSuffix(line, "]]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", n)
+			}
+			name := strings.TrimSpace(line[2 : len(line)-2])
+			if name == "" {
+				return nil, fmt.Errorf("line %d: empty table name", n)
+			}
+			section = ""
+			current = map[string]fileValue{}
+			f.tables[name] = append(f.tables[name], current)
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section header", n)
+			}
+			section = strings.TrimSpace(line[1:len(line)-1]) + "."
+			current = f.values
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", n)
+		}
+
+		value, err := parseFileValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+
+		if _, ok := current[section+key]; ok {
+			return nil, fmt.Errorf("line %d: %s is set twice", n, section+key)
+		}
+		current[section+key] = fileValue{value: value, line: n}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// stripComment drops a trailing # comment that is not inside a string.
+func stripComment(line string) string {
+	inString := false
+	for i, r := range line {
+		switch {
+		case r == '"' && (i == 0 || line[i-1] != '\\'):
+			inString = !inString
+		case r == '#' && !inString:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseFileValue(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return "", fmt.Errorf("unterminated array")
+		}
+		var items []string
+		for _, item := range splitArray(raw[1 : len(raw)-1]) {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			v, err := parseFileValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	default:
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return "", fmt.Errorf("%s is not a string, number, boolean or array", raw)
+		}
+		return raw, nil
+	}
+}
+
+// splitArray splits array items on commas outside of strings.
+func splitArray(s string) []string {
+	var items []string
+	inString, start := false, 0
+	for i, r := range s {
+		switch {
+		case r == '"' && (i == 0 || s[i-1] != '\\'):
+			inString = !inString
+		case r == ',' && !inString:
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv sets key to value, or unsets it when value is nil, and returns a
+// func that puts it back.
+func setenv(t *testing.T, key string, value *string) func() {
+	t.Helper()
+	old, had := os.LookupEnv(key)
+	if value == nil {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, *value)
+	}
+	return func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer setenv(t, "IOT_CONFIG", nil)()
+
+	cases := []struct {
+		name            string
+		file, env, flag bool
+		device          string
+		heartbeat       time.Duration
+	}{
+		{"defaults", false, false, false, "test-device", defaultHeartbeat},
+		{"file", true, false, false, "from-file", time.Minute},
+		{"env over default", false, true, false, "from-env", 2 * time.Minute},
+		{"env over file", true, true, false, "from-env", 2 * time.Minute},
+		{"flag over default", false, false, true, "from-flag", 3 * time.Minute},
+		{"flag over file", true, false, true, "from-flag", 3 * time.Minute},
+		{"flag over env", false, true, true, "from-flag", 3 * time.Minute},
+		{"flag over env and file", true, true, true, "from-flag", 3 * time.Minute},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, strings.Replace(c.name, " ", "-", -1)+".toml")
+		contents := "connector = \"mqtt\"\nbroker = \"tcp://localhost:1883\"\n"
+		if c.file {
+			contents += "device_id = \"from-file\"\n[state]\nheartbeat = \"1m\"\n"
+		}
+		writeFile(t, path, []byte(contents))
+
+		var device, heartbeat *string
+		if c.env {
+			device, heartbeat = str("from-env"), str("2m")
+		}
+		restoreDevice := setenv(t, "DEVICE_ID", device)
+		restoreHeartbeat := setenv(t, "STATE_HEARTBEAT", heartbeat)
+
+		args := []string{"-config", path}
+		if c.flag {
+			args = append(args, "-device-id", "from-flag", "-state.heartbeat", "3m")
+		}
+		cfg, err := loadConfig("iot-client", args)
+		restoreDevice()
+		restoreHeartbeat()
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if cfg.DeviceID != c.device || cfg.StateHeartbeat != c.heartbeat {
+			t.Errorf("%s: device_id %q, state.heartbeat %s; want %q, %s", c.name, cfg.DeviceID, cfg.StateHeartbeat, c.device, c.heartbeat)
+		}
+	}
+}
+
+func TestConfigFileFromEnv(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fromEnv := filepath.Join(dir, "env.toml")
+	writeFile(t, fromEnv, []byte("connector = \"mqtt\"\nbroker = \"tcp://env:1883\"\n"))
+	fromFlag := filepath.Join(dir, "flag.toml")
+	writeFile(t, fromFlag, []byte("connector = \"mqtt\"\nbroker = \"tcp://flag:1883\"\n"))
+	defer setenv(t, "IOT_CONFIG", &fromEnv)()
+
+	cfg, err := loadConfig("iot-client", nil)
+	if err != nil || cfg.Broker != "tcp://env:1883" {
+		t.Errorf("with IOT_CONFIG the broker is %q, %v", cfg.Broker, err)
+	}
+	cfg, err = loadConfig("iot-client", []string{"-config", fromFlag})
+	if err != nil || cfg.Broker != "tcp://flag:1883" {
+		t.Errorf("with -config the broker is %q, %v", cfg.Broker, err)
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		values map[string]string
+		err    string
+	}{
+		{
+			"quoting",
+			`a = "x # not a comment"` + "\n" + `b = "say \"hi\""` + "\n" + `c = "tab\there"` + "\n" + `d = ""`,
+			map[string]string{"a": "x # not a comment", "b": `say "hi"`, "c": "tab\there", "d": ""},
+			"",
+		},
+		{
+			"comments",
+			"# a whole line\n\n  # indented\na = 1 # trailing\nb = true#tight\n",
+			map[string]string{"a": "1", "b": "true"},
+			"",
+		},
+		{
+			"arrays",
+			`a = ["x", "y"]` + "\n" + `b = []` + "\n" + `c = [1, 2.5, ]` + "\n" + `d = ["p,q", "r"] # comment`,
+			map[string]string{"a": "x,y", "b": "", "c": "1,2.5", "d": "p,q,r"},
+			"",
+		},
+		{
+			"sections",
+			"top = 1\n[tls]\nca_file = \"roots.pem\"\n[ state ]\nheartbeat = \"1m\"\n",
+			map[string]string{"top": "1", "tls.ca_file": "roots.pem", "state.heartbeat": "1m"},
+			"",
+		},
+		{"missing equals", "a = 1\nb\n", nil, "line 2: expected key = value"},
+		{"missing key", "= 1", nil, "line 1: missing key"},
+		{"missing value", "\n\na =", nil, "line 3: missing value"},
+		{"bare word", "a = on", nil, "line 1: on is not a string"},
+		{"unterminated string", `a = "open`, nil, "line 1:"},
+		{"unterminated array", "a = [1, 2", nil, "line 1: unterminated array"},
+		{"bad array item", "a = [1, nope]", nil, "line 1: nope is not"},
+		{"unterminated section", "a = 1\n[tls\n", nil, "line 2: unterminated section header"},
+		{"unterminated table", "[[light]\n", nil, "line 1: unterminated table header"},
+		{"empty table name", "[[ ]]\n", nil, "line 1: empty table name"},
+		{"set twice", "[tls]\nca_file = \"a\"\n\nca_file = \"b\"\n", nil, "line 4: tls.ca_file is set twice"},
+	}
+	for _, c := range cases {
+		f, err := parseConfigFile(strings.NewReader(c.input))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if len(f.values) != len(c.values) {
+			t.Errorf("%s: values are %+v", c.name, f.values)
+		}
+		for key, want := range c.values {
+			if got, ok := f.values[key]; !ok || got.value != want {
+				t.Errorf("%s: %s is %q, want %q", c.name, key, got.value, want)
+			}
+		}
+	}
+}
+
+func TestParseConfigFileTables(t *testing.T) {
+	f, err := parseConfigFile(strings.NewReader(`
+device_id = "hall"
+
+[[light]]
+device_id = "desk"
+led_pin = "12"
+
+[tls]
+ca_file = "roots.pem"
+
+[[light]]
+device_id = "shelf"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.values["device_id"].value != "hall" || f.values["tls.ca_file"].value != "roots.pem" {
+		t.Errorf("values are %+v", f.values)
+	}
+	lights := f.tables["light"]
+	if len(lights) != 2 {
+		t.Fatalf("lights are %+v", lights)
+	}
+	if lights[0]["device_id"].value != "desk" || lights[0]["led_pin"].value != "12" || len(lights[0]) != 2 {
+		t.Errorf("first light is %+v", lights[0])
+	}
+	if lights[1]["device_id"].value != "shelf" || lights[1]["device_id"].line != 12 || len(lights[1]) != 1 {
+		t.Errorf("second light is %+v", lights[1])
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer setenv(t, "IOT_CONFIG", nil)()
+	path := filepath.Join(dir, "bad.toml")
+	writeFile(t, path, []byte(`connector = "mqtt"
+broker = "tcp://localhost:1883"
+colour = "red"
+
+[state]
+heartbeat = "often"
+
+[[lamp]]
+`))
+
+	_, _, errs, err := parseConfig("iot-client", []string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		path + ":3: unknown setting colour",
+		path + `:6: state.heartbeat: "often" is not a duration`,
+		path + ": unknown table [[lamp]]",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("errors are %v", errs)
+	}
+	for _, w := range want {
+		found := false
+		for _, err := range errs {
+			found = found || err.Error() == w
+		}
+		if !found {
+			t.Errorf("no %q in %v", w, errs)
+		}
+	}
+
+	writeFile(t, path, []byte("connector = \"mqtt\"\nbroker\n"))
+	if _, err := loadConfig("iot-client", []string{"-config", path}); err == nil || !strings.Contains(err.Error(), path+": line 2: expected key = value") {
+		t.Errorf("syntax error gave %v", err)
+	}
+}
+
+func TestConfigValidateReportsEverything(t *testing.T) {
+	c := defaultConfig()
+	c.Connector = "mqtt"
+	if errs := c.validate(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "broker is required") {
+		t.Fatalf("a config without a broker gave %v", errs)
+	}
+
+	c.Broker = "http://localhost"
+	c.LEDMode = "dim"
+	c.Gamma = 9
+	c.ButtonPin = c.LEDPin
+	c.ConflictPolicy = "mine"
+	c.SafeState = "sideways"
+	c.Token, c.Password = "t", "p"
+	c.StateMinInterval = 2 * c.StateHeartbeat
+	want := []string{
+		`led_mode must be "pwm" or "digital", not "dim"`,
+		"gamma must be between 1 and 4, not 9",
+		"button.pin and led_pin must be different pins",
+		`conflict.policy must be "local-override" or "last-writer-wins", not "mine"`,
+		`shutdown.safe_state must be "off", "on" or "keep", not "sideways"`,
+		`broker: scheme must be tcp, ssl, tls, ws or wss, not "http"`,
+		"only one of password and token can be set",
+		"state.min_interval must be between 0 and state.heartbeat",
+	}
+	errs := c.validate()
+	if len(errs) != len(want) {
+		t.Errorf("errors are %v", errs)
+	}
+	for _, w := range want {
+		found := false
+		for _, err := range errs {
+			found = found || strings.HasPrefix(err.Error(), w)
+		}
+		if !found {
+			t.Errorf("no %q in %v", w, errs)
+		}
+	}
+
+	// loadConfig reports them all in one error, with problems in the
+	// environment and flags alongside.
+	defer setenv(t, "IOT_CONFIG", nil)()
+	defer setenv(t, "STATE_HEARTBEAT", str("never"))()
+	_, err := loadConfig("iot-client", []string{
+		"-connector", "mqtt",
+		"-broker", "tcp://localhost:1883",
+		"-led-mode", "dim",
+		"-gamma", "9",
+		"-button.pin", "10",
+		"-jwt.lifetime", "forever",
+	})
+	if err == nil {
+		t.Fatal("an invalid config loaded")
+	}
+	for _, w := range []string{
+		`STATE_HEARTBEAT: "never" is not a duration`,
+		`-jwt.lifetime: "forever" is not a duration`,
+		"led_mode must be",
+		"gamma must be",
+		"button.pin and led_pin",
+	} {
+		if !strings.Contains(err.Error(), "\n  "+w) {
+			t.Errorf("no %q in %s", w, err)
+		}
+	}
+}
+
+func TestConfigLights(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer setenv(t, "IOT_CONFIG", nil)()
+	path := filepath.Join(dir, "lights.toml")
+	writeFile(t, path, []byte(`connector = "mqtt"
+broker = "tcp://localhost:1883"
+led_pin = "10"
+gamma = 2.0
+schedule.file = "schedules.json"
+outbox.dir = "outbox"
+
+[state]
+heartbeat = "1m"
+
+[[sensor]]
+name = "room"
+driver = "bme280"
+
+[[light]]
+device_id = "desk"
+gamma = 3.0
+state.heartbeat = "2m"
+state.min_interval = "5s"
+
+[[light]]
+device_id = "shelf"
+led_pin = "12"
+gamma = 3.0
+rules.file = "shelf.json"
+schedule.file = "shelf-schedules.json"
+`))
+
+	// The environment and flags override the tables as they do the file,
+	// and derived paths follow them.
+	defer setenv(t, "STATE_HEARTBEAT", str("3m"))()
+	defer setenv(t, "STATE_MIN_INTERVAL", nil)()
+	cfg, err := loadConfig("iot-client", []string{"-config", path, "-gamma", "1.5", "-schedule.file", "cli.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lights := cfg.devices()
+	if len(lights) != 2 {
+		t.Fatalf("lights are %+v", lights)
+	}
+	desk, shelf := lights[0], lights[1]
+
+	cases := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"desk led_pin from the file", desk.LEDPin, "10"},
+		{"shelf led_pin from its table", shelf.LEDPin, "12"},
+		{"desk state.min_interval from its table", desk.StateMinInterval, 5 * time.Second},
+		{"shelf state.min_interval from the defaults", shelf.StateMinInterval, defaultMinStateInterval},
+		{"desk state.heartbeat from the environment", desk.StateHeartbeat, 3 * time.Minute},
+		{"shelf state.heartbeat from the environment", shelf.StateHeartbeat, 3 * time.Minute},
+		{"desk gamma from the flag", desk.Gamma, 1.5},
+		{"shelf gamma from the flag", shelf.Gamma, 1.5},
+		{"desk outbox.dir from the file", desk.OutboxDir, filepath.Join("outbox", "desk")},
+		{"shelf outbox.dir from the file", shelf.OutboxDir, filepath.Join("outbox", "shelf")},
+		{"desk schedule.file from the flag", desk.ScheduleFile, "cli-desk.json"},
+		{"shelf schedule.file from the flag over its table", shelf.ScheduleFile, "cli-shelf.json"},
+		{"desk rules.file from the defaults", desk.RulesFile, strings.TrimSuffix(defaultRulesFile, ".json") + "-desk.json"},
+		{"shelf rules.file from its table", shelf.RulesFile, "shelf.json"},
+		{"desk sensors", len(desk.Sensors), 1},
+		{"shelf sensors", len(shelf.Sensors), 0},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("%s: %v, want %v", c.name, c.got, c.want)
+		}
+	}
+
+	// A setting given on the command line is every light's, so they clash.
+	_, err = loadConfig("iot-client", []string{"-config", path, "-led-pin", "16"})
+	if err == nil || !strings.Contains(err.Error(), "light 1 and light 2 both use pin 16") {
+		t.Errorf("a shared led pin gave %v", err)
+	}
+}
+
+func TestConfigLightErrors(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer setenv(t, "IOT_CONFIG", nil)()
+	path := filepath.Join(dir, "lights.toml")
+	writeFile(t, path, []byte(`connector = "mqtt"
+broker = "tcp://localhost:1883"
+
+[[light]]
+device_id = "desk"
+colour = "red"
+api.listen = ":8443"
+
+[[light]]
+device_id = "desk"
+led_pin = "10"
+gamma = 9.0
+`))
+
+	_, err := loadConfig("iot-client", []string{"-config", path})
+	if err == nil {
+		t.Fatal("invalid lights loaded")
+	}
+	for _, w := range []string{
+		path + ":6: unknown setting colour",
+		path + ":7: api.listen is shared by all lights",
+		"light 2 (desk): gamma must be between 1 and 4",
+		"light 1 and light 2 both use device_id desk",
+		"light 1 and light 2 both use pin 10",
+	} {
+		if !strings.Contains(err.Error(), "\n  "+w) {
+			t.Errorf("no %q in %s", w, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	sourceRemote = "remote"
+	sourceLocal  = "local"
+
+	// policyLocalOverride ignores remote configs for a while after a local
+	// change.
+	policyLocalOverride = "local-override"
+	// policyLastWriterWins applies a remote config only if it was issued
+	// after the last local change.
+	policyLastWriterWins = "last-writer-wins"
+
+	defaultOverrideWindow = 15 * time.Minute
+)
+
+// conflictError is returned for a remote config that lost to a local change.
+type conflictError struct {
+	version int64
+	reason  string
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("ignoring config version %d, %s", e.version, e.reason)
+}
+
+// conflictPolicy decides whether a remote config may replace a state chosen
+// locally, e.g. with the wall button. Remote configs always apply over other
+// remote configs.
+type conflictPolicy struct {
+	Mode   string
+	Window time.Duration
+}
+
+// check returns a *conflictError if c, received at now, should not replace a
+// local change made at localAt.
+func (p conflictPolicy) check(c *lightConfig, now, localAt time.Time) error {
+	switch p.Mode {
+	case policyLastWriterWins:
+		// Configs without a timestamp are taken to be written when they
+		// arrive.
+		issued := now
+		if !c.IssuedAt.IsZero() {
+			issued = c.IssuedAt
+		}
+		if !issued.After(localAt) {
+			return &conflictError{c.Version, fmt.Sprintf("it was issued at %s, before the local change at %s", issued.Format(time.RFC3339), localAt.Format(time.RFC3339))}
+		}
+	default:
+		if until := localAt.Add(p.Window); now.Before(until) {
+			return &conflictError{c.Version, fmt.Sprintf("the light was set locally and remote changes are held until %s", until.Format(time.RFC3339))}
+		}
+	}
+	return nil
+}
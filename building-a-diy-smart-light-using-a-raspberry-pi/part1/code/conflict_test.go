@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConflictPolicyCheck(t *testing.T) {
+	local := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	override := conflictPolicy{Mode: policyLocalOverride, Window: time.Minute}
+	lastWriter := conflictPolicy{Mode: policyLastWriterWins}
+
+	cases := []struct {
+		name     string
+		policy   conflictPolicy
+		issued   time.Time
+		received time.Time
+		held     bool
+	}{
+		{"override at the change", override, time.Time{}, local, true},
+		{"override inside the window", override, local.Add(time.Hour), local.Add(59 * time.Second), true},
+		{"override at the end of the window", override, time.Time{}, local.Add(time.Minute), false},
+		{"override after the window", override, local.Add(-time.Hour), local.Add(time.Hour), false},
+		{"no window", conflictPolicy{Mode: policyLocalOverride}, time.Time{}, local, false},
+		{"last writer issued after", lastWriter, local.Add(time.Second), local.Add(2 * time.Second), false},
+		{"last writer issued before", lastWriter, local.Add(-time.Second), local.Add(time.Hour), true},
+		{"last writer issued at the change", lastWriter, local, local.Add(time.Second), true},
+		{"last writer unstamped after", lastWriter, time.Time{}, local.Add(time.Millisecond), false},
+		{"last writer unstamped at the change", lastWriter, time.Time{}, local, true},
+	}
+	for _, c := range cases {
+		err := c.policy.check(&lightConfig{Version: 9, Power: powerOn, IssuedAt: c.issued}, c.received, local)
+		if _, held := err.(*conflictError); held != c.held || (err != nil && !held) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestLightConflictPolicies(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Under local-override a button press holds off remote configs for the
+	// window, however new they are.
+	clk := newFakeClock(start)
+	l, _ := testLight(clk)
+	l.policy = conflictPolicy{Mode: policyLocalOverride, Window: 10 * time.Minute}
+	if err := l.Apply(&lightConfig{Version: 1, Power: powerOff}); err != nil {
+		t.Fatal(err)
+	}
+	l.Toggle()
+	for _, wait := range []time.Duration{0, time.Minute, 9*time.Minute + 59*time.Second} {
+		clk.Set(start.Add(wait))
+		err := l.Apply(&lightConfig{Version: 2, Power: powerOff, IssuedAt: clk.Now()})
+		if _, ok := err.(*conflictError); !ok {
+			t.Errorf("%s after the press the config gave %v", wait, err)
+		}
+	}
+	if c, v := l.Current(); c.Power != powerOn || v != 1 {
+		t.Errorf("inside the window the light is %s at version %d", c.Power, v)
+	}
+	clk.Set(start.Add(10 * time.Minute))
+	if err := l.Apply(&lightConfig{Version: 2, Power: powerOff}); err != nil {
+		t.Errorf("after the window: %s", err)
+	}
+	if c, _ := l.Current(); c.Power != powerOff || l.LEDOn() {
+		t.Errorf("after the window the light is %s", c.Power)
+	}
+	if source, _ := l.Source(); source != sourceRemote {
+		t.Errorf("after the window the light was set from %s", source)
+	}
+
+	// Under last-writer-wins a remote change made after the press wins at
+	// once and one made before it loses, even when it arrives later.
+	clk = newFakeClock(start)
+	l, _ = testLight(clk)
+	l.policy = conflictPolicy{Mode: policyLastWriterWins, Window: 10 * time.Minute}
+	clk.Advance(time.Minute)
+	l.Toggle()
+	clk.Advance(time.Second)
+	err := l.Apply(&lightConfig{Version: 1, Power: powerOff, IssuedAt: start})
+	if _, ok := err.(*conflictError); !ok {
+		t.Errorf("a config issued before the press gave %v", err)
+	}
+	if err := l.Apply(&lightConfig{Version: 2, Power: powerOff, IssuedAt: clk.Now()}); err != nil {
+		t.Errorf("a config issued after the press: %s", err)
+	}
+	if c, v := l.Current(); c.Power != powerOff || v != 2 || l.LEDOn() {
+		t.Errorf("the light is %s at version %d", c.Power, v)
+	}
+}
+
+func TestLightToggleRacesRemoteConfig(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	for i := 0; i < 200; i++ {
+		l, _ := testLight(clk)
+		l.policy = conflictPolicy{Mode: policyLocalOverride, Window: time.Minute}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		var applyErr error
+		go func() {
+			defer wg.Done()
+			applyErr = l.Apply(&lightConfig{Version: 1, Power: powerOn})
+		}()
+		go func() {
+			defer wg.Done()
+			l.Toggle()
+		}()
+		wg.Wait()
+
+		// Either the config came first and the press turned it off again,
+		// or the press came first and held the config off. Nothing in
+		// between, and the LED always agrees with the state.
+		c, v := l.Current()
+		source, _ := l.Source()
+		switch {
+		case applyErr == nil:
+			if c.Power != powerOff || v != 1 || source != sourceLocal {
+				t.Fatalf("config then press left %s at version %d from %s", c.Power, v, source)
+			}
+		default:
+			if _, ok := applyErr.(*conflictError); !ok {
+				t.Fatal(applyErr)
+			}
+			if c.Power != powerOn || v != 0 || source != sourceLocal {
+				t.Fatalf("press then config left %s at version %d from %s", c.Power, v, source)
+			}
+		}
+		if l.LEDOn() != (c.Power == powerOn) {
+			t.Fatalf("the light is %s but the LED on is %v", c.Power, l.LEDOn())
+		}
+	}
+}
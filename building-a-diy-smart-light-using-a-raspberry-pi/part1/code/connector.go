@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Logical topic names. A connector maps these onto the topic layout used by
+// the broker it talks to.
+const (
+	topicConfig   = "config"
+	topicState    = "state"
+	topicEvents   = "events"
+	topicStatus   = "status"
+	topicCommands = "commands"
+	topicResults  = "results"
+	topicAttach   = "attach"
+	topicDetach   = "detach"
+)
+
+// connector knows how to reach one kind of broker. It fills in the broker
+// address, client identity and credentials on the paho options, and expands
+// logical topic names into the broker's topics. deviceTopic gives the topics
+// of another device, such as a board bridged by the gateway.
+type connector interface {
+	configure(opts *MQTT.ClientOptions) error
+	topic(name string) string
+	deviceTopic(name, deviceID string) string
+}
+
+// expiringConnector is implemented by connectors whose credentials expire.
+// The client calls refresh before refreshAt and then reconnects so the broker
+// sees the new credentials.
+type expiringConnector interface {
+	refreshAt() time.Time
+	refresh() error
+}
+
+// rotatingConnector is implemented by connectors that can hold more than one
+// set of credentials. The client calls rejected when the broker refuses a
+// connect; it reports whether there are other credentials to try.
+type rotatingConnector interface {
+	rejected() bool
+}
+
+// defaultTopics are the topic templates used when none are configured. The
+// "{device}" placeholder is replaced with the device id.
+var defaultTopics = map[string]string{
+	topicConfig:   "/devices/{device}/config",
+	topicState:    "/devices/{device}/state",
+	topicEvents:   "/devices/{device}/events",
+	topicStatus:   "/devices/{device}/status",
+	topicCommands: "/devices/{device}/commands",
+	topicResults:  "/devices/{device}/results",
+	topicAttach:   "/devices/{device}/attach",
+	topicDetach:   "/devices/{device}/detach",
+}
+
+func expandTopic(tmpl, deviceID string) string {
+	return strings.Replace(tmpl, "{device}", deviceID, -1)
+}
+
+// mqttConnector talks to any MQTT 3.1.1 broker, e.g. Mosquitto. Credentials
+// are optional; when a token is set it is sent as the password.
+type mqttConnector struct {
+	broker   string
+	clientID string
+	deviceID string
+	username string
+	password string
+	token    string
+	topics   map[string]string
+	tls      tlsOptions
+}
+
+func (m *mqttConnector) configure(opts *MQTT.ClientOptions) error {
+	u, err := url.Parse(m.broker)
+	if err != nil {
+		return fmt.Errorf("invalid broker url %q: %s", m.broker, err)
+	}
+
+	opts.AddBroker(m.broker)
+	opts.SetClientID(m.clientID)
+
+	if u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "wss" {
+		tlsConfig, err := newTLSConfig(m.broker, m.tls)
+		if err != nil {
+			return err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	opts.SetUsername(m.username)
+	if m.token != "" {
+		opts.SetPassword(m.token)
+	} else {
+		opts.SetPassword(m.password)
+	}
+	return nil
+}
+
+func (m *mqttConnector) topic(name string) string {
+	return m.deviceTopic(name, m.deviceID)
+}
+
+func (m *mqttConnector) deviceTopic(name, deviceID string) string {
+	tmpl, ok := m.topics[name]
+	if !ok {
+		tmpl = defaultTopics[name]
+	}
+	return expandTopic(tmpl, deviceID)
+}
+
+// iotCoreConnector connects the way Google Cloud IoT Core expected: a long
+// client id naming the device, and a JWT signed by the device key as the
+// password. The JWT is re-minted before it expires. During a key rotation
+// it switches to the next key at nextFrom.
+type iotCoreConnector struct {
+	broker         string
+	projectID      string
+	region         string
+	registryID     string
+	deviceID       string
+	keyFile        string
+	nextKeyFile    string
+	nextFrom       time.Time
+	passphraseFile string
+	algorithm      string
+	tokenLifetime  time.Duration
+	tls            tlsOptions
+	clock          clock
+
+	tokens *tokenSource
+}
+
+func (g *iotCoreConnector) configure(opts *MQTT.ClientOptions) error {
+	clientID := fmt.Sprintf("projects/%v/locations/%v/registries/%v/devices/%v",
+		g.projectID,
+		g.region,
+		g.registryID,
+		g.deviceID,
+	)
+
+	passphrase, err := readPassphrase(g.passphraseFile)
+	if err != nil {
+		return err
+	}
+	defer zero(passphrase)
+
+	key, err := loadDeviceKey(g.keyFile, passphrase, g.algorithm)
+	if err != nil {
+		return err
+	}
+	g.tokens = newTokenSource(g.projectID, key, g.tokenLifetime, g.clock)
+	if g.nextKeyFile != "" {
+		next, err := loadDeviceKey(g.nextKeyFile, passphrase, "")
+		if err != nil {
+			return err
+		}
+		g.tokens.Rotate(next, g.nextFrom)
+	}
+
+	tlsConfig, err := newTLSConfig(g.broker, g.tls)
+	if err != nil {
+		return err
+	}
+
+	if _, err := g.tokens.Token(); err != nil {
+		return err
+	}
+
+	opts.AddBroker(g.broker)
+	opts.SetClientID(clientID).SetTLSConfig(tlsConfig)
+
+	// paho asks for credentials on every connect, including its own
+	// automatic reconnects, so those never reuse an expired token.
+	opts.SetCredentialsProvider(func() (string, string) {
+		jwtString, err := g.tokens.Token()
+		if err != nil {
+			fmt.Printf("failed to mint device token: %s\n", err)
+		}
+		return "unused", jwtString
+	})
+	return nil
+}
+
+func (g *iotCoreConnector) refreshAt() time.Time {
+	return g.tokens.RefreshAt()
+}
+
+func (g *iotCoreConnector) refresh() error {
+	_, err := g.tokens.Refresh()
+	return err
+}
+
+func (g *iotCoreConnector) rejected() bool {
+	return g.tokens.Rejected()
+}
+
+// topic gives no status topic: IoT Core has neither retained messages nor
+// wills. Devices may only publish events and state there, so command results
+// go to a subfolder of the events topic.
+func (g *iotCoreConnector) topic(name string) string {
+	return g.deviceTopic(name, g.deviceID)
+}
+
+func (g *iotCoreConnector) deviceTopic(name, deviceID string) string {
+	switch name {
+	case topicStatus:
+		return ""
+	case topicResults:
+		return expandTopic(defaultTopics[topicEvents], deviceID) + "/results"
+	}
+	return expandTopic(defaultTopics[name], deviceID)
+}
+
+// newConnector builds the connector selected by the config.
+func newConnector(c *config) (connector, error) {
+	switch c.connectorName() {
+	case "mqtt":
+		clientID := c.ClientID
+		if clientID == "" {
+			clientID = c.DeviceID
+		}
+
+		topics := map[string]string{}
+		if c.ConfigTopic != "" {
+			topics[topicConfig] = c.ConfigTopic
+		}
+		if c.StateTopic != "" {
+			topics[topicState] = c.StateTopic
+		}
+		if c.EventsTopic != "" {
+			topics[topicEvents] = c.EventsTopic
+		}
+		if c.StatusTopic != "" {
+			topics[topicStatus] = c.StatusTopic
+		}
+		if c.CommandsTopic != "" {
+			topics[topicCommands] = c.CommandsTopic
+		}
+		if c.ResultsTopic != "" {
+			topics[topicResults] = c.ResultsTopic
+		}
+
+		return &mqttConnector{
+			broker:   c.Broker,
+			clientID: clientID,
+			deviceID: c.DeviceID,
+			username: c.Username,
+			password: c.Password,
+			token:    c.Token,
+			topics:   topics,
+			tls:      c.brokerTLS(),
+		}, nil
+	case "iotcore":
+		var nextKeyFile string
+		var nextFrom time.Time
+		if c.NextKeyFile != "" {
+			nextKeyFile = c.certFile(c.NextKeyFile)
+			if c.NextKeyFrom != "" {
+				var err error
+				if nextFrom, err = time.Parse(time.RFC3339, c.NextKeyFrom); err != nil {
+					return nil, fmt.Errorf("jwt.next_key_from: %s", err)
+				}
+			}
+		}
+
+		return &iotCoreConnector{
+			broker:         c.brokerURL(),
+			projectID:      c.ProjectID,
+			region:         c.Region,
+			registryID:     c.RegistryID,
+			deviceID:       c.DeviceID,
+			keyFile:        c.certFile(c.KeyFile),
+			nextKeyFile:    nextKeyFile,
+			nextFrom:       nextFrom,
+			passphraseFile: c.passphraseFile(),
+			algorithm:      c.JWTAlgorithm,
+			tokenLifetime:  c.TokenLifetime,
+			tls:            c.brokerTLS(),
+			clock:          realClock{},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown connector %q", c.Connector)
+}
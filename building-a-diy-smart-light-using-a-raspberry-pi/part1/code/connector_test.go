@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// testWait is how long tests wait for something to arrive over a socket.
+const testWait = 5 * time.Second
+
+// startTestBroker starts the in-process broker on a free port.
+func startTestBroker(t *testing.T) *broker {
+	t.Helper()
+	b, err := startBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// watchTopic collects what the broker routes on filter.
+func watchTopic(t *testing.T, b *broker, filter string) <-chan string {
+	t.Helper()
+	got := make(chan string, 16)
+	if err := b.Watch(filter, func(_ string, payload []byte) { got <- string(payload) }); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func receive(t *testing.T, ch <-chan string, what string) string {
+	t.Helper()
+	select {
+	case s := <-ch:
+		return s
+	case <-time.After(testWait):
+		t.Fatalf("no %s within %s", what, testWait)
+	}
+	return ""
+}
+
+func TestMQTTConnectorEndToEnd(t *testing.T) {
+	b := startTestBroker(t)
+	defer b.Close()
+	status := watchTopic(t, b, "/devices/lamp/status")
+	events := watchTopic(t, b, "/devices/lamp/events")
+
+	conn, err := newConnector(&config{
+		Connector: "mqtt",
+		Broker:    "tcp://" + b.Addr(),
+		DeviceID:  "lamp",
+		Username:  "lamp",
+		Password:  "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got := receive(t, status, "status"); got != statusOnline {
+		t.Errorf("status is %q, want %q", got, statusOnline)
+	}
+
+	configs := make(chan string, 1)
+	err = c.Subsribe(c.Topic(topicConfig), func(_ MQTT.Client, m MQTT.Message) {
+		configs <- string(m.Payload())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Publish("/devices/lamp/config", []byte(`{"version": 2, "power": "on", "brightness": 40}`), false)
+	lc, err := parseLightConfig([]byte(receive(t, configs, "config")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lc.Version != 2 || lc.Power != powerOn || lc.brightness() != 40 {
+		t.Errorf("config arrived as %+v", lc)
+	}
+
+	if err := c.Publish(`{"type": "test"}`, c.Topic(topicEvents)); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, events, "event"); got != `{"type": "test"}` {
+		t.Errorf("event is %q", got)
+	}
+}
+
+func TestMQTTConnectorTopics(t *testing.T) {
+	m := &mqttConnector{
+		deviceID: "lamp",
+		topics:   map[string]string{topicConfig: "/lights/{device}/set"},
+	}
+	cases := map[string]string{
+		topicConfig: "/lights/lamp/set",
+		topicState:  "/devices/lamp/state",
+		topicStatus: "/devices/lamp/status",
+	}
+	for name, want := range cases {
+		if got := m.topic(name); got != want {
+			t.Errorf("topic(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	g := &iotCoreConnector{deviceID: "lamp"}
+	if got := g.topic(topicStatus); got != "" {
+		t.Errorf("iotcore status topic is %q, want none", got)
+	}
+	if got := g.topic(topicResults); got != "/devices/lamp/events/results" {
+		t.Errorf("iotcore results topic is %q", got)
+	}
+}
+
+// closedAddr returns a local address nothing is listening on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestClientConnectsInBackground(t *testing.T) {
+	addr := closedAddr(t)
+	conn, err := newConnector(&config{Connector: "mqtt", Broker: "tcp://" + addr, DeviceID: "lamp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	clk := newFakeClock(time.Now())
+	c.clock = clk
+	errs := make(chan string, 16)
+	c.OnError = func(err error) { errs <- err.Error() }
+
+	// Subscriptions and handlers set up offline wait for the connection.
+	configs := make(chan string, 1)
+	if err := c.Subsribe(c.Topic(topicConfig), func(_ MQTT.Client, m MQTT.Message) { configs <- string(m.Payload()) }); err != nil {
+		t.Fatalf("subscribing offline: %s", err)
+	}
+	if err := c.Subsribe("/devices/#/config", nil); err == nil {
+		t.Error("subscribed to an invalid filter")
+	}
+	connected := make(chan string, 1)
+	c.AddConnectHandler(func() { connected <- "connected" })
+
+	stop := make(chan struct{})
+	defer close(stop)
+	done := make(chan struct{})
+	go func() {
+		c.Connect(stop)
+		close(done)
+	}()
+
+	// Each failed attempt waits longer before the next.
+	for _, retry := range []time.Duration{minConnectRetry, 2 * minConnectRetry} {
+		if e := receive(t, errs, "connect error"); !strings.Contains(e, "retrying in "+retry.String()) {
+			t.Errorf("connect error is %q", e)
+		}
+		waitForWaiters(t, clk, 1)
+		if retry == minConnectRetry {
+			clk.Advance(retry)
+		}
+	}
+
+	b, err := startBroker(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	status := watchTopic(t, b, "/devices/lamp/status")
+	clk.Advance(2 * minConnectRetry)
+
+	receive(t, connected, "connect handler")
+	if got := receive(t, status, "online status"); got != statusOnline {
+		t.Errorf("status is %q", got)
+	}
+	b.Publish("/devices/lamp/config", []byte(`{"version":1}`), false)
+	if got := receive(t, configs, "config"); got != `{"version":1}` {
+		t.Errorf("config is %q", got)
+	}
+	select {
+	case <-done:
+	case <-time.After(testWait):
+		t.Fatal("Connect kept going after connecting")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	defaultTokenLifetime = 24 * time.Hour
+
+	// A token is refreshed once this fraction of its lifetime is left, so
+	// there is time to retry before the broker rejects it.
+	tokenRefreshFraction = 10
+
+	// When the broker refuses the next key during a rotation, the current
+	// key is used again and the next one retried after this long.
+	nextKeyRetry = time.Hour
+)
+
+// tokenSource mints device JWTs signed with the device key and remembers when
+// the most recently minted one expires.
+//
+// During a key rotation it holds two keys, both registered with the broker:
+// the current key and the next one, which takes over from nextFrom on. If the
+// broker refuses whichever key is in use, Rejected moves the switchover so
+// the other key is tried, unless that one was refused too.
+type tokenSource struct {
+	audience string
+	lifetime time.Duration
+	clock    clock
+
+	mu       sync.Mutex
+	key      *deviceKey
+	next     *deviceKey
+	nextFrom time.Time
+	refused  bool
+	current  string
+	signer   *deviceKey
+	expires  time.Time
+}
+
+func newTokenSource(audience string, key *deviceKey, lifetime time.Duration, clk clock) *tokenSource {
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	return &tokenSource{
+		audience: audience,
+		lifetime: lifetime,
+		clock:    clk,
+		key:      key,
+	}
+}
+
+// Rotate stages next to replace the current key from the given time on. A
+// zero time switches on the next refresh.
+func (t *tokenSource) Rotate(next *deviceKey, from time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next, t.nextFrom = next, from
+}
+
+// Token returns the current token, minting a new one when it is due for
+// refresh or was signed with a key that is no longer in use.
+func (t *tokenSource) Token() (string, error) {
+	t.mu.Lock()
+	current, due := t.current, t.refreshAt()
+	t.mu.Unlock()
+
+	if current != "" && t.clock.Now().Before(due) {
+		return current, nil
+	}
+	return t.Refresh()
+}
+
+// Refresh mints a new token and makes it the current one.
+func (t *tokenSource) Refresh() (string, error) {
+	now := t.clock.Now()
+	expires := now.Add(t.lifetime)
+
+	t.mu.Lock()
+	key := t.signingKey(now)
+	t.mu.Unlock()
+
+	token := jwt.New(key.method)
+	token.Claims = jwt.StandardClaims{
+		Audience:  t.audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	}
+
+	tokenString, err := token.SignedString(key.key)
+	if err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	if t.signer != key {
+		fmt.Printf("signing device tokens with %s\n", key.path)
+	}
+	if key == t.next {
+		t.refused = false
+	}
+	t.current, t.expires, t.signer = tokenString, expires, key
+	t.mu.Unlock()
+
+	return tokenString, nil
+}
+
+// Rejected is called when the broker refuses the current token. It reports
+// whether there is another key to try, in which case the next Token is
+// signed with it.
+func (t *tokenSource) Rejected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	switch {
+	case t.next == nil || t.current == "":
+		return false
+	case t.signer == t.next:
+		t.nextFrom, t.refused = now.Add(nextKeyRetry), true
+		fmt.Printf("broker refused %s, going back to %s until %s\n", t.next.path, t.key.path, t.nextFrom.Format(time.RFC3339))
+	case now.Before(t.nextFrom) && !t.refused:
+		t.nextFrom = now
+		fmt.Printf("broker refused %s, switching to %s early\n", t.key.path, t.next.path)
+	default:
+		return false
+	}
+	t.current = ""
+	return true
+}
+
+// RefreshAt returns when the current token should be replaced.
+func (t *tokenSource) RefreshAt() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.refreshAt()
+}
+
+func (t *tokenSource) refreshAt() time.Time {
+	due := t.expires.Add(-t.lifetime / tokenRefreshFraction)
+	if t.next != nil && t.signer != t.next && t.nextFrom.Before(due) {
+		return t.nextFrom
+	}
+	return due
+}
+
+func (t *tokenSource) signingKey(now time.Time) *deviceKey {
+	if t.next != nil && !now.Before(t.nextFrom) {
+		return t.next
+	}
+	return t.key
+}
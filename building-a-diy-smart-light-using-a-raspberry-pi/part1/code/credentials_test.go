@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// tempDir makes a directory that the returned func removes.
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "iot-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// writeECKey writes a new P-256 device key to dir and returns its path and
+// the key.
+func writeECKey(t *testing.T, dir, name string) (string, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+// passwordRecorder is a broker that records the password each connection
+// connects with. It refuses those refuse reports true for and accepts the
+// rest, and acks each publish after ackDelay.
+type passwordRecorder struct {
+	listener  net.Listener
+	passwords chan string
+	ackDelay  time.Duration
+	refuse    func(password string) bool
+}
+
+func startPasswordRecorder(t *testing.T, ackDelay time.Duration) *passwordRecorder {
+	t.Helper()
+	return startRefusingRecorder(t, ackDelay, func(string) bool { return false })
+}
+
+func startRefusingRecorder(t *testing.T, ackDelay time.Duration, refuse func(password string) bool) *passwordRecorder {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &passwordRecorder{listener: l, passwords: make(chan string, 8), ackDelay: ackDelay, refuse: refuse}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *passwordRecorder) serve(conn net.Conn) {
+	defer conn.Close()
+	pkt, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	cp, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+	r.passwords <- string(cp.Password)
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	if r.refuse(string(cp.Password)) {
+		ack.ReturnCode = packets.ErrRefusedBadUsernameOrPassword
+		ack.Write(conn)
+		return
+	}
+	if err := ack.Write(conn); err != nil {
+		return
+	}
+	for {
+		pkt, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := pkt.(type) {
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.PublishPacket:
+			time.Sleep(r.ackDelay)
+			ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			ack.MessageID = p.MessageID
+			ack.Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (r *passwordRecorder) Close() {
+	r.listener.Close()
+}
+
+// tokenClaims parses a device JWT without checking its times against the
+// real clock.
+func tokenClaims(t *testing.T, token string, key *ecdsa.PrivateKey) *jwt.StandardClaims {
+	t.Helper()
+	claims := &jwt.StandardClaims{}
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	if err != nil {
+		t.Fatalf("token does not verify: %s", err)
+	}
+	return claims
+}
+
+// signedBy reports whether token is a device JWT signed with key.
+func signedBy(token string, key *ecdsa.PrivateKey) bool {
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.Parse(token, func(*jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	return err == nil
+}
+
+func TestTokenRefreshedBeforeExpiry(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	keyFile, key := writeECKey(t, dir, "ec_private.pem")
+
+	clk := newFakeClock(time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC))
+	start := clk.Now()
+	ts := newTokenSource("project", &deviceKey{path: keyFile, method: jwt.SigningMethodES256, key: key}, time.Hour, clk)
+
+	first, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Unix(tokenClaims(t, first, key).ExpiresAt, 0)
+	if !exp.Equal(start.Add(time.Hour)) {
+		t.Fatalf("token expires at %s, want %s", exp, start.Add(time.Hour))
+	}
+	if due := ts.RefreshAt(); !due.Before(exp) {
+		t.Errorf("refresh is due at %s, not before the expiry at %s", due, exp)
+	}
+
+	clk.Advance(time.Minute)
+	if again, _ := ts.Token(); again != first {
+		t.Error("token was replaced long before it was due")
+	}
+
+	clk.Set(exp.Add(time.Second))
+	next, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := tokenClaims(t, next, key)
+	if next == first || time.Unix(claims.ExpiresAt, 0).Before(clk.Now().Add(time.Hour)) {
+		t.Errorf("past the expiry Token gave a token expiring at %s", time.Unix(claims.ExpiresAt, 0))
+	}
+}
+
+func TestClientReconnectsWithFreshToken(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	keyFile, key := writeECKey(t, dir, "ec_private.pem")
+
+	r := startPasswordRecorder(t, 0)
+	defer r.Close()
+
+	clk := newFakeClock(time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC))
+	conn := &iotCoreConnector{
+		broker:        "tcp://" + r.listener.Addr().String(),
+		projectID:     "project",
+		region:        "europe-west1",
+		registryID:    "lights",
+		deviceID:      "lamp",
+		keyFile:       keyFile,
+		algorithm:     "ES256",
+		tokenLifetime: time.Hour,
+		clock:         clk,
+	}
+	c, err := newClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.clock = clk
+
+	first := receive(t, r.passwords, "first connect")
+	exp := time.Unix(tokenClaims(t, first, key).ExpiresAt, 0)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.KeepCredentialsFresh(stop)
+	waitForWaiters(t, clk, 1)
+
+	// Nothing happens until the refresh is due.
+	clk.Advance(time.Minute)
+	select {
+	case p := <-r.passwords:
+		t.Fatalf("reconnected early with %q", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Set(conn.refreshAt())
+	second := receive(t, r.passwords, "reconnect")
+	if second == first {
+		t.Fatal("reconnected with the old token")
+	}
+	claims := tokenClaims(t, second, key)
+	if issued := time.Unix(claims.IssuedAt, 0); !issued.Before(exp) {
+		t.Errorf("new token issued at %s, after the old one expired at %s", issued, exp)
+	}
+	if got := time.Unix(claims.ExpiresAt, 0); !got.Equal(clk.Now().Add(time.Hour)) {
+		t.Errorf("new token expires at %s, want %s", got, clk.Now().Add(time.Hour))
+	}
+	eventually(t, "client to connect again", c.IsConnected)
+}
+
+// checkSigners checks that the connects r has seen were signed with
+// refused until the last, which was signed with accepted. paho tries a
+// refused connect again with MQTT 3.1, so refused may be seen more than once.
+func checkSigners(t *testing.T, r *passwordRecorder, refused, accepted *ecdsa.PrivateKey) {
+	t.Helper()
+	var passwords []string
+	for len(r.passwords) > 0 {
+		passwords = append(passwords, <-r.passwords)
+	}
+	if len(passwords) < 2 {
+		t.Fatalf("%d connects", len(passwords))
+	}
+	last := len(passwords) - 1
+	for i, p := range passwords[:last] {
+		if !signedBy(p, refused) {
+			t.Errorf("connect %d was not signed with the refused key", i)
+		}
+	}
+	if !signedBy(passwords[last], accepted) {
+		t.Error("the last connect was not signed with the other key")
+	}
+}
+
+func TestClientRotatesKeyWhenRefused(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	keyFile, key := writeECKey(t, dir, "ec_private.pem")
+	nextFile, next := writeECKey(t, dir, "ec_next.pem")
+
+	clk := newFakeClock(time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC))
+	connect := func(refused *ecdsa.PrivateKey, nextFrom time.Time) (*passwordRecorder, *client, *iotCoreConnector) {
+		t.Helper()
+		r := startRefusingRecorder(t, 0, func(password string) bool { return signedBy(password, refused) })
+		conn := &iotCoreConnector{
+			broker:        "tcp://" + r.listener.Addr().String(),
+			projectID:     "project",
+			region:        "europe-west1",
+			registryID:    "lights",
+			deviceID:      "lamp",
+			keyFile:       keyFile,
+			nextKeyFile:   nextFile,
+			nextFrom:      nextFrom,
+			algorithm:     "ES256",
+			tokenLifetime: time.Hour,
+			clock:         clk,
+		}
+		c, err := newClient(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.connect(); err != nil {
+			t.Fatal(err)
+		}
+		return r, c, conn
+	}
+
+	// The broker already has the next key in place of the current one, so
+	// the next key is switched to before its time.
+	r, c, conn := connect(key, clk.Now().Add(24*time.Hour))
+	checkSigners(t, r, key, next)
+	if !c.IsConnected() {
+		t.Error("not connected with the next key")
+	}
+	token, err := conn.tokens.Token()
+	if err != nil || !signedBy(token, next) {
+		t.Errorf("after the switch tokens are not signed with the next key: %v", err)
+	}
+	c.Close()
+	r.Close()
+
+	// The broker does not have the next key yet, so the current one is used
+	// again and the next one retried later.
+	r, c, conn = connect(next, time.Time{})
+	defer r.Close()
+	defer c.Close()
+	checkSigners(t, r, next, key)
+	if !c.IsConnected() {
+		t.Error("not connected with the current key")
+	}
+
+	// Refused with both keys, the client gives up rather than looping.
+	if conn.tokens.Rejected() {
+		t.Error("the current key was refused and the next one tried again")
+	}
+	clk.Advance(nextKeyRetry)
+	token, err = conn.tokens.Token()
+	if err != nil || !signedBy(token, next) {
+		t.Errorf("after %s tokens are not signed with the next key: %v", nextKeyRetry, err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week. Fields take *, numbers, ranges (1-5), steps
+// (*/15, 8-18/2) and comma separated lists of those. As in Vixie cron, when
+// both day fields are restricted a day matches if either does.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// cronSearchDays bounds the search for the next match, so an expression that
+// can never match, such as 30 February, gives up.
+const cronSearchDays = 5 * 366
+
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, not %d", expr, len(fields))
+	}
+
+	s := &cronSpec{}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cron minute: %s", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cron hour: %s", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cron day of month: %s", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cron month: %s", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cron day of week: %s", err)
+	}
+	// Sunday is both 0 and 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField returns the values a field matches as a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil || lo > hi {
+				return 0, fmt.Errorf("bad range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			lo, hi = n, n
+		}
+		if lo < min || hi > max {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSpec) dayMatches(t time.Time) bool {
+	if s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first matching minute after after, in after's location,
+// or the zero time if there is none. Times are matched on the wall clock: a
+// time skipped by a daylight saving change runs at the moment the clocks go
+// forward, and a time that happens twice runs the first time only.
+func (s *cronSpec) Next(after time.Time) time.Time {
+	loc := after.Location()
+	y, m, d := after.Date()
+
+	for day := 0; day < cronSearchDays; day++ {
+		// Noon is never skipped by a daylight saving change.
+		date := time.Date(y, m, d+day, 12, 0, 0, 0, loc)
+		if !s.dayMatches(date) {
+			continue
+		}
+		for h := 0; h < 24; h++ {
+			if s.hour&(1<<uint(h)) == 0 {
+				continue
+			}
+			for min := 0; min < 60; min++ {
+				if s.minute&(1<<uint(min)) == 0 {
+					continue
+				}
+				t := wallTime(date, h, min)
+				if t.After(after) {
+					return t
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// wallTime returns the instant the clock on date's day shows h:min. When the
+// clocks go forward over it, that is the moment they change; when they go
+// back over it, the first of the two. time.Date leaves both cases to the
+// zone, so they are settled here.
+func wallTime(date time.Time, h, min int) time.Time {
+	t := time.Date(date.Year(), date.Month(), date.Day(), h, min, 0, 0, date.Location())
+	if t.Hour() != h || t.Minute() != min {
+		for t.Hour()*60+t.Minute() < h*60+min {
+			t = t.Add(time.Minute)
+		}
+		_, offset := t.Zone()
+		for {
+			prev := t.Add(-time.Minute)
+			if _, o := prev.Zone(); o != offset {
+				return t
+			}
+			t = prev
+		}
+	}
+
+	_, offset := t.Zone()
+	_, earlier := t.Add(-12 * time.Hour).Zone()
+	if back := time.Duration(earlier-offset) * time.Second; back > 0 {
+		if first := t.Add(-back); first.Hour() == h && first.Minute() == min {
+			return first
+		}
+	}
+	return t
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/drivers/gpio"
+	"gobot.io/x/gobot/drivers/spi"
+)
+
+// device is one logical light: its own adaptor and robot, broker connection,
+// state and background work, so a fault in one light leaves the others
+// running.
+type device struct {
+	cfg       *config
+	robot     *gobot.Robot
+	client    *client
+	light     *light
+	reporter  *stateReporter
+	box       *outbox
+	queued    *queuedPublisher
+	telemetry *telemetryLog
+	commands  *commandRegistry
+	gateway   *gateway
+	rules     *ruleEngine
+	health    *healthMonitor
+	shared    *shared
+	onConfig  MQTT.MessageHandler
+	stop      chan struct{}
+}
+
+// shared is what the lights in one process have in common. Any of it may be
+// nil.
+type shared struct {
+	view    *simView
+	updater *updater
+	// restart shuts the client down cleanly and starts it again, saying
+	// why.
+	restart func(reason string)
+	// lights returns the light of every running device, for rules that
+	// change them all.
+	lights func() []*light
+	// reading passes a sensor sample from one device to the rules of the
+	// others.
+	reading func(from *device, event telemetryEvent)
+}
+
+// startDevice sets up and starts the light described by cfg.
+func startDevice(cfg *config, sh *shared) (d *device, err error) {
+	r := newHardware(cfg, sh.view)
+	led := gpio.NewLedDriver(r, cfg.LEDPin)
+
+	devices := []gobot.Device{led}
+	var button *gpio.ButtonDriver
+	if cfg.ButtonPin != "" {
+		button = gpio.NewButtonDriver(r, cfg.ButtonPin, buttonPollInterval)
+		if cfg.ButtonActiveLow {
+			button.DefaultState = 1
+		}
+		devices = append(devices, button)
+	}
+	var pir *gpio.PIRMotionDriver
+	if cfg.OccupancyPin != "" {
+		pir = gpio.NewPIRMotionDriver(r, cfg.OccupancyPin, pirPollInterval)
+		devices = append(devices, pir)
+	}
+
+	robot := gobot.NewRobot(cfg.DeviceID,
+		[]gobot.Connection{r},
+		devices,
+	)
+
+	conn, err := newConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newClient(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	var box *outbox
+	var queued *queuedPublisher
+	defer func() {
+		if err != nil {
+			close(stop)
+			c.Close()
+			// A retry opens the outbox again, which must not find this
+			// one still writing to the same segments.
+			if box != nil {
+				<-queued.Done()
+				box.Close()
+			}
+		}
+	}()
+
+	var pub publisher = c
+	if cfg.OutboxDir != "" {
+		box, err = openOutbox(cfg.OutboxDir, cfg.OutboxMaxBytes, cfg.OutboxMaxAge, cfg.OutboxDropPolicy, realClock{})
+		if err != nil {
+			return nil, err
+		}
+		queued = newQueuedPublisher(c, box, realClock{}, func(err error) { c.OnError(err) })
+		go queued.Run(stop)
+		pub = queued
+	}
+	telemetry := newTelemetryLog(pub, c.Topic(topicEvents), realClock{}, maxTelemetry)
+	pub = telemetry
+
+	var out ledOutput = digitalLED{led}
+	if cfg.LEDMode == "pwm" {
+		out = pwmLED{led}
+	}
+
+	var strip *stripRenderer
+	if cfg.StripPixels > 0 {
+		var bus spi.Connector = r
+		if cfg.FakeStrip {
+			bus = newSPISink(1)
+		}
+		apa := spi.NewAPA102Driver(bus, int(cfg.StripPixels), stripGlobalIntensity, spi.WithBus(int(cfg.StripBus)), spi.WithChip(int(cfg.StripChip)))
+		if err = apa.Start(); err != nil {
+			return nil, err
+		}
+		strip = newStripRenderer(apa, int(cfg.StripPixels), int(cfg.StripFPS), realClock{}, func(err error) { c.OnError(err) })
+		out = strip
+	}
+
+	policy := conflictPolicy{Mode: cfg.ConflictPolicy, Window: cfg.ConflictWindow}
+	l := newLight(newFader(out, cfg.Gamma, realClock{}, func(err error) { c.OnError(err) }), realClock{}, policy)
+	l.Strip = strip
+	loc, _ := cfg.location()
+	sched := newScheduler(l, cfg.ScheduleFile, loc, cfg.Latitude, cfg.Longitude, realClock{}, rand.New(rand.NewSource(time.Now().UnixNano())), func(err error) { c.OnError(err) })
+	if err := sched.Load(); err != nil {
+		fmt.Printf("could not restore schedules: %s\n", err)
+	}
+	rules := newRuleEngine(l, pub, c.Topic(topicEvents), cfg.RulesFile, loc, cfg.Latitude, cfg.Longitude, realClock{}, func(err error) { c.OnError(err) })
+	rules.Lights = sh.lights
+	var debounce *debouncer
+	if button != nil {
+		debounce = &debouncer{interval: cfg.ButtonDebounce, clock: realClock{}}
+		rules.ButtonDown = debounce.Pushed
+	}
+	if err := rules.Load(); err != nil {
+		fmt.Printf("could not restore rules: %s\n", err)
+	}
+
+	reporter := newStateReporter(pub, c.Topic(topicState), l, realClock{}, cfg.StateHeartbeat, cfg.StateMinInterval)
+	reporter.Outbox = box
+	reporter.Scheduler = sched
+	l.OnChange = reporter.Changed
+	c.OnError = func(err error) {
+		fmt.Println(err)
+		reporter.Error(err)
+	}
+
+	d = &device{
+		cfg:       cfg,
+		robot:     robot,
+		client:    c,
+		light:     l,
+		reporter:  reporter,
+		box:       box,
+		queued:    queued,
+		telemetry: telemetry,
+		rules:     rules,
+		health:    newHealthMonitor(cfg.HealthInterval, cfg.HealthTimeout, int(cfg.HealthMaxFailures), realClock{}, c.OnError),
+		shared:    sh,
+		stop:      stop,
+	}
+	d.health.Add(checkBroker, d.checkBroker)
+	d.health.Add(checkActuator, d.checkActuator)
+	if sh.restart != nil {
+		d.health.OnFailing = func() { sh.restart(restartHealth) }
+	}
+
+	fmt.Printf("%s: setup config subscription\n", cfg.DeviceID)
+	d.onConfig = func(_ MQTT.Client, m MQTT.Message) {
+		defer d.health.Track("config")()
+
+		lc, err := parseLightConfig(m.Payload())
+		// Schedules and rules that will not build reject the config before
+		// the light is changed.
+		if err == nil && lc.Schedules != nil {
+			_, err = sched.build(*lc.Schedules)
+		}
+		if err == nil && lc.Rules != nil {
+			_, err = rules.build(*lc.Rules)
+		}
+		if err == nil {
+			err = l.Apply(lc)
+		}
+		// Stale and conflicting configs leave the schedules and rules as
+		// they are.
+		if err == nil && lc.Schedules != nil {
+			err = sched.Set(lc.Version, *lc.Schedules)
+		}
+		if err == nil && lc.Rules != nil {
+			err = rules.Set(lc.Version, *lc.Rules)
+		}
+		// Only an accepted config can start an update.
+		if err == nil && lc.Update != nil {
+			if sh.updater != nil {
+				sh.updater.Start(*lc.Update, pub, c.Topic(topicEvents))
+			} else {
+				c.OnError(fmt.Errorf("ignoring update to %s: update.public_key is not set", lc.Update.Version))
+			}
+		}
+
+		switch err.(type) {
+		case nil:
+		case *staleConfigError, *conflictError:
+			fmt.Println(err)
+		default:
+			c.OnError(fmt.Errorf("rejected config: %s", err))
+		}
+	}
+	if err = c.Subsribe(c.Topic(topicConfig), d.onConfig); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("%s: setup command subscription\n", cfg.DeviceID)
+	d.commands = newCommandRegistry(pub, c.Topic(topicCommands), c.Topic(topicResults), realClock{})
+	d.registerCommands()
+	err = c.Subsribe(d.commands.Filter(), func(_ MQTT.Client, m MQTT.Message) {
+		// Handlers may take a while or publish, which must not hold up
+		// paho's delivery of other messages.
+		go func() {
+			defer d.health.Track("command")()
+			d.commands.Dispatch(m.Topic(), m.Payload(), m.Retained())
+		}()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if sh.updater != nil {
+		c.AddConnectHandler(func() { sh.updater.Connected(pub, c.Topic(topicEvents)) })
+	}
+
+	var bus sensorBus = r
+	if cfg.FakeSensors {
+		bus = newFakeBus()
+	}
+	sensors := newSensorPoller(pub, c.Topic(topicEvents), realClock{}, c.OnError, cfg.Sensors, bus)
+	sensors.OnReading = func(event telemetryEvent) {
+		rules.Observe(event)
+		if sh.reading != nil {
+			sh.reading(d, event)
+		}
+	}
+
+	go c.KeepCredentialsFresh(stop)
+	go reporter.Run(stop)
+	go sensors.Run(stop)
+	go sched.Run(stop)
+	go rules.Run(stop)
+	if len(cfg.GatewayPorts) > 0 {
+		d.gateway = newGateway(c, pub, c.Topic(topicEvents), cfg.GatewayPorts, cfg.GatewayBaud, cfg.GatewayKeepalive, realClock{})
+		c.AddConnectHandler(d.gateway.Reattach)
+		go d.gateway.Run(stop)
+	}
+	if pir != nil {
+		inhibit, _ := parseInhibit(cfg.OccupancyInhibit, cfg.Latitude, cfg.Longitude, loc)
+		occ := newOccupancy(l, realClock{}, cfg.OccupancyTimeout, cfg.OccupancyHold, inhibit, pub, c.Topic(topicEvents), c.OnError)
+		go occ.Run(pir, stop)
+	}
+	if strip != nil {
+		go strip.Run(stop)
+	}
+	if button != nil {
+		watchButton(button, debounce, func() {
+			if err := l.Toggle(); err != nil {
+				c.OnError(fmt.Errorf("button: %s", err))
+			}
+			rules.ButtonPress()
+		}, stop)
+	}
+
+	if err = robot.Start(false); err != nil {
+		return nil, err
+	}
+	go d.health.Run(stop)
+	// The light runs whether or not the broker can be reached; messages
+	// wait in the outbox until it can.
+	go c.Connect(stop)
+	return d, nil
+}
+
+// checkBroker times a round trip to the broker. While paho is reconnecting
+// the check is only degraded: restarting would not bring the broker back.
+// A connection that looks open but gets no answer is half-open and fails.
+func (d *device) checkBroker() (time.Duration, error) {
+	if !d.client.IsConnected() {
+		return 0, degradedError{fmt.Errorf("not connected")}
+	}
+	return d.client.Ping(d.cfg.HealthTimeout)
+}
+
+// checkActuator fails when the robot has stopped, and otherwise times how
+// long the light takes to be free.
+func (d *device) checkActuator() (time.Duration, error) {
+	if !d.robot.Running() {
+		return 0, fmt.Errorf("robot is not running")
+	}
+	return d.light.Responsive(), nil
+}
+
+// Stop shuts the device down in order: background work stops so nothing
+// else changes the light and bridged boards are detached, the light goes to
+// its safe state and reports it, queued messages are flushed, the retained
+// status becomes offline and the client disconnects cleanly before the robot
+// halts.
+func (d *device) Stop() error {
+	close(d.stop)
+	if d.gateway != nil {
+		select {
+		case <-d.gateway.Done():
+		case <-time.After(d.cfg.ShutdownTimeout):
+			fmt.Printf("%s: gave up waiting for the gateway to detach its boards\n", d.cfg.DeviceID)
+		}
+	}
+	select {
+	case <-d.health.Done():
+	case <-time.After(d.cfg.ShutdownTimeout):
+	}
+
+	if err := d.light.SafeState(d.cfg.SafeState); err != nil {
+		fmt.Printf("%s: could not set the safe state: %s\n", d.cfg.DeviceID, err)
+	}
+	d.reporter.publish()
+
+	if d.box != nil {
+		// The queued publisher may be part way through sending the outbox;
+		// flushing alongside it would send messages twice.
+		select {
+		case <-d.queued.Done():
+			if err := flushOutbox(d.box, d.client, d.cfg.ShutdownTimeout); err != nil {
+				fmt.Printf("%s: outbox: %s\n", d.cfg.DeviceID, err)
+			}
+		case <-time.After(d.cfg.ShutdownTimeout):
+			fmt.Printf("%s: outbox: still draining, %d messages left queued\n", d.cfg.DeviceID, d.box.Len())
+		}
+	}
+	if d.client.IsConnected() {
+		if err := d.client.SetStatus(statusOffline); err != nil {
+			fmt.Printf("%s: failed to publish offline status: %s\n", d.cfg.DeviceID, err)
+		}
+	}
+	d.client.Close()
+	if d.box != nil {
+		// A drain still running fails its next publish now the client is
+		// closed, and must be over before the outbox is.
+		<-d.queued.Done()
+		d.box.Close()
+	}
+	return d.robot.Stop()
+}
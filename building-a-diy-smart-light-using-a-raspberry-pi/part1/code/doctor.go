@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultDoctorTimeout = 10 * time.Second
+
+	// clockFloor is earlier than any time a working clock can show. A Pi
+	// without a real time clock boots in 1970 until it syncs.
+	clockFloor = "2024-01-01T00:00:00Z"
+
+	// certExpiryWarning is how soon a certificate's expiry is warned about.
+	certExpiryWarning = 30 * 24 * time.Hour
+)
+
+// Outcomes of a doctor check.
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+// doctorCheck is the outcome of one doctor check, with a hint on fixing it
+// when it did not pass.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// doctorReport is what doctor -json prints.
+type doctorReport struct {
+	OK     bool          `json:"ok"`
+	Checks []doctorCheck `json:"checks"`
+}
+
+// doctor checks what a device needs to run. The /sys, /dev and /run paths it
+// looks at are under root, so it can be pointed at a directory of fixtures.
+type doctor struct {
+	root    string
+	timeout time.Duration
+	clock   clock
+	checks  []doctorCheck
+
+	// newest is the latest NotBefore of the certificates read, which the
+	// clock must be past.
+	newest     time.Time
+	newestFrom string
+}
+
+// runDoctor runs the checks against the config the client would load with
+// the same file, environment and flags, given after "--", and prints a
+// report. It fails when any check does.
+func runDoctor(name string, args []string) error {
+	d := &doctor{clock: realClock{}}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the report as json")
+	fs.DurationVar(&d.timeout, "timeout", defaultDoctorTimeout, "how long each network check may take")
+	fs.StringVar(&d.root, "root", "/", "directory the /sys, /dev and /run paths are looked up in, to check against fixtures")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] [-- client flags]\n", name)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, file, errs, err := parseConfig(name+" --", fs.Args())
+	if err != nil {
+		return err
+	}
+
+	d.checkConfig(file, errs)
+	devices := cfg.devices()
+	for _, dc := range devices {
+		label := ""
+		if len(devices) > 1 {
+			label = " (" + dc.DeviceID + ")"
+		}
+		d.checkProject(dc, label)
+		d.checkKeys(dc, label)
+		d.checkRoots(dc, label)
+		d.checkClientCert(dc, label)
+		d.checkBroker(dc, label)
+		d.checkHardware(dc, label)
+	}
+	d.checkClock(cfg)
+
+	report := doctorReport{OK: true, Checks: d.checks}
+	failed, warned := 0, 0
+	for _, c := range d.checks {
+		switch c.Status {
+		case doctorFail:
+			failed++
+			report.OK = false
+		case doctorWarn:
+			warned++
+		}
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	} else {
+		printDoctorReport(report.Checks)
+		fmt.Printf("\n%s, %d failed, %s\n", plural(len(d.checks), "check"), failed, plural(warned, "warning"))
+	}
+	if !report.OK {
+		return errExit
+	}
+	return nil
+}
+
+func printDoctorReport(checks []doctorCheck) {
+	width := 0
+	for _, c := range checks {
+		if len(c.Name) > width {
+			width = len(c.Name)
+		}
+	}
+	for _, c := range checks {
+		fmt.Printf("%-4s  %-*s  %s\n", strings.ToUpper(c.Status), width, c.Name, c.Detail)
+		if c.Hint != "" {
+			fmt.Printf("%-4s  %-*s  fix: %s\n", "", width, "", c.Hint)
+		}
+	}
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func (d *doctor) add(name, status, detail, hint string) {
+	d.checks = append(d.checks, doctorCheck{name, status, detail, hint})
+}
+
+func (d *doctor) path(p string) string {
+	return filepath.Join(d.root, p)
+}
+
+// sawCert notes a certificate's NotBefore for the clock check.
+func (d *doctor) sawCert(cert *x509.Certificate, from string) {
+	if cert.NotBefore.After(d.newest) {
+		d.newest, d.newestFrom = cert.NotBefore, from
+	}
+}
+
+func (d *doctor) checkConfig(file string, errs configErrors) {
+	loaded := "no config file, defaults and environment only"
+	if file != "" {
+		loaded = "loaded " + file
+	}
+	if len(errs) == 0 {
+		d.add("config", doctorPass, loaded, "")
+		return
+	}
+	problems := make([]string, len(errs))
+	for i, err := range errs {
+		problems[i] = err.Error()
+	}
+	d.add("config", doctorFail, loaded+"; "+strings.Join(problems, "; "),
+		"fix the settings listed, iot-client.example.toml describes each")
+}
+
+func (d *doctor) checkProject(c *config, label string) {
+	name := "project id" + label
+	if c.connectorName() != "iotcore" {
+		d.add(name, doctorSkip, "not used by the "+c.connectorName()+" connector", "")
+		return
+	}
+	if c.ProjectID == "" {
+		d.add(name, doctorFail, "iotcore.project_id is not set",
+			"set iotcore.project_id in the config file, -iotcore.project-id or PROJECT_ID")
+		return
+	}
+	d.add(name, doctorPass, fmt.Sprintf("project %s, region %s, registry %s", c.ProjectID, c.Region, c.RegistryID), "")
+}
+
+func (d *doctor) checkKeys(c *config, label string) {
+	if c.connectorName() != "iotcore" {
+		d.add("device key"+label, doctorSkip, "not used by the "+c.connectorName()+" connector", "")
+		return
+	}
+	passphrase, err := readPassphrase(c.passphraseFile())
+	if err != nil {
+		d.add("device key"+label, doctorFail, "cannot read the passphrase: "+err.Error(),
+			"check jwt.passphrase_file, or unset it and use "+passphraseEnv)
+		return
+	}
+	defer zero(passphrase)
+
+	d.checkKey("device key"+label, c.certFile(c.KeyFile), passphrase, c.JWTAlgorithm, c.DeviceID)
+	if c.NextKeyFile != "" {
+		d.checkKey("next device key"+label, c.certFile(c.NextKeyFile), passphrase, "", c.DeviceID)
+	}
+}
+
+func (d *doctor) checkKey(name, path string, passphrase []byte, algorithm, deviceID string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		d.add(name, doctorFail, err.Error(),
+			fmt.Sprintf("run iot-client provision -device-id %s, or copy the device's key to %s", deviceID, path))
+		return
+	}
+	key, err := loadDeviceKey(path, passphrase, algorithm)
+	if err != nil {
+		hint := "the key must be an RSA or P-256 EC private key in PEM"
+		if len(passphrase) == 0 && strings.Contains(err.Error(), "encrypted") {
+			hint = "set " + passphraseEnv + " or jwt.passphrase_file to the key's passphrase"
+		}
+		d.add(name, doctorFail, err.Error(), hint)
+		return
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		d.add(name, doctorWarn, fmt.Sprintf("%s key in %s is readable by others (%s)", key.method.Alg(), path, perm),
+			"chmod 600 "+path)
+		return
+	}
+	d.add(name, doctorPass, fmt.Sprintf("%s key in %s", key.method.Alg(), path), "")
+}
+
+// checkRoots reads the CA bundle the broker is verified against.
+func (d *doctor) checkRoots(c *config, label string) {
+	name := "ca roots" + label
+	if !usesTLS(c.brokerURL()) {
+		d.add(name, doctorSkip, "the broker is not reached over tls", "")
+		return
+	}
+	path := c.brokerTLS().caFile
+	if path == "" {
+		if _, err := x509.SystemCertPool(); err != nil {
+			d.add(name, doctorFail, "no system roots: "+err.Error(), "install ca-certificates, or set tls.ca_file")
+			return
+		}
+		d.add(name, doctorPass, "system roots", "")
+		return
+	}
+
+	hint := "set tls.ca_file to the bundle of the broker's CA"
+	if c.connectorName() == "iotcore" {
+		hint = "download https://pki.google.com/roots.pem to " + path + ", or run iot-client provision with -roots"
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		d.add(name, doctorFail, err.Error(), hint)
+		return
+	}
+	now := d.clock.Now()
+	valid, expired := 0, 0
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if block.Type != "CERTIFICATE" || err != nil {
+			continue
+		}
+		d.sawCert(cert, path)
+		if now.After(cert.NotAfter) {
+			expired++
+		} else {
+			valid++
+		}
+	}
+	switch {
+	case valid == 0 && expired == 0:
+		d.add(name, doctorFail, "no certificates in "+path, hint)
+	case valid == 0:
+		d.add(name, doctorFail, fmt.Sprintf("every certificate in %s has expired", path), hint+"; or check the clock")
+	case expired > 0:
+		d.add(name, doctorWarn, fmt.Sprintf("%s in %s, %d expired", plural(valid+expired, "certificate"), path, expired), hint)
+	default:
+		d.add(name, doctorPass, fmt.Sprintf("%s in %s", plural(valid, "certificate"), path), "")
+	}
+}
+
+func (d *doctor) checkClientCert(c *config, label string) {
+	name := "client certificate" + label
+	o := c.brokerTLS()
+	if o.certFile == "" {
+		d.add(name, doctorSkip, "tls.client_auth is off", "")
+		return
+	}
+	cert, err := loadClientCertificate(o.certFile, o.keyFile, o.passphraseFile)
+	if err != nil {
+		d.add(name, doctorFail, err.Error(), "check tls.client_cert and tls.client_key name the device's certificate and its key")
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		d.add(name, doctorFail, err.Error(), "replace "+o.certFile)
+		return
+	}
+	d.sawCert(leaf, o.certFile)
+
+	now := d.clock.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		d.add(name, doctorFail, fmt.Sprintf("%s expired on %s", o.certFile, leaf.NotAfter.Format(time.RFC3339)), "renew the client certificate, or check the clock")
+	case leaf.NotAfter.Sub(now) < certExpiryWarning:
+		d.add(name, doctorWarn, fmt.Sprintf("%s expires on %s", o.certFile, leaf.NotAfter.Format(time.RFC3339)), "renew the client certificate")
+	default:
+		d.add(name, doctorPass, fmt.Sprintf("%s for %s, valid until %s", o.certFile, leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339)), "")
+	}
+}
+
+// checkBroker resolves the broker, connects to it and, for TLS brokers,
+// completes a handshake verified just as the client does. It does not
+// connect over MQTT: that would take over a running client's session.
+func (d *doctor) checkBroker(c *config, label string) {
+	dnsName, connName := "broker dns"+label, "broker connection"+label
+	if c.SimBroker != "" {
+		d.add(dnsName, doctorSkip, "the in-process broker runs inside the client", "")
+		d.add(connName, doctorSkip, "the in-process broker runs inside the client", "")
+		return
+	}
+	broker := c.brokerURL()
+	u, err := url.Parse(broker)
+	if err != nil || u.Hostname() == "" {
+		d.add(dnsName, doctorFail, fmt.Sprintf("%q is not a broker url", broker), "set broker, e.g. ssl://mqtt.example.com:8883")
+		d.add(connName, doctorSkip, "no broker to connect to", "")
+		return
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = map[string]string{"tcp": "1883", "ssl": "8883", "tls": "8883", "ws": "80", "wss": "443"}[u.Scheme]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	if net.ParseIP(host) != nil {
+		d.add(dnsName, doctorSkip, host+" is an address", "")
+	} else if addrs, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		d.add(dnsName, doctorFail, err.Error(), "check the network and /etc/resolv.conf, and that the broker is spelled right")
+		d.add(connName, doctorSkip, "the broker did not resolve", "")
+		return
+	} else {
+		d.add(dnsName, doctorPass, fmt.Sprintf("%s is %s", host, strings.Join(addrs, ", ")), "")
+	}
+
+	addr := net.JoinHostPort(host, port)
+	start := d.clock.Now()
+	conn, err := (&net.Dialer{Timeout: d.timeout}).Dial("tcp", addr)
+	if err != nil {
+		d.add(connName, doctorFail, err.Error(), "check the broker's port and any firewall in the way")
+		return
+	}
+	defer conn.Close()
+	if !usesTLS(broker) {
+		d.add(connName, doctorPass, fmt.Sprintf("connected to %s in %s, without tls", addr, d.clock.Now().Sub(start).Round(time.Millisecond)), "")
+		return
+	}
+
+	tlsConfig, err := newTLSConfig(broker, c.brokerTLS())
+	if err != nil {
+		d.add(connName, doctorFail, err.Error(), "fix the tls settings")
+		return
+	}
+	conn.SetDeadline(time.Now().Add(d.timeout))
+	tc := tls.Client(conn, tlsConfig)
+	if err := tc.Handshake(); err != nil {
+		d.add(connName, doctorFail, "tls handshake with "+addr+": "+err.Error(), tlsHint(err))
+		return
+	}
+	state := tc.ConnectionState()
+	d.add(connName, doctorPass, fmt.Sprintf("tls handshake with %s in %s, certificate for %s",
+		addr, d.clock.Now().Sub(start).Round(time.Millisecond), state.PeerCertificates[0].Subject.CommonName), "")
+}
+
+func usesTLS(broker string) bool {
+	u, err := url.Parse(broker)
+	return err == nil && (u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "wss")
+}
+
+// tlsHint suggests a fix for a failed handshake.
+func tlsHint(err error) string {
+	// Newer Go wraps verification errors; they are unwrapped by hand to
+	// keep building with Go 1.12.
+	cause := err
+	for {
+		w, ok := cause.(interface{ Unwrap() error })
+		if !ok || w.Unwrap() == nil {
+			break
+		}
+		cause = w.Unwrap()
+	}
+	switch e := cause.(type) {
+	case x509.UnknownAuthorityError:
+		return "the ca roots do not include the broker's CA; update tls.ca_file or roots.pem"
+	case x509.CertificateInvalidError:
+		if e.Reason == x509.Expired {
+			return "the broker's certificate looks expired or not yet valid; check the clock"
+		}
+	case x509.HostnameError:
+		return "the broker's certificate is for another name; check the broker url"
+	}
+	switch {
+	case strings.Contains(err.Error(), "pinned"):
+		return "the broker's keys changed; update tls.pins"
+	case strings.Contains(err.Error(), "certificate required"), strings.Contains(err.Error(), "bad certificate"):
+		return "the broker wants a client certificate it accepts; check tls.client_auth and tls.client_cert"
+	}
+	return "check the broker url, port and tls settings"
+}
+
+// checkHardware checks the device files the light's pins, strip, sensors and
+// bridged boards are reached through.
+func (d *doctor) checkHardware(c *config, label string) {
+	if c.Hardware == hardwareSim {
+		d.add("gpio"+label, doctorSkip, "simulated hardware", "")
+		return
+	}
+
+	d.checkDeviceFile("gpio"+label, "/sys/class/gpio/export", os.O_WRONLY,
+		"run as root or add the user to the gpio group: sudo adduser $USER gpio")
+	if c.LEDMode == "pwm" {
+		d.checkDeviceFile("pwm"+label, "/dev/pi-blaster", os.O_WRONLY|syscall.O_NONBLOCK,
+			"install pi-blaster and start it: sudo systemctl start pi-blaster")
+	}
+
+	spiHint := "enable spi with raspi-config, or dtparam=spi=on in /boot/config.txt"
+	if c.StripPixels > 0 && !c.FakeStrip {
+		d.checkDeviceFile("strip"+label, fmt.Sprintf("/dev/spidev%d.%d", c.StripBus, c.StripChip), os.O_RDWR, spiHint)
+	}
+	if !c.FakeSensors {
+		for _, s := range c.Sensors {
+			bus, chip := s.Bus, s.Chip
+			if spiSensor(s.Driver) {
+				if bus < 0 {
+					bus = raspiSPIBus
+				}
+				if chip < 0 {
+					chip = raspiSPIChip
+				}
+				d.checkDeviceFile("sensor "+s.Name+label, fmt.Sprintf("/dev/spidev%d.%d", bus, chip), os.O_RDWR, spiHint)
+			} else {
+				if bus < 0 {
+					bus = raspiI2CBus
+				}
+				d.checkDeviceFile("sensor "+s.Name+label, fmt.Sprintf("/dev/i2c-%d", bus), os.O_RDWR,
+					"enable i2c with raspi-config, or dtparam=i2c_arm=on in /boot/config.txt, and add the user to the i2c group")
+			}
+		}
+	}
+
+	// Opening a serial port resets many boards, so bridged ports are only
+	// looked for.
+	for _, port := range c.GatewayPorts {
+		if strings.HasPrefix(port, "sim:") {
+			continue
+		}
+		name := "gateway " + port + label
+		if _, err := os.Stat(d.path(port)); err != nil {
+			d.add(name, doctorFail, err.Error(), "check the board is plugged in; ls /dev/serial/by-id lists the ports")
+			continue
+		}
+		d.add(name, doctorPass, port+" is present", "")
+	}
+}
+
+// checkDeviceFile opens path the way the driver will, without using it.
+func (d *doctor) checkDeviceFile(name, path string, flag int, hint string) {
+	f, err := os.OpenFile(d.path(path), flag, 0)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+			err = fmt.Errorf("nothing is reading %s", path)
+		}
+		d.add(name, doctorFail, err.Error(), hint)
+		return
+	}
+	f.Close()
+	d.add(name, doctorPass, path+" is accessible", "")
+}
+
+// checkClock makes sure the time is plausible enough for device JWTs and
+// certificate checks, which fail when it is far off.
+func (d *doctor) checkClock(c *config) {
+	now := d.clock.Now()
+	floor, _ := time.Parse(time.RFC3339, clockFloor)
+	hint := "sync the clock: sudo timedatectl set-ntp true, and install fake-hwclock so it survives reboots"
+	switch {
+	case now.Before(floor):
+		d.add("clock", doctorFail, fmt.Sprintf("the clock says %s, which is too early", now.UTC().Format(time.RFC3339)), hint)
+		return
+	case now.Before(d.newest):
+		d.add("clock", doctorFail, fmt.Sprintf("the clock says %s, before %s became valid at %s",
+			now.UTC().Format(time.RFC3339), d.newestFrom, d.newest.UTC().Format(time.RFC3339)), hint)
+		return
+	}
+
+	detail := now.UTC().Format(time.RFC3339)
+	if c.connectorName() == "iotcore" {
+		detail += ", device tokens valid until " + now.Add(c.TokenLifetime).UTC().Format(time.RFC3339)
+	}
+	if _, err := os.Stat(d.path("/run/systemd/timesync/synchronized")); err != nil {
+		d.add("clock", doctorWarn, detail+"; not known to be synchronized",
+			"IoT Core rejects tokens issued more than 10 minutes off; "+hint)
+		return
+	}
+	d.add("clock", doctorPass, detail+"; synchronized", "")
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDoctor(root string) *doctor {
+	return &doctor{root: root, timeout: testWait, clock: realClock{}}
+}
+
+// only returns the one check d ran, failing the test if it ran more.
+func only(t *testing.T, d *doctor) doctorCheck {
+	t.Helper()
+	if len(d.checks) != 1 {
+		t.Fatalf("ran %d checks: %+v", len(d.checks), d.checks)
+	}
+	return d.checks[0]
+}
+
+// garbageCertPEM is a PEM block that claims to be a certificate but does not
+// parse as one.
+var garbageCertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a certificate")})
+
+func writeKey(t *testing.T, path string, key *ecdsa.PrivateKey) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+func TestDoctorCheckRoots(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	now := time.Now()
+	ca := newTestCA(t, "ca")
+	expired, _ := issueCert(t, nil, "old ca", now.Add(-48*time.Hour), now.Add(-24*time.Hour), true)
+
+	cases := []struct {
+		name   string
+		bundle []byte
+		status string
+		detail string
+	}{
+		{"valid", ca.PEM(), doctorPass, "1 certificate in"},
+		{"some expired", append(ca.PEM(), certPEM(expired)...), doctorWarn, "2 certificates in"},
+		{"all expired", certPEM(expired), doctorFail, "every certificate"},
+		{"unparseable", garbageCertPEM, doctorFail, "no certificates"},
+		{"missing", nil, doctorFail, "no such file"},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, strings.Replace(c.name, " ", "-", -1)+".pem")
+		if c.bundle != nil {
+			writeFile(t, path, c.bundle)
+		}
+		d := testDoctor(dir)
+		d.checkRoots(&config{Connector: "mqtt", Broker: "ssl://localhost:8883", CAFile: path}, "")
+		got := only(t, d)
+		if got.Status != c.status || !strings.Contains(got.Detail, c.detail) {
+			t.Errorf("%s: %s %q", c.name, got.Status, got.Detail)
+		}
+		if c.status != doctorPass && got.Hint == "" {
+			t.Errorf("%s: no hint", c.name)
+		}
+	}
+
+	d := testDoctor(dir)
+	d.checkRoots(&config{Connector: "mqtt", Broker: "tcp://localhost:1883"}, "")
+	if got := only(t, d); got.Status != doctorSkip {
+		t.Errorf("plain tcp broker: %+v", got)
+	}
+}
+
+func TestDoctorCheckClientCert(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	now := time.Now()
+	ca := newTestCA(t, "ca")
+	valid, validKey := ca.issue(t, "lamp", now.Add(-time.Hour), now.Add(365*24*time.Hour), false)
+	expiring, expiringKey := ca.issue(t, "lamp", now.Add(-time.Hour), now.Add(10*24*time.Hour), false)
+	expired, expiredKey := ca.issue(t, "lamp", now.Add(-48*time.Hour), now.Add(-24*time.Hour), false)
+	_, otherKey := ca.issue(t, "other", now.Add(-time.Hour), now.Add(time.Hour), false)
+
+	cases := []struct {
+		name   string
+		cert   []byte
+		key    *ecdsa.PrivateKey
+		status string
+		detail string
+	}{
+		{"valid", certPEM(valid), validKey, doctorPass, "for lamp, valid until"},
+		{"expiring", certPEM(expiring), expiringKey, doctorWarn, "expires on"},
+		{"expired", certPEM(expired), expiredKey, doctorFail, "expired on"},
+		{"unparseable", garbageCertPEM, validKey, doctorFail, "x509"},
+		{"wrong key", certPEM(valid), otherKey, doctorFail, "does not match"},
+	}
+	for _, c := range cases {
+		certFile := filepath.Join(dir, c.name+"-cert.pem")
+		keyFile := filepath.Join(dir, c.name+"-key.pem")
+		writeFile(t, certFile, c.cert)
+		writeKey(t, keyFile, c.key)
+
+		d := testDoctor(dir)
+		d.checkClientCert(&config{Connector: "mqtt", ClientAuth: true, ClientCert: certFile, ClientKey: keyFile}, "")
+		got := only(t, d)
+		if got.Status != c.status || !strings.Contains(got.Detail, c.detail) {
+			t.Errorf("%s: %s %q", c.name, got.Status, got.Detail)
+		}
+	}
+}
+
+func TestDoctorCheckBroker(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	now := time.Now()
+	ca := newTestCA(t, "ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.PEM())
+	otherFile := filepath.Join(dir, "other.pem")
+	writeFile(t, otherFile, newTestCA(t, "other").PEM())
+
+	port, _, stop := brokerChain(t, ca)
+	defer stop()
+	leaf, key := ca.issue(t, "localhost", now.Add(-48*time.Hour), now.Add(-24*time.Hour), false, "localhost")
+	expiredAddr, stopExpired := serveTLS(t, tlsCert(key, leaf))
+	defer stopExpired()
+	_, expiredPort, _ := net.SplitHostPort(expiredAddr)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	cases := []struct {
+		name, broker, caFile string
+		conn                 string
+		detail, hint         string
+	}{
+		{"verified", "ssl://localhost:" + port, caFile, doctorPass, "certificate for localhost", ""},
+		{"unknown ca", "ssl://localhost:" + port, otherFile, doctorFail, "unknown authority", "ca roots"},
+		{"expired", "ssl://localhost:" + expiredPort, caFile, doctorFail, "expired", "check the clock"},
+		{"wrong name", "ssl://127.0.0.1:" + port, caFile, doctorFail, "127.0.0.1", "another name"},
+		{"refused", "ssl://" + closedAddr, caFile, doctorFail, "refused", "firewall"},
+		{"plain", "tcp://localhost:" + port, "", doctorPass, "without tls", ""},
+	}
+	for _, c := range cases {
+		d := testDoctor(dir)
+		d.checkBroker(&config{Connector: "mqtt", Broker: c.broker, CAFile: c.caFile}, "")
+		if len(d.checks) != 2 {
+			t.Fatalf("%s: ran %+v", c.name, d.checks)
+		}
+		dns, conn := d.checks[0], d.checks[1]
+		if dns.Status == doctorFail {
+			t.Errorf("%s: dns %+v", c.name, dns)
+		}
+		if conn.Status != c.conn || !strings.Contains(conn.Detail, c.detail) || !strings.Contains(conn.Hint, c.hint) {
+			t.Errorf("%s: %+v", c.name, conn)
+		}
+	}
+}
+
+func TestDoctorCheckHardware(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, p := range []string{"sys/class/gpio/export", "dev/i2c-1", "dev/spidev0.0", "dev/spidev0.1"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, p), nil)
+	}
+
+	// Sensors that name no bus or chip are on the adaptor's defaults.
+	sensor := func(name, driver string, bus, chip int) sensorConfig {
+		return sensorConfig{Name: name, Driver: driver, Bus: bus, Address: -1, Chip: chip}
+	}
+	d := testDoctor(dir)
+	d.checkHardware(&config{Hardware: hardwareRaspi, Sensors: []sensorConfig{
+		sensor("climate", "bme280", -1, -1),
+		sensor("light", "bh1750", 0, -1),
+		sensor("soil", "mcp3002", -1, -1),
+		sensor("dial", "mcp3004", -1, 1),
+		sensor("mains", "mcp3008", 1, -1),
+	}}, "")
+
+	want := []struct {
+		name, status, detail string
+	}{
+		{"gpio", doctorPass, "/sys/class/gpio/export"},
+		{"sensor climate", doctorPass, "/dev/i2c-1"},
+		{"sensor light", doctorFail, "i2c-0"},
+		{"sensor soil", doctorPass, "/dev/spidev0.0"},
+		{"sensor dial", doctorPass, "/dev/spidev0.1"},
+		{"sensor mains", doctorFail, "spidev1.0"},
+	}
+	if len(d.checks) != len(want) {
+		t.Fatalf("ran %+v", d.checks)
+	}
+	for i, w := range want {
+		c := d.checks[i]
+		if c.Name != w.name || c.Status != w.status || !strings.Contains(c.Detail, w.detail) {
+			t.Errorf("check %d is %+v, want %s %s with %q", i, c, w.name, w.status, w.detail)
+		}
+	}
+}
+
+// captureStdout returns what f prints.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- b
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return string(<-out)
+}
+
+func TestDoctorJSON(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	ca := newTestCA(t, "ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.PEM())
+	otherFile := filepath.Join(dir, "other.pem")
+	writeFile(t, otherFile, newTestCA(t, "other").PEM())
+	port, _, stop := brokerChain(t, ca)
+	defer stop()
+	os.MkdirAll(filepath.Join(dir, "run", "systemd", "timesync"), 0700)
+	writeFile(t, filepath.Join(dir, "run", "systemd", "timesync", "synchronized"), nil)
+
+	run := func(ca string) (doctorReport, error) {
+		var err error
+		out := captureStdout(t, func() {
+			err = runDoctor("doctor", []string{"-json", "-root", dir, "--",
+				"-hardware", "sim",
+				"-connector", "mqtt",
+				"-broker", "ssl://localhost:" + port,
+				"-tls.ca-file", ca,
+			})
+		})
+		var report doctorReport
+		if err := json.Unmarshal([]byte(out), &report); err != nil {
+			t.Fatalf("malformed report %q: %s", out, err)
+		}
+		return report, err
+	}
+
+	report, err := run(caFile)
+	if err != nil || !report.OK {
+		t.Fatalf("report failed: %v %+v", err, report)
+	}
+	statuses := map[string]string{}
+	for _, c := range report.Checks {
+		statuses[c.Name] = c.Status
+	}
+	want := map[string]string{
+		"config":             doctorPass,
+		"project id":         doctorSkip,
+		"device key":         doctorSkip,
+		"ca roots":           doctorPass,
+		"client certificate": doctorSkip,
+		"broker dns":         doctorPass,
+		"broker connection":  doctorPass,
+		"gpio":               doctorSkip,
+		"clock":              doctorPass,
+	}
+	if len(statuses) != len(want) {
+		t.Errorf("checks are %v", statuses)
+	}
+	for name, status := range want {
+		if statuses[name] != status {
+			t.Errorf("%s is %q, want %q", name, statuses[name], status)
+		}
+	}
+
+	report, err = run(otherFile)
+	if err != errExit || report.OK {
+		t.Errorf("with the wrong roots the report gave %v, ok %v", err, report.OK)
+	}
+	for _, c := range report.Checks {
+		if c.Name == "broker connection" && (c.Status != doctorFail || c.Hint == "") {
+			t.Errorf("broker connection is %+v", c)
+		}
+	}
+}
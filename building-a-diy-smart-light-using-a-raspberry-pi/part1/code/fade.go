@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/drivers/gpio"
+)
+
+const (
+	defaultGamma = 2.2
+
+	// fadeStep is how often the output is updated during a fade.
+	fadeStep = 20 * time.Millisecond
+)
+
+// easing maps the fraction of a fade's time that has passed, 0 to 1, onto the
+// fraction of the brightness change that should have happened.
+type easing func(t float64) float64
+
+var easings = map[string]easing{
+	"linear": func(t float64) float64 { return t },
+	"ease-in": func(t float64) float64 {
+		return t * t
+	},
+	"ease-out": func(t float64) float64 {
+		return t * (2 - t)
+	},
+	"ease-in-out": func(t float64) float64 {
+		if t < 0.5 {
+			return 2 * t * t
+		}
+		return -1 + (4-2*t)*t
+	},
+	"smoothstep": func(t float64) float64 {
+		return t * t * (3 - 2*t)
+	},
+}
+
+const defaultEasing = "ease-in-out"
+
+func easingNames() []string {
+	var names []string
+	for name := range easings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ledOutput sets the raw output level of the LED.
+type ledOutput interface {
+	Write(level byte) error
+}
+
+// pwmLED dims the LED with PWM.
+type pwmLED struct {
+	*gpio.LedDriver
+}
+
+func (l pwmLED) Write(level byte) error {
+	return l.Brightness(level)
+}
+
+// digitalLED can only switch the LED fully on or off; any level above zero is
+// on.
+type digitalLED struct {
+	*gpio.LedDriver
+}
+
+func (l digitalLED) Write(level byte) error {
+	if level == 0 {
+		return l.Off()
+	}
+	return l.On()
+}
+
+// fader moves the LED between brightness levels, optionally over time. Levels
+// are perceptual, from 0 to 1, and are gamma corrected before being written
+// so that equal steps look equally bright. Starting a new fade cancels the
+// one in progress, which stops at whatever level it had reached.
+type fader struct {
+	out     ledOutput
+	gamma   float64
+	clock   clock
+	onError func(error)
+
+	// run serialises FadeTo calls.
+	run    sync.Mutex
+	cancel chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	level   float64
+	written int
+}
+
+func newFader(out ledOutput, gamma float64, clk clock, onError func(error)) *fader {
+	return &fader{
+		out:     out,
+		gamma:   gamma,
+		clock:   clk,
+		onError: onError,
+		written: -1,
+	}
+}
+
+// FadeTo moves to target over d using ease. With no duration the level is set
+// straight away and any error returned; otherwise the fade runs in the
+// background and errors go to onError.
+func (f *fader) FadeTo(target float64, d time.Duration, ease easing) error {
+	target = math.Max(0, math.Min(1, target))
+
+	f.run.Lock()
+	defer f.run.Unlock()
+
+	f.cancelFade()
+	if d <= 0 {
+		return f.set(target)
+	}
+
+	cancel, done := make(chan struct{}), make(chan struct{})
+	f.cancel, f.done = cancel, done
+	from := f.Level()
+	start := f.clock.Now()
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-cancel:
+				return
+			case <-f.clock.After(fadeStep):
+			}
+
+			t := float64(f.clock.Now().Sub(start)) / float64(d)
+			if t >= 1 {
+				if err := f.set(target); err != nil {
+					f.onError(err)
+				}
+				return
+			}
+
+			if err := f.set(from + (target-from)*ease(t)); err != nil {
+				f.onError(fmt.Errorf("fade stopped: %s", err))
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop cancels a fade in progress, leaving the level where it is.
+func (f *fader) Stop() {
+	f.run.Lock()
+	defer f.run.Unlock()
+	f.cancelFade()
+}
+
+// cancelFade stops the running fade and waits for it to finish. f.run must be
+// held.
+func (f *fader) cancelFade() {
+	if f.cancel != nil {
+		close(f.cancel)
+		<-f.done
+		f.cancel, f.done = nil, nil
+	}
+}
+
+func (f *fader) set(level float64) error {
+	out := f.corrected(level)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if out != f.written {
+		if err := f.out.Write(byte(out)); err != nil {
+			return err
+		}
+		f.written = out
+	}
+	f.level = level
+	return nil
+}
+
+// corrected returns the output level, 0 to 255, for a perceptual level.
+func (f *fader) corrected(level float64) int {
+	out := int(math.Round(255 * math.Pow(level, f.gamma)))
+	if out == 0 && level > 0 {
+		// Keep the LED visibly on at the lowest settings.
+		out = 1
+	}
+	return out
+}
+
+// Level returns the current perceptual level.
+func (f *fader) Level() float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.level
+}
+
+// Output returns the last value written to the LED, or -1 before the first
+// write.
+func (f *fader) Output() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.written
+}
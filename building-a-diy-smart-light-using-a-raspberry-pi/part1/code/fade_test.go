@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLED keeps every level written to it.
+type recordingLED struct {
+	mu     sync.Mutex
+	levels []byte
+}
+
+func (l *recordingLED) Write(level byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.levels = append(l.levels, level)
+	return nil
+}
+
+// Levels returns what has been written so far.
+func (l *recordingLED) Levels() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]byte(nil), l.levels...)
+}
+
+func TestFaderGammaCurve(t *testing.T) {
+	led := &recordingLED{}
+	f := newFader(led, defaultGamma, newFakeClock(time.Now()), func(err error) { t.Error(err) })
+
+	cases := []struct {
+		level float64
+		out   byte
+	}{
+		{0, 0},
+		{0.001, 1},
+		{0.25, 12},
+		{0.5, 55},
+		{0.75, 135},
+		{1, 255},
+		{1.5, 255},
+	}
+	for _, c := range cases {
+		if err := f.FadeTo(c.level, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Output(); got != int(c.out) {
+			t.Errorf("level %v wrote %d, want %d", c.level, got, c.out)
+		}
+	}
+
+	// Setting the same output again does not write it again.
+	n := len(led.Levels())
+	f.FadeTo(1, 0, nil)
+	if len(led.Levels()) != n {
+		t.Error("an unchanged output was written again")
+	}
+
+	linear := newFader(&recordingLED{}, 1, newFakeClock(time.Now()), nil)
+	if got := linear.corrected(0.5); got != 128 {
+		t.Errorf("gamma 1 maps 0.5 to %d, want 128", got)
+	}
+}
+
+func TestFaderTiming(t *testing.T) {
+	led := &recordingLED{}
+	clk := newFakeClock(time.Date(2026, 4, 1, 20, 0, 0, 0, time.UTC))
+	f := newFader(led, defaultGamma, clk, func(err error) { t.Error(err) })
+
+	if err := f.FadeTo(1, 5*fadeStep, easings["linear"]); err != nil {
+		t.Fatal(err)
+	}
+	if got := led.Levels(); len(got) != 0 {
+		t.Fatalf("fade wrote %v before its first step", got)
+	}
+
+	var want []byte
+	for i := 1; i <= 5; i++ {
+		waitForWaiters(t, clk, 1)
+		clk.Advance(fadeStep)
+		want = append(want, byte(f.corrected(float64(i)/5)))
+		eventually(t, "the next fade step", func() bool { return len(led.Levels()) == i })
+	}
+	if got := led.Levels(); string(got) != string(want) {
+		t.Errorf("fade wrote %v, want %v", got, want)
+	}
+	if f.Level() != 1 {
+		t.Errorf("level is %v after the fade, want 1", f.Level())
+	}
+
+	// The fade has finished, so nothing more is written.
+	clk.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if n := len(led.Levels()); n != 5 {
+		t.Errorf("%d writes after the fade finished, want 5", n)
+	}
+}
+
+func TestFaderNewFadeCancelsCurrent(t *testing.T) {
+	led := &recordingLED{}
+	clk := newFakeClock(time.Date(2026, 4, 1, 20, 0, 0, 0, time.UTC))
+	f := newFader(led, defaultGamma, clk, func(err error) { t.Error(err) })
+
+	f.FadeTo(1, 10*fadeStep, easings["linear"])
+	for i := 1; i <= 3; i++ {
+		waitForWaiters(t, clk, 1)
+		clk.Advance(fadeStep)
+		eventually(t, "the fade up to step", func() bool { return len(led.Levels()) == i })
+	}
+	// Let the first fade get back to waiting before it is replaced.
+	waitForWaiters(t, clk, 1)
+	reached := f.Level()
+	if reached < 0.29 || reached > 0.31 {
+		t.Fatalf("fade up reached %v after 3 of 10 steps", reached)
+	}
+
+	f.FadeTo(0, 2*fadeStep, easings["linear"])
+	if f.Level() != reached {
+		t.Errorf("starting a new fade moved the level from %v to %v", reached, f.Level())
+	}
+
+	// The first fade's abandoned wait is still on the clock alongside the
+	// new one.
+	waitForWaiters(t, clk, 2)
+	clk.Advance(fadeStep)
+	eventually(t, "the fade down to start", func() bool { return len(led.Levels()) == 4 })
+	waitForWaiters(t, clk, 1)
+	clk.Advance(fadeStep)
+	eventually(t, "the fade down to finish", func() bool { return len(led.Levels()) == 5 })
+
+	got := led.Levels()
+	if got[3] != byte(f.corrected(reached/2)) || got[4] != 0 {
+		t.Errorf("fade down wrote %v, want %d then 0", got[3:], f.corrected(reached/2))
+	}
+	if f.Level() != 0 {
+		t.Errorf("level is %v, want 0", f.Level())
+	}
+
+	// Stop leaves a fade where it got to.
+	f.FadeTo(1, 4*fadeStep, easings["linear"])
+	waitForWaiters(t, clk, 1)
+	clk.Advance(fadeStep)
+	eventually(t, "the fade to step", func() bool { return len(led.Levels()) == 6 })
+	f.Stop()
+	level := f.Level()
+	clk.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if f.Level() != level || len(led.Levels()) != 6 {
+		t.Errorf("stopped fade went on to %v", f.Level())
+	}
+}
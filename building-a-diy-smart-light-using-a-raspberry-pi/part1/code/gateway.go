@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sigurn/crc8"
+)
+
+const (
+	defaultGatewayBaud      = 115200
+	defaultGatewayKeepalive = 5 * time.Second
+
+	// gatewayRetry is how long to wait before opening a port again after
+	// it failed or its board stopped answering.
+	gatewayRetry = 5 * time.Second
+	// gatewayMissedPings is how many keepalives a board may stay silent
+	// for before it is detached.
+	gatewayMissedPings = 3
+
+	simPortPrefix = "sim:"
+
+	frameStart      = 0x7e
+	maxFramePayload = 1024
+	// frameByteTimeout is how long the rest of a frame may keep the line
+	// waiting between bytes; even at 9600 baud a byte takes about 1ms.
+	frameByteTimeout = 250 * time.Millisecond
+
+	// Frame types.
+	frameHello  = 'H'
+	frameConfig = 'C'
+	frameState  = 'S'
+	frameEvent  = 'E'
+	framePing   = 'P'
+	framePong   = 'O'
+	frameBye    = 'B'
+
+	boardAttached = "attached"
+	boardDetached = "detached"
+)
+
+// crc8Table is CRC-8 with polynomial 0x07, which AVR libc's _crc8_ccitt_update
+// computes too.
+var crc8Table = crc8.MakeTable(crc8.CRC8)
+
+// The serial protocol between the gateway and a board is a stream of frames:
+//
+//	0x7e | type | length, 2 bytes big endian | payload | crc-8
+//
+// with the CRC over the type, length and payload. A reader that finds a bad
+// length or CRC, or a frame that stops short, skips the start byte and looks
+// for the next one, so it recovers from noise and from joining the stream
+// halfway.
+//
+//	H  both ways   the gateway asks the board to identify itself with an
+//	               empty payload; the board answers, or announces itself on
+//	               reset, with its device id
+//	C  to board    a config document for the board, as published to its
+//	               config topic
+//	S  from board  a state document, published to the board's state topic
+//	E  from board  an event, published to the board's events topic
+//	P  to board    ping, sent every keepalive
+//	O  from board  pong; any frame from the board shows it is alive
+//	B  from board  the board is going away and should be detached
+func encodeFrame(typ byte, payload []byte) []byte {
+	b := make([]byte, 0, len(payload)+5)
+	b = append(b, frameStart, typ, byte(len(payload)>>8), byte(len(payload)))
+	b = append(b, payload...)
+	return append(b, crc8.Checksum(b[1:], crc8Table))
+}
+
+// frameReader reads frames from a serial line.
+type frameReader struct {
+	line *lineReader
+	r    *bufio.Reader
+	// Dropped counts the bytes skipped looking for a good frame.
+	Dropped int
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	line := &lineReader{r: r, timeout: frameByteTimeout}
+	return &frameReader{line: line, r: bufio.NewReaderSize(line, maxFramePayload+8)}
+}
+
+// Next returns the type and payload of the next good frame.
+func (f *frameReader) Next() (byte, []byte, error) {
+	for {
+		f.line.inFrame = false
+		b, err := f.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if b != frameStart {
+			f.Dropped++
+			continue
+		}
+
+		// A start byte may be noise, with whatever follows it read as a
+		// length, so the rest of the frame is only waited for so long.
+		f.line.inFrame = true
+		head, err := f.r.Peek(3)
+		if err != nil {
+			if shortFrame(err) {
+				f.Dropped++
+				continue
+			}
+			return 0, nil, err
+		}
+		n := int(head[1])<<8 | int(head[2])
+		if n > maxFramePayload {
+			f.Dropped++
+			continue
+		}
+		body, err := f.r.Peek(3 + n + 1)
+		if err != nil {
+			if shortFrame(err) {
+				f.Dropped++
+				continue
+			}
+			return 0, nil, err
+		}
+		if crc8.Checksum(body[:3+n], crc8Table) != body[3+n] {
+			f.Dropped++
+			continue
+		}
+		typ, payload := body[0], append([]byte(nil), body[3:3+n]...)
+		f.r.Discard(len(body))
+		return typ, payload, nil
+	}
+}
+
+// shortFrame reports whether err, from reading the rest of a frame, means
+// the frame stopped short: the line went quiet or ended part way in. The
+// bytes read so far are still buffered and are scanned again.
+func shortFrame(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	t, ok := err.(interface{ Timeout() bool })
+	return ok && t.Timeout()
+}
+
+// lineReader reads from a serial line. While a frame is part way in, each
+// read waits at most timeout for the next bytes, if the line supports read
+// deadlines as ports and ptys do.
+type lineReader struct {
+	r       io.Reader
+	timeout time.Duration
+	inFrame bool
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	if d, ok := l.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		var deadline time.Time
+		if l.inFrame {
+			deadline = time.Now().Add(l.timeout)
+		}
+		d.SetReadDeadline(deadline)
+	}
+	return l.r.Read(p)
+}
+
+// validDeviceID checks a device id, such as one a board gave, which goes into
+// topics.
+func validDeviceID(id string) error {
+	if id == "" {
+		return fmt.Errorf("empty device id")
+	}
+	if len(id) > 128 || strings.ContainsAny(id, "/+#") {
+		return fmt.Errorf("device id %q must be at most 128 characters without /, + or #", id)
+	}
+	return nil
+}
+
+// gatewayEvent is published on the gateway's events topic when a board is
+// attached or detached.
+type gatewayEvent struct {
+	Type      string    `json:"type"`
+	Device    string    `json:"device"`
+	Port      string    `json:"port"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// boardLink is the serial line to an attached board.
+type boardLink struct {
+	port string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *boardLink) send(typ byte, payload []byte) error {
+	if len(payload) > maxFramePayload {
+		return fmt.Errorf("%d byte payload is larger than the %d a frame takes", len(payload), maxFramePayload)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(encodeFrame(typ, payload))
+	return err
+}
+
+// gateway bridges microcontroller boards on serial ports to the broker, the
+// way IoT Core gateways did: each board is a device of its own, attached
+// through the gateway's connection. Its config is relayed down the serial
+// line, and the state and events it sends up are published on its topics.
+type gateway struct {
+	client    *client
+	pub       publisher
+	events    string
+	ports     []string
+	baud      int64
+	keepalive time.Duration
+	clock     clock
+
+	mu       sync.Mutex
+	attached map[string]*boardLink
+	done     chan struct{}
+}
+
+func newGateway(c *client, pub publisher, events string, ports []string, baud int64, keepalive time.Duration, clk clock) *gateway {
+	return &gateway{
+		client:    c,
+		pub:       pub,
+		events:    events,
+		ports:     ports,
+		baud:      baud,
+		keepalive: keepalive,
+		clock:     clk,
+		attached:  map[string]*boardLink{},
+		done:      make(chan struct{}),
+	}
+}
+
+// Run bridges every port until stop is closed, then detaches the boards.
+func (g *gateway) Run(stop <-chan struct{}) {
+	defer close(g.done)
+	var wg sync.WaitGroup
+	for _, port := range g.ports {
+		wg.Add(1)
+		go func(port string) {
+			defer wg.Done()
+			g.servePort(port, stop)
+		}(port)
+	}
+	wg.Wait()
+}
+
+// Done is closed when Run has returned.
+func (g *gateway) Done() <-chan struct{} {
+	return g.done
+}
+
+// Boards returns the attached boards' ports by device id.
+func (g *gateway) Boards() map[string]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	boards := map[string]string{}
+	for id, l := range g.attached {
+		boards[id] = l.port
+	}
+	return boards
+}
+
+// servePort keeps port open, opening it again after it fails, until stop is
+// closed.
+func (g *gateway) servePort(port string, stop <-chan struct{}) {
+	path := port
+	if strings.HasPrefix(port, simPortPrefix) {
+		board, err := startSimBoard(strings.TrimPrefix(port, simPortPrefix))
+		if err != nil {
+			fmt.Printf("gateway: %s: %s\n", port, err)
+			return
+		}
+		defer board.Close()
+		path = board.Path()
+	}
+
+	for {
+		err := g.session(port, path, stop)
+		if err == nil {
+			return
+		}
+		fmt.Printf("gateway: %s: %s, retrying in %s\n", port, err, gatewayRetry)
+
+		select {
+		case <-stop:
+			return
+		case <-g.clock.After(gatewayRetry):
+		}
+	}
+}
+
+type frame struct {
+	typ     byte
+	payload []byte
+}
+
+// session runs the port from opening it until it fails, its board stops
+// answering or stop is closed, when it returns nil. The board is attached
+// when it says who it is and detached when the session ends.
+func (g *gateway) session(port, path string, stop <-chan struct{}) (err error) {
+	f, err := openSerial(path, g.baud)
+	if err != nil {
+		return err
+	}
+	link := &boardLink{port: port, w: f}
+
+	frames := make(chan frame)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		f.Close()
+	}()
+	go func() {
+		r := newFrameReader(f)
+		for {
+			typ, payload, err := r.Next()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case frames <- frame{typ, payload}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	board := ""
+	defer func() {
+		if board != "" {
+			reason := "gateway stopped"
+			if err != nil {
+				reason = err.Error()
+			}
+			g.detach(board, reason)
+		}
+	}()
+
+	if err := link.send(frameHello, nil); err != nil {
+		return err
+	}
+	lastSeen := g.clock.Now()
+	tick := g.clock.After(g.keepalive)
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err := <-readErr:
+			return err
+		case <-tick:
+			if silent := g.clock.Now().Sub(lastSeen); silent >= gatewayMissedPings*g.keepalive {
+				return fmt.Errorf("no answer from the board for %s", silent.Round(time.Millisecond))
+			}
+			// Until the board is attached, keep asking who it is.
+			ping := byte(framePing)
+			if board == "" {
+				ping = frameHello
+			}
+			if err := link.send(ping, nil); err != nil {
+				return err
+			}
+			tick = g.clock.After(g.keepalive)
+		case fr := <-frames:
+			lastSeen = g.clock.Now()
+			switch fr.typ {
+			case frameHello:
+				id := string(fr.payload)
+				if id == board {
+					continue
+				}
+				if board != "" {
+					g.detach(board, fmt.Sprintf("the board on %s is now %s", port, id))
+					board = ""
+				}
+				if err := validDeviceID(id); err != nil {
+					fmt.Printf("gateway: %s: %s\n", port, err)
+					continue
+				}
+				if err := g.attach(id, link); err != nil {
+					fmt.Printf("gateway: %s: %s\n", port, err)
+					continue
+				}
+				board = id
+			case frameState, frameEvent:
+				if board == "" {
+					continue
+				}
+				topic := g.client.DeviceTopic(topicState, board)
+				if fr.typ == frameEvent {
+					topic = g.client.DeviceTopic(topicEvents, board)
+				}
+				if err := g.pub.Publish(string(fr.payload), topic); err != nil {
+					fmt.Printf("gateway: %s: failed to relay to %s: %s\n", board, topic, err)
+				}
+			case framePong:
+			case frameBye:
+				if board != "" {
+					g.detach(board, "the board said bye")
+					board = ""
+				}
+			default:
+				fmt.Printf("gateway: %s: ignoring a frame of unknown type %q\n", port, fr.typ)
+			}
+		}
+	}
+}
+
+// attach makes the board a device on the broker: announced, marked online
+// and subscribed to its config.
+func (g *gateway) attach(id string, link *boardLink) error {
+	g.mu.Lock()
+	if other, ok := g.attached[id]; ok {
+		g.mu.Unlock()
+		return fmt.Errorf("%s is already attached on %s", id, other.port)
+	}
+	g.attached[id] = link
+	g.mu.Unlock()
+
+	fmt.Printf("gateway: %s attached on %s\n", id, link.port)
+	g.announce(id, link)
+	g.event(id, link.port, boardAttached, "")
+	return nil
+}
+
+// announce tells the broker about an attached board. It is done again on
+// every reconnect, as the broker forgets attachments with the connection.
+func (g *gateway) announce(id string, link *boardLink) {
+	if !g.client.IsConnected() {
+		return
+	}
+	if err := g.client.Publish("{}", g.client.DeviceTopic(topicAttach, id)); err != nil {
+		fmt.Printf("gateway: %s: failed to attach: %s\n", id, err)
+	}
+	if err := g.client.SetDeviceStatus(id, statusOnline); err != nil {
+		fmt.Printf("gateway: %s: failed to publish online status: %s\n", id, err)
+	}
+	err := g.client.Subsribe(g.client.DeviceTopic(topicConfig, id), func(_ MQTT.Client, m MQTT.Message) {
+		if err := link.send(frameConfig, m.Payload()); err != nil {
+			fmt.Printf("gateway: %s: failed to relay config: %s\n", id, err)
+		}
+	})
+	if err != nil {
+		fmt.Printf("gateway: %s: failed to subscribe to config: %s\n", id, err)
+	}
+}
+
+// Reattach announces every attached board again. It is a connect handler.
+func (g *gateway) Reattach() {
+	g.mu.Lock()
+	attached := make(map[string]*boardLink, len(g.attached))
+	for id, link := range g.attached {
+		attached[id] = link
+	}
+	g.mu.Unlock()
+
+	for id, link := range attached {
+		g.announce(id, link)
+	}
+}
+
+// detach takes the board off the broker: it stops relaying its config and
+// marks it offline.
+func (g *gateway) detach(id, reason string) {
+	g.mu.Lock()
+	link := g.attached[id]
+	delete(g.attached, id)
+	g.mu.Unlock()
+	if link == nil {
+		return
+	}
+
+	fmt.Printf("gateway: %s detached from %s: %s\n", id, link.port, reason)
+	if err := g.client.Unsubscribe(g.client.DeviceTopic(topicConfig, id)); err != nil && g.client.IsConnected() {
+		fmt.Printf("gateway: %s: failed to unsubscribe from config: %s\n", id, err)
+	}
+	if g.client.IsConnected() {
+		if err := g.client.SetDeviceStatus(id, statusOffline); err != nil {
+			fmt.Printf("gateway: %s: failed to publish offline status: %s\n", id, err)
+		}
+		if err := g.client.Publish("{}", g.client.DeviceTopic(topicDetach, id)); err != nil {
+			fmt.Printf("gateway: %s: failed to detach: %s\n", id, err)
+		}
+	}
+	g.event(id, link.port, boardDetached, reason)
+}
+
+func (g *gateway) event(id, port, state, reason string) {
+	b, err := json.Marshal(gatewayEvent{
+		Type:      "gateway",
+		Device:    id,
+		Port:      port,
+		State:     state,
+		Reason:    reason,
+		Timestamp: g.clock.Now(),
+	})
+	if err != nil {
+		fmt.Printf("gateway: failed to encode event: %s\n", err)
+		return
+	}
+	if err := g.pub.Publish(string(b), g.events); err != nil {
+		fmt.Printf("gateway: failed to publish event: %s\n", err)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// testPTY opens a pseudo-terminal pair, skipping the test where there are
+// none. The master side plays the board.
+func testPTY(t *testing.T) (master, slave *os.File) {
+	t.Helper()
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Skip(err)
+	}
+	return master, slave
+}
+
+// startTestGateway bridges ports for the gateway lamp, connected to b. The
+// clock only moves when the test says, so there are no pings or retries
+// unless it asks for them.
+func startTestGateway(t *testing.T, b *broker, ports ...string) (g *gateway, stop func()) {
+	t.Helper()
+	c := mqttTestClient(t, b.Addr())
+	g = newGateway(c, c, c.Topic(topicEvents), ports, defaultGatewayBaud, time.Minute, newFakeClock(time.Now()))
+	done := make(chan struct{})
+	go g.Run(done)
+	return g, func() {
+		close(done)
+		<-g.Done()
+		c.Close()
+	}
+}
+
+func gatewayEventOf(t *testing.T, msg string) gatewayEvent {
+	t.Helper()
+	var e gatewayEvent
+	if err := json.Unmarshal([]byte(msg), &e); err != nil {
+		t.Fatalf("malformed gateway event %q: %s", msg, err)
+	}
+	return e
+}
+
+func TestFrameReaderSkipsBadFrames(t *testing.T) {
+	bad := encodeFrame(frameState, []byte(`{"a":1}`))
+	bad[len(bad)-1]++
+	long := []byte{frameStart, frameState, 0xff, 0xff}
+	var stream []byte
+	stream = append(stream, "noise"...)
+	stream = append(stream, bad...)
+	stream = append(stream, long...)
+	stream = append(stream, encodeFrame(frameState, []byte(`{"a":2}`))...)
+	stream = append(stream, encodeFrame(framePong, nil)...)
+
+	r := newFrameReader(bytes.NewReader(stream))
+	typ, payload, err := r.Next()
+	if err != nil || typ != frameState || string(payload) != `{"a":2}` {
+		t.Fatalf("first good frame is %q %q, %v", typ, payload, err)
+	}
+	typ, payload, err = r.Next()
+	if err != nil || typ != framePong || len(payload) != 0 {
+		t.Fatalf("second good frame is %q %q, %v", typ, payload, err)
+	}
+	if r.Dropped != len("noise")+len(bad)+len(long) {
+		t.Errorf("dropped %d bytes", r.Dropped)
+	}
+}
+
+func TestFrameReaderSkipsStrayStart(t *testing.T) {
+	// A start byte in the noise reads as a 64 byte frame, longer than
+	// everything the board sends after it.
+	stray := []byte{frameStart, frameState, 0x00, 0x40}
+	good := encodeFrame(frameState, []byte(`{"a":3}`))
+	stream := append(append([]byte("noise"), stray...), good...)
+
+	// At the end of the stream the stray frame is cut short.
+	r := newFrameReader(bytes.NewReader(stream))
+	typ, payload, err := r.Next()
+	if err != nil || typ != frameState || string(payload) != `{"a":3}` {
+		t.Fatalf("frame after the stray start is %q %q, %v", typ, payload, err)
+	}
+	if r.Dropped != len("noise")+len(stray) {
+		t.Errorf("dropped %d bytes", r.Dropped)
+	}
+
+	// On a live line it is cut short by the line going quiet.
+	master, slave := testPTY(t)
+	defer master.Close()
+	defer slave.Close()
+	if _, err := master.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		typ     byte
+		payload []byte
+		err     error
+	}
+	got := make(chan result, 1)
+	go func() {
+		typ, payload, err := newFrameReader(slave).Next()
+		got <- result{typ, payload, err}
+	}()
+	select {
+	case res := <-got:
+		if res.err != nil || res.typ != frameState || string(res.payload) != `{"a":3}` {
+			t.Errorf("frame after the stray start is %q %q, %v", res.typ, res.payload, res.err)
+		}
+	case <-time.After(testWait):
+		t.Fatalf("no frame within %s of a stray start byte", testWait)
+	}
+}
+
+func TestGatewayBridgesSimBoard(t *testing.T) {
+	master, slave := testPTY(t)
+	master.Close()
+	slave.Close()
+	b := startTestBroker(t)
+	defer b.Close()
+	events := watchTopic(t, b, "/devices/lamp/events")
+	state := watchTopic(t, b, "/devices/desk/state")
+	status := watchTopic(t, b, "/devices/desk/status")
+
+	g, stop := startTestGateway(t, b, "sim:desk")
+	stopped := false
+	defer func() {
+		if !stopped {
+			stop()
+		}
+	}()
+
+	// Hello: the board says who it is and is attached.
+	e := gatewayEventOf(t, receive(t, events, "attach event"))
+	if e.Device != "desk" || e.State != boardAttached || e.Port != "sim:desk" {
+		t.Errorf("attach event is %+v", e)
+	}
+	if got := receive(t, status, "online status"); got != statusOnline {
+		t.Errorf("status is %q", got)
+	}
+	if boards := g.Boards(); boards["desk"] != "sim:desk" {
+		t.Errorf("boards are %v", boards)
+	}
+	var s simBoardState
+	if err := json.Unmarshal([]byte(receive(t, state, "first state")), &s); err != nil || s.Board != "desk" || s.Config != nil {
+		t.Errorf("first state is %+v, %v", s, err)
+	}
+
+	// Its config goes down the serial line and comes back as its state.
+	b.Publish("/devices/desk/config", []byte(`{"version":1,"power":"on"}`), false)
+	if err := json.Unmarshal([]byte(receive(t, state, "state with the config")), &s); err != nil || string(s.Config) != `{"version":1,"power":"on"}` {
+		t.Errorf("state after the config is %+v, %v", s, err)
+	}
+
+	stopped = true
+	stop()
+	e = gatewayEventOf(t, receive(t, events, "detach event"))
+	if e.Device != "desk" || e.State != boardDetached || e.Reason != "gateway stopped" {
+		t.Errorf("detach event is %+v", e)
+	}
+	if got := receive(t, status, "offline status"); got != statusOffline {
+		t.Errorf("status is %q", got)
+	}
+}
+
+func TestGatewaySerialLine(t *testing.T) {
+	master, slave := testPTY(t)
+	defer slave.Close()
+	b := startTestBroker(t)
+	defer b.Close()
+	events := watchTopic(t, b, "/devices/lamp/events")
+	state := watchTopic(t, b, "/devices/desk/state")
+	status := watchTopic(t, b, "/devices/desk/status")
+
+	g, stop := startTestGateway(t, b, slave.Name())
+	defer stop()
+
+	frames := make(chan frame, 16)
+	go func() {
+		r := newFrameReader(master)
+		for {
+			typ, payload, err := r.Next()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- frame{typ, payload}
+		}
+	}()
+	next := func(what string) frame {
+		t.Helper()
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				t.Fatalf("serial line closed waiting for %s", what)
+			}
+			return f
+		case <-time.After(testWait):
+			t.Fatalf("no %s within %s", what, testWait)
+		}
+		return frame{}
+	}
+	corrupt := func(typ byte, payload string) []byte {
+		f := encodeFrame(typ, []byte(payload))
+		f[len(f)-1]++
+		return f
+	}
+
+	if f := next("hello from the gateway"); f.typ != frameHello || len(f.payload) != 0 {
+		t.Fatalf("gateway opened with %q %q", f.typ, f.payload)
+	}
+
+	// A hello that fails its CRC is ignored; the good one after it attaches
+	// the board.
+	master.Write(append(corrupt(frameHello, "bad"), encodeFrame(frameHello, []byte("desk"))...))
+	if e := gatewayEventOf(t, receive(t, events, "attach event")); e.Device != "desk" || e.State != boardAttached {
+		t.Errorf("attach event is %+v", e)
+	}
+	if got := receive(t, status, "online status"); got != statusOnline {
+		t.Errorf("status is %q", got)
+	}
+
+	// State is forwarded, except a frame that fails its CRC.
+	master.Write(corrupt(frameState, `{"n":1}`))
+	master.Write(encodeFrame(frameState, []byte(`{"n":2}`)))
+	if got := receive(t, state, "state"); got != `{"n":2}` {
+		t.Errorf("forwarded state is %q", got)
+	}
+
+	// Config is relayed down the line.
+	b.Publish("/devices/desk/config", []byte(`{"version":1}`), false)
+	if f := next("config"); f.typ != frameConfig || string(f.payload) != `{"version":1}` {
+		t.Errorf("relayed %q %q", f.typ, f.payload)
+	}
+
+	// Unplugging the board detaches it.
+	master.Close()
+	e := gatewayEventOf(t, receive(t, events, "detach event"))
+	if e.Device != "desk" || e.State != boardDetached || e.Reason == "" || e.Reason == "gateway stopped" {
+		t.Errorf("detach event is %+v", e)
+	}
+	if got := receive(t, status, "offline status"); got != statusOffline {
+		t.Errorf("status is %q", got)
+	}
+	if boards := g.Boards(); len(boards) != 0 {
+		t.Errorf("boards are %v", boards)
+	}
+	select {
+	case got := <-state:
+		t.Errorf("unexpected state %q", got)
+	default:
+	}
+}
@@ -5,6 +5,8 @@ go 1.12
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/sigurn/crc8 v0.0.0-20160107002456-e55481d6f45c
 	gobot.io/x/gobot v1.14.0
+	golang.org/x/crypto v0.0.0-20191001170739-f9e2070545dc
 	golang.org/x/net v0.0.0-20200202094626-16171245cfb2 // indirect
 )
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthInterval    = 30 * time.Second
+	defaultHealthTimeout     = 10 * time.Second
+	defaultHealthMaxFailures = 3
+)
+
+// Names of the health checks every device runs.
+const (
+	checkBroker   = "broker"
+	checkHandlers = "handlers"
+	checkActuator = "actuator"
+)
+
+// healthProbe checks one part of the device and returns how long it took to
+// answer. It may block; the monitor stops waiting after its timeout and does
+// not start the probe again until the stuck call returns.
+type healthProbe func() (time.Duration, error)
+
+// degradedError is a probe error that is reported but does not fail the
+// round, for trouble something else is already dealing with.
+type degradedError struct {
+	error
+}
+
+// healthCheck is the latest result of one probe. A degraded check is not OK
+// but leaves the device healthy.
+type healthCheck struct {
+	Name      string    `json:"name"`
+	OK        bool      `json:"ok"`
+	Degraded  bool      `json:"degraded,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	LastOK    time.Time `json:"last_ok"`
+}
+
+// healthSummary is the body of /health and part of dump-diagnostics.
+type healthSummary struct {
+	Healthy   bool          `json:"healthy"`
+	Failures  int           `json:"consecutive_failures"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Checks    []healthCheck `json:"checks"`
+}
+
+// healthMonitor runs a device's probes every interval. A round fails when any
+// probe errors or does not answer within timeout; after maxFailures failed
+// rounds in a row OnFailing is called, once. The device counts as healthy
+// until the first round says otherwise.
+type healthMonitor struct {
+	interval    time.Duration
+	timeout     time.Duration
+	maxFailures int
+	clock       clock
+	onError     func(error)
+	done        chan struct{}
+
+	// OnFailing, when set, is called when the device has failed too many
+	// rounds in a row.
+	OnFailing func()
+
+	names  []string
+	probes map[string]healthProbe
+
+	mu        sync.Mutex
+	pending   map[string]time.Time
+	checks    map[string]healthCheck
+	failures  int
+	checkedAt time.Time
+
+	// Message handlers still running, and the slowest to finish since the
+	// last round.
+	nextRun  int
+	running  map[int]handlerRun
+	slowest  time.Duration
+	slowName string
+}
+
+type handlerRun struct {
+	name  string
+	start time.Time
+}
+
+func newHealthMonitor(interval, timeout time.Duration, maxFailures int, clk clock, onError func(error)) *healthMonitor {
+	h := &healthMonitor{
+		interval:    interval,
+		timeout:     timeout,
+		maxFailures: maxFailures,
+		clock:       clk,
+		onError:     onError,
+		done:        make(chan struct{}),
+		probes:      map[string]healthProbe{},
+		pending:     map[string]time.Time{},
+		checks:      map[string]healthCheck{},
+		running:     map[int]handlerRun{},
+	}
+	h.Add(checkHandlers, h.handlers)
+	return h
+}
+
+// Add registers a probe. Probes must all be added before Run.
+func (h *healthMonitor) Add(name string, probe healthProbe) {
+	h.names = append(h.names, name)
+	h.probes[name] = probe
+}
+
+// Track marks a message handler as running until the returned func is
+// called, so a handler that never returns fails the handlers check.
+func (h *healthMonitor) Track(name string) func() {
+	start := h.clock.Now()
+	h.mu.Lock()
+	id := h.nextRun
+	h.nextRun++
+	h.running[id] = handlerRun{name, start}
+	h.mu.Unlock()
+
+	return func() {
+		took := h.clock.Now().Sub(start)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.running, id)
+		if took > h.slowest {
+			h.slowest, h.slowName = took, name
+		}
+	}
+}
+
+// handlers fails when a handler has been running longer than the timeout,
+// and otherwise gives the slowest handler since the last round.
+func (h *healthMonitor) handlers() (time.Duration, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.clock.Now()
+	slowest, name := h.slowest, h.slowName
+	h.slowest, h.slowName = 0, ""
+	stuck := false
+	for _, r := range h.running {
+		if age := now.Sub(r.start); age > slowest {
+			slowest, name, stuck = age, r.name, true
+		}
+	}
+	switch {
+	case slowest <= h.timeout:
+		return slowest, nil
+	case stuck:
+		return slowest, fmt.Errorf("%s handler has been running for %s", name, slowest.Round(time.Millisecond))
+	}
+	return slowest, fmt.Errorf("%s handler took %s", name, slowest.Round(time.Millisecond))
+}
+
+// Run checks the device straight away and then every interval until stop is
+// closed.
+func (h *healthMonitor) Run(stop <-chan struct{}) {
+	defer close(h.done)
+	for {
+		h.Check()
+		select {
+		case <-stop:
+			return
+		case <-h.clock.After(h.interval):
+		}
+	}
+}
+
+// Done is closed once Run has returned.
+func (h *healthMonitor) Done() <-chan struct{} {
+	return h.done
+}
+
+type probeResult struct {
+	name    string
+	latency time.Duration
+	err     error
+}
+
+// Check runs one round of probes and reports whether all of them passed.
+func (h *healthMonitor) Check() bool {
+	now := h.clock.Now()
+	results := make(chan probeResult, len(h.names))
+	got := map[string]probeResult{}
+
+	h.mu.Lock()
+	for _, name := range h.names {
+		if since, ok := h.pending[name]; ok {
+			got[name] = probeResult{name, now.Sub(since), fmt.Errorf("no answer for %s", now.Sub(since).Round(time.Second))}
+			continue
+		}
+		h.pending[name] = now
+		go func(name string, probe healthProbe) {
+			latency, err := probe()
+			h.mu.Lock()
+			delete(h.pending, name)
+			h.mu.Unlock()
+			results <- probeResult{name, latency, err}
+		}(name, h.probes[name])
+	}
+	h.mu.Unlock()
+
+	timeout := h.clock.After(h.timeout)
+wait:
+	for len(got) < len(h.names) {
+		select {
+		case r := <-results:
+			got[r.name] = r
+		case <-timeout:
+			break wait
+		}
+	}
+
+	// Errors are reported once the lock is released, as reporting publishes
+	// and handlers must not wait on that.
+	var errs []error
+	h.mu.Lock()
+	healthy := true
+	for _, name := range h.names {
+		r, ok := got[name]
+		if !ok {
+			r = probeResult{name, h.timeout, fmt.Errorf("no answer within %s", h.timeout)}
+		}
+		prev, seen := h.checks[name]
+		c := healthCheck{Name: name, OK: r.err == nil, LatencyMS: int64(r.latency / time.Millisecond), LastOK: prev.LastOK}
+		if r.err != nil {
+			_, c.Degraded = r.err.(degradedError)
+			healthy = healthy && c.Degraded
+			c.Error = r.err.Error()
+			if !seen || prev.OK {
+				errs = append(errs, fmt.Errorf("health: %s: %s", name, r.err))
+			}
+		} else {
+			c.LastOK = now
+			if seen && !prev.OK {
+				fmt.Printf("health: %s recovered\n", name)
+			}
+		}
+		h.checks[name] = c
+	}
+	h.checkedAt = now
+
+	failing := false
+	if healthy {
+		h.failures = 0
+	} else {
+		h.failures++
+		failing = h.maxFailures > 0 && h.failures == h.maxFailures
+		if failing {
+			errs = append(errs, fmt.Errorf("health: failed %d rounds of checks in a row", h.failures))
+		}
+	}
+	h.mu.Unlock()
+
+	for _, err := range errs {
+		h.onError(err)
+	}
+	if failing && h.OnFailing != nil {
+		h.OnFailing()
+	}
+	return healthy
+}
+
+// Healthy reports whether the last round passed.
+func (h *healthMonitor) Healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures == 0
+}
+
+// Summary returns the latest result of every check.
+func (h *healthMonitor) Summary() healthSummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := healthSummary{
+		Healthy:   h.failures == 0,
+		Failures:  h.failures,
+		CheckedAt: h.checkedAt,
+		Checks:    []healthCheck{},
+	}
+	for _, name := range h.names {
+		if c, ok := h.checks[name]; ok {
+			s.Checks = append(s.Checks, c)
+		}
+	}
+	return s
+}
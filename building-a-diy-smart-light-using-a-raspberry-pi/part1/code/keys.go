@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// passphraseEnv holds the passphrase of encrypted keys when no passphrase
+// file is configured.
+const passphraseEnv = "DEVICE_KEY_PASSPHRASE"
+
+// deviceKey is a private key the device signs its JWTs with.
+type deviceKey struct {
+	path   string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+// loadDeviceKey reads a JWT signing key: RSA in PKCS#1 or PKCS#8, or P-256
+// EC in SEC1 or PKCS#8, optionally encrypted with passphrase. algorithm,
+// when not empty, is the one the key must sign with.
+func loadDeviceKey(path string, passphrase []byte, algorithm string) (*deviceKey, error) {
+	key, err := loadPrivateKey(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	method, err := jwtMethod(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if algorithm != "" && method.Alg() != algorithm {
+		return nil, fmt.Errorf("%s is an %s key, not %s", path, method.Alg(), algorithm)
+	}
+	return &deviceKey{path: path, method: method, key: key}, nil
+}
+
+func jwtMethod(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("EC keys must be on P-256, not %s", k.Curve.Params().Name)
+		}
+		return jwt.SigningMethodES256, nil
+	}
+	return nil, fmt.Errorf("%T keys cannot sign device tokens", key)
+}
+
+// loadPrivateKey reads a PEM private key file, zeroing the file contents
+// once the key is parsed.
+func loadPrivateKey(path string, passphrase []byte) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(b)
+
+	key, err := parsePrivateKey(b, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return key, nil
+}
+
+// parsePrivateKey parses the first PEM block of b. Keys may be encrypted as
+// PKCS#8 "ENCRYPTED PRIVATE KEY" (PBES2 with PBKDF2 and AES-CBC, what
+// openssl pkcs8 -topk8 writes) or with the legacy "Proc-Type: 4,ENCRYPTED"
+// headers. Decrypted key material is zeroed once parsed.
+func parsePrivateKey(b, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	defer zero(block.Bytes)
+
+	der := block.Bytes
+	encrypted := false
+	if x509.IsEncryptedPEMBlock(block) || block.Type == "ENCRYPTED PRIVATE KEY" {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("key is encrypted and no passphrase is set")
+		}
+		var err error
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			der, err = decryptPKCS8(block.Bytes, passphrase)
+		} else {
+			der, err = x509.DecryptPEMBlock(block, passphrase)
+			if err == x509.IncorrectPasswordError {
+				err = fmt.Errorf("wrong passphrase or corrupt key")
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer zero(der)
+		encrypted = true
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		if encrypted {
+			return nil, fmt.Errorf("wrong passphrase or corrupt key")
+		}
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Scheme pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo (RFC 5958) to the DER of
+// the PKCS#8 key inside it.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("malformed encrypted key: %s", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %s, only PBES2 is", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("malformed PBES2 parameters: %s", err)
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s, only PBKDF2 is", params.KDF.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("malformed PBKDF2 parameters: %s", err)
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 hash %s", kdf.PRF.Algorithm)
+	}
+
+	var keyLen int
+	switch {
+	case params.Scheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.Scheme.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.Scheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported key cipher %s, only AES-CBC is", params.Scheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Scheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("malformed AES-CBC parameters")
+	}
+	if kdf.Iterations < 1 || len(info.Data) == 0 || len(info.Data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("malformed encrypted key")
+	}
+
+	k := pbkdf2Key(passphrase, kdf.Salt, kdf.Iterations, keyLen, prf)
+	defer zero(k)
+	c, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(out, info.Data)
+
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(out[len(out)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		zero(out)
+		return nil, fmt.Errorf("wrong passphrase or corrupt key")
+	}
+	return out[:len(out)-pad], nil
+}
+
+// pbkdf2Key derives a key from a password as in RFC 8018 section 5.2.
+func pbkdf2Key(password, salt []byte, iterations, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	size := prf.Size()
+
+	dk := make([]byte, 0, (keyLen+size-1)/size*size)
+	u := make([]byte, size)
+	defer zero(u)
+	for i := 1; len(dk) < keyLen; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)})
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-size:]
+		copy(u, t)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	zero(dk[keyLen:cap(dk)])
+	return dk[:keyLen]
+}
+
+// readPassphrase returns the passphrase for encrypted keys: the contents of
+// path without a trailing newline, or the passphraseEnv variable when path
+// is empty. It is nil when there is neither. Callers zero it once done.
+func readPassphrase(path string) ([]byte, error) {
+	if path == "" {
+		if p := os.Getenv(passphraseEnv); p != "" {
+			return []byte(p), nil
+		}
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := bytes.TrimRight(b, "\r\n")
+	zero(b[len(p):])
+	return p, nil
+}
+
+// loadClientCertificate is tls.LoadX509KeyPair for keys that may be
+// encrypted.
+func loadClientCertificate(certFile, keyFile, passphraseFile string) (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readPassphrase(passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(passphrase)
+	key, err := loadPrivateKey(keyFile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{PrivateKey: key}
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", certFile)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !samePublicKey(leaf.PublicKey, key.Public()) {
+		return nil, fmt.Errorf("%s does not match the key in %s", certFile, keyFile)
+	}
+	return cert, nil
+}
+
+// zero overwrites key material that is no longer needed. The garbage
+// collector may have copied it already, so this narrows the window rather
+// than closing it.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
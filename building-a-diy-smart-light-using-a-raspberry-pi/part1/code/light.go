@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staleConfigError is returned for a config whose version has already been
+// applied or superseded.
+type staleConfigError struct {
+	version, applied int64
+}
+
+func (e *staleConfigError) Error() string {
+	return fmt.Sprintf("ignoring config version %d, version %d is already applied", e.version, e.applied)
+}
+
+// light applies config documents to the LED, ignoring out of date ones.
+// Local changes, such as from the wall button, are kept against remote
+// configs as the conflict policy says.
+type light struct {
+	fader  *fader
+	clock  clock
+	policy conflictPolicy
+
+	// Strip, when set, shows the effect from each config. The fader should
+	// then be driving it.
+	Strip *stripRenderer
+
+	mu        sync.Mutex
+	version   int64
+	current   lightConfig
+	source    string
+	changedAt time.Time
+	localAt   time.Time
+
+	// identifying is set while Identify blinks the light; the LED is
+	// left to it meanwhile. identifyRun counts the runs, so a blinker
+	// whose run was ended gives up rather than carrying on with a newer one.
+	identifying bool
+	identifyRun int
+
+	// OnChange, when set, is called after every config that is applied.
+	OnChange func()
+}
+
+func newLight(f *fader, clk clock, policy conflictPolicy) *light {
+	return &light{
+		fader:   f,
+		clock:   clk,
+		policy:  policy,
+		current: lightConfig{Power: powerOff},
+		source:  sourceRemote,
+	}
+}
+
+// Apply drives the LED to match the remote config c. Versioned configs that
+// are not newer than the last applied version return a *staleConfigError, and
+// configs that lose to a local change return a *conflictError; neither
+// changes anything.
+func (l *light) Apply(c *lightConfig) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !c.legacy && c.Version <= l.version {
+		return &staleConfigError{c.Version, l.version}
+	}
+	now := l.clock.Now()
+	if !l.localAt.IsZero() {
+		if err := l.policy.check(c, now, l.localAt); err != nil {
+			return err
+		}
+	}
+	return l.set(c, sourceRemote, now)
+}
+
+// Toggle switches the light on or off locally, keeping the brightness and
+// effect of the current config.
+func (l *light) Toggle() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.current
+	next.Power = powerOn
+	if l.current.Power == powerOn {
+		next.Power = powerOff
+	}
+	now := l.clock.Now()
+	if err := l.set(&next, sourceLocal, now); err != nil {
+		return err
+	}
+	l.localAt = now
+	return nil
+}
+
+// Local applies a local change, such as from the LAN API, on top of the
+// current config. Like the wall button it counts as a local change for the
+// conflict policy.
+func (l *light) Local(ch *lightChange) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := ch.applyTo(l.current)
+	if problems := next.settingProblems(); len(problems) > 0 {
+		return &invalidChangeError{problems}
+	}
+	now := l.clock.Now()
+	if err := l.set(&next, sourceLocal, now); err != nil {
+		return err
+	}
+	l.localAt = now
+	return nil
+}
+
+// invalidChangeError is returned for a local change that would leave the
+// light with invalid settings.
+type invalidChangeError struct {
+	problems []string
+}
+
+func (e *invalidChangeError) Error() string {
+	return "invalid change: " + strings.Join(e.problems, "; ")
+}
+
+// Schedule applies a scheduled change to the current config. It is not held
+// off by the conflict policy: the schedule itself came from a remote config.
+func (l *light) Schedule(e scheduleEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.current
+	next.Power = e.Power
+	if e.Brightness != nil {
+		next.Brightness = e.Brightness
+	}
+	next.TransitionMS = e.TransitionMS
+	return l.set(&next, sourceSchedule, l.clock.Now())
+}
+
+// Rule applies a rule's change to the current config. Like schedules, rules
+// came from a remote config and are not held off by the conflict policy.
+func (l *light) Rule(ch *lightChange) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := ch.applyTo(l.current)
+	if problems := next.settingProblems(); len(problems) > 0 {
+		return &invalidChangeError{problems}
+	}
+	return l.set(&next, sourceRule, l.clock.Now())
+}
+
+// Occupy switches the light on or off for the occupancy mode, keeping the
+// rest of the current config.
+func (l *light) Occupy(power string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.current
+	next.Power = power
+	return l.set(&next, sourceOccupancy, l.clock.Now())
+}
+
+// set drives the LED to c and records it. l.mu must be held.
+func (l *light) set(c *lightConfig, source string, now time.Time) error {
+	if err := l.drive(c); err != nil {
+		return err
+	}
+	if l.Strip != nil {
+		l.Strip.SetEffect(newEffect(c))
+	}
+
+	if source == sourceRemote && !c.legacy {
+		l.version = c.Version
+	}
+	l.current = *c
+	l.source, l.changedAt = source, now
+
+	if l.OnChange != nil {
+		l.OnChange()
+	}
+	return nil
+}
+
+// drive starts the LED towards the brightness c asks for, cancelling any fade
+// still running from an earlier config. It does nothing while the light is
+// identifying.
+func (l *light) drive(c *lightConfig) error {
+	if l.identifying {
+		return nil
+	}
+	target := 0.0
+	if c.Power == powerOn {
+		target = float64(c.brightness()) / 100
+	}
+	return l.fader.FadeTo(target, time.Duration(c.TransitionMS)*time.Millisecond, easings[c.easing()])
+}
+
+// Current returns the last applied config and its version.
+func (l *light) Current() (lightConfig, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current, l.version
+}
+
+// Source returns where the current state came from, sourceRemote,
+// sourceLocal, sourceSchedule, sourceOccupancy or sourceRule, and when it
+// was set.
+func (l *light) Source() (string, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.source, l.changedAt
+}
+
+// Responsive waits for the light and the LED to be free and returns how long
+// that took. A write to the LED that never returns holds them, so the wait
+// is the light's responsiveness.
+func (l *light) Responsive() time.Duration {
+	start := l.clock.Now()
+	l.mu.Lock()
+	l.mu.Unlock()
+	l.fader.mu.Lock()
+	l.fader.mu.Unlock()
+	return l.clock.Now().Sub(start)
+}
+
+// LEDOn reports whether the LED output is on.
+func (l *light) LEDOn() bool {
+	return l.fader.Output() > 0
+}
+
+// Output returns the raw level last written to the LED, 0 to 255.
+func (l *light) Output() int {
+	if out := l.fader.Output(); out > 0 {
+		return out
+	}
+	return 0
+}
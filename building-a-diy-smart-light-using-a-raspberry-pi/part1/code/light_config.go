@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	powerOn  = "on"
+	powerOff = "off"
+
+	maxTransitionMS = 10 * 60 * 1000
+)
+
+// lightConfig is the config document pushed to the device, e.g.
+//
+//	{"version": 7, "power": "on", "brightness": 40, "color": "#ffa040", "transition_ms": 500, "easing": "ease-out"}
+//
+// Version must increase with every change. Documents with a version at or
+// below the one already applied are ignored. Brightness is perceptual, so 50
+// looks half as bright as 100.
+type lightConfig struct {
+	Version      int64  `json:"version"`
+	Power        string `json:"power"`
+	Brightness   *int   `json:"brightness,omitempty"`
+	Color        string `json:"color,omitempty"`
+	TransitionMS int    `json:"transition_ms,omitempty"`
+	Easing       string `json:"easing,omitempty"`
+
+	// IssuedAt is when the sender made the change. The last-writer-wins
+	// conflict policy compares it with local changes.
+	IssuedAt time.Time `json:"issued_at,omitempty"`
+
+	// Effect is only used by led strips.
+	Effect *effectConfig `json:"effect,omitempty"`
+
+	// Schedules, when present, replace the device's schedules. An empty
+	// list removes them all.
+	Schedules *[]scheduleEntry `json:"schedules,omitempty"`
+
+	// Rules, when present, replace the device's rules. An empty list
+	// removes them all.
+	Rules *[]ruleEntry `json:"rules,omitempty"`
+
+	// Update, when present, asks the device to install another build.
+	Update *updateDirective `json:"update,omitempty"`
+
+	// legacy is set for the plain "ON" and "OFF" payloads, which carry no
+	// version and are always applied.
+	legacy bool
+}
+
+// lightChange is a local change to the light, such as from the LAN API.
+// Settings left out keep their current values, e.g.
+//
+//	{"power": "on", "brightness": 30}
+type lightChange struct {
+	Power        *string       `json:"power,omitempty"`
+	Brightness   *int          `json:"brightness,omitempty"`
+	Color        *string       `json:"color,omitempty"`
+	TransitionMS *int          `json:"transition_ms,omitempty"`
+	Easing       *string       `json:"easing,omitempty"`
+	Effect       *effectConfig `json:"effect,omitempty"`
+}
+
+// applyTo returns c with the change made. The version is kept; schedules,
+// rules, updates and the issue time are dropped, as they belong to remote
+// configs.
+func (ch *lightChange) applyTo(c lightConfig) lightConfig {
+	if ch.Power != nil {
+		c.Power = *ch.Power
+	}
+	if ch.Brightness != nil {
+		c.Brightness = ch.Brightness
+	}
+	if ch.Color != nil {
+		c.Color = *ch.Color
+	}
+	if ch.TransitionMS != nil {
+		c.TransitionMS = *ch.TransitionMS
+	} else {
+		c.TransitionMS = 0
+	}
+	if ch.Easing != nil {
+		c.Easing = *ch.Easing
+	}
+	if ch.Effect != nil {
+		c.Effect = ch.Effect
+	}
+	c.Schedules = nil
+	c.Rules = nil
+	c.Update = nil
+	c.IssuedAt = time.Time{}
+	return c
+}
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+var errEmptyConfig = errors.New("config payload is empty")
+
+// parseLightConfig parses and validates a config payload. Plain "ON" and "OFF"
+// are still accepted from older senders.
+func parseLightConfig(payload []byte) (*lightConfig, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 {
+		return nil, errEmptyConfig
+	}
+
+	switch strings.ToUpper(string(trimmed)) {
+	case "ON":
+		return &lightConfig{Power: powerOn, legacy: true}, nil
+	case "OFF":
+		return &lightConfig{Power: powerOff, legacy: true}, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.DisallowUnknownFields()
+
+	var c lightConfig
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("malformed config payload: %s", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("malformed config payload: trailing data after the document")
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *lightConfig) validate() error {
+	var problems []string
+
+	if c.Version < 1 {
+		problems = append(problems, "version must be 1 or more")
+	}
+	problems = append(problems, c.settingProblems()...)
+	if c.Schedules != nil {
+		problems = append(problems, validateSchedules(*c.Schedules)...)
+	}
+	if c.Rules != nil {
+		problems = append(problems, validateRules(*c.Rules)...)
+	}
+	if c.Update != nil {
+		problems = append(problems, c.Update.validate()...)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config payload: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// settingProblems checks the settings that describe the light itself, leaving
+// out the version, schedules and rules.
+func (c *lightConfig) settingProblems() []string {
+	var problems []string
+
+	if c.Power != powerOn && c.Power != powerOff {
+		problems = append(problems, fmt.Sprintf("power must be %q or %q, not %q", powerOn, powerOff, c.Power))
+	}
+	if c.Brightness != nil && (*c.Brightness < 0 || *c.Brightness > 100) {
+		problems = append(problems, fmt.Sprintf("brightness must be between 0 and 100, not %d", *c.Brightness))
+	}
+	if c.Color != "" && !colorPattern.MatchString(c.Color) {
+		problems = append(problems, fmt.Sprintf("color must look like #rrggbb, not %q", c.Color))
+	}
+	if c.TransitionMS < 0 || c.TransitionMS > maxTransitionMS {
+		problems = append(problems, fmt.Sprintf("transition_ms must be between 0 and %d, not %d", maxTransitionMS, c.TransitionMS))
+	}
+
+	if _, ok := easings[c.easing()]; !ok {
+		problems = append(problems, fmt.Sprintf("easing must be one of %s, not %q", strings.Join(easingNames(), ", "), c.Easing))
+	}
+
+	if c.Effect != nil {
+		problems = append(problems, c.Effect.validate()...)
+	}
+	return problems
+}
+
+// brightness returns the requested brightness, 100 when none was given.
+func (c *lightConfig) brightness() int {
+	if c.Brightness == nil {
+		return 100
+	}
+	return *c.Brightness
+}
+
+func (c *lightConfig) easing() string {
+	if c.Easing == "" {
+		return defaultEasing
+	}
+	return c.Easing
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// applyPayload parses payload and applies it to l, as the config handler
+// does.
+func applyPayload(l *light, payload string) error {
+	c, err := parseLightConfig([]byte(payload))
+	if err != nil {
+		return err
+	}
+	return l.Apply(c)
+}
+
+func TestParseLightConfig(t *testing.T) {
+	cases := []struct {
+		payload string
+		err     string
+	}{
+		{`{"version": 1, "power": "on"}`, ""},
+		{`{"version": 2, "power": "off", "brightness": 0, "color": "#A0ff40", "transition_ms": 600000, "easing": "linear"}`, ""},
+		{"  \n", "empty"},
+		{`{"version": 1, "power": "on"`, "malformed"},
+		{`{"version": "1", "power": "on"}`, "malformed"},
+		{`{"version": 1, "power": "on", "colour": "#ffffff"}`, `unknown field "colour"`},
+		{`{"version": 1, "power": "on"} {"version": 2, "power": "off"}`, "trailing data"},
+		{`{"power": "on"}`, "version must be 1 or more"},
+		{`{"version": 1, "power": "ON"}`, `power must be "on" or "off", not "ON"`},
+		{`{"version": 1, "power": "on", "brightness": 101}`, "brightness must be between 0 and 100"},
+		{`{"version": 1, "power": "on", "color": "red"}`, "color must look like #rrggbb"},
+		{`{"version": 1, "power": "on", "transition_ms": -1}`, "transition_ms must be between"},
+		{`{"version": 1, "power": "on", "easing": "bouncy"}`, "easing must be one of"},
+		{`{"version": 0, "power": "dim", "brightness": -1}`, "version must be 1 or more; power must be"},
+	}
+	for _, c := range cases {
+		lc, err := parseLightConfig([]byte(c.payload))
+		if c.err == "" {
+			if err != nil || lc == nil {
+				t.Errorf("%s: %v", c.payload, err)
+			}
+			continue
+		}
+		if err == nil || lc != nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got %+v, %v; want an error with %q", c.payload, lc, err, c.err)
+		}
+	}
+}
+
+func TestLightIgnoresStaleConfigs(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	l, led := testLight(clk)
+
+	if err := applyPayload(l, `{"version": 5, "power": "on", "brightness": 40}`); err != nil {
+		t.Fatal(err)
+	}
+	levels := len(led.Levels())
+
+	for _, payload := range []string{
+		`{"version": 5, "power": "off"}`,
+		`{"version": 5, "power": "on", "brightness": 40}`,
+		`{"version": 4, "power": "on", "brightness": 90}`,
+		`{"version": 1, "power": "off"}`,
+	} {
+		err := applyPayload(l, payload)
+		if _, ok := err.(*staleConfigError); !ok {
+			t.Errorf("%s: %v", payload, err)
+		}
+		if c, v := l.Current(); v != 5 || c.Power != powerOn || c.brightness() != 40 {
+			t.Errorf("%s: changed the light to %+v, version %d", payload, c, v)
+		}
+	}
+	if n := len(led.Levels()); n != levels {
+		t.Errorf("stale configs wrote the LED %v", led.Levels()[levels:])
+	}
+
+	if err := applyPayload(l, `{"version": 6, "power": "off"}`); err != nil {
+		t.Fatal(err)
+	}
+	if c, v := l.Current(); v != 6 || c.Power != powerOff || l.LEDOn() {
+		t.Errorf("version 6 left the light %+v, version %d", c, v)
+	}
+}
+
+func TestLightRejectsMalformedConfigs(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	l, led := testLight(clk)
+	if err := applyPayload(l, `{"version": 2, "power": "on", "brightness": 60, "color": "#ff8000"}`); err != nil {
+		t.Fatal(err)
+	}
+	before, version := l.Current()
+	source, changed := l.Source()
+	levels := len(led.Levels())
+
+	clk.Advance(time.Minute)
+	for _, payload := range []string{
+		`{"version": 3, "power": "off"`,
+		`{"version": 3, "power": "off", "extra": true}`,
+		`{"version": 3, "power": "sideways"}`,
+		`{"version": 3, "power": "off", "brightness": 500}`,
+		`{"version": 3, "power": "off", "schedules": [{"at": "25:00", "power": "on"}]}`,
+		`{"version": 3, "power": "off"} trailing`,
+		`{"version": 3, "power": "off", "rules": [{"name": "x"}]}`,
+		`toggle`,
+		``,
+	} {
+		if err := applyPayload(l, payload); err == nil {
+			t.Errorf("%q was accepted", payload)
+		}
+	}
+
+	after, v := l.Current()
+	if v != version || after.Power != before.Power || after.brightness() != before.brightness() || after.Color != before.Color {
+		t.Errorf("light went from %+v, version %d to %+v, version %d", before, version, after, v)
+	}
+	if s, at := l.Source(); s != source || !at.Equal(changed) {
+		t.Errorf("source went from %s at %s to %s at %s", source, changed, s, at)
+	}
+	if n := len(led.Levels()); n != levels {
+		t.Errorf("malformed configs wrote the LED %v", led.Levels()[levels:])
+	}
+
+	// The next good version still applies.
+	if err := applyPayload(l, `{"version": 3, "power": "off"}`); err != nil {
+		t.Errorf("version 3 after the malformed ones: %s", err)
+	}
+}
+
+func TestLightLegacyPayloads(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	l, _ := testLight(clk)
+
+	for _, payload := range []string{"ON", " on\n", "On"} {
+		c, err := parseLightConfig([]byte(payload))
+		if err != nil || !c.legacy || c.Power != powerOn {
+			t.Errorf("%q parsed as %+v, %v", payload, c, err)
+		}
+	}
+
+	if err := applyPayload(l, `{"version": 7, "power": "on", "brightness": 30}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Legacy payloads carry no version, so they apply whatever has been
+	// applied before and leave the version alone.
+	if err := applyPayload(l, "OFF"); err != nil {
+		t.Fatal(err)
+	}
+	if c, v := l.Current(); c.Power != powerOff || v != 7 || l.LEDOn() {
+		t.Errorf("after OFF the light is %+v, version %d", c, v)
+	}
+	if err := applyPayload(l, "on"); err != nil {
+		t.Fatal(err)
+	}
+	if c, v := l.Current(); c.Power != powerOn || v != 7 || !l.LEDOn() {
+		t.Errorf("after on the light is %+v, version %d", c, v)
+	}
+
+	// Versioned configs are still checked against the last version.
+	if _, ok := applyPayload(l, `{"version": 7, "power": "off"}`).(*staleConfigError); !ok {
+		t.Error("version 7 applied twice")
+	}
+	if err := applyPayload(l, `{"version": 8, "power": "off"}`); err != nil {
+		t.Errorf("version 8 after the legacy ones: %s", err)
+	}
+}
@@ -1,39 +1,327 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"gobot.io/x/gobot"
-	"gobot.io/x/gobot/drivers/gpio"
-	"gobot.io/x/gobot/platforms/raspi"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func main() {
-	r := raspi.NewAdaptor()
-	led := gpio.NewLedDriver(r, "10")
+const (
+	// deviceRetry is how long to wait before trying again to start a light
+	// that failed to start.
+	deviceRetry = time.Minute
+
+	// restartStopTimeout bounds how long a restart waits for the lights to
+	// stop, as a light failing its health checks may never.
+	restartStopTimeout = time.Minute
+)
+
+// Why the client restarts.
+const (
+	restartUpdate  = "an update"
+	restartCommand = "a reboot command"
+	restartHealth  = "failing health checks"
+)
 
-	robot := gobot.NewRobot("unused",
-		[]gobot.Connection{r},
-		[]gobot.Device{led},
-	)
+// subcommands run instead of the client when named as the first argument.
+var subcommands = map[string]func(name string, args []string) error{
+	"provision": runProvision,
+	"doctor":    runDoctor,
+}
+
+// errExit is returned by a subcommand that has reported its failure itself
+// and only needs to exit with an error status.
+var errExit = errors.New("exit")
+
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			err := run(os.Args[0]+" "+os.Args[1], os.Args[2:])
+			if err == errExit {
+				os.Exit(1)
+			}
+			if err != nil && err != flag.ErrHelp {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
-	c, err := newClient()
+	cfg, err := loadConfig(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if cfg.SimBroker != "" {
+		b, err := startBroker(cfg.SimBroker)
+		if err != nil {
+			fmt.Printf("could not start the in-process broker: %s\n", err)
+			os.Exit(1)
+		}
+		defer b.Close()
+		fmt.Printf("in-process broker listening on %s\n", b.Addr())
+	}
+
+	var api *apiServer
+	if cfg.APIListen != "" {
+		api, err = startAPI(cfg.APIListen, cfg.APIToken, cfg.APICert, cfg.APIKey)
+		if err != nil {
+			fmt.Printf("could not start the api: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("api listening on %s\n", cfg.APIListen)
 	}
 
-	fmt.Println("Setup Google IOT Core Config subscription")
-	err = c.Subsribe(configTopic, func(_ MQTT.Client, m MQTT.Message) {
-		if string(m.Payload()) == "ON" {
-			led.On()
+	sh := &shared{}
+	for _, dc := range cfg.devices() {
+		if dc.SimView {
+			sh.view = newSimView(os.Stdout)
+			defer sh.view.Close()
+			break
+		}
+	}
+
+	restarts := make(chan string, 1)
+	sh.restart = func(reason string) {
+		select {
+		case restarts <- reason:
+		default:
+		}
+	}
+	if cfg.UpdateKey != "" {
+		sh.updater, err = setupUpdater(cfg)
+		if err != nil {
+			fmt.Printf("could not set up updates: %s\n", err)
+			os.Exit(1)
+		}
+		sh.updater.Restart = func() { sh.restart(restartUpdate) }
+		if err := sh.updater.Load(); err != nil {
+			fmt.Printf("update: %s\n", err)
+		}
+	}
+
+	var mu sync.Mutex
+	var running []*device
+	var stopping bool
+	sh.lights = func() []*light {
+		mu.Lock()
+		defer mu.Unlock()
+		var lights []*light
+		for _, d := range running {
+			lights = append(lights, d.light)
+		}
+		return lights
+	}
+	sh.reading = func(from *device, event telemetryEvent) {
+		mu.Lock()
+		others := make([]*device, 0, len(running))
+		for _, d := range running {
+			if d != from {
+				others = append(others, d)
+			}
+		}
+		mu.Unlock()
+		for _, d := range others {
+			d.rules.Observe(event)
+		}
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// Each light starts on its own, so one that cannot set up its pins or
+	// connector does not hold up the rest; it is retried until it starts.
+	// A broker that cannot be reached does not stop a light starting, it
+	// connects in the background.
+	for _, dc := range cfg.devices() {
+		wg.Add(1)
+		go func(dc *config) {
+			defer wg.Done()
+			for {
+				d, err := startDevice(dc, sh)
+				if err == nil {
+					mu.Lock()
+					late := stopping
+					if !late {
+						running = append(running, d)
+						if api != nil {
+							api.Add(d)
+						}
+					}
+					mu.Unlock()
+
+					// It finished starting after shutdown began.
+					if late {
+						stopDevice(d)
+					}
+					return
+				}
+				fmt.Printf("%s: failed to start, retrying in %s: %s\n", dc.DeviceID, deviceRetry, err)
+
+				select {
+				case <-done:
+					return
+				case <-time.After(deviceRetry):
+				}
+			}
+		}(dc)
+	}
+
+	sdNotify("READY=1")
+	if interval := watchdogInterval(); interval > 0 {
+		// It keeps going through shutdown, which systemd bounds itself.
+		go feedWatchdog(interval, func() (bool, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			return lightsHealthy(running, len(cfg.devices()))
+		}, realClock{}, nil)
+	}
+
+	// systemd sends SIGTERM when it stops the service. A second signal
+	// gives up on shutting down cleanly.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	restarting := ""
+	select {
+	case sig := <-signals:
+		fmt.Printf("received %s, shutting down\n", sig)
+	case restarting = <-restarts:
+		fmt.Printf("restarting for %s\n", restarting)
+	}
+	sdNotify("STOPPING=1")
+	go func() {
+		<-signals
+		fmt.Println("stopping now")
+		os.Exit(1)
+	}()
+
+	// Nothing may change the lights while they go to their safe state.
+	if api != nil {
+		api.Close()
+	}
+
+	mu.Lock()
+	stopping = true
+	devices := running
+	mu.Unlock()
+	close(done)
+
+	for _, d := range devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			stopDevice(d)
+		}(d)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	if restarting != "" {
+		select {
+		case <-stopped:
+		case <-time.After(restartStopTimeout):
+			fmt.Println("gave up waiting for the lights to stop")
+		}
+	} else {
+		<-stopped
+	}
+
+	if restarting != "" {
+		if restarting == restartUpdate {
+			err = sh.updater.Exec(os.Args, os.Environ())
 		} else {
-			led.Off()
+			err = restartSelf(realExec{})
 		}
-	})
+		if err != nil {
+			fmt.Printf("could not restart: %s\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// restartSelf starts the running binary again in place of this process.
+func restartSelf(ex execer) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return ex.Exec(self, os.Args, os.Environ())
+}
 
+// setupUpdater makes the updater for the binary the config names, or the
+// running one.
+func setupUpdater(cfg *config) (*updater, error) {
+	key, err := cfg.updateKey()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	binary := cfg.UpdateBinary
+	if binary == "" {
+		if binary, err = os.Executable(); err != nil {
+			return nil, err
+		}
 	}
+	if binary, err = filepath.EvalSymlinks(binary); err != nil {
+		return nil, err
+	}
+	return newUpdater(key, cfg.UpdateDir, binary, cfg.UpdateDeadline, realExec{}, realClock{}), nil
+}
 
-	robot.Start()
+// lightsHealthy is the watchdog's health check. It passes while every running
+// light still answers locally, since that is what a restart would fix. Lights
+// still starting and lights waiting on the broker only make the client
+// degraded: a restart brings neither the broker nor the pins back, and the
+// lights keep working from their buttons and schedules meanwhile. It runs
+// under the lock the main loop keeps its lights under, so a main loop stuck
+// holding it stops the watchdog too.
+func lightsHealthy(running []*device, configured int) (bool, string) {
+	healthy, waiting, stuck := 0, 0, 0
+	for _, d := range running {
+		ok := true
+		for _, c := range d.health.Summary().Checks {
+			if c.OK {
+				continue
+			}
+			ok = false
+			switch c.Name {
+			case checkBroker:
+				waiting++
+			case checkActuator:
+				stuck++
+			}
+		}
+		if ok {
+			healthy++
+		}
+	}
+
+	status := fmt.Sprintf("%d of %d lights running, %d healthy", len(running), configured, healthy)
+	if waiting > 0 {
+		status += fmt.Sprintf(", %d waiting on the broker", waiting)
+	}
+	if stuck > 0 {
+		return false, status + fmt.Sprintf(", %d not responding", stuck)
+	}
+	if healthy < configured {
+		status = "degraded: " + status
+	}
+	return true, status
+}
+
+func stopDevice(d *device) {
+	if err := d.Stop(); err != nil {
+		fmt.Printf("%s: %s\n", d.cfg.DeviceID, err)
+	}
 }
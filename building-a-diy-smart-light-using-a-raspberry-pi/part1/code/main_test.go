@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLightsHealthy(t *testing.T) {
+	monitor := func(broker, actuator error) *healthMonitor {
+		h := newHealthMonitor(time.Minute, time.Second, 3, realClock{}, func(error) {})
+		h.Add(checkBroker, func() (time.Duration, error) { return 0, broker })
+		h.Add(checkActuator, func() (time.Duration, error) { return 0, actuator })
+		h.Check()
+		return h
+	}
+	ok := &device{health: monitor(nil, nil)}
+	offline := &device{health: monitor(degradedError{errors.New("not connected")}, nil)}
+	unreachable := &device{health: monitor(errors.New("no answer"), nil)}
+	stuck := &device{health: monitor(nil, errors.New("robot is not running"))}
+
+	cases := []struct {
+		running    []*device
+		configured int
+		healthy    bool
+		status     string
+	}{
+		{[]*device{ok, ok}, 2, true, "2 of 2 lights running, 2 healthy"},
+		// The broker being away only makes the client degraded, so the
+		// watchdog does not restart it over and over.
+		{[]*device{ok, offline}, 2, true, "degraded: 2 of 2 lights running, 1 healthy, 1 waiting on the broker"},
+		{[]*device{offline, unreachable}, 2, true, "degraded: 2 of 2 lights running, 0 healthy, 2 waiting on the broker"},
+		{[]*device{ok}, 2, true, "degraded: 1 of 2 lights running, 1 healthy"},
+		{nil, 1, true, "degraded: 0 of 1 lights running, 0 healthy"},
+		// A light that no longer answers is what a restart is for.
+		{[]*device{ok, stuck}, 2, false, "2 of 2 lights running, 1 healthy, 1 not responding"},
+		{[]*device{offline, stuck}, 2, false, "2 of 2 lights running, 0 healthy, 1 waiting on the broker, 1 not responding"},
+	}
+	for _, c := range cases {
+		healthy, status := lightsHealthy(c.running, c.configured)
+		if healthy != c.healthy || status != c.status {
+			t.Errorf("got %v %q, want %v %q", healthy, status, c.healthy, c.status)
+		}
+	}
+}
@@ -1,127 +1,357 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"io/ioutil"
-	"os"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 const (
-	deviceID    = "test-device"
-	registryID  = "devices"
-	region      = "us-central1"
-	configTopic = "/devices/test-device/config"
-	certPath    = "certs/"
+	// Retry delays when refreshing credentials fails.
+	minRefreshRetry = 30 * time.Second
+	maxRefreshRetry = 5 * time.Minute
+
+	// publishTimeout bounds how long a publish waits for the broker, so a
+	// dropped connection fails the publish rather than blocking it.
+	publishTimeout = 10 * time.Second
+
+	// Retry delays until the first connection is made. paho reconnects by
+	// itself after that.
+	minConnectRetry = 5 * time.Second
+	maxConnectRetry = 2 * time.Minute
 )
 
-var projectID string
+// newClient sets up a client for conn without connecting it. Call connect,
+// or Connect to keep trying in the background.
+func newClient(conn connector) (*client, error) {
+	c := &client{
+		conn:          conn,
+		clock:         realClock{},
+		subscriptions: map[string]MQTT.MessageHandler{},
+		OnError: func(err error) {
+			fmt.Println(err)
+		},
+	}
+
+	opts := MQTT.NewClientOptions()
+	if err := conn.configure(opts); err != nil {
+		return nil, err
+	}
+	opts.SetOnConnectHandler(c.onConnect)
 
-func init() {
-	if projectID = os.Getenv("PROJECT_ID"); projectID == "" {
-		panic("PROJECT_ID environment variable is required.\n Please start this application by running `PROJECT_ID=<INSERT_PROJECT_ID>`")
+	// The broker marks the device offline if it goes away without saying
+	// so; onConnect marks it online again.
+	if status := conn.topic(topicStatus); status != "" {
+		opts.SetWill(status, statusOffline, 1, true)
 	}
+
+	c.mqttClient = MQTT.NewClient(opts)
+	return c, nil
 }
 
-func getSSLCerts() (rootsCert []byte, clientKey []byte, err error) {
-	rootsCert, err = ioutil.ReadFile(certPath + "roots.pem")
-	if err != nil {
-		return
+type client struct {
+	mqttClient MQTT.Client
+	conn       connector
+	clock      clock
+
+	mu              sync.Mutex
+	subscriptions   map[string]MQTT.MessageHandler
+	connectHandlers []func()
+
+	// closed is set by Close, and connecting while a dial waits for the
+	// broker.
+	closed     bool
+	connecting bool
+
+	// dialing is held while connecting, so a credentials refresh and the
+	// first connection attempts do not connect at the same time.
+	dialing sync.Mutex
+
+	// OnError is called with errors from background work such as refreshing
+	// credentials.
+	OnError func(error)
+}
+
+// Topic returns the broker topic for a logical topic name such as "config".
+func (c *client) Topic(name string) string {
+	return c.conn.topic(name)
+}
+
+// DeviceTopic returns the broker topic for a logical topic name of another
+// device, one the gateway bridges.
+func (c *client) DeviceTopic(name, deviceID string) string {
+	return c.conn.deviceTopic(name, deviceID)
+}
+
+// Publish publishes a message on a specific topic. An error is returned if there was problem. This function will publish with a QOS of 1.
+func (c *client) Publish(msg, topic string) error {
+	token := c.mqttClient.Publish(topic, 1, false, msg)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
 	}
+	return token.Error()
+}
 
-	clientKey, err = ioutil.ReadFile(certPath + "rsa_private.pem")
-	if err != nil {
-		return
+// SetStatus publishes status, retained, on the status topic. It does nothing
+// if the connector has no status topic.
+func (c *client) SetStatus(status string) error {
+	return c.setStatus(c.Topic(topicStatus), status)
+}
+
+// SetDeviceStatus is SetStatus for a device the gateway bridges.
+func (c *client) SetDeviceStatus(deviceID, status string) error {
+	return c.setStatus(c.DeviceTopic(topicStatus, deviceID), status)
+}
+
+func (c *client) setStatus(topic, status string) error {
+	if topic == "" {
+		return nil
 	}
-	return
+	token := c.mqttClient.Publish(topic, 1, true, status)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return token.Error()
 }
 
-func getTokenString(rsaPrivate string) (string, error) {
-	token := jwt.New(jwt.SigningMethodRS256)
+// Ping publishes to the broker and waits for it to acknowledge, returning
+// the round trip. It sends "online" to the status topic, not retained so the
+// retained status is left alone, or "{}" to the events topic's ping
+// subfolder when there is no status topic.
+func (c *client) Ping(timeout time.Duration) (time.Duration, error) {
+	if !c.IsConnected() {
+		return 0, fmt.Errorf("not connected")
+	}
+	topic, payload := c.Topic(topicStatus), statusOnline
+	if topic == "" {
+		topic, payload = c.Topic(topicEvents)+"/ping", "{}"
+	}
 
-	token.Claims = jwt.StandardClaims{
-		Audience:  projectID,
-		IssuedAt:  time.Now().Unix(),
-		ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
+	start := c.clock.Now()
+	token := c.mqttClient.Publish(topic, 1, false, payload)
+	if !token.WaitTimeout(timeout) {
+		return c.clock.Now().Sub(start), fmt.Errorf("no acknowledgement within %s", timeout)
 	}
+	return c.clock.Now().Sub(start), token.Error()
+}
 
-	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(rsaPrivate))
-	if err != nil {
-		return "", err
+// IsConnected reports whether the client currently has a broker connection.
+func (c *client) IsConnected() bool {
+	return c.mqttClient.IsConnectionOpen()
+}
+
+// AddConnectHandler registers f to be called every time the connection to the
+// broker is established.
+func (c *client) AddConnectHandler(f func()) {
+	c.mu.Lock()
+	c.connectHandlers = append(c.connectHandlers, f)
+	c.mu.Unlock()
+}
+
+// Subsribe subscribes to topic, including after reconnects. While there is
+// no connection the subscription is only recorded, and is made when the
+// client connects; a filter no broker would take is refused straight away.
+func (c *client) Subsribe(topic string, f MQTT.MessageHandler) error {
+	if !validTopicFilter(topic) {
+		return fmt.Errorf("cannot subscribe to %q, it is not a valid topic filter", topic)
 	}
 
-	tokenString, err := token.SignedString(key)
-	if err != nil {
-		return "", err
+	c.mu.Lock()
+	c.subscriptions[topic] = f
+	c.mu.Unlock()
+
+	if !c.IsConnected() {
+		return nil
 	}
 
-	return tokenString, err
+	if token := c.mqttClient.Subscribe(topic, 0, f); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
 }
 
-func getTLSConfig(rootsCert string) *tls.Config {
-	certpool := x509.NewCertPool()
-	certpool.AppendCertsFromPEM([]byte(rootsCert))
+// Unsubscribe stops the subscription to topic, including after reconnects.
+func (c *client) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	delete(c.subscriptions, topic)
+	c.mu.Unlock()
 
-	return &tls.Config{
-		RootCAs:            certpool,
-		ClientAuth:         tls.NoClientCert,
-		ClientCAs:          nil,
-		InsecureSkipVerify: true,
-		Certificates:       []tls.Certificate{},
-		MinVersion:         tls.VersionTLS12,
+	token := c.mqttClient.Unsubscribe(topic)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timed out unsubscribing from %s", topic)
 	}
+	return token.Error()
 }
 
-func newClient() (*client, error) {
+// onConnect marks the device online, restores subscriptions and runs the
+// connect handlers. The session is clean, so the broker has forgotten them
+// whenever the connection was re-established.
+func (c *client) onConnect(m MQTT.Client) {
+	c.mu.Lock()
+	subs := make(map[string]MQTT.MessageHandler, len(c.subscriptions))
+	for topic, f := range c.subscriptions {
+		subs[topic] = f
+	}
+	handlers := append([]func(){}, c.connectHandlers...)
+	c.mu.Unlock()
 
-	clientID := fmt.Sprintf("projects/%v/locations/%v/registries/%v/devices/%v",
-		projectID,
-		region,
-		registryID,
-		deviceID,
-	)
+	if err := c.SetStatus(statusOnline); err != nil {
+		c.OnError(fmt.Errorf("failed to publish online status: %s", err))
+	}
 
-	roots, clientKey, err := getSSLCerts()
-	if err != nil {
-		return nil, err
+	for topic, f := range subs {
+		if token := m.Subscribe(topic, 0, f); token.Wait() && token.Error() != nil {
+			c.OnError(fmt.Errorf("failed to resubscribe to %s: %s", topic, token.Error()))
+		}
 	}
 
-	jwtString, err := getTokenString(string(clientKey))
-	if err != nil {
-		return nil, err
+	for _, f := range handlers {
+		f()
 	}
+}
 
-	tlsConfig := getTLSConfig(string(roots))
+// KeepCredentialsFresh replaces expiring credentials before the broker drops
+// the session, and reconnects so the broker sees them. It returns when stop is
+// closed, or straight away if the connector's credentials never expire.
+func (c *client) KeepCredentialsFresh(stop <-chan struct{}) {
+	ec, ok := c.conn.(expiringConnector)
+	if !ok {
+		return
+	}
 
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker("ssl://mqtt.googleapis.com:8883")
-	opts.SetClientID(clientID).SetTLSConfig(tlsConfig)
-	opts.SetUsername("unused")
-	opts.SetPassword(jwtString)
+	retry := minRefreshRetry
+	wait := ec.refreshAt().Sub(c.clock.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case <-c.clock.After(wait):
+		}
 
-	mqttClient := MQTT.NewClient(opts)
+		err := ec.refresh()
+		if err == nil {
+			err = c.reconnect()
+		}
+		if err != nil {
+			c.OnError(fmt.Errorf("failed to refresh credentials, retrying in %s: %s", retry, err))
+			wait = retry
+			if retry *= 2; retry > maxRefreshRetry {
+				retry = maxRefreshRetry
+			}
+			continue
+		}
 
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+		retry = minRefreshRetry
+		wait = ec.refreshAt().Sub(c.clock.Now())
 	}
+}
+
+// Close disconnects from the broker. The disconnect is clean, so the broker
+// does not publish the will; call SetStatus first to say the device is going
+// offline. paho cannot stop a connect part way, so one in progress is
+// disconnected as soon as it is over.
+func (c *client) Close() {
+	c.mu.Lock()
+	c.closed = true
+	connecting := c.connecting
+	c.mu.Unlock()
 
-	return &client{
-		mqttClient,
-	}, nil
+	if !connecting {
+		c.mqttClient.Disconnect(250)
+	}
 }
 
-type client struct {
-	mqttClient MQTT.Client
+// Connect connects to the broker, retrying with a growing delay until it
+// succeeds, the client is closed or stop is closed. Everything else works
+// offline meanwhile: subscriptions are made and connect handlers run once it
+// is through.
+func (c *client) Connect(stop <-chan struct{}) {
+	retry := minConnectRetry
+	for {
+		if c.IsConnected() {
+			return
+		}
+		err := c.connect()
+		if err == nil || err == errClientClosed {
+			return
+		}
+		c.OnError(fmt.Errorf("failed to connect to the broker, retrying in %s: %s", retry, err))
+
+		select {
+		case <-stop:
+			return
+		case <-c.clock.After(retry):
+		}
+		if retry *= 2; retry > maxConnectRetry {
+			retry = maxConnectRetry
+		}
+	}
 }
 
-func (c *client) Subsribe(topic string, f MQTT.MessageHandler) error {
-	if token := c.mqttClient.Subscribe(topic, 0, f); token.Wait() && token.Error() != nil {
+var errClientClosed = errors.New("client is closed")
+
+func (c *client) connect() error {
+	return c.dial(false)
+}
+
+func (c *client) reconnect() error {
+	return c.dial(true)
+}
+
+// dial connects to the broker, first dropping the connection there is when
+// again is set. When the broker refuses the credentials and the connector
+// has others, it tries once more with those. Only one dial runs at a time.
+func (c *client) dial(again bool) error {
+	c.dialing.Lock()
+	defer c.dialing.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errClientClosed
+	}
+	c.connecting = true
+	c.mu.Unlock()
+
+	if again {
+		c.mqttClient.Disconnect(250)
+	}
+	err := c.connectOnce()
+
+	c.mu.Lock()
+	c.connecting = false
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		c.mqttClient.Disconnect(250)
+		return errClientClosed
+	}
+	return err
+}
+
+func (c *client) connectOnce() error {
+	token := c.mqttClient.Connect()
+	if token.Wait() && token.Error() == nil {
+		return nil
+	}
+	err := token.Error()
+
+	rc, ok := c.conn.(rotatingConnector)
+	if !ok || !refused(err) || !rc.rejected() {
+		return err
+	}
+	if token := c.mqttClient.Connect(); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 	return nil
 }
+
+// refused reports whether a connect failed because of the credentials.
+func refused(err error) bool {
+	return err == packets.ConnErrors[packets.ErrRefusedBadUsernameOrPassword] ||
+		err == packets.ConnErrors[packets.ErrRefusedNotAuthorised]
+}
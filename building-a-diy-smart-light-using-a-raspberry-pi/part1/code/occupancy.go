@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/drivers/gpio"
+)
+
+const (
+	sourceOccupancy = "occupancy"
+
+	occupied = "occupied"
+	vacant   = "vacant"
+
+	defaultVacancyTimeout = 5 * time.Minute
+	defaultOverrideHold   = time.Hour
+
+	// occupancyTick is how often timers are checked.
+	occupancyTick   = time.Second
+	pirPollInterval = 50 * time.Millisecond
+)
+
+// What the occupancy mode did to the light, reported with each event.
+const (
+	actionNone      = "none"
+	actionLightOn   = "light_on"
+	actionLightOff  = "light_off"
+	actionInhibited = "inhibited"
+	actionHeld      = "held"
+)
+
+// occupancyEvent is published on the events topic when the room becomes
+// occupied or vacant, or a manual override starts.
+type occupancyEvent struct {
+	Type      string    `json:"type"`
+	State     string    `json:"state"`
+	Action    string    `json:"action"`
+	HoldUntil string    `json:"hold_until,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// inhibitWindow says when motion should not turn the light on.
+type inhibitWindow interface {
+	Inhibited(t time.Time) bool
+}
+
+// parseInhibit reads the occupancy.inhibit setting: "daylight" for between
+// sunrise and sunset, a daily window such as "08:00-17:30" in loc, or empty
+// for none.
+func parseInhibit(s string, latitude, longitude float64, loc *time.Location) (inhibitWindow, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case s == "daylight":
+		if latitude == 0 && longitude == 0 {
+			return nil, errors.New("daylight needs location.latitude and location.longitude")
+		}
+		return daylight{latitude, longitude}, nil
+	}
+
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("%q is not daylight or a window like 08:00-17:30", s)
+	}
+	from, err := parseClockTime(bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	until, err := parseClockTime(bounds[1])
+	if err != nil {
+		return nil, err
+	}
+	return dailyWindow{from, until, loc}, nil
+}
+
+// parseClockTime returns the minute of the day for "HH:MM".
+func parseClockTime(s string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) == 2 {
+		h, err1 := strconv.Atoi(parts[0])
+		m, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil && h >= 0 && h < 24 && m >= 0 && m < 60 {
+			return h*60 + m, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a time like 17:30", s)
+}
+
+// daylight inhibits while the sun is up.
+type daylight struct {
+	latitude, longitude float64
+}
+
+func (d daylight) Inhibited(t time.Time) bool {
+	sunrise := solarEvent{"sunrise", d.latitude, d.longitude}.Next(t)
+	sunset := solarEvent{"sunset", d.latitude, d.longitude}.Next(t)
+	switch {
+	case sunset.IsZero():
+		return false
+	case sunrise.IsZero():
+		return true
+	}
+	// The sun is up if it sets before it next rises.
+	return sunset.Before(sunrise)
+}
+
+// dailyWindow inhibits between two times of day. The window may run over
+// midnight.
+type dailyWindow struct {
+	from, until int
+	location    *time.Location
+}
+
+func (w dailyWindow) Inhibited(t time.Time) bool {
+	t = t.In(w.location)
+	now := t.Hour()*60 + t.Minute()
+	if w.from <= w.until {
+		return now >= w.from && now < w.until
+	}
+	return now >= w.from || now < w.until
+}
+
+// occupancy turns the light on when motion is seen and off again once there
+// has been none for the vacancy timeout, counted from when the sensor stops
+// seeing motion however long it saw it for. Motion does not turn the light on
+// inside the inhibit window. When someone uses the wall button the occupancy
+// mode leaves the light alone for the hold time, and it only ever turns off a
+// light that it turned on itself.
+type occupancy struct {
+	light   *light
+	clock   clock
+	timeout time.Duration
+	hold    time.Duration
+	inhibit inhibitWindow
+	pub     publisher
+	topic   string
+	onError func(error)
+
+	mu    sync.Mutex
+	state string
+	// moving is true while the sensor sees motion.
+	moving     bool
+	lastMotion time.Time
+	holdUntil  time.Time
+	manualSeen time.Time
+}
+
+func newOccupancy(l *light, clk clock, timeout, hold time.Duration, inhibit inhibitWindow, pub publisher, topic string, onError func(error)) *occupancy {
+	return &occupancy{
+		light:      l,
+		clock:      clk,
+		timeout:    timeout,
+		hold:       hold,
+		inhibit:    inhibit,
+		pub:        pub,
+		topic:      topic,
+		onError:    onError,
+		state:      vacant,
+		manualSeen: clk.Now(),
+	}
+}
+
+// Motion records that the sensor sees motion.
+func (o *occupancy) Motion() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.clock.Now()
+	o.checkManual(now)
+	o.moving = true
+	o.lastMotion = now
+
+	lightOn := o.lightOn()
+	action := actionNone
+	switch {
+	case lightOn:
+	case o.held(now):
+		action = actionHeld
+	case o.inhibit != nil && o.inhibit.Inhibited(now):
+		action = actionInhibited
+	default:
+		if err := o.light.Occupy(powerOn); err != nil {
+			o.onError(fmt.Errorf("occupancy: %s", err))
+		} else {
+			action = actionLightOn
+		}
+	}
+
+	// A retrigger only extends the timeout, unless it turned the light on.
+	if o.state == vacant || action == actionLightOn {
+		o.state = occupied
+		o.publish(action, now)
+	}
+}
+
+// MotionStopped records that the sensor no longer sees motion, which starts
+// the vacancy timeout.
+func (o *occupancy) MotionStopped() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.moving = false
+	o.lastMotion = o.clock.Now()
+}
+
+// Check ends the occupancy once the timeout has passed without motion, and
+// ends a manual override hold once it has run out.
+func (o *occupancy) Check() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.clock.Now()
+	o.checkManual(now)
+	if !o.holdUntil.IsZero() && !now.Before(o.holdUntil) {
+		o.holdUntil = time.Time{}
+	}
+
+	if o.state != occupied || o.moving || now.Sub(o.lastMotion) < o.timeout {
+		return
+	}
+	o.state = vacant
+
+	action := actionNone
+	if source, _ := o.light.Source(); source == sourceOccupancy && o.lightOn() {
+		if o.held(now) {
+			action = actionHeld
+		} else if err := o.light.Occupy(powerOff); err != nil {
+			o.onError(fmt.Errorf("occupancy: %s", err))
+		} else {
+			action = actionLightOff
+		}
+	}
+	o.publish(action, now)
+}
+
+// checkManual starts a hold if the wall button was used since it last looked.
+// o.mu must be held.
+func (o *occupancy) checkManual(now time.Time) {
+	source, at := o.light.Source()
+	if source != sourceLocal || !at.After(o.manualSeen) {
+		return
+	}
+	o.manualSeen = at
+	o.holdUntil = at.Add(o.hold)
+	o.publish(actionHeld, now)
+}
+
+func (o *occupancy) held(now time.Time) bool {
+	return !o.holdUntil.IsZero() && now.Before(o.holdUntil)
+}
+
+func (o *occupancy) lightOn() bool {
+	current, _ := o.light.Current()
+	return current.Power == powerOn
+}
+
+// State returns whether the room is occupied or vacant.
+func (o *occupancy) State() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.state
+}
+
+// publish sends an occupancy event. o.mu must be held.
+func (o *occupancy) publish(action string, now time.Time) {
+	event := occupancyEvent{
+		Type:      "occupancy",
+		State:     o.state,
+		Action:    action,
+		Timestamp: now,
+	}
+	if o.held(now) {
+		event.HoldUntil = o.holdUntil.Format(time.RFC3339)
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		o.onError(fmt.Errorf("occupancy: failed to encode event: %s", err))
+		return
+	}
+	if err := o.pub.Publish(string(b), o.topic); err != nil {
+		o.onError(fmt.Errorf("occupancy: failed to publish event: %s", err))
+	}
+}
+
+// Run feeds motion from the sensor into the state machine until stop is
+// closed.
+func (o *occupancy) Run(pir *gpio.PIRMotionDriver, stop <-chan struct{}) {
+	events := pir.Subscribe()
+	defer pir.Unsubscribe(events)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case e := <-events:
+			switch e.Name {
+			case gpio.MotionDetected:
+				o.Motion()
+			case gpio.MotionStopped:
+				o.MotionStopped()
+			case gpio.Error:
+				o.onError(fmt.Errorf("occupancy: motion sensor: %v", e.Data))
+			}
+		case <-o.clock.After(occupancyTick):
+			o.Check()
+		}
+	}
+}
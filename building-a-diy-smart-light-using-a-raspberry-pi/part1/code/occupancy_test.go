@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot/drivers/gpio"
+)
+
+// fakePin is a digital input the test sets.
+type fakePin struct {
+	value int32
+}
+
+func (p *fakePin) Set(v int) {
+	atomic.StoreInt32(&p.value, int32(v))
+}
+
+func (p *fakePin) DigitalRead(string) (int, error) {
+	return int(atomic.LoadInt32(&p.value)), nil
+}
+
+// occupancyEvents decodes what the occupancy mode has published.
+func occupancyEvents(t *testing.T, pub *recordingPublisher) []occupancyEvent {
+	t.Helper()
+	var events []occupancyEvent
+	for _, m := range pub.Messages() {
+		var e occupancyEvent
+		if err := json.Unmarshal([]byte(m.msg), &e); err != nil {
+			t.Fatalf("malformed event %q: %s", m.msg, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func lightPower(l *light) string {
+	c, _ := l.Current()
+	return c.Power
+}
+
+func TestOccupancyWithSimulatedMotion(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 1, 20, 19, 0, 0, 0, time.UTC))
+	l, _ := testLight(clk)
+	pub := &recordingPublisher{}
+	o := newOccupancy(l, clk, 5*time.Minute, time.Hour, nil, pub, "events", func(err error) { t.Error(err) })
+
+	pin := &fakePin{}
+	pir := gpio.NewPIRMotionDriver(pin, "7", time.Millisecond)
+	pir.Start()
+	defer pir.Halt()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		o.Run(pir, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	waitForWaiters(t, clk, 1)
+
+	pin.Set(1)
+	eventually(t, "motion to turn the light on", func() bool { return lightPower(l) == powerOn })
+	if o.State() != occupied {
+		t.Errorf("state is %s with motion", o.State())
+	}
+
+	// Someone is moving about for longer than the timeout. The sensor stays
+	// high and sends no more events, and the light must stay on.
+	for i := 0; i < 10; i++ {
+		waitForWaiters(t, clk, 1)
+		clk.Advance(time.Minute)
+	}
+	waitForWaiters(t, clk, 1)
+	if o.State() != occupied || lightPower(l) != powerOn {
+		t.Fatalf("light went %s during 10 minutes of motion", lightPower(l))
+	}
+
+	pin.Set(0)
+	eventually(t, "the sensor to stop seeing motion", func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return !o.moving
+	})
+	stopped := clk.Now()
+
+	for _, d := range []time.Duration{time.Minute, time.Minute, time.Minute, time.Minute, 59 * time.Second} {
+		waitForWaiters(t, clk, 1)
+		clk.Advance(d)
+	}
+	waitForWaiters(t, clk, 1)
+	if o.State() != occupied {
+		t.Fatalf("vacant %s after motion stopped, before the timeout", clk.Now().Sub(stopped))
+	}
+
+	clk.Advance(time.Second)
+	eventually(t, "the light to go off", func() bool { return lightPower(l) == powerOff })
+	if o.State() != vacant {
+		t.Errorf("state is %s after the timeout", o.State())
+	}
+
+	events := occupancyEvents(t, pub)
+	if len(events) != 2 {
+		t.Fatalf("published %+v, want occupied then vacant", events)
+	}
+	if e := events[0]; e.State != occupied || e.Action != actionLightOn || !e.Timestamp.Equal(stopped.Add(-10*time.Minute)) {
+		t.Errorf("first event is %+v", e)
+	}
+	if e := events[1]; e.State != vacant || e.Action != actionLightOff || !e.Timestamp.Equal(stopped.Add(5*time.Minute)) {
+		t.Errorf("second event is %+v", e)
+	}
+}
+
+func TestOccupancyLeavesButtonLightAlone(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 1, 20, 19, 0, 0, 0, time.UTC))
+	l, _ := testLight(clk)
+	pub := &recordingPublisher{}
+	o := newOccupancy(l, clk, time.Minute, 30*time.Minute, nil, pub, "events", func(err error) { t.Error(err) })
+
+	clk.Advance(time.Second)
+	l.Toggle()
+	o.Motion()
+	o.MotionStopped()
+	clk.Advance(2 * time.Minute)
+	o.Check()
+	if lightPower(l) != powerOn {
+		t.Error("occupancy turned off a light switched on at the wall")
+	}
+	if e := occupancyEvents(t, pub); len(e) == 0 || e[0].Action != actionHeld || e[0].HoldUntil == "" {
+		t.Errorf("button press was published as %+v", e)
+	}
+
+	// Inside the hold, motion does not turn the light back on.
+	l.Toggle()
+	o.Motion()
+	if lightPower(l) != powerOff {
+		t.Error("motion turned the light on during a manual hold")
+	}
+}
+
+func TestOccupancyInhibitWindow(t *testing.T) {
+	w, err := parseInhibit("22:00-06:30", 0, 0, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{"21:59": false, "22:00": true, "03:00": true, "06:29": true, "06:30": false, "12:00": false}
+	for at, want := range cases {
+		tm, _ := time.Parse("15:04", at)
+		if got := w.Inhibited(tm); got != want {
+			t.Errorf("inhibited at %s is %v, want %v", at, got, want)
+		}
+	}
+	if _, err := parseInhibit("daylight", 0, 0, time.UTC); err == nil {
+		t.Error("daylight was accepted without a location")
+	}
+}
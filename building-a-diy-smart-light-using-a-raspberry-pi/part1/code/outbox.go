@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dropOldest = "oldest"
+	dropNewest = "newest"
+
+	defaultOutboxDir      = "outbox"
+	defaultOutboxMaxBytes = 8 << 20
+	defaultOutboxMaxAge   = 24 * time.Hour
+
+	outboxSegmentSize = 1 << 20
+	outboxFrameHeader = 8
+)
+
+var (
+	errOutboxFull   = errors.New("outbox is full")
+	errDrainStopped = errors.New("drain stopped")
+)
+
+// outboxMessage is a message waiting to be published.
+type outboxMessage struct {
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+	Queued  time.Time `json:"queued"`
+}
+
+// outboxStats are the queue metrics included in state reports.
+type outboxStats struct {
+	Depth   int   `json:"depth"`
+	Bytes   int64 `json:"bytes"`
+	Dropped int64 `json:"dropped"`
+	Expired int64 `json:"expired"`
+}
+
+// outbox is a bounded on-disk queue of outgoing messages. Messages are
+// appended to numbered segment files as length and crc framed records, and
+// the position of the oldest unsent record is kept in a cursor file. A torn
+// record at the end of a segment, left by a crash or power cut, is cut off
+// when the outbox is opened.
+type outbox struct {
+	dir        string
+	maxBytes   int64
+	maxAge     time.Duration
+	dropPolicy string
+	clock      clock
+
+	// segmentSize is kept well under maxBytes so consumed segments can be
+	// deleted long before the disk holds much more than maxBytes.
+	segmentSize int64
+
+	mu      sync.Mutex
+	records []outboxRecord
+	bytes   int64
+	active  *os.File
+	segment int64
+	offset  int64
+	dropped int64
+	expired int64
+}
+
+type outboxRecord struct {
+	segment int64
+	end     int64
+	size    int64
+	msg     outboxMessage
+}
+
+func openOutbox(dir string, maxBytes int64, maxAge time.Duration, dropPolicy string, clk clock) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	o := &outbox{
+		dir:        dir,
+		maxBytes:   maxBytes,
+		maxAge:     maxAge,
+		dropPolicy: dropPolicy,
+		clock:      clk,
+
+		segmentSize: outboxSegmentSize,
+	}
+	if o.segmentSize > maxBytes/4 {
+		o.segmentSize = maxBytes / 4
+	}
+
+	cursorSegment, cursorOffset, err := o.readCursor()
+	if err != nil {
+		return nil, err
+	}
+	o.segment = cursorSegment
+
+	segments, err := o.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seg := range segments {
+		if seg < cursorSegment {
+			os.Remove(o.segmentPath(seg))
+			continue
+		}
+		start := int64(0)
+		if seg == cursorSegment {
+			start = cursorOffset
+		}
+		if err := o.load(seg, start); err != nil {
+			return nil, err
+		}
+		o.segment = seg
+	}
+
+	if err := o.openSegment(o.segment); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *outbox) segmentPath(seg int64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%016d.seg", seg))
+}
+
+func (o *outbox) segments() ([]int64, error) {
+	names, err := filepath.Glob(filepath.Join(o.dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	var segs []int64
+	for _, name := range names {
+		seg, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err == nil {
+			segs = append(segs, seg)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+// load reads the records of a segment from offset start, truncating the file
+// at the first record that is incomplete or fails its checksum.
+func (o *outbox) load(seg, start int64) error {
+	f, err := os.OpenFile(o.segmentPath(seg), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	offset := start
+	header := make([]byte, outboxFrameHeader)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			break
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[:4]))
+		if _, err := io.ReadFull(f, body); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+
+		size := int64(outboxFrameHeader + len(body))
+		offset += size
+
+		// The frame is intact, so a record that does not decode can only be
+		// skipped; the cursor moves past it with the next record sent.
+		var msg outboxMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			fmt.Printf("outbox: skipping undecodable record in segment %d: %s\n", seg, err)
+			continue
+		}
+		o.records = append(o.records, outboxRecord{seg, offset, size, msg})
+		o.bytes += size
+	}
+
+	if info, err := f.Stat(); err == nil && info.Size() > offset {
+		fmt.Printf("outbox: discarding %d bytes of a torn record in segment %d\n", info.Size()-offset, seg)
+		return f.Truncate(offset)
+	}
+	return nil
+}
+
+func (o *outbox) openSegment(seg int64) error {
+	f, err := os.OpenFile(o.segmentPath(seg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if o.active != nil {
+		o.active.Close()
+	}
+	o.active, o.segment, o.offset = f, seg, info.Size()
+	return nil
+}
+
+// Enqueue appends a message. When the outbox is full the drop policy decides
+// whether the oldest messages make room or the new one is refused with
+// errOutboxFull.
+func (o *outbox) Enqueue(topic, payload string) error {
+	msg := outboxMessage{Topic: topic, Payload: payload, Queued: o.clock.Now()}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	size := int64(outboxFrameHeader + len(body))
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if size > o.maxBytes {
+		o.dropped++
+		return errOutboxFull
+	}
+	for o.bytes+size > o.maxBytes {
+		if o.dropPolicy == dropNewest {
+			o.dropped++
+			return errOutboxFull
+		}
+		o.dropped++
+		if err := o.pop(); err != nil {
+			return err
+		}
+	}
+
+	if o.offset >= o.segmentSize {
+		if err := o.openSegment(o.segment + 1); err != nil {
+			return err
+		}
+	}
+
+	frame := make([]byte, size)
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(body))
+	copy(frame[outboxFrameHeader:], body)
+
+	if _, err := o.active.Write(frame); err != nil {
+		return err
+	}
+	if err := o.active.Sync(); err != nil {
+		return err
+	}
+
+	o.offset += size
+	o.records = append(o.records, outboxRecord{o.segment, o.offset, size, msg})
+	o.bytes += size
+	return nil
+}
+
+// Drain publishes queued messages in order until the outbox is empty or
+// publish fails. Messages older than the maximum age are dropped instead.
+func (o *outbox) Drain(publish func(msg, topic string) error) error {
+	for {
+		o.mu.Lock()
+		if len(o.records) == 0 {
+			o.mu.Unlock()
+			return nil
+		}
+		head := o.records[0]
+		if o.maxAge > 0 && o.clock.Now().Sub(head.msg.Queued) > o.maxAge {
+			o.expired++
+			err := o.pop()
+			o.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		o.mu.Unlock()
+
+		if err := publish(head.msg.Payload, head.msg.Topic); err != nil {
+			return err
+		}
+
+		// A full outbox may have dropped the record while it was being
+		// published, in which case it is no longer at the head.
+		o.mu.Lock()
+		var err error
+		if len(o.records) > 0 && o.records[0].segment == head.segment && o.records[0].end == head.end {
+			err = o.pop()
+		}
+		o.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// pop removes the oldest record and moves the cursor past it. o.mu must be
+// held.
+func (o *outbox) pop() error {
+	head := o.records[0]
+	o.records = o.records[1:]
+	o.bytes -= head.size
+
+	if err := o.writeCursor(head.segment, head.end); err != nil {
+		return err
+	}
+
+	next := o.segment
+	if len(o.records) > 0 {
+		next = o.records[0].segment
+	}
+	for seg := head.segment; seg < next; seg++ {
+		os.Remove(o.segmentPath(seg))
+	}
+	return nil
+}
+
+func (o *outbox) readCursor() (int64, int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(o.dir, "cursor"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var seg, offset int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seg, &offset); err != nil {
+		return 0, 0, fmt.Errorf("outbox: corrupt cursor file: %s", err)
+	}
+	return seg, offset, nil
+}
+
+// writeCursor replaces the cursor file atomically.
+func (o *outbox) writeCursor(seg, offset int64) error {
+	return writeFileAtomic(filepath.Join(o.dir, "cursor"), []byte(fmt.Sprintf("%d %d\n", seg, offset)), 0600)
+}
+
+// Stats returns the queue metrics.
+func (o *outbox) Stats() outboxStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return outboxStats{
+		Depth:   len(o.records),
+		Bytes:   o.bytes,
+		Dropped: o.dropped,
+		Expired: o.expired,
+	}
+}
+
+// Len returns the number of queued messages.
+func (o *outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.records)
+}
+
+func (o *outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.active.Close()
+}
+
+// queuedPublisher publishes straight to the broker while it is connected and
+// nothing is waiting, and otherwise puts messages in the outbox to be sent in
+// order once the connection is back.
+type queuedPublisher struct {
+	client  *client
+	box     *outbox
+	clock   clock
+	onError func(error)
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+const outboxRetry = 30 * time.Second
+
+func newQueuedPublisher(c *client, box *outbox, clk clock, onError func(error)) *queuedPublisher {
+	q := &queuedPublisher{
+		client:  c,
+		box:     box,
+		clock:   clk,
+		onError: onError,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	c.AddConnectHandler(q.Wake)
+	return q
+}
+
+func (q *queuedPublisher) Publish(msg, topic string) error {
+	if q.box.Len() == 0 && q.client.IsConnected() {
+		if err := q.client.Publish(msg, topic); err == nil {
+			return nil
+		}
+	}
+
+	if err := q.box.Enqueue(topic, msg); err != nil {
+		return err
+	}
+	q.Wake()
+	return nil
+}
+
+// Wake asks for the outbox to be drained. It never blocks.
+func (q *queuedPublisher) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run drains the outbox whenever it is woken and the client is connected,
+// retrying periodically while messages remain. Closing stop also ends a drain
+// in progress after the message being sent.
+func (q *queuedPublisher) Run(stop <-chan struct{}) {
+	defer close(q.done)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-q.wake:
+		case <-q.clock.After(outboxRetry):
+		}
+
+		if !q.client.IsConnected() || q.box.Len() == 0 {
+			continue
+		}
+		err := q.box.Drain(publishUntil(stop, q.client.Publish))
+		if err != nil && err != errDrainStopped {
+			q.onError(fmt.Errorf("outbox: %d messages still queued: %s", q.box.Len(), err))
+		}
+	}
+}
+
+// Done is closed once Run has returned.
+func (q *queuedPublisher) Done() <-chan struct{} {
+	return q.done
+}
+
+// publishUntil wraps publish so a drain using it stops with errDrainStopped
+// once stop is closed.
+func publishUntil(stop <-chan struct{}, publish func(msg, topic string) error) func(msg, topic string) error {
+	return func(msg, topic string) error {
+		select {
+		case <-stop:
+			return errDrainStopped
+		default:
+		}
+		return publish(msg, topic)
+	}
+}
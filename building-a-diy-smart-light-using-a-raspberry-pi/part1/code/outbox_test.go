@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"testing"
+	"time"
+)
+
+// appendFrame writes a well-framed record holding body to the end of path.
+func appendFrame(t *testing.T, path string, body []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header := make([]byte, outboxFrameHeader)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(body))
+	if _, err := f.Write(append(header, body...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func drainAll(t *testing.T, o *outbox) []string {
+	t.Helper()
+	var got []string
+	err := o.Drain(func(msg, topic string) error {
+		got = append(got, topic+" "+msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestOutboxSkipsUndecodableRecords(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	clk := newFakeClock(time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC))
+
+	o, err := openOutbox(dir, defaultOutboxMaxBytes, time.Hour, dropOldest, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Enqueue("events", "first"); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	// A record whose checksum matches but whose body is not a message, then
+	// a good one after it, then half a frame from a power cut.
+	path := o.segmentPath(0)
+	appendFrame(t, path, []byte("{not json"))
+	appendFrame(t, path, []byte(`{"topic":"events","payload":"second","queued":"2026-02-01T12:00:00Z"}`))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1})
+	f.Close()
+
+	o, err = openOutbox(dir, defaultOutboxMaxBytes, time.Hour, dropOldest, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if n := o.Len(); n != 2 {
+		t.Fatalf("reopened outbox holds %d messages, want 2", n)
+	}
+	got := drainAll(t, o)
+	if len(got) != 2 || got[0] != "events first" || got[1] != "events second" {
+		t.Errorf("drained %q", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != o.offset {
+		t.Errorf("torn record was not cut off: %v", err)
+	}
+}
+
+func TestOutboxExpiresOldMessages(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	clk := newFakeClock(time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC))
+
+	o, err := openOutbox(dir, defaultOutboxMaxBytes, time.Hour, dropOldest, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	o.Enqueue("state", `{"power":"on"}`)
+	clk.Advance(2 * time.Hour)
+	o.Enqueue("state", `{"power":"off"}`)
+
+	if got := drainAll(t, o); len(got) != 1 || got[0] != `state {"power":"off"}` {
+		t.Errorf("drained %q, want only the message younger than the maximum age", got)
+	}
+	if s := o.Stats(); s.Expired != 1 || s.Depth != 0 {
+		t.Errorf("stats are %+v", s)
+	}
+}
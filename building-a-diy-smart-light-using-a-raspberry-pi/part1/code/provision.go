@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRSABits = 2048
+	minRSABits     = 2048
+
+	provisionTimeout = 30 * time.Second
+)
+
+// provisionOptions are the flags of the provision subcommand.
+type provisionOptions struct {
+	DeviceID   string
+	CertPath   string
+	Algorithm  string
+	RSABits    int
+	ConfigFile string
+	Connector  string
+	Broker     string
+	ProjectID  string
+	Region     string
+	RegistryID string
+	RootsURL   string
+	Register   string
+	Token      string
+}
+
+// registration is the body POSTed to the registration endpoint.
+type registration struct {
+	DeviceID  string `json:"device_id"`
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+	CSR       string `json:"csr"`
+}
+
+// runProvision sets a device up to run: its key pair, a CSR for it, the
+// broker's roots and a config file, and optionally registers it. It can be
+// run again safely: files that exist are kept, and whatever is missing is
+// made from them, so a second run only fills gaps and re-registers.
+func runProvision(name string, args []string) error {
+	o := provisionOptions{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&o.DeviceID, "device-id", "", "device id, required")
+	fs.StringVar(&o.CertPath, "cert-path", "certs/", "directory for the key, public key, csr and roots")
+	fs.StringVar(&o.Algorithm, "algorithm", "RS256", `key type, "RS256" for RSA or "ES256" for EC P-256`)
+	fs.IntVar(&o.RSABits, "rsa-bits", defaultRSABits, "size of a new RSA key")
+	fs.StringVar(&o.ConfigFile, "config", defaultConfigFile, "device config file to write")
+	fs.StringVar(&o.Connector, "connector", "", `connector written to the config, "iotcore" or "mqtt"`)
+	fs.StringVar(&o.Broker, "broker", "", "broker url written to the config")
+	fs.StringVar(&o.ProjectID, "iotcore.project-id", "", "google cloud project id written to the config")
+	fs.StringVar(&o.Region, "iotcore.region", "", "iot core region written to the config")
+	fs.StringVar(&o.RegistryID, "iotcore.registry-id", "", "iot core registry id written to the config")
+	fs.StringVar(&o.RootsURL, "roots", "", "url to download roots.pem from when it is missing, e.g. https://pki.google.com/roots.pem")
+	fs.StringVar(&o.Register, "register", "", "url to POST the device's public key and csr to, empty to skip registering")
+	fs.StringVar(&o.Token, "register-token", os.Getenv("REGISTER_TOKEN"), "bearer token for -register (env REGISTER_TOKEN)")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if o.DeviceID == "" {
+		return fmt.Errorf("-device-id is required")
+	}
+	if err := validDeviceID(o.DeviceID); err != nil {
+		return fmt.Errorf("-device-id: %s", err)
+	}
+	if o.Algorithm == "RS256" && o.RSABits < minRSABits {
+		return fmt.Errorf("-rsa-bits must be at least %d, not %d", minRSABits, o.RSABits)
+	}
+	prefix, ok := map[string]string{"RS256": "rsa", "ES256": "ec"}[o.Algorithm]
+	if !ok {
+		return fmt.Errorf("-algorithm must be RS256 or ES256, not %q", o.Algorithm)
+	}
+
+	if err := os.MkdirAll(o.CertPath, 0700); err != nil {
+		return err
+	}
+	keyFile := prefix + "_private.pem"
+	key, err := provisionKey(filepath.Join(o.CertPath, keyFile), o.Algorithm, o.RSABits)
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := provisionFile(filepath.Join(o.CertPath, prefix+"_public.pem"), publicPEM, 0644, true); err != nil {
+		return err
+	}
+
+	csrPEM, err := provisionCSR(filepath.Join(o.CertPath, prefix+".csr"), key, o.DeviceID)
+	if err != nil {
+		return err
+	}
+
+	if o.RootsURL != "" {
+		if err := provisionRoots(filepath.Join(o.CertPath, "roots.pem"), o.RootsURL); err != nil {
+			return err
+		}
+	}
+
+	if err := provisionFile(o.ConfigFile, provisionConfig(o, keyFile), 0644, false); err != nil {
+		return err
+	}
+	if err := checkProvisionedConfig(o, keyFile); err != nil {
+		fmt.Printf("%s: %s; edit it, or remove it to have it written again\n", o.ConfigFile, err)
+	} else if _, err := loadConfig(name, []string{"-config", o.ConfigFile}); err != nil {
+		fmt.Printf("%s does not load yet, fill in the rest:\n%s\n", o.ConfigFile, err)
+	}
+
+	if o.Register != "" {
+		return register(o.Register, o.Token, registration{
+			DeviceID:  o.DeviceID,
+			Algorithm: o.Algorithm,
+			PublicKey: string(publicPEM),
+			CSR:       string(csrPEM),
+		})
+	}
+	return nil
+}
+
+// provisionKey loads the private key at path, making a new one when there
+// is none. A key readable by anyone but its owner is made private.
+func provisionKey(path, algorithm string, bits int) (crypto.Signer, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		var key crypto.Signer
+		var block *pem.Block
+		if algorithm == "RS256" {
+			k, err := rsa.GenerateKey(rand.Reader, bits)
+			if err != nil {
+				return nil, err
+			}
+			key, block = k, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		} else {
+			k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+			der, err := x509.MarshalECPrivateKey(k)
+			if err != nil {
+				return nil, err
+			}
+			key, block = k, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+		}
+		b := pem.EncodeToMemory(block)
+		err := writeFileAtomic(path, b, 0600)
+		zero(b)
+		zero(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("created %s\n", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// An existing key may be encrypted, for which the passphrase comes from
+	// the environment.
+	passphrase, err := readPassphrase("")
+	if err != nil {
+		return nil, err
+	}
+	defer zero(passphrase)
+	dk, err := loadDeviceKey(path, passphrase, algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("%s, remove it or pick its -algorithm", err)
+	}
+	key := dk.key
+
+	if info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(path, 0600); err != nil {
+			return nil, err
+		}
+		fmt.Printf("kept %s, made it readable by its owner only (it was %s)\n", path, info.Mode().Perm())
+		return key, nil
+	}
+	fmt.Printf("kept %s\n", path)
+	return key, nil
+}
+
+// provisionCSR writes a certificate signing request for key naming the
+// device, unless path already has a good one, and returns it.
+func provisionCSR(path string, key crypto.Signer, deviceID string) ([]byte, error) {
+	if b, err := ioutil.ReadFile(path); err == nil {
+		if block, _ := pem.Decode(b); block != nil && block.Type == "CERTIFICATE REQUEST" {
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err == nil && csr.CheckSignature() == nil && csr.Subject.CommonName == deviceID && samePublicKey(csr.PublicKey, key.Public()) {
+				fmt.Printf("kept %s\n", path)
+				return b, nil
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: deviceID},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	if err := writeFileAtomic(path, b, 0644); err != nil {
+		return nil, err
+	}
+	fmt.Printf("wrote %s\n", path)
+	return b, nil
+}
+
+func samePublicKey(a, b crypto.PublicKey) bool {
+	da, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	db, err := x509.MarshalPKIXPublicKey(b)
+	return err == nil && bytes.Equal(da, db)
+}
+
+// provisionFile writes data to path. An existing file is kept, unless
+// replace is set and it differs.
+func provisionFile(path string, data []byte, perm os.FileMode, replace bool) error {
+	old, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil && bytes.Equal(old, data):
+		fmt.Printf("kept %s\n", path)
+		return nil
+	case err == nil && !replace:
+		fmt.Printf("kept %s, it already exists\n", path)
+		return nil
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	if err := writeFileAtomic(path, data, perm); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", path)
+	return nil
+}
+
+// checkProvisionedConfig checks that a config file kept from before is for
+// this device and key.
+func checkProvisionedConfig(o provisionOptions, keyFile string) error {
+	r, err := os.Open(o.ConfigFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := parseConfigFile(r)
+	if err != nil {
+		return err
+	}
+
+	get := func(key, def string) string {
+		if v, ok := f.values[key]; ok {
+			return v.value
+		}
+		return def
+	}
+	defaults := defaultConfig()
+	if id := get("device_id", defaults.DeviceID); id != o.DeviceID {
+		return fmt.Errorf("it is for device %s, not %s", id, o.DeviceID)
+	}
+	key := get("jwt.key_file", defaults.KeyFile)
+	if !filepath.IsAbs(key) {
+		key = filepath.Join(get("cert_path", defaults.CertPath), key)
+	}
+	if want := filepath.Join(o.CertPath, keyFile); filepath.Clean(key) != filepath.Clean(want) {
+		return fmt.Errorf("it uses the key %s, not %s", key, want)
+	}
+	return nil
+}
+
+// provisionRoots downloads the broker's trusted roots when path has none.
+func provisionRoots(path, url string) error {
+	if _, err := os.Stat(path); err == nil {
+		fmt.Printf("kept %s\n", path)
+		return nil
+	}
+	resp, err := (&http.Client{Timeout: provisionTimeout}).Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading roots from %s: %s", url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(b); block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("%s did not return PEM certificates", url)
+	}
+	if err := writeFileAtomic(path, b, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", path)
+	return nil
+}
+
+// provisionConfig is the config file for the device. Only the settings
+// given are written; the rest keep their defaults.
+func provisionConfig(o provisionOptions, keyFile string) []byte {
+	var b bytes.Buffer
+	line := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s = %s\n", key, strconv.Quote(value))
+		}
+	}
+	b.WriteString("# Written by iot-client provision. See iot-client.example.toml for the\n# other settings.\n\n")
+	line("device_id", o.DeviceID)
+	line("connector", o.Connector)
+	line("broker", o.Broker)
+	line("cert_path", o.CertPath)
+	if o.ProjectID != "" || o.Region != "" || o.RegistryID != "" {
+		b.WriteString("\n[iotcore]\n")
+		line("project_id", o.ProjectID)
+		line("region", o.Region)
+		line("registry_id", o.RegistryID)
+	}
+	b.WriteString("\n[jwt]\n")
+	line("key_file", keyFile)
+	line("algorithm", o.Algorithm)
+	return b.Bytes()
+}
+
+// register POSTs the device's public key and CSR to url. A 409 means the
+// device is registered already, which is fine on a re-run.
+func register(url, token string, r registration) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Timeout: provisionTimeout}).Do(req)
+	if err != nil {
+		return fmt.Errorf("registering: %s", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		fmt.Printf("%s is already registered\n", r.DeviceID)
+		return nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		fmt.Printf("registered %s\n", r.DeviceID)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("registering: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
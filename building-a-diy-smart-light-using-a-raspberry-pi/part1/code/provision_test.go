@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// provisionedFile is what a provisioning run left at a path.
+type provisionedFile struct {
+	info os.FileInfo
+	data []byte
+}
+
+func provisionedFiles(t *testing.T, dir string) map[string]provisionedFile {
+	t.Helper()
+	files := map[string]provisionedFile{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[path] = provisionedFile{info, b}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestProvisionTwice(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	requests := map[string]int{}
+	roots := newTestCA(t, "test root").PEM()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		n := requests[r.Method+" "+r.URL.Path]
+		mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/roots.pem":
+			w.Write(roots)
+		case r.Method == "POST" && r.URL.Path == "/register" && n == 1:
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "POST" && r.URL.Path == "/register":
+			w.WriteHeader(http.StatusConflict)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	config := filepath.Join(dir, "iot-client.toml")
+	args := []string{
+		"-device-id", "lamp",
+		"-cert-path", filepath.Join(dir, "certs"),
+		"-algorithm", "ES256",
+		"-config", config,
+		"-connector", "mqtt",
+		"-broker", "tcp://localhost:1883",
+		"-roots", srv.URL + "/roots.pem",
+		"-register", srv.URL + "/register",
+	}
+	if err := runProvision("iot-client provision", args); err != nil {
+		t.Fatal(err)
+	}
+	// Edits made since must survive the second run too.
+	b, err := ioutil.ReadFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, config, append(b, "\n[state]\nheartbeat = \"1m\"\n"...))
+
+	first := provisionedFiles(t, dir)
+	for _, name := range []string{"ec_private.pem", "ec_public.pem", "ec.csr", "roots.pem"} {
+		if _, ok := first[filepath.Join(dir, "certs", name)]; !ok {
+			t.Errorf("the first run did not write %s", name)
+		}
+	}
+
+	if err := runProvision("iot-client provision", args); err != nil {
+		t.Fatal(err)
+	}
+	second := provisionedFiles(t, dir)
+	if len(second) != len(first) {
+		t.Errorf("the second run left %d files, not %d", len(second), len(first))
+	}
+	for path, f := range first {
+		g, ok := second[path]
+		switch {
+		case !ok:
+			t.Errorf("the second run removed %s", path)
+		case !os.SameFile(f.info, g.info) || !g.info.ModTime().Equal(f.info.ModTime()):
+			t.Errorf("the second run replaced %s", path)
+		case !bytes.Equal(g.data, f.data):
+			t.Errorf("the second run changed %s", path)
+		case g.info.Mode() != f.info.Mode():
+			t.Errorf("the second run changed the mode of %s from %s to %s", path, f.info.Mode(), g.info.Mode())
+		}
+	}
+
+	// Roots are kept rather than downloaded again, and registering again
+	// is taken as done.
+	mu.Lock()
+	defer mu.Unlock()
+	if n := requests["GET /roots.pem"]; n != 1 {
+		t.Errorf("roots downloaded %d times", n)
+	}
+	if n := requests["POST /register"]; n != 2 {
+		t.Errorf("registered %d times", n)
+	}
+}
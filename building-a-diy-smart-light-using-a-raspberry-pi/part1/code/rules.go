@@ -0,0 +1,748 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	sourceRule = "rule"
+
+	defaultRulesFile = "rules.json"
+	maxRules         = 32
+	maxButtonHold    = time.Minute
+
+	// ruleTick is the longest the engine sleeps. It also bounds how long an
+	// edit to the rules file takes to be picked up.
+	ruleTick = 5 * time.Second
+)
+
+// Wall button triggers.
+const (
+	buttonPress = "press"
+	buttonHeld  = "held"
+)
+
+// ruleEntry is one rule from the config document or the rules file, e.g.
+//
+//	{"name": "too-hot", "when": {"sensor": "living-room", "quantity": "temperature", "above": 28, "hysteresis": 1},
+//	 "if": [{"during": "08:00-23:00"}], "then": [{"set": {"power": "on", "color": "#ff0000"}}, {"publish": {"event": "too-hot"}}]}
+//	{"name": "all-off", "when": {"button": "held", "for": "3s"}, "then": [{"set": {"power": "off"}, "all": true}]}
+//
+// When the trigger fires and every condition holds, the actions run in
+// order.
+type ruleEntry struct {
+	Name string          `json:"name"`
+	When ruleTrigger     `json:"when"`
+	If   []ruleCondition `json:"if,omitempty"`
+	Then []ruleAction    `json:"then"`
+}
+
+// ruleTrigger is one of a sensor threshold, the wall button, or a time given
+// by a cron expression or a solar event.
+//
+// A threshold fires when a reading goes above (or below) it, and not again
+// until a reading has come back past it by hysteresis. The first reading
+// past it fires too, so a rule holds from startup. "held" fires once the
+// button has been held down for the given time.
+type ruleTrigger struct {
+	Sensor     string   `json:"sensor,omitempty"`
+	Quantity   string   `json:"quantity,omitempty"`
+	Above      *float64 `json:"above,omitempty"`
+	Below      *float64 `json:"below,omitempty"`
+	Hysteresis float64  `json:"hysteresis,omitempty"`
+
+	Button string `json:"button,omitempty"`
+	For    string `json:"for,omitempty"`
+
+	Cron   string `json:"cron,omitempty"`
+	Solar  string `json:"solar,omitempty"`
+	Offset string `json:"offset,omitempty"`
+}
+
+// ruleCondition is checked when the trigger fires: the latest reading of a
+// sensor against a bound, the light's power, or whether it is during or
+// outside a window like "08:00-17:30" or "daylight". A sensor that has not
+// been read yet fails its condition.
+type ruleCondition struct {
+	Sensor   string   `json:"sensor,omitempty"`
+	Quantity string   `json:"quantity,omitempty"`
+	Above    *float64 `json:"above,omitempty"`
+	Below    *float64 `json:"below,omitempty"`
+
+	Power   string `json:"power,omitempty"`
+	During  string `json:"during,omitempty"`
+	Outside string `json:"outside,omitempty"`
+}
+
+// ruleAction changes the light, every light run by this process when all is
+// set, or publishes an event.
+type ruleAction struct {
+	Set     *lightChange `json:"set,omitempty"`
+	All     bool         `json:"all,omitempty"`
+	Publish *rulePublish `json:"publish,omitempty"`
+}
+
+type rulePublish struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// ruleEvent is published on the events topic by a publish action. Value is
+// the reading that fired a threshold trigger.
+type ruleEvent struct {
+	Type      string          `json:"type"`
+	Rule      string          `json:"rule"`
+	Event     string          `json:"event"`
+	Value     *float64        `json:"value,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+func validateRules(entries []ruleEntry) []string {
+	var problems []string
+	if len(entries) > maxRules {
+		problems = append(problems, fmt.Sprintf("at most %d rules are allowed", maxRules))
+	}
+	names := map[string]bool{}
+	for i, e := range entries {
+		if names[e.Name] {
+			problems = append(problems, fmt.Sprintf("rules[%d]: name %q is used twice", i, e.Name))
+		}
+		names[e.Name] = true
+		if _, err := e.build(time.UTC, 0, 0); err != nil {
+			problems = append(problems, fmt.Sprintf("rules[%d]: %s", i, err))
+		}
+	}
+	return problems
+}
+
+// needsLocation reports whether the rule uses the sun.
+func (e ruleEntry) needsLocation() bool {
+	if e.When.Solar != "" {
+		return true
+	}
+	for _, c := range e.If {
+		if c.During == "daylight" || c.Outside == "daylight" {
+			return true
+		}
+	}
+	return false
+}
+
+// build checks the entry and turns it into a rule.
+func (e ruleEntry) build(loc *time.Location, latitude, longitude float64) (*rule, error) {
+	if e.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	r := &rule{entry: e, armed: true}
+	if err := r.buildTrigger(latitude, longitude); err != nil {
+		return nil, fmt.Errorf("%s: when: %s", e.Name, err)
+	}
+
+	for i, c := range e.If {
+		check, err := c.build(loc, latitude, longitude)
+		if err != nil {
+			return nil, fmt.Errorf("%s: if[%d]: %s", e.Name, i, err)
+		}
+		r.conditions = append(r.conditions, check)
+	}
+
+	if len(e.Then) == 0 {
+		return nil, fmt.Errorf("%s: then needs at least one action", e.Name)
+	}
+	for i, a := range e.Then {
+		if err := a.validate(); err != nil {
+			return nil, fmt.Errorf("%s: then[%d]: %s", e.Name, i, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *rule) buildTrigger(latitude, longitude float64) error {
+	t := r.entry.When
+	kinds := 0
+	for _, set := range []bool{t.Sensor != "", t.Button != "", t.Cron != "", t.Solar != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("exactly one of sensor, button, cron and solar is required")
+	}
+
+	var err error
+	switch {
+	case t.Sensor != "":
+		if err := checkBounds(t.Quantity, t.Above, t.Below, true); err != nil {
+			return err
+		}
+		if t.Hysteresis < 0 {
+			return fmt.Errorf("hysteresis must not be negative, not %g", t.Hysteresis)
+		}
+	case t.Button != "":
+		switch t.Button {
+		case buttonPress:
+			if t.For != "" {
+				return errors.New("for only applies to held")
+			}
+		case buttonHeld:
+			if t.For == "" {
+				return errors.New("held needs for, e.g. \"3s\"")
+			}
+			if r.holdFor, err = time.ParseDuration(t.For); err != nil {
+				return fmt.Errorf("for %q is not a duration", t.For)
+			}
+			if r.holdFor <= 0 || r.holdFor > maxButtonHold {
+				return fmt.Errorf("for must be more than 0 and at most %s", maxButtonHold)
+			}
+		default:
+			return fmt.Errorf("button must be %q or %q, not %q", buttonPress, buttonHeld, t.Button)
+		}
+	case t.Cron != "":
+		if r.when, err = parseCron(t.Cron); err != nil {
+			return err
+		}
+	case t.Solar != "":
+		if _, ok := solarEvents[t.Solar]; !ok {
+			return fmt.Errorf("solar must be sunrise, sunset, dawn or dusk, not %q", t.Solar)
+		}
+		r.when = solarEvent{t.Solar, latitude, longitude}
+	}
+
+	if t.Offset != "" {
+		if r.when == nil {
+			return errors.New("offset only applies to cron and solar")
+		}
+		if r.offset, err = time.ParseDuration(t.Offset); err != nil {
+			return fmt.Errorf("offset %q is not a duration", t.Offset)
+		}
+		if r.offset < -12*time.Hour || r.offset > 12*time.Hour {
+			return errors.New("offset must be within 12h")
+		}
+	}
+	return nil
+}
+
+// checkBounds checks the sensor part of a trigger, which needs exactly one
+// bound, or of a condition, which needs at least one.
+func checkBounds(quantity string, above, below *float64, trigger bool) error {
+	if quantity == "" {
+		return errors.New("quantity is required with sensor, e.g. \"temperature\"")
+	}
+	switch {
+	case trigger && (above == nil) == (below == nil):
+		return errors.New("exactly one of above and below is required")
+	case above == nil && below == nil:
+		return errors.New("above or below is required")
+	}
+	return nil
+}
+
+// ruleCheck is a condition ready to be checked.
+type ruleCheck struct {
+	ruleCondition
+	window inhibitWindow
+	inside bool
+}
+
+func (c ruleCondition) build(loc *time.Location, latitude, longitude float64) (ruleCheck, error) {
+	check := ruleCheck{ruleCondition: c}
+	kinds := 0
+	for _, set := range []bool{c.Sensor != "", c.Power != "", c.During != "", c.Outside != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return check, errors.New("exactly one of sensor, power, during and outside is required")
+	}
+
+	switch {
+	case c.Sensor != "":
+		if err := checkBounds(c.Quantity, c.Above, c.Below, false); err != nil {
+			return check, err
+		}
+	case c.Power != "":
+		if c.Power != powerOn && c.Power != powerOff {
+			return check, fmt.Errorf("power must be %q or %q, not %q", powerOn, powerOff, c.Power)
+		}
+	default:
+		window := c.During
+		check.inside = c.During != ""
+		if !check.inside {
+			window = c.Outside
+		}
+		if window == "daylight" {
+			check.window = daylight{latitude, longitude}
+			break
+		}
+		w, err := parseInhibit(window, latitude, longitude, loc)
+		if err != nil {
+			return check, err
+		}
+		check.window = w
+	}
+	return check, nil
+}
+
+func (a ruleAction) validate() error {
+	switch {
+	case (a.Set == nil) == (a.Publish == nil):
+		return errors.New("exactly one of set and publish is required")
+	case a.Set != nil:
+		next := a.Set.applyTo(lightConfig{Power: powerOff})
+		if problems := next.settingProblems(); len(problems) > 0 {
+			return &invalidChangeError{problems}
+		}
+	case a.All:
+		return errors.New("all only applies to set")
+	case a.Publish.Event == "":
+		return errors.New("publish needs an event name")
+	}
+	return nil
+}
+
+// rule is an entry with its trigger's state. armed says a threshold may
+// fire, or that a hold has not fired yet for the current press. fire is the
+// next run of a time trigger.
+type rule struct {
+	entry      ruleEntry
+	conditions []ruleCheck
+
+	holdFor time.Duration
+	when    scheduleTimes
+	offset  time.Duration
+
+	armed bool
+	fire  time.Time
+}
+
+// plan works out the first run of a time trigger after after. fire is left
+// zero if it never runs again.
+func (r *rule) plan(after time.Time) {
+	r.fire = time.Time{}
+	if base := r.when.Next(after.Add(-r.offset)); !base.IsZero() {
+		r.fire = base.Add(r.offset)
+	}
+}
+
+// cross feeds a reading to a threshold trigger and reports whether it fires.
+func (r *rule) cross(v float64) bool {
+	t := r.entry.When
+	past, back := false, false
+	if t.Above != nil {
+		past, back = v > *t.Above, v <= *t.Above-t.Hysteresis
+	} else {
+		past, back = v < *t.Below, v >= *t.Below+t.Hysteresis
+	}
+	switch {
+	case past && r.armed:
+		r.armed = false
+		return true
+	case back:
+		r.armed = true
+	}
+	return false
+}
+
+type sensorQuantity struct {
+	sensor, quantity string
+}
+
+// firing is a rule whose trigger fired and whose conditions held.
+type firing struct {
+	entry ruleEntry
+	value *float64
+	at    time.Time
+}
+
+// rulesFile is how rules are kept on disk between restarts.
+type rulesFile struct {
+	Version int64       `json:"version"`
+	Rules   []ruleEntry `json:"rules"`
+}
+
+// ruleEngine runs a light's rules on the device, so they keep working while
+// it is offline. Triggers are fed by the sensor poller, the wall button and
+// the engine's own clock; a trigger whose conditions do not hold is used up
+// all the same. Rules are evaluated in order and their actions run on the
+// caller's goroutine, so a fake clock and fed readings make it
+// deterministic.
+type ruleEngine struct {
+	light     *light
+	pub       publisher
+	topic     string
+	path      string
+	location  *time.Location
+	latitude  float64
+	longitude float64
+	clock     clock
+	onError   func(error)
+
+	// Lights, when set, returns every light in the process for actions
+	// with all set. Otherwise they change only this engine's light.
+	Lights func() []*light
+	// ButtonDown, when set, says whether the wall button is still pushed.
+	// Without it a hold counts from the press alone.
+	ButtonDown func() bool
+
+	wake chan struct{}
+
+	mu        sync.Mutex
+	version   int64
+	modTime   time.Time
+	rules     []*rule
+	readings  map[sensorQuantity]float64
+	pressedAt time.Time
+}
+
+func newRuleEngine(l *light, pub publisher, topic, path string, loc *time.Location, latitude, longitude float64, clk clock, onError func(error)) *ruleEngine {
+	return &ruleEngine{
+		light:     l,
+		pub:       pub,
+		topic:     topic,
+		path:      path,
+		location:  loc,
+		latitude:  latitude,
+		longitude: longitude,
+		clock:     clk,
+		onError:   onError,
+		wake:      make(chan struct{}, 1),
+		readings:  map[sensorQuantity]float64{},
+	}
+}
+
+// Load reads the rules file, whether saved by an earlier run or edited by
+// hand. A missing file is not an error. Rules that fail to load leave the
+// previous ones running.
+func (e *ruleEngine) Load() error {
+	info, err := os.Stat(e.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.modTime = info.ModTime()
+	e.mu.Unlock()
+
+	b, err := ioutil.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	var f rulesFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %s", e.path, err)
+	}
+	if problems := validateRules(f.Rules); len(problems) > 0 {
+		return fmt.Errorf("%s: %s", e.path, problems[0])
+	}
+	rules, err := e.build(f.Rules)
+	if err != nil {
+		return fmt.Errorf("%s: %s", e.path, err)
+	}
+
+	e.mu.Lock()
+	e.version = f.Version
+	e.replace(rules)
+	e.mu.Unlock()
+	e.Wake()
+	return nil
+}
+
+// Set replaces the rules with the ones from config version. Versions at or
+// below the current one are ignored, so a config sent again does not reset
+// the rules.
+func (e *ruleEngine) Set(version int64, entries []ruleEntry) error {
+	rules, err := e.build(entries)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if version <= e.version {
+		return nil
+	}
+	b, err := json.MarshalIndent(rulesFile{version, entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(e.path, b, 0600); err != nil {
+		return fmt.Errorf("saving rules: %s", err)
+	}
+	// The engine's own write is not an edit to reload.
+	if info, err := os.Stat(e.path); err == nil {
+		e.modTime = info.ModTime()
+	}
+
+	e.version = version
+	e.replace(rules)
+	e.Wake()
+	return nil
+}
+
+func (e *ruleEngine) build(entries []ruleEntry) ([]*rule, error) {
+	var rules []*rule
+	for i, entry := range entries {
+		if entry.needsLocation() && e.latitude == 0 && e.longitude == 0 {
+			return nil, fmt.Errorf("rules[%d]: %s: the sun needs location.latitude and location.longitude", i, entry.Name)
+		}
+		r, err := entry.build(e.location, e.latitude, e.longitude)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %s", i, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// replace swaps in new rules. A rule kept under the same name with the same
+// trigger keeps its state, so a reload does not fire it again. e.mu must be
+// held.
+func (e *ruleEngine) replace(rules []*rule) {
+	old := map[string]*rule{}
+	for _, r := range e.rules {
+		old[r.entry.Name] = r
+	}
+	for _, r := range rules {
+		if prev, ok := old[r.entry.Name]; ok && reflect.DeepEqual(prev.entry.When, r.entry.When) {
+			r.armed, r.fire = prev.armed, prev.fire
+		}
+	}
+	e.rules = rules
+}
+
+// reload loads the rules file again if it has changed since it was last
+// read.
+func (e *ruleEngine) reload() {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	changed := !info.ModTime().Equal(e.modTime)
+	e.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if err := e.Load(); err != nil {
+		e.onError(fmt.Errorf("rules: keeping the previous rules: %s", err))
+		return
+	}
+	fmt.Printf("rules: reloaded %s\n", e.path)
+}
+
+// Wake asks the engine to look at its time triggers again. It never blocks.
+func (e *ruleEngine) Wake() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Observe records a sensor sample and fires the threshold triggers it
+// crosses.
+func (e *ruleEngine) Observe(event telemetryEvent) {
+	now := e.clock.Now()
+	var fired []firing
+
+	e.mu.Lock()
+	for _, rd := range event.Readings {
+		e.readings[sensorQuantity{event.Sensor, rd.Quantity}] = rd.Value
+	}
+	for _, r := range e.rules {
+		t := r.entry.When
+		if t.Sensor != event.Sensor {
+			continue
+		}
+		for _, rd := range event.Readings {
+			if rd.Quantity != t.Quantity || !r.cross(rd.Value) {
+				continue
+			}
+			if e.met(r, now) {
+				v := rd.Value
+				fired = append(fired, firing{r.entry, &v, now})
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	e.run(fired)
+}
+
+// ButtonPress fires the press triggers and starts timing holds.
+func (e *ruleEngine) ButtonPress() {
+	now := e.clock.Now()
+	var fired []firing
+
+	e.mu.Lock()
+	e.pressedAt = now
+	for _, r := range e.rules {
+		switch r.entry.When.Button {
+		case buttonHeld:
+			r.armed = true
+		case buttonPress:
+			if e.met(r, now) {
+				fired = append(fired, firing{r.entry, nil, now})
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	e.Wake()
+	e.run(fired)
+}
+
+// met reports whether every condition of r holds. e.mu must be held.
+func (e *ruleEngine) met(r *rule, now time.Time) bool {
+	for _, c := range r.conditions {
+		switch {
+		case c.Sensor != "":
+			v, ok := e.readings[sensorQuantity{c.Sensor, c.Quantity}]
+			if !ok || (c.Above != nil && v <= *c.Above) || (c.Below != nil && v >= *c.Below) {
+				return false
+			}
+		case c.Power != "":
+			current, _ := e.light.Current()
+			if current.Power != c.Power {
+				return false
+			}
+		default:
+			if c.window.Inhibited(now) != c.inside {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Run fires time and hold triggers as they come due, and picks up edits to
+// the rules file, until stop is closed.
+func (e *ruleEngine) Run(stop <-chan struct{}) {
+	for {
+		e.reload()
+		wait := e.step()
+
+		select {
+		case <-stop:
+			return
+		case <-e.wake:
+		case <-e.clock.After(wait):
+		}
+	}
+}
+
+// step fires the time and hold triggers that are due and returns how long to
+// wait before looking again.
+func (e *ruleEngine) step() time.Duration {
+	now := e.clock.Now().In(e.location)
+	var fired []firing
+	wait := ruleTick
+	sooner := func(t time.Time) {
+		if d := t.Sub(now); d < wait {
+			wait = d
+		}
+	}
+
+	e.mu.Lock()
+	for _, r := range e.rules {
+		switch {
+		case r.when != nil:
+			if r.fire.IsZero() {
+				r.plan(now)
+			}
+			if r.fire.IsZero() {
+				continue
+			}
+			if !now.Before(r.fire) {
+				if late := now.Sub(r.fire); late <= scheduleGrace {
+					if e.met(r, now) {
+						fired = append(fired, firing{r.entry, nil, r.fire})
+					}
+					r.plan(r.fire)
+				} else {
+					fmt.Printf("rule %q: skipping the run due at %s, the clock is %s ahead of it\n", r.entry.Name, r.fire.Format(time.RFC3339), late.Round(time.Second))
+					r.plan(now)
+				}
+			}
+			if !r.fire.IsZero() {
+				sooner(r.fire)
+			}
+
+		case r.entry.When.Button == buttonHeld && r.armed && !e.pressedAt.IsZero():
+			due := e.pressedAt.Add(r.holdFor)
+			if now.Before(due) {
+				sooner(due)
+				continue
+			}
+			r.armed = false
+			if (e.ButtonDown == nil || e.ButtonDown()) && e.met(r, now) {
+				fired = append(fired, firing{r.entry, nil, due})
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	e.run(fired)
+	return wait
+}
+
+// run carries out the actions of the rules that fired, in order.
+func (e *ruleEngine) run(fired []firing) {
+	for _, f := range fired {
+		fmt.Printf("rule %q: fired\n", f.entry.Name)
+		for _, a := range f.entry.Then {
+			if err := e.act(f, a); err != nil {
+				e.onError(fmt.Errorf("rule %q: %s", f.entry.Name, err))
+			}
+		}
+	}
+}
+
+func (e *ruleEngine) act(f firing, a ruleAction) error {
+	if a.Set != nil {
+		lights := []*light{e.light}
+		if a.All && e.Lights != nil {
+			for _, l := range e.Lights() {
+				if l != e.light {
+					lights = append(lights, l)
+				}
+			}
+		}
+		var failed error
+		for _, l := range lights {
+			if err := l.Rule(a.Set); err != nil {
+				failed = err
+			}
+		}
+		return failed
+	}
+
+	event := ruleEvent{
+		Type:      "rule",
+		Rule:      f.entry.Name,
+		Event:     a.Publish.Event,
+		Value:     f.value,
+		Data:      a.Publish.Data,
+		Timestamp: f.at,
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %s", err)
+	}
+	if err := e.pub.Publish(string(b), e.topic); err != nil {
+		return fmt.Errorf("failed to publish event: %s", err)
+	}
+	return nil
+}
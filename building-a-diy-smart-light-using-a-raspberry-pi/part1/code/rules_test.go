@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func publishEvent(name string) []ruleAction {
+	return []ruleAction{{Publish: &rulePublish{Event: name}}}
+}
+
+// testRules starts an engine on a fake clock in loc, publishing to the
+// returned recorder.
+func testRules(t *testing.T, dir string, clk *fakeClock, loc *time.Location, latitude, longitude float64, entries ...ruleEntry) (*ruleEngine, *recordingPublisher) {
+	t.Helper()
+	l, _ := testLight(clk)
+	pub := &recordingPublisher{}
+	e := newRuleEngine(l, pub, "events", filepath.Join(dir, "rules.json"), loc, latitude, longitude, clk, func(err error) { t.Error(err) })
+	if err := e.Set(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	return e, pub
+}
+
+func ruleEvents(t *testing.T, pub *recordingPublisher) []ruleEvent {
+	t.Helper()
+	var events []ruleEvent
+	for _, m := range pub.Messages() {
+		var e ruleEvent
+		if err := json.Unmarshal([]byte(m.msg), &e); err != nil {
+			t.Fatalf("malformed rule event %q: %s", m.msg, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestRuleThresholdHysteresis(t *testing.T) {
+	cases := []struct {
+		name     string
+		when     ruleTrigger
+		readings []float64
+		fires    []bool
+	}{
+		{
+			"above",
+			ruleTrigger{Sensor: "room", Quantity: "temperature", Above: float(28), Hysteresis: 1},
+			[]float64{27, 28, 28.5, 29, 27.5, 28.5, 27, 28.1},
+			[]bool{false, false, true, false, false, false, false, true},
+		},
+		{
+			// The first reading past the threshold fires, so the rule holds
+			// from startup.
+			"below",
+			ruleTrigger{Sensor: "room", Quantity: "lux", Below: float(10), Hysteresis: 2},
+			[]float64{9, 5, 11, 9.5, 12, 9.9},
+			[]bool{true, false, false, false, false, true},
+		},
+		{
+			"no hysteresis",
+			ruleTrigger{Sensor: "room", Quantity: "temperature", Above: float(28)},
+			[]float64{29, 28, 29, 29},
+			[]bool{true, false, true, false},
+		},
+	}
+	for _, c := range cases {
+		r, err := ruleEntry{Name: c.name, When: c.when, Then: publishEvent("x")}.build(time.UTC, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range c.readings {
+			if got := r.cross(v); got != c.fires[i] {
+				t.Errorf("%s: reading %d (%g) fired %v", c.name, i, v, got)
+			}
+		}
+	}
+}
+
+func TestRuleButtonHeld(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	clk := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	e, pub := testRules(t, dir, clk, time.UTC, 0, 0,
+		ruleEntry{Name: "held", When: ruleTrigger{Button: buttonHeld, For: "3s"}, Then: publishEvent("held")},
+		ruleEntry{Name: "press", When: ruleTrigger{Button: buttonPress}, Then: publishEvent("press")},
+	)
+	button := &debouncer{interval: defaultDebounce, clock: clk}
+	e.ButtonDown = button.Pushed
+	push := func() {
+		if button.Edge(true) {
+			e.ButtonPress()
+		}
+	}
+	count := func(name string) int {
+		n := 0
+		for _, ev := range ruleEvents(t, pub) {
+			if ev.Rule == name {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Held for long enough.
+	start := clk.Now()
+	push()
+	if count("press") != 1 {
+		t.Fatalf("press did not fire")
+	}
+	if wait := e.step(); wait != 3*time.Second {
+		t.Errorf("engine waits %s for the hold", wait)
+	}
+	clk.Advance(2999 * time.Millisecond)
+	if e.step(); count("held") != 0 {
+		t.Fatal("held fired early")
+	}
+	clk.Advance(time.Millisecond)
+	e.step()
+	events := ruleEvents(t, pub)
+	if count("held") != 1 || !events[len(events)-1].Timestamp.Equal(start.Add(3*time.Second)) {
+		t.Fatalf("events are %+v", events)
+	}
+	clk.Advance(time.Minute)
+	if e.step(); count("held") != 1 {
+		t.Error("held fired twice for one press")
+	}
+	button.Edge(false)
+
+	// Let go before the hold is up.
+	clk.Advance(time.Second)
+	push()
+	clk.Advance(time.Second)
+	button.Edge(false)
+	clk.Advance(5 * time.Second)
+	e.step()
+	if count("held") != 1 || count("press") != 2 {
+		t.Errorf("events are %+v", ruleEvents(t, pub))
+	}
+
+	// Without a way to tell, a hold counts from the press alone.
+	e.ButtonDown = nil
+	push()
+	clk.Advance(3 * time.Second)
+	e.step()
+	if count("held") != 2 {
+		t.Errorf("events are %+v", ruleEvents(t, pub))
+	}
+}
+
+func TestRuleTimeTriggers(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	const latitude, longitude = 51.5, -0.13
+	start := time.Date(2026, 6, 1, 0, 0, 0, 0, london)
+	clk := newFakeClock(start)
+	e, pub := testRules(t, dir, clk, london, latitude, longitude,
+		ruleEntry{Name: "morning", When: ruleTrigger{Cron: "30 7 * * 1-5"}, Then: publishEvent("morning")},
+		ruleEntry{Name: "evening", When: ruleTrigger{Solar: "sunset", Offset: "-30m"}, Then: publishEvent("evening")},
+	)
+
+	// Run the engine as Run would, sleeping as long as it asks, for three
+	// days from a Monday.
+	end := start.Add(72 * time.Hour)
+	for clk.Now().Before(end) {
+		clk.Advance(e.step())
+	}
+
+	var want []string
+	for day := 0; day < 3; day++ {
+		date := start.AddDate(0, 0, day)
+		want = append(want, "morning "+time.Date(date.Year(), date.Month(), date.Day(), 7, 30, 0, 0, london).Format(time.RFC3339))
+		sunset := solarEvent{"sunset", latitude, longitude}.Next(date)
+		if h := sunset.In(london).Hour(); h != 21 {
+			t.Fatalf("sunset on %s is at %s", date.Format("2006-01-02"), sunset.In(london))
+		}
+		want = append(want, "evening "+sunset.Add(-30*time.Minute).In(london).Format(time.RFC3339))
+	}
+	var got []string
+	for _, ev := range ruleEvents(t, pub) {
+		got = append(got, ev.Rule+" "+ev.Timestamp.In(london).Format(time.RFC3339))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("fired %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("run %d was %s, want %s", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sourceSchedule = "schedule"
+
+	defaultScheduleFile = "schedules.json"
+	maxSchedules        = 32
+	maxScheduleJitter   = 2 * time.Hour
+
+	// scheduleTick is the longest the scheduler sleeps, so it notices the
+	// wall clock being set, as happens when a Pi without a real time clock
+	// reaches an NTP server.
+	scheduleTick = time.Minute
+	// scheduleGrace is how late an event may run. Events missed by more,
+	// because the clock jumped or the device was busy, are skipped.
+	scheduleGrace = 2 * time.Minute
+)
+
+// scheduleEntry is one schedule from the config document. It has either a
+// cron expression or a solar event, e.g.
+//
+//	{"name": "evening", "solar": "sunset", "offset": "-15m", "jitter": "10m", "power": "on", "brightness": 60}
+//	{"name": "night", "cron": "30 23 * * *", "power": "off", "transition_ms": 60000}
+//
+// Offset moves the event earlier or later and jitter delays it by a random
+// amount up to the given duration.
+type scheduleEntry struct {
+	Name         string `json:"name,omitempty"`
+	Cron         string `json:"cron,omitempty"`
+	Solar        string `json:"solar,omitempty"`
+	Offset       string `json:"offset,omitempty"`
+	Jitter       string `json:"jitter,omitempty"`
+	Power        string `json:"power"`
+	Brightness   *int   `json:"brightness,omitempty"`
+	TransitionMS int    `json:"transition_ms,omitempty"`
+}
+
+func validateSchedules(entries []scheduleEntry) []string {
+	var problems []string
+	if len(entries) > maxSchedules {
+		problems = append(problems, fmt.Sprintf("at most %d schedules are allowed", maxSchedules))
+	}
+	for i, e := range entries {
+		if _, err := e.build(0, 0); err != nil {
+			problems = append(problems, fmt.Sprintf("schedules[%d]: %s", i, err))
+		}
+	}
+	return problems
+}
+
+// build checks the entry and turns it into a schedule.
+func (e scheduleEntry) build(latitude, longitude float64) (*schedule, error) {
+	s := &schedule{entry: e}
+
+	switch {
+	case e.Cron != "" && e.Solar != "":
+		return nil, errors.New("only one of cron and solar can be set")
+	case e.Cron != "":
+		spec, err := parseCron(e.Cron)
+		if err != nil {
+			return nil, err
+		}
+		s.when = spec
+	case e.Solar != "":
+		if _, ok := solarEvents[e.Solar]; !ok {
+			return nil, fmt.Errorf("solar must be sunrise, sunset, dawn or dusk, not %q", e.Solar)
+		}
+		s.when = solarEvent{e.Solar, latitude, longitude}
+	default:
+		return nil, errors.New("one of cron and solar is required")
+	}
+
+	var err error
+	if e.Offset != "" {
+		if s.offset, err = time.ParseDuration(e.Offset); err != nil {
+			return nil, fmt.Errorf("offset %q is not a duration", e.Offset)
+		}
+		if s.offset < -12*time.Hour || s.offset > 12*time.Hour {
+			return nil, errors.New("offset must be within 12h")
+		}
+	}
+	if e.Jitter != "" {
+		if s.jitter, err = time.ParseDuration(e.Jitter); err != nil {
+			return nil, fmt.Errorf("jitter %q is not a duration", e.Jitter)
+		}
+		if s.jitter < 0 || s.jitter > maxScheduleJitter {
+			return nil, fmt.Errorf("jitter must be between 0 and %s", maxScheduleJitter)
+		}
+	}
+
+	if e.Power != powerOn && e.Power != powerOff {
+		return nil, fmt.Errorf("power must be %q or %q, not %q", powerOn, powerOff, e.Power)
+	}
+	if e.Brightness != nil && (*e.Brightness < 0 || *e.Brightness > 100) {
+		return nil, fmt.Errorf("brightness must be between 0 and 100, not %d", *e.Brightness)
+	}
+	if e.TransitionMS < 0 || e.TransitionMS > maxTransitionMS {
+		return nil, fmt.Errorf("transition_ms must be between 0 and %d, not %d", maxTransitionMS, e.TransitionMS)
+	}
+	return s, nil
+}
+
+// scheduleTimes gives the times a schedule runs at. cronSpec and solarEvent
+// provide it.
+type scheduleTimes interface {
+	Next(after time.Time) time.Time
+}
+
+// schedule is an entry with its next run worked out. base is the time the
+// cron expression or solar event gives, fire is when it will actually run
+// after the offset and jitter.
+type schedule struct {
+	entry  scheduleEntry
+	when   scheduleTimes
+	offset time.Duration
+	jitter time.Duration
+
+	base time.Time
+	fire time.Time
+}
+
+// plan works out the first run after after. fire is left zero if the
+// schedule never runs again.
+func (s *schedule) plan(after time.Time, rnd *rand.Rand) {
+	s.base = s.when.Next(after.Add(-s.offset))
+	s.fire = time.Time{}
+	if s.base.IsZero() {
+		return
+	}
+	s.fire = s.base.Add(s.offset)
+	if s.jitter > 0 {
+		s.fire = s.fire.Add(time.Duration(rnd.Int63n(int64(s.jitter))))
+	}
+}
+
+// scheduleFile is how schedules are kept on disk between restarts.
+type scheduleFile struct {
+	Version   int64           `json:"version"`
+	Schedules []scheduleEntry `json:"schedules"`
+}
+
+// scheduler changes the light at the times its schedules give. It works from
+// the device's own clock and location, so it carries on while the device is
+// offline.
+type scheduler struct {
+	light     *light
+	path      string
+	location  *time.Location
+	latitude  float64
+	longitude float64
+	clock     clock
+	rand      *rand.Rand
+	onError   func(error)
+
+	wake chan struct{}
+
+	mu        sync.Mutex
+	version   int64
+	entries   []scheduleEntry
+	schedules []*schedule
+}
+
+func newScheduler(l *light, path string, loc *time.Location, latitude, longitude float64, clk clock, rnd *rand.Rand, onError func(error)) *scheduler {
+	return &scheduler{
+		light:     l,
+		path:      path,
+		location:  loc,
+		latitude:  latitude,
+		longitude: longitude,
+		clock:     clk,
+		rand:      rnd,
+		onError:   onError,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Load restores the schedules saved by an earlier run. A missing file is not
+// an error.
+func (s *scheduler) Load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var f scheduleFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %s", s.path, err)
+	}
+	schedules, err := s.build(f.Schedules)
+	if err != nil {
+		return fmt.Errorf("%s: %s", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.version, s.entries, s.schedules = f.Version, f.Schedules, schedules
+	s.mu.Unlock()
+	s.Wake()
+	return nil
+}
+
+// Set replaces the schedules with the ones from config version. Versions at
+// or below the current one are ignored, so a config sent again does not
+// reset the schedules.
+func (s *scheduler) Set(version int64, entries []scheduleEntry) error {
+	schedules, err := s.build(entries)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version <= s.version {
+		return nil
+	}
+	b, err := json.MarshalIndent(scheduleFile{version, entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, b, 0600); err != nil {
+		return fmt.Errorf("saving schedules: %s", err)
+	}
+
+	s.version, s.entries, s.schedules = version, entries, schedules
+	s.Wake()
+	return nil
+}
+
+func (s *scheduler) build(entries []scheduleEntry) ([]*schedule, error) {
+	var schedules []*schedule
+	for i, e := range entries {
+		if e.Solar != "" && s.latitude == 0 && s.longitude == 0 {
+			return nil, fmt.Errorf("schedules[%d]: solar schedules need location.latitude and location.longitude", i)
+		}
+		sc, err := e.build(s.latitude, s.longitude)
+		if err != nil {
+			return nil, fmt.Errorf("schedules[%d]: %s", i, err)
+		}
+		schedules = append(schedules, sc)
+	}
+	return schedules, nil
+}
+
+// Wake asks the scheduler to look at its schedules again. It never blocks.
+func (s *scheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Next returns the name and time of the next run, or a zero time if nothing
+// is planned.
+func (s *scheduler) Next() (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var name string
+	var next time.Time
+	for _, sc := range s.schedules {
+		if !sc.fire.IsZero() && (next.IsZero() || sc.fire.Before(next)) {
+			name, next = sc.entry.Name, sc.fire
+		}
+	}
+	return name, next
+}
+
+// Run applies schedules as they come due until stop is closed.
+func (s *scheduler) Run(stop <-chan struct{}) {
+	for {
+		wait := s.step()
+
+		select {
+		case <-stop:
+			return
+		case <-s.wake:
+		case <-s.clock.After(wait):
+		}
+	}
+}
+
+// step runs the schedules that are due and returns how long to wait before
+// looking again.
+func (s *scheduler) step() time.Duration {
+	now := s.clock.Now().In(s.location)
+
+	s.mu.Lock()
+	var due []*schedule
+	wait := scheduleTick
+	for _, sc := range s.schedules {
+		if sc.base.IsZero() {
+			sc.plan(now, s.rand)
+		}
+		if sc.fire.IsZero() {
+			continue
+		}
+
+		if !now.Before(sc.fire) {
+			if late := now.Sub(sc.fire); late <= scheduleGrace {
+				due = append(due, sc)
+				sc.plan(sc.base.Add(sc.offset), s.rand)
+			} else {
+				fmt.Printf("schedule %q: skipping the run due at %s, the clock is %s ahead of it\n", sc.entry.Name, sc.fire.Format(time.RFC3339), late.Round(time.Second))
+				sc.plan(now, s.rand)
+			}
+		}
+		if d := sc.fire.Sub(now); !sc.fire.IsZero() && d < wait {
+			wait = d
+		}
+	}
+	entries := make([]scheduleEntry, len(due))
+	sort.SliceStable(due, func(i, j int) bool { return due[i].base.Before(due[j].base) })
+	for i, sc := range due {
+		entries[i] = sc.entry
+	}
+	s.mu.Unlock()
+
+	for _, e := range entries {
+		fmt.Printf("schedule %q: setting the light %s\n", e.Name, e.Power)
+		if err := s.light.Schedule(e); err != nil {
+			s.onError(fmt.Errorf("schedule %q: %s", e.Name, err))
+		}
+	}
+	return wait
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testLight is a light on a recording LED, driven by clk.
+func testLight(clk clock) (*light, *recordingLED) {
+	led := &recordingLED{}
+	return newLight(newFader(led, defaultGamma, clk, func(error) {}), clk, conflictPolicy{}), led
+}
+
+// runSchedulesUntil steps s, moving clk on by however long it asks to wait,
+// until clk reaches end. It returns the times, in loc, that the light was
+// changed with the power it was set to.
+func runSchedulesUntil(t *testing.T, s *scheduler, l *light, clk *fakeClock, end time.Time, loc *time.Location) []string {
+	t.Helper()
+	var runs []string
+	for {
+		var changed bool
+		l.OnChange = func() { changed = true }
+		wait := s.step()
+		if changed {
+			c, _ := l.Current()
+			runs = append(runs, clk.Now().In(loc).Format("2006-01-02 15:04 MST ")+c.Power)
+		}
+		if !clk.Now().Add(wait).Before(end) {
+			return runs
+		}
+		clk.Advance(wait)
+	}
+}
+
+func TestScheduleAcrossDaylightSaving(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("no time zone data: %s", err)
+	}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	cases := []struct {
+		name  string
+		start time.Time
+		want  []string
+	}{
+		{
+			// The clocks go forward from 01:00 to 02:00, so 01:30 never
+			// happens and the schedule runs as soon as the gap is over.
+			"spring forward",
+			time.Date(2026, 3, 28, 22, 0, 0, 0, time.UTC),
+			[]string{
+				"2026-03-28 23:00 GMT off",
+				"2026-03-29 02:00 BST on",
+				"2026-03-29 23:00 BST off",
+				"2026-03-30 01:30 BST on",
+			},
+		},
+		{
+			// The clocks go back from 02:00 to 01:00, so 01:30 happens
+			// twice and the schedule runs only the first time. The
+			// scheduler must not see the second 01:30 as a new run.
+			"fall back",
+			time.Date(2026, 10, 24, 21, 0, 0, 0, time.UTC),
+			[]string{
+				"2026-10-24 23:00 BST off",
+				"2026-10-25 01:30 BST on",
+				"2026-10-25 23:00 GMT off",
+				"2026-10-26 01:30 GMT on",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		clk := newFakeClock(c.start)
+		l, _ := testLight(clk)
+		s := newScheduler(l, filepath.Join(dir, c.name+".json"), london, 0, 0, clk, rand.New(rand.NewSource(1)), func(err error) { t.Error(err) })
+		err := s.Set(1, []scheduleEntry{
+			{Name: "night", Cron: "0 23 * * *", Power: powerOff},
+			{Name: "early", Cron: "30 1 * * *", Power: powerOn},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := runSchedulesUntil(t, s, l, clk, c.start.Add(29*time.Hour), london)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: ran at %q, want %q", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: run %d at %s, want %s", c.name, i, got[i], c.want[i])
+			}
+		}
+	}
+}
+
+func TestCronNextAcrossDaylightSaving(t *testing.T) {
+	// time.Date settles skipped and repeated times differently in zones
+	// east and west of Greenwich; Next must not.
+	cases := []struct {
+		zone  string
+		cron  string
+		after string
+		want  string
+	}{
+		{"Europe/London", "30 1 * * *", "2026-03-29 00:00", "2026-03-29 02:00 BST"},
+		{"Europe/London", "30 1 * * *", "2026-10-25 00:00", "2026-10-25 01:30 BST"},
+		{"America/New_York", "30 2 * * *", "2026-03-08 00:00", "2026-03-08 03:00 EDT"},
+		{"America/New_York", "30 1 * * *", "2026-11-01 00:00", "2026-11-01 01:30 EDT"},
+		{"Australia/Sydney", "30 2 * * *", "2026-10-04 00:00", "2026-10-04 03:00 AEDT"},
+		{"Australia/Sydney", "30 2 * * *", "2026-04-05 00:00", "2026-04-05 02:30 AEDT"},
+	}
+	for _, c := range cases {
+		loc, err := time.LoadLocation(c.zone)
+		if err != nil {
+			t.Skipf("no time zone data: %s", err)
+		}
+		spec, err := parseCron(c.cron)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, _ := time.ParseInLocation("2006-01-02 15:04", c.after, loc)
+		first := spec.Next(after)
+		if got := first.Format("2006-01-02 15:04 MST"); got != c.want {
+			t.Errorf("%s: %s next after %s is %s, want %s", c.zone, c.cron, c.after, got, c.want)
+		}
+		// The next run is the following day, not the repeat.
+		if next := spec.Next(first); next.Sub(first) < 22*time.Hour {
+			t.Errorf("%s: %s runs again at %s", c.zone, c.cron, next.Format("2006-01-02 15:04 MST"))
+		}
+	}
+}
+
+func TestScheduleSkipsRunsMissedByClockJump(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	clk := newFakeClock(time.Date(2026, 6, 1, 6, 0, 0, 0, time.UTC))
+	l, _ := testLight(clk)
+	s := newScheduler(l, filepath.Join(dir, "schedules.json"), time.UTC, 0, 0, clk, rand.New(rand.NewSource(1)), func(err error) { t.Error(err) })
+	if err := s.Set(1, []scheduleEntry{{Name: "morning", Cron: "0 7 * * *", Power: powerOn}}); err != nil {
+		t.Fatal(err)
+	}
+	s.step()
+
+	// NTP moves the clock on to the afternoon.
+	clk.Set(time.Date(2026, 6, 1, 15, 0, 0, 0, time.UTC))
+	s.step()
+	if c, _ := l.Current(); c.Power != powerOff {
+		t.Error("a run missed by hours was made up")
+	}
+	if _, next := s.Next(); !next.Equal(time.Date(2026, 6, 2, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("next run is %s, want tomorrow at 07:00", next)
+	}
+
+	// A config sent again does not reset the schedules.
+	if err := s.Set(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := s.Next(); name != "morning" {
+		t.Errorf("a resent config replaced the schedules")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state such as "READY=1" to systemd's notify socket. It
+// does nothing when the client was not started by systemd with one.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval is how often systemd's watchdog wants to hear from this
+// process, half its WatchdogSec, or 0 when it is not watching.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// feedWatchdog tells systemd's watchdog the client is alive every interval,
+// but only while healthy says so, along with a status line. Once it stops,
+// systemd restarts the service when WatchdogSec runs out.
+func feedWatchdog(interval time.Duration, healthy func() (bool, string), clk clock, stop <-chan struct{}) {
+	for {
+		state := "STATUS="
+		ok, status := healthy()
+		if ok {
+			state = "WATCHDOG=1\n" + state
+		}
+		if err := sdNotify(state + status); err != nil {
+			fmt.Printf("watchdog: %s\n", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-clk.After(interval):
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/drivers/i2c"
+	"gobot.io/x/gobot/drivers/spi"
+)
+
+const (
+	defaultSensorInterval = time.Minute
+
+	// The buses the raspi adaptor uses for sensors that do not name one.
+	raspiI2CBus  = 1
+	raspiSPIBus  = 0
+	raspiSPIChip = 0
+)
+
+// sensorConfig declares one sensor in a [[sensor]] table of the config file:
+//
+//	[[sensor]]
+//	name = "living-room"
+//	driver = "bme280"
+//	bus = 1
+//	address = "0x76"
+//	interval = "30s"
+//	units = "metric"
+type sensorConfig struct {
+	Name     string
+	Driver   string
+	Bus      int
+	Address  int
+	Chip     int
+	Channel  int
+	Interval time.Duration
+	Units    string
+
+	// Scale multiplies raw ADC counts. Unit names the result.
+	Scale float64
+	Unit  string
+}
+
+func parseSensorConfig(table map[string]fileValue) (sensorConfig, []error) {
+	s := sensorConfig{
+		Bus:      -1,
+		Address:  -1,
+		Chip:     -1,
+		Interval: defaultSensorInterval,
+		Units:    "metric",
+		Scale:    1,
+	}
+
+	var errs []error
+	fail := func(v fileValue, key string, err error) {
+		errs = append(errs, fmt.Errorf("line %d: %s: %s", v.line, key, err))
+	}
+	parseInt := func(v fileValue, key string, dst *int) {
+		n, err := strconv.ParseInt(v.value, 0, 0)
+		if err != nil {
+			fail(v, key, fmt.Errorf("%q is not an integer", v.value))
+			return
+		}
+		*dst = int(n)
+	}
+
+	for key, v := range table {
+		switch key {
+		case "name":
+			s.Name = v.value
+		case "driver":
+			s.Driver = strings.ToLower(v.value)
+		case "bus":
+			parseInt(v, key, &s.Bus)
+		case "address":
+			parseInt(v, key, &s.Address)
+		case "chip":
+			parseInt(v, key, &s.Chip)
+		case "channel":
+			parseInt(v, key, &s.Channel)
+		case "interval":
+			d, err := time.ParseDuration(v.value)
+			if err != nil {
+				fail(v, key, fmt.Errorf("%q is not a duration", v.value))
+				continue
+			}
+			s.Interval = d
+		case "units":
+			s.Units = v.value
+		case "scale":
+			f, err := strconv.ParseFloat(v.value, 64)
+			if err != nil {
+				fail(v, key, fmt.Errorf("%q is not a number", v.value))
+				continue
+			}
+			s.Scale = f
+		case "unit":
+			s.Unit = v.value
+		default:
+			fail(v, key, fmt.Errorf("unknown sensor setting"))
+		}
+	}
+	return s, errs
+}
+
+func (s *sensorConfig) validate() []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("sensor %q: "+format, append([]interface{}{s.Name}, args...)...))
+	}
+
+	if s.Name == "" {
+		fail("name is required")
+	}
+	if _, ok := sensorDrivers[s.Driver]; !ok {
+		fail("driver must be one of %s, not %q", strings.Join(sensorDriverNames(), ", "), s.Driver)
+	}
+	if s.Interval < time.Second {
+		fail("interval must be at least 1s, not %s", s.Interval)
+	}
+	if s.Units != "metric" && s.Units != "imperial" {
+		fail("units must be \"metric\" or \"imperial\", not %q", s.Units)
+	}
+	if s.Address > 0x7f {
+		fail("address 0x%x is not a 7-bit i2c address", s.Address)
+	}
+	if s.Channel < 0 || s.Channel > 7 {
+		fail("channel must be between 0 and 7, not %d", s.Channel)
+	}
+	return errs
+}
+
+// reading is one measured quantity.
+type reading struct {
+	Quantity string  `json:"quantity"`
+	Value    float64 `json:"value"`
+	Unit     string  `json:"unit"`
+}
+
+// sensor is a started driver that can be sampled.
+type sensor interface {
+	Start() error
+	Read() ([]reading, error)
+}
+
+// sensorBus is what sensors are attached to. The raspi adaptor provides both
+// buses.
+type sensorBus interface {
+	i2c.Connector
+	spi.Connector
+}
+
+func i2cOptions(s sensorConfig) []func(i2c.Config) {
+	var opts []func(i2c.Config)
+	if s.Bus >= 0 {
+		opts = append(opts, i2c.WithBus(s.Bus))
+	}
+	if s.Address >= 0 {
+		opts = append(opts, i2c.WithAddress(s.Address))
+	}
+	return opts
+}
+
+func spiOptions(s sensorConfig) []func(spi.Config) {
+	var opts []func(spi.Config)
+	if s.Bus >= 0 {
+		opts = append(opts, spi.WithBus(s.Bus))
+	}
+	if s.Chip >= 0 {
+		opts = append(opts, spi.WithChip(s.Chip))
+	}
+	return opts
+}
+
+// sensorDrivers builds each supported driver onto a bus.
+var sensorDrivers = map[string]func(s sensorConfig, bus sensorBus) sensor{
+	"bme280": func(s sensorConfig, bus sensorBus) sensor {
+		return &bme280Sensor{i2c.NewBME280Driver(bus, i2cOptions(s)...), s.Units}
+	},
+	"bmp280": func(s sensorConfig, bus sensorBus) sensor {
+		return &bmp280Sensor{i2c.NewBMP280Driver(bus, i2cOptions(s)...), s.Units}
+	},
+	"sht3x": func(s sensorConfig, bus sensorBus) sensor {
+		return &sht3xSensor{i2c.NewSHT3xDriver(bus, i2cOptions(s)...), s.Units}
+	},
+	"bh1750": func(s sensorConfig, bus sensorBus) sensor {
+		return &bh1750Sensor{i2c.NewBH1750Driver(bus, i2cOptions(s)...)}
+	},
+	"tsl2561": func(s sensorConfig, bus sensorBus) sensor {
+		return &tsl2561Sensor{i2c.NewTSL2561Driver(bus, i2cOptions(s)...)}
+	},
+	"ccs811": func(s sensorConfig, bus sensorBus) sensor {
+		return &ccs811Sensor{i2c.NewCCS811Driver(bus, i2cOptions(s)...)}
+	},
+	"mcp3002": func(s sensorConfig, bus sensorBus) sensor {
+		return &adcSensor{spi.NewMCP3002Driver(bus, spiOptions(s)...), s}
+	},
+	"mcp3004": func(s sensorConfig, bus sensorBus) sensor {
+		return &adcSensor{spi.NewMCP3004Driver(bus, spiOptions(s)...), s}
+	},
+	"mcp3008": func(s sensorConfig, bus sensorBus) sensor {
+		return &adcSensor{spi.NewMCP3008Driver(bus, spiOptions(s)...), s}
+	},
+}
+
+// spiSensor reports whether a sensor driver talks SPI rather than I2C, as the
+// MCP300x ADCs do.
+func spiSensor(driver string) bool {
+	return strings.HasPrefix(driver, "mcp300")
+}
+
+func sensorDriverNames() []string {
+	var names []string
+	for name := range sensorDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func temperature(celsius float32, units string) reading {
+	if units == "imperial" {
+		return reading{"temperature", float64(celsius)*9/5 + 32, "F"}
+	}
+	return reading{"temperature", float64(celsius), "C"}
+}
+
+func pressure(pascals float32, units string) reading {
+	if units == "imperial" {
+		return reading{"pressure", float64(pascals) / 3386.389, "inHg"}
+	}
+	return reading{"pressure", float64(pascals) / 100, "hPa"}
+}
+
+type bme280Sensor struct {
+	*i2c.BME280Driver
+	units string
+}
+
+func (s *bme280Sensor) Read() ([]reading, error) {
+	t, err := s.Temperature()
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.Pressure()
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.Humidity()
+	if err != nil {
+		return nil, err
+	}
+	return []reading{temperature(t, s.units), pressure(p, s.units), {"humidity", float64(h), "%"}}, nil
+}
+
+type bmp280Sensor struct {
+	*i2c.BMP280Driver
+	units string
+}
+
+func (s *bmp280Sensor) Read() ([]reading, error) {
+	t, err := s.Temperature()
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.Pressure()
+	if err != nil {
+		return nil, err
+	}
+	return []reading{temperature(t, s.units), pressure(p, s.units)}, nil
+}
+
+type sht3xSensor struct {
+	*i2c.SHT3xDriver
+	units string
+}
+
+func (s *sht3xSensor) Read() ([]reading, error) {
+	t, h, err := s.Sample()
+	if err != nil {
+		return nil, err
+	}
+	return []reading{temperature(t, s.units), {"humidity", float64(h), "%"}}, nil
+}
+
+type bh1750Sensor struct {
+	*i2c.BH1750Driver
+}
+
+func (s *bh1750Sensor) Read() ([]reading, error) {
+	lux, err := s.Lux()
+	if err != nil {
+		return nil, err
+	}
+	return []reading{{"illuminance", float64(lux), "lx"}}, nil
+}
+
+type tsl2561Sensor struct {
+	*i2c.TSL2561Driver
+}
+
+func (s *tsl2561Sensor) Read() ([]reading, error) {
+	broadband, ir, err := s.GetLuminocity()
+	if err != nil {
+		return nil, err
+	}
+	return []reading{{"illuminance", float64(s.CalculateLux(broadband, ir)), "lx"}}, nil
+}
+
+type ccs811Sensor struct {
+	*i2c.CCS811Driver
+}
+
+func (s *ccs811Sensor) Read() ([]reading, error) {
+	ready, err := s.HasData()
+	if err != nil {
+		return nil, err
+	}
+	if !ready {
+		return nil, nil
+	}
+	eco2, tvoc, err := s.GetGasData()
+	if err != nil {
+		return nil, err
+	}
+	return []reading{{"eco2", float64(eco2), "ppm"}, {"tvoc", float64(tvoc), "ppb"}}, nil
+}
+
+// adcDriver is the part of the MCP300x drivers used here.
+type adcDriver interface {
+	Start() error
+	Read(channel int) (int, error)
+}
+
+type adcSensor struct {
+	adcDriver
+	config sensorConfig
+}
+
+func (s *adcSensor) Read() ([]reading, error) {
+	counts, err := s.adcDriver.Read(s.config.Channel)
+	if err != nil {
+		return nil, err
+	}
+	unit := s.config.Unit
+	if unit == "" {
+		unit = "counts"
+	}
+	return []reading{{"analog", float64(counts) * s.config.Scale, unit}}, nil
+}
+
+// telemetryEvent is published on the events topic for every sample.
+type telemetryEvent struct {
+	Type      string    `json:"type"`
+	Sensor    string    `json:"sensor"`
+	Driver    string    `json:"driver"`
+	Readings  []reading `json:"readings"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// sensorPoller samples every configured sensor on its own interval and
+// publishes the readings. A sensor that fails to start or read is retried on
+// its next interval without affecting the others.
+type sensorPoller struct {
+	pub     publisher
+	topic   string
+	clock   clock
+	onError func(error)
+
+	// OnReading, when set, is called with every successful sample.
+	OnReading func(event telemetryEvent)
+
+	sensors []polledSensor
+}
+
+type polledSensor struct {
+	config sensorConfig
+	sensor sensor
+}
+
+func newSensorPoller(pub publisher, topic string, clk clock, onError func(error), configs []sensorConfig, bus sensorBus) *sensorPoller {
+	p := &sensorPoller{
+		pub:     pub,
+		topic:   topic,
+		clock:   clk,
+		onError: onError,
+	}
+	for _, s := range configs {
+		p.sensors = append(p.sensors, polledSensor{s, sensorDrivers[s.Driver](s, bus)})
+	}
+	return p
+}
+
+// Run polls until stop is closed.
+func (p *sensorPoller) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, s := range p.sensors {
+		wg.Add(1)
+		go func(s polledSensor) {
+			defer wg.Done()
+			p.poll(s, stop)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (p *sensorPoller) poll(s polledSensor, stop <-chan struct{}) {
+	started := false
+	for {
+		if !started {
+			if err := s.sensor.Start(); err != nil {
+				p.onError(fmt.Errorf("sensor %s: failed to start: %s", s.config.Name, err))
+			} else {
+				started = true
+			}
+		}
+
+		if started {
+			p.sample(s)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-p.clock.After(s.config.Interval):
+		}
+	}
+}
+
+func (p *sensorPoller) sample(s polledSensor) {
+	readings, err := s.sensor.Read()
+	if err != nil {
+		p.onError(fmt.Errorf("sensor %s: failed to read: %s", s.config.Name, err))
+		return
+	}
+	if len(readings) == 0 {
+		return
+	}
+
+	event := telemetryEvent{
+		Type:      "telemetry",
+		Sensor:    s.config.Name,
+		Driver:    s.config.Driver,
+		Readings:  readings,
+		Timestamp: p.clock.Now(),
+	}
+	if p.OnReading != nil {
+		p.OnReading(event)
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		p.onError(fmt.Errorf("sensor %s: failed to encode readings: %s", s.config.Name, err))
+		return
+	}
+	if err := p.pub.Publish(string(b), p.topic); err != nil {
+		p.onError(fmt.Errorf("sensor %s: failed to publish readings: %s", s.config.Name, err))
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sigurn/crc8"
+)
+
+var errFakePublish = errors.New("not connected")
+
+// recordingPublisher keeps everything published through it.
+type recordingPublisher struct {
+	mu       sync.Mutex
+	messages []publishedMessage
+	err      error
+}
+
+type publishedMessage struct {
+	topic, msg string
+}
+
+func (p *recordingPublisher) Publish(msg, topic string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, publishedMessage{topic, msg})
+	return nil
+}
+
+// Messages returns what has been published so far.
+func (p *recordingPublisher) Messages() []publishedMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]publishedMessage(nil), p.messages...)
+}
+
+// errorLog collects errors reported by background work.
+type errorLog struct {
+	mu   sync.Mutex
+	errs []string
+}
+
+func (l *errorLog) Add(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = append(l.errs, err.Error())
+}
+
+func (l *errorLog) Errors() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.errs...)
+}
+
+// seedSHT3x makes the fake sensor at address answer a measurement with the
+// raw temperature and humidity words, each followed by its CRC.
+func seedSHT3x(b *fakeBus, address int, temp, humidity uint16) {
+	table := crc8.MakeTable(crc8.Params{Poly: 0x31, Init: 0xff, Check: 0xf7, Name: "CRC-8/SENSIRON"})
+	word := func(v uint16) []byte {
+		w := []byte{byte(v >> 8), byte(v)}
+		return append(w, crc8.Checksum(w, table))
+	}
+	// The measure command is written to register 0x24 and the result read
+	// from the register after it.
+	b.Device(address).Set(0x25, append(word(temp), word(humidity)...)...)
+}
+
+func decodeTelemetry(t *testing.T, m publishedMessage) telemetryEvent {
+	t.Helper()
+	var e telemetryEvent
+	if err := json.Unmarshal([]byte(m.msg), &e); err != nil {
+		t.Fatalf("malformed telemetry %q: %s", m.msg, err)
+	}
+	return e
+}
+
+func readingOf(e telemetryEvent, quantity string) (reading, bool) {
+	for _, r := range e.Readings {
+		if r.Quantity == quantity {
+			return r, true
+		}
+	}
+	return reading{}, false
+}
+
+func near(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestSensorPipelineOnFakeBus(t *testing.T) {
+	bus := newFakeBus()
+	seedSHT3x(bus, 0x44, 0x6666, 0x8000)
+
+	configs := []sensorConfig{
+		{Name: "hall", Driver: "bme280", Bus: 1, Address: 0x76, Chip: -1, Interval: time.Minute, Units: "metric"},
+		{Name: "bath", Driver: "sht3x", Bus: 1, Address: 0x44, Chip: -1, Interval: 10 * time.Second, Units: "imperial"},
+	}
+	for _, c := range configs {
+		if errs := c.validate(); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+	}
+
+	clk := newFakeClock(time.Date(2026, 1, 10, 8, 0, 0, 0, time.UTC))
+	pub := &recordingPublisher{}
+	var errs errorLog
+	p := newSensorPoller(pub, "/devices/lamp/events", clk, errs.Add, configs, bus)
+	var observed []telemetryEvent
+	var mu sync.Mutex
+	p.OnReading = func(e telemetryEvent) {
+		mu.Lock()
+		observed = append(observed, e)
+		mu.Unlock()
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		p.Run(stop)
+		close(done)
+	}()
+	waitForWaiters(t, clk, 2)
+
+	got := map[string]telemetryEvent{}
+	for _, m := range pub.Messages() {
+		if m.topic != "/devices/lamp/events" {
+			t.Errorf("published to %s", m.topic)
+		}
+		e := decodeTelemetry(t, m)
+		got[e.Sensor] = e
+	}
+	if len(got) != 2 {
+		t.Fatalf("first round published %d sensors, want 2: %v", len(got), pub.Messages())
+	}
+
+	hall := got["hall"]
+	if temp, ok := readingOf(hall, "temperature"); !ok || !near(temp.Value, 25.08, 0.1) || temp.Unit != "C" {
+		t.Errorf("bme280 temperature is %+v, want about 25.08C", temp)
+	}
+	if p, ok := readingOf(hall, "pressure"); !ok || !near(p.Value, 1006.5, 1) || p.Unit != "hPa" {
+		t.Errorf("bme280 pressure is %+v, want about 1006.5hPa", p)
+	}
+	if !hall.Timestamp.Equal(clk.Now()) || hall.Type != "telemetry" || hall.Driver != "bme280" {
+		t.Errorf("bme280 event is %+v", hall)
+	}
+
+	bath := got["bath"]
+	if temp, ok := readingOf(bath, "temperature"); !ok || !near(temp.Value, 77, 0.1) || temp.Unit != "F" {
+		t.Errorf("sht3x temperature is %+v, want 77F", temp)
+	}
+	if h, ok := readingOf(bath, "humidity"); !ok || !near(h.Value, 50, 0.1) {
+		t.Errorf("sht3x humidity is %+v, want 50%%", h)
+	}
+
+	// A reading with a bad CRC is reported and not published, and the
+	// sensor is read again on its next interval.
+	bus.Device(0x44).Set(0x27, 0x00)
+	clk.Advance(10 * time.Second)
+	eventually(t, "the bad read to be reported", func() bool { return len(errs.Errors()) == 1 })
+	if e := errs.Errors()[0]; !strings.Contains(e, "sensor bath: failed to read") || !strings.Contains(e, "crc") {
+		t.Errorf("bad read reported as %q", e)
+	}
+	waitForWaiters(t, clk, 2)
+	if n := len(pub.Messages()); n != 2 {
+		t.Errorf("%d messages after the bad read, want 2", n)
+	}
+
+	seedSHT3x(bus, 0x44, 0x6666, 0x4000)
+	clk.Advance(10 * time.Second)
+	eventually(t, "the sensor to recover", func() bool { return len(pub.Messages()) == 3 })
+	if h, _ := readingOf(decodeTelemetry(t, pub.Messages()[2]), "humidity"); !near(h.Value, 25, 0.1) {
+		t.Errorf("humidity after recovering is %+v, want 25%%", h)
+	}
+
+	close(stop)
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if len(observed) != 3 {
+		t.Errorf("OnReading saw %d samples, want 3", len(observed))
+	}
+}
+
+func TestSensorPublishFailure(t *testing.T) {
+	bus := newFakeBus()
+	pub := &recordingPublisher{err: errFakePublish}
+	var errs errorLog
+	configs := []sensorConfig{{Name: "hall", Driver: "bmp280", Bus: 1, Address: 0x77, Chip: -1, Interval: time.Minute, Units: "metric"}}
+	p := newSensorPoller(pub, "events", newFakeClock(time.Now()), errs.Add, configs, bus)
+
+	s := p.sensors[0]
+	if err := s.sensor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p.sample(s)
+	if got := errs.Errors(); len(got) != 1 || !strings.Contains(got[0], "failed to publish readings") {
+		t.Errorf("publish failure reported as %v", got)
+	}
+}
+
+func TestParseSensorConfig(t *testing.T) {
+	s, errs := parseSensorConfig(map[string]fileValue{
+		"name":     {value: "desk", line: 3},
+		"driver":   {value: "MCP3008", line: 4},
+		"channel":  {value: "9", line: 5},
+		"interval": {value: "soon", line: 6},
+	})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "line 6: interval") {
+		t.Errorf("parse errors %v", errs)
+	}
+	if s.Driver != "mcp3008" {
+		t.Errorf("driver is %q", s.Driver)
+	}
+	if errs := s.validate(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "channel") {
+		t.Errorf("validate gave %v", errs)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// termios flags from asm-generic/termbits.h, which the syscall package does
+// not have for arm.
+const (
+	tcIGNBRK = 0x1
+	tcBRKINT = 0x2
+	tcPARMRK = 0x8
+	tcISTRIP = 0x20
+	tcINLCR  = 0x40
+	tcIGNCR  = 0x80
+	tcICRNL  = 0x100
+	tcIXON   = 0x400
+
+	tcOPOST = 0x1
+
+	tcCBAUD  = 0x100f
+	tcCSIZE  = 0x30
+	tcCS8    = 0x30
+	tcCSTOPB = 0x40
+	tcCREAD  = 0x80
+	tcPARENB = 0x100
+	tcCLOCAL = 0x800
+
+	tcISIG   = 0x1
+	tcICANON = 0x2
+	tcECHO   = 0x8
+	tcECHONL = 0x40
+	tcIEXTEN = 0x8000
+
+	tcVTIME = 5
+	tcVMIN  = 6
+)
+
+// serialBauds are the line speeds a serial port can be set to.
+var serialBauds = map[int64]uint32{
+	9600:   0xd,
+	19200:  0xe,
+	38400:  0xf,
+	57600:  0x1001,
+	115200: 0x1002,
+	230400: 0x1003,
+}
+
+// openSerial opens a serial port, or the slave side of a pseudo-terminal,
+// as a raw 8N1 line at baud.
+func openSerial(path string, baud int64) (*os.File, error) {
+	speed, ok := serialBauds[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := makeRaw(f, speed); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return f, nil
+}
+
+// makeRaw turns off all line editing, echo and translation, as cfmakeraw
+// does, and sets the speed.
+func makeRaw(f *os.File, speed uint32) error {
+	var t syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return err
+	}
+	t.Iflag &^= tcIGNBRK | tcBRKINT | tcPARMRK | tcISTRIP | tcINLCR | tcIGNCR | tcICRNL | tcIXON
+	t.Oflag &^= tcOPOST
+	t.Lflag &^= tcECHO | tcECHONL | tcICANON | tcISIG | tcIEXTEN
+	t.Cflag &^= tcCBAUD | tcCSIZE | tcCSTOPB | tcPARENB
+	t.Cflag |= tcCS8 | tcCREAD | tcCLOCAL | speed
+	t.Ispeed, t.Ospeed = speed, speed
+	t.Cc[tcVMIN], t.Cc[tcVTIME] = 1, 0
+	return ioctl(f, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+}
+
+// openPTY makes a pseudo-terminal pair with the slave side already raw, so
+// nothing written before the other end opens it is echoed back. The slave
+// must be kept open: reads of the master fail while no slave is.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			master.Close()
+		}
+	}()
+
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		return nil, nil, fmt.Errorf("unlocking the pty: %s", err)
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		return nil, nil, fmt.Errorf("naming the pty: %s", err)
+	}
+	slave, err = openSerial(fmt.Sprintf("/dev/pts/%d", n), 115200)
+	if err != nil {
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+func ioctl(f *os.File, req, arg uintptr) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
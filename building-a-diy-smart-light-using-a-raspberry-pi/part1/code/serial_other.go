@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+var serialBauds = map[int64]uint32{9600: 0, 19200: 0, 38400: 0, 57600: 0, 115200: 0, 230400: 0}
+
+func openSerial(path string, baud int64) (*os.File, error) {
+	return nil, fmt.Errorf("serial ports are not supported on %s", runtime.GOOS)
+}
+
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, fmt.Errorf("pseudo-terminals are not supported on %s", runtime.GOOS)
+}
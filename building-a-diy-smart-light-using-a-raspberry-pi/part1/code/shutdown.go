@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	sourceShutdown = "shutdown"
+
+	// Safe states the light can be left in when the client stops.
+	safeOff  = "off"
+	safeOn   = "on"
+	safeKeep = "keep"
+
+	defaultShutdownTimeout = 5 * time.Second
+
+	// Retained on the status topic. The broker publishes statusOffline as
+	// the client's will if the connection drops without a clean disconnect.
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// SafeState puts the light into the state it is left in when the client
+// stops: off, on at the current brightness, or kept as it is. Any fade still
+// running, or identify blinking, is stopped, so the output does not change
+// after this returns.
+func (l *light) SafeState(state string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if state == safeKeep {
+		if err := l.endIdentify(); err != nil {
+			return err
+		}
+		l.fader.Stop()
+		return nil
+	}
+	l.identifying = false
+	next := l.current
+	next.Power = state
+	next.TransitionMS = 0
+	if err := l.set(&next, sourceShutdown, l.clock.Now()); err != nil {
+		return err
+	}
+	if l.Strip != nil {
+		// The renderer has stopped, so draw the last frame here.
+		return l.Strip.Step()
+	}
+	return nil
+}
+
+// flushOutbox sends what is queued in box, giving up after timeout. Whatever
+// is left stays on disk for the next run. The queued publisher must have
+// stopped, so nothing else is draining box, and the drain has finished by the
+// time this returns, so box can be closed.
+func flushOutbox(box *outbox, c *client, timeout time.Duration) error {
+	if box.Len() == 0 {
+		return nil
+	}
+	if !c.IsConnected() {
+		return fmt.Errorf("not connected, %d messages left queued", box.Len())
+	}
+
+	cancel := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- box.Drain(publishUntil(cancel, c.Publish)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		// Let the message being sent finish.
+		close(cancel)
+		<-done
+		return fmt.Errorf("timed out after %s, %d messages left queued", timeout, box.Len())
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttTestClient connects a client for device lamp to the broker at addr.
+func mqttTestClient(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := newConnector(&config{Connector: "mqtt", Broker: "tcp://" + addr, DeviceID: "lamp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.connect(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func fillOutbox(t *testing.T, dir string, n int) *outbox {
+	t.Helper()
+	box, err := openOutbox(filepath.Join(dir, "outbox"), defaultOutboxMaxBytes, 0, dropOldest, realClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := box.Enqueue("/devices/lamp/events", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return box
+}
+
+func TestShutdownFlushSendsEachMessageOnce(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	b := startTestBroker(t)
+	defer b.Close()
+
+	var mu sync.Mutex
+	var got []string
+	err := b.Watch("/devices/lamp/events", func(_ string, payload []byte) {
+		mu.Lock()
+		got = append(got, string(payload))
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), got...)
+	}
+
+	const n = 200
+	box := fillOutbox(t, dir, n)
+	defer box.Close()
+	c := mqttTestClient(t, b.Addr())
+	defer c.Close()
+
+	// Stop the queued publisher part way through a drain, as Stop does,
+	// and flush what it left.
+	stop := make(chan struct{})
+	q := newQueuedPublisher(c, box, realClock{}, func(err error) { t.Error(err) })
+	go q.Run(stop)
+	q.Wake()
+	eventually(t, "the drain to start", func() bool { return len(received()) > 0 })
+	close(stop)
+	<-q.Done()
+
+	if err := flushOutbox(box, c, testWait); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "every message to arrive", func() bool { return len(received()) >= n })
+	time.Sleep(50 * time.Millisecond)
+
+	msgs := received()
+	if len(msgs) != n {
+		t.Fatalf("broker got %d messages, want %d", len(msgs), n)
+	}
+	for i, m := range msgs {
+		if m != strconv.Itoa(i) {
+			t.Fatalf("message %d is %s; sent twice or out of order", i, m)
+		}
+	}
+}
+
+func TestShutdownFlushTimeoutWaitsForDrain(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	r := startPasswordRecorder(t, 20*time.Millisecond)
+	defer r.Close()
+
+	const n = 100
+	box := fillOutbox(t, dir, n)
+	c := mqttTestClient(t, r.listener.Addr().String())
+	defer c.Close()
+
+	start := time.Now()
+	err := flushOutbox(box, c, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("flush gave %v, want a timeout", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("flush took %s to give up", took)
+	}
+
+	// The drain is over once flush returns, so nothing moves and the
+	// outbox can be closed and reopened with what was left.
+	left := box.Len()
+	if left == 0 || left == n {
+		t.Fatalf("%d of %d messages left queued", left, n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if box.Len() != left {
+		t.Fatalf("outbox went from %d to %d messages after the flush returned", left, box.Len())
+	}
+	if err := box.Close(); err != nil {
+		t.Fatal(err)
+	}
+	box, err = openOutbox(filepath.Join(dir, "outbox"), defaultOutboxMaxBytes, 0, dropOldest, realClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.Close()
+	if box.Len() != left {
+		t.Errorf("reopened outbox holds %d messages, want %d", box.Len(), left)
+	}
+	var first string
+	box.Drain(func(msg, _ string) error {
+		first = msg
+		return fmt.Errorf("stop")
+	})
+	if first != strconv.Itoa(n-left) {
+		t.Errorf("first message left is %s, want %d", first, n-left)
+	}
+}
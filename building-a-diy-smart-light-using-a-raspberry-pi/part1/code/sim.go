@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/drivers/gpio"
+	"gobot.io/x/gobot/drivers/i2c"
+	"gobot.io/x/gobot/drivers/spi"
+	"gobot.io/x/gobot/platforms/raspi"
+)
+
+const (
+	hardwareRaspi = "raspi"
+	hardwareSim   = "sim"
+
+	// maxSimTransitions is how many pin transitions the simulated adaptor
+	// keeps.
+	maxSimTransitions = 1000
+	// simViewInterval is the shortest time between two redraws of the view.
+	simViewInterval = 50 * time.Millisecond
+	simViewWidth    = 20
+)
+
+// hardware is everything a device needs from its adaptor. The raspi adaptor
+// and simAdaptor provide it.
+type hardware interface {
+	gobot.Connection
+	gpio.DigitalReader
+	gpio.DigitalWriter
+	gpio.PwmWriter
+	sensorBus
+}
+
+// newHardware returns the adaptor cfg asks for. view may be nil.
+func newHardware(cfg *config, view *simView) hardware {
+	if cfg.Hardware != hardwareSim {
+		return raspi.NewAdaptor()
+	}
+	s := newSimAdaptor(realClock{})
+	if cfg.SimView && view != nil {
+		s.View(view, cfg.DeviceID)
+	}
+	// The pin of an idle active low button reads high.
+	if cfg.ButtonPin != "" && cfg.ButtonActiveLow {
+		s.Set(cfg.ButtonPin, 1)
+	}
+	return s
+}
+
+// pinTransition is a change of an output pin seen by the simulated adaptor.
+// Kind is "digital" or "pwm"; digital values are 0 or 1 and pwm values 0 to
+// 255.
+type pinTransition struct {
+	Pin   string    `json:"pin"`
+	Kind  string    `json:"kind"`
+	Value int       `json:"value"`
+	At    time.Time `json:"at"`
+}
+
+// simAdaptor stands in for the Pi so the whole client runs on a machine
+// without one. Output pins are recorded as transitions with the time they
+// changed, input pins read whatever Set last gave them, i2c is a fakeBus and
+// spi an spiSink.
+type simAdaptor struct {
+	name  string
+	clock clock
+	bus   *fakeBus
+	spi   *spiSink
+
+	mu          sync.Mutex
+	outputs     map[string]pinTransition
+	inputs      map[string]int
+	transitions []pinTransition
+	view        *simView
+	label       string
+}
+
+func newSimAdaptor(clk clock) *simAdaptor {
+	s := &simAdaptor{
+		name:    gobot.DefaultName("Sim"),
+		clock:   clk,
+		bus:     newFakeBus(),
+		spi:     newSPISink(1),
+		outputs: map[string]pinTransition{},
+		inputs:  map[string]int{},
+	}
+	s.spi.onFrame = s.frame
+	return s
+}
+
+func (s *simAdaptor) Name() string     { return s.name }
+func (s *simAdaptor) SetName(n string) { s.name = n }
+func (s *simAdaptor) Connect() error   { return nil }
+func (s *simAdaptor) Finalize() error  { return nil }
+
+// View shows the adaptor's outputs on v under label.
+func (s *simAdaptor) View(v *simView, label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.view, s.label = v, label
+}
+
+func (s *simAdaptor) DigitalWrite(pin string, val byte) error {
+	s.record(pin, "digital", int(val))
+	return nil
+}
+
+func (s *simAdaptor) PwmWrite(pin string, val byte) error {
+	s.record(pin, "pwm", int(val))
+	return nil
+}
+
+func (s *simAdaptor) DigitalRead(pin string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inputs[pin], nil
+}
+
+// Set sets what an input pin reads, as a button or motion sensor would.
+func (s *simAdaptor) Set(pin string, val int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inputs[pin] = val
+}
+
+// Transitions returns the output changes kept, oldest first.
+func (s *simAdaptor) Transitions() []pinTransition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]pinTransition(nil), s.transitions...)
+}
+
+// Output returns the last value written to pin and whether it was written.
+func (s *simAdaptor) Output(pin string) (pinTransition, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.outputs[pin]
+	return t, ok
+}
+
+// record keeps a write to an output pin if it changed the pin.
+func (s *simAdaptor) record(pin, kind string, val int) {
+	s.mu.Lock()
+	last, ok := s.outputs[pin]
+	if ok && last.Kind == kind && last.Value == val {
+		s.mu.Unlock()
+		return
+	}
+	t := pinTransition{pin, kind, val, s.clock.Now()}
+	s.outputs[pin] = t
+	s.transitions = append(s.transitions, t)
+	if len(s.transitions) > maxSimTransitions {
+		s.transitions = s.transitions[len(s.transitions)-maxSimTransitions:]
+	}
+	view, label := s.view, s.label
+	s.mu.Unlock()
+
+	if view != nil {
+		level := val * 255
+		if kind == "pwm" {
+			level = val
+		}
+		view.Set(label, fmt.Sprintf("%s:%s %s %3d%%", label, pin, levelBar(level), (level*100+127)/255))
+	}
+}
+
+// frame shows an APA102 frame written to the spi bus.
+func (s *simAdaptor) frame(b []byte) {
+	s.mu.Lock()
+	view, label := s.view, s.label
+	s.mu.Unlock()
+	if view == nil {
+		return
+	}
+	if px := decodeAPA102(b, apa102Pixels(len(b))); px != nil {
+		view.Set(label, fmt.Sprintf("%s %s", label, pixelBar(px)))
+	}
+}
+
+func (s *simAdaptor) GetConnection(address int, bus int) (i2c.Connection, error) {
+	return s.bus.GetConnection(address, bus)
+}
+
+func (s *simAdaptor) GetDefaultBus() int {
+	return s.bus.GetDefaultBus()
+}
+
+func (s *simAdaptor) GetSpiConnection(busNum, chip, mode, bits int, maxSpeed int64) (spi.Connection, error) {
+	return s.spi.GetSpiConnection(busNum, chip, mode, bits, maxSpeed)
+}
+
+func (s *simAdaptor) GetSpiDefaultBus() int        { return s.spi.GetSpiDefaultBus() }
+func (s *simAdaptor) GetSpiDefaultChip() int       { return s.spi.GetSpiDefaultChip() }
+func (s *simAdaptor) GetSpiDefaultMode() int       { return s.spi.GetSpiDefaultMode() }
+func (s *simAdaptor) GetSpiDefaultBits() int       { return s.spi.GetSpiDefaultBits() }
+func (s *simAdaptor) GetSpiDefaultMaxSpeed() int64 { return s.spi.GetSpiDefaultMaxSpeed() }
+
+// apa102Pixels works out how many pixels an APA102 frame of n bytes is for:
+// a 4 byte start frame, 4 bytes a pixel and an end frame of half a byte a
+// pixel.
+func apa102Pixels(n int) int {
+	px := 0
+	for 4*(px+2)+(px+1)/2+1 <= n {
+		px++
+	}
+	return px
+}
+
+// levelBar draws a level from 0 to 255 as a bar.
+func levelBar(level int) string {
+	filled := (level*simViewWidth + 127) / 255
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", simViewWidth-filled) + "]"
+}
+
+// pixelBar draws pixels as colored blocks, sampling long strips down to the
+// view's width.
+func pixelBar(px []color.RGBA) string {
+	n := len(px)
+	if n > simViewWidth {
+		n = simViewWidth
+	}
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		p := px[i*len(px)/n]
+		fmt.Fprintf(&b, "\x1b[38;2;%d;%d;%dm█", p.R, p.G, p.B)
+	}
+	b.WriteString("\x1b[0m")
+	return b.String()
+}
+
+// simView is a "virtual LED": one terminal line, redrawn in place, showing
+// what every simulated light is doing. A log line written meanwhile lands on
+// the view's line, and the view is drawn again after it on the next change.
+type simView struct {
+	out io.Writer
+
+	mu      sync.Mutex
+	order   []string
+	cells   map[string]string
+	drawn   time.Time
+	pending bool
+}
+
+func newSimView(out io.Writer) *simView {
+	return &simView{out: out, cells: map[string]string{}}
+}
+
+// Set changes what is shown for name and redraws, at most every
+// simViewInterval; a change arriving sooner is drawn when the interval is up.
+func (v *simView) Set(name, text string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.cells[name]; !ok {
+		v.order = append(v.order, name)
+	}
+	v.cells[name] = text
+	if v.pending {
+		return
+	}
+	if wait := simViewInterval - time.Since(v.drawn); wait > 0 {
+		v.pending = true
+		time.AfterFunc(wait, func() {
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			v.pending = false
+			v.draw()
+		})
+		return
+	}
+	v.draw()
+}
+
+// Close ends the view's line so later output starts on a new one.
+func (v *simView) Close() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.drawn.IsZero() {
+		fmt.Fprintln(v.out)
+	}
+}
+
+// draw writes the line. v.mu must be held.
+func (v *simView) draw() {
+	cells := make([]string, len(v.order))
+	for i, name := range v.order {
+		cells[i] = v.cells[name]
+	}
+	fmt.Fprintf(v.out, "\r%s\x1b[K", strings.Join(cells, "  "))
+	v.drawn = time.Now()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// simBoard stands in for a microcontroller on a serial port. It speaks the
+// gateway protocol on the master side of a pseudo-terminal, and the gateway
+// opens the slave side like any serial port. Like a sketch would, it
+// announces itself, answers pings and reports each config it gets back as
+// its state.
+type simBoard struct {
+	id            string
+	master, slave *os.File
+
+	mu sync.Mutex
+}
+
+// simBoardState is the state a simulated board reports.
+type simBoardState struct {
+	Board     string          `json:"board"`
+	Config    json.RawMessage `json:"config,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+func startSimBoard(id string) (*simBoard, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	b := &simBoard{id: id, master: master, slave: slave}
+	go b.run()
+	return b, nil
+}
+
+// Path is the serial port to open to reach the board.
+func (b *simBoard) Path() string {
+	return b.slave.Name()
+}
+
+// Close unplugs the board.
+func (b *simBoard) Close() error {
+	b.slave.Close()
+	return b.master.Close()
+}
+
+func (b *simBoard) run() {
+	b.send(frameHello, []byte(b.id))
+	b.report(nil)
+
+	r := newFrameReader(b.master)
+	for {
+		typ, payload, err := r.Next()
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameHello:
+			b.send(frameHello, []byte(b.id))
+		case framePing:
+			b.send(framePong, nil)
+		case frameConfig:
+			if !json.Valid(payload) {
+				b.send(frameEvent, []byte(`{"type":"error","error":"config is not json"}`))
+				continue
+			}
+			b.report(payload)
+		}
+	}
+}
+
+func (b *simBoard) report(config json.RawMessage) {
+	state, _ := json.Marshal(simBoardState{b.id, config, time.Now()})
+	b.send(frameState, state)
+}
+
+func (b *simBoard) send(typ byte, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.master.Write(encodeFrame(typ, payload))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot"
+)
+
+// simConfig is the config of a simulated light named id talking to b, with
+// its files kept in dir.
+func simConfig(t *testing.T, b *broker, dir, id string, extra ...string) *config {
+	t.Helper()
+	args := append([]string{
+		"-hardware", "sim",
+		"-device-id", id,
+		"-led-pin", "12",
+		"-led-mode", "pwm",
+		"-connector", "mqtt",
+		"-broker", "tcp://" + b.Addr(),
+		"-schedule.file", filepath.Join(dir, id+"-schedules.json"),
+		"-rules.file", filepath.Join(dir, id+"-rules.json"),
+		"-outbox.dir", filepath.Join(dir, id+"-outbox"),
+		"-state.min-interval", "10ms",
+		"-location.timezone", "UTC",
+	}, extra...)
+	cfg, err := loadConfig("iot-client", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// simHardware returns the simulated adaptor a device is running on.
+func simHardware(t *testing.T, d *device) *simAdaptor {
+	t.Helper()
+	var s *simAdaptor
+	d.robot.Connections().Each(func(c gobot.Connection) {
+		if a, ok := c.(*simAdaptor); ok {
+			s = a
+		}
+	})
+	if s == nil {
+		t.Fatal("device is not running on the simulated adaptor")
+	}
+	return s
+}
+
+// waitForState reads state reports from ch until one satisfies ok.
+func waitForState(t *testing.T, ch <-chan string, what string, ok func(stateReport) bool) stateReport {
+	t.Helper()
+	deadline := time.After(testWait)
+	for {
+		select {
+		case msg := <-ch:
+			var s stateReport
+			if err := json.Unmarshal([]byte(msg), &s); err != nil {
+				t.Fatalf("malformed state report %q: %s", msg, err)
+			}
+			if ok(s) {
+				return s
+			}
+		case <-deadline:
+			t.Fatalf("no state report with %s within %s", what, testWait)
+		}
+	}
+}
+
+func TestSimLightThroughBroker(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	b := startTestBroker(t)
+	defer b.Close()
+	status := watchTopic(t, b, "/devices/lamp/status")
+	states := watchTopic(t, b, "/devices/lamp/state")
+
+	cfg := simConfig(t, b, dir, "lamp", "-button.pin", "16")
+	d, err := startDevice(cfg, &shared{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			d.Stop()
+		}
+	}()
+	sim := simHardware(t, d)
+
+	if got := receive(t, status, "online status"); got != statusOnline {
+		t.Fatalf("status is %q", got)
+	}
+	waitForState(t, states, "the light off", func(s stateReport) bool { return s.Power == powerOff })
+
+	// A config from the broker drives the pin.
+	b.Publish("/devices/lamp/config", []byte(`{"version": 3, "power": "on", "brightness": 50}`), true)
+	s := waitForState(t, states, "version 3 applied", func(s stateReport) bool { return s.AppliedVersion == 3 })
+	if s.Power != powerOn || s.Brightness != 50 || s.Source != sourceRemote || !s.LEDOn {
+		t.Errorf("after the config the state is %+v", s)
+	}
+	want := d.light.fader.corrected(0.5)
+	eventually(t, "the pin to be driven", func() bool {
+		out, ok := sim.Output("12")
+		return ok && out.Kind == "pwm" && out.Value == want
+	})
+
+	// The wall button toggles it off again and the change is reported.
+	sim.Set("16", 1)
+	s = waitForState(t, states, "the button press", func(s stateReport) bool { return s.Source == sourceLocal })
+	sim.Set("16", 0)
+	if s.Power != powerOff || s.AppliedVersion != 3 {
+		t.Errorf("after the button the state is %+v", s)
+	}
+	eventually(t, "the pin to go low", func() bool {
+		out, _ := sim.Output("12")
+		return out.Value == 0
+	})
+
+	// Under the default local-override policy a remote config straight
+	// after the press is held off.
+	b.Publish("/devices/lamp/config", []byte(`{"version": 4, "power": "on"}`), true)
+	time.Sleep(100 * time.Millisecond)
+	if c, v := d.light.Current(); c.Power != powerOff || v != 3 {
+		t.Errorf("config arriving during the override window applied: %s, version %d", c.Power, v)
+	}
+
+	var last pinTransition
+	for _, tr := range sim.Transitions() {
+		if tr.Pin == "12" {
+			last = tr
+		}
+	}
+	if last.Value != 0 {
+		t.Errorf("last transition of the light pin is %+v", last)
+	}
+
+	stopped = true
+	if err := d.Stop(); err != nil {
+		t.Errorf("stopping: %s", err)
+	}
+	for receive(t, status, "offline status") != statusOffline {
+	}
+}
+
+// openFiles returns how many files this process has open under dir, skipping
+// the test where that cannot be told.
+func openFiles(t *testing.T, dir string) int {
+	t.Helper()
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip(err)
+	}
+	n := 0
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.HasPrefix(target, dir+string(filepath.Separator)) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSimDeviceFailedStartClosesOutbox(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	b := startTestBroker(t)
+	defer b.Close()
+	outbox := filepath.Join(dir, "lamp-outbox")
+
+	// A filter with # in the middle is refused when subscribing, after the
+	// outbox has been opened.
+	cfg := simConfig(t, b, dir, "lamp", "-topics.config", "/devices/#/{device}/config")
+	if _, err := startDevice(cfg, &shared{}); err == nil {
+		t.Fatal("started with an invalid config topic")
+	}
+	if n := openFiles(t, outbox); n != 0 {
+		t.Errorf("%d outbox files left open", n)
+	}
+
+	d, err := startDevice(simConfig(t, b, dir, "lamp"), &shared{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := openFiles(t, outbox); n != 1 {
+		t.Errorf("%d outbox files open while running", n)
+	}
+	d.Stop()
+	if n := openFiles(t, outbox); n != 0 {
+		t.Errorf("%d outbox files left open after stopping", n)
+	}
+}
+
+func TestSimLightRunsWithoutBroker(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	b := startTestBroker(t)
+	cfg := simConfig(t, b, dir, "lamp", "-button.pin", "16")
+	b.Close()
+
+	// Nothing is listening, yet the light starts and answers its button.
+	d, err := startDevice(cfg, &shared{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	sim := simHardware(t, d)
+	if d.client.IsConnected() {
+		t.Fatal("connected to a closed broker")
+	}
+
+	sim.Set("16", 1)
+	eventually(t, "the button to turn the light on", func() bool {
+		out, _ := sim.Output("12")
+		return out.Value > 0
+	})
+	sim.Set("16", 0)
+	if c, _ := d.light.Current(); c.Power != powerOn {
+		t.Errorf("the light is %s", c.Power)
+	}
+
+	// Its reports wait in the outbox, and the broker check is degraded
+	// rather than failing.
+	eventually(t, "state reports to be queued", func() bool { return d.box.Len() > 0 })
+	if _, err := d.checkBroker(); err == nil {
+		t.Error("the broker check passed")
+	} else if _, ok := err.(degradedError); !ok {
+		t.Errorf("the broker check failed with %v", err)
+	}
+}
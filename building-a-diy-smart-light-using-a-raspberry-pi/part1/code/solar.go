@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Sun elevations, in degrees, at which the solar events happen. Sunrise and
+// sunset allow for refraction and the size of the sun's disc; dawn and dusk
+// are civil twilight.
+var solarEvents = map[string]float64{
+	"sunrise": -0.833,
+	"sunset":  -0.833,
+	"dawn":    -6,
+	"dusk":    -6,
+}
+
+func risingEvent(event string) bool {
+	return event == "sunrise" || event == "dawn"
+}
+
+// solarEvent is a schedule that follows the sun at a fixed place. It needs no
+// network: the times come from the NOAA sunrise equation, which is good to a
+// minute or so away from the poles.
+type solarEvent struct {
+	event     string
+	latitude  float64
+	longitude float64
+}
+
+// Next returns the first event after after, or the zero time if the sun does
+// not cross the event's elevation for a year, as near the poles.
+func (s solarEvent) Next(after time.Time) time.Time {
+	y, m, d := after.Date()
+	for day := -1; day <= 366; day++ {
+		t, ok := solarTime(time.Date(y, m, d+day, 12, 0, 0, 0, time.UTC), s.event, s.latitude, s.longitude)
+		if ok && t.After(after) {
+			return t.In(after.Location())
+		}
+	}
+	return time.Time{}
+}
+
+// solarTime returns when event happens around local solar noon of date's
+// day. ok is false when the sun stays above or below the event's elevation
+// all day.
+func solarTime(date time.Time, event string, latitude, longitude float64) (t time.Time, ok bool) {
+	const j2000 = 2451545.0
+
+	rad := math.Pi / 180
+	julian := float64(date.Unix())/86400 + 2440587.5
+	n := math.Floor(julian-j2000+0.5) + 0.0008
+
+	// Mean solar noon, solar mean anomaly and the equation of the center.
+	noon := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*noon, 360)
+	center := 1.9148*math.Sin(anomaly*rad) + 0.02*math.Sin(2*anomaly*rad) + 0.0003*math.Sin(3*anomaly*rad)
+
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := j2000 + noon + 0.0053*math.Sin(anomaly*rad) - 0.0069*math.Sin(2*ecliptic*rad)
+
+	declination := math.Asin(math.Sin(ecliptic*rad) * math.Sin(23.4397*rad))
+	cosHour := (math.Sin(solarEvents[event]*rad) - math.Sin(latitude*rad)*math.Sin(declination)) /
+		(math.Cos(latitude*rad) * math.Cos(declination))
+	if cosHour < -1 || cosHour > 1 {
+		return time.Time{}, false
+	}
+	hour := math.Acos(cosHour) / rad
+
+	j := transit + hour/360
+	if risingEvent(event) {
+		j = transit - hour/360
+	}
+	seconds := (j - 2440587.5) * 86400
+	return time.Unix(int64(math.Round(seconds)), 0).UTC(), true
+}
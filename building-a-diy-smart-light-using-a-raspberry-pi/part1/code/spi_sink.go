@@ -0,0 +1,95 @@
+package main
+
+import (
+	"image/color"
+	"sync"
+
+	"gobot.io/x/gobot/drivers/spi"
+)
+
+// spiSink is a software spi bus that keeps the last frames written to it, so
+// what a driver sends can be checked without hardware. Reads return zeros.
+type spiSink struct {
+	keep int
+	// onFrame, when set, is called with every frame written.
+	onFrame func([]byte)
+
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func newSPISink(keep int) *spiSink {
+	return &spiSink{keep: keep}
+}
+
+func (s *spiSink) GetSpiConnection(busNum, chip, mode, bits int, maxSpeed int64) (spi.Connection, error) {
+	return spiSinkConnection{s}, nil
+}
+
+func (s *spiSink) GetSpiDefaultBus() int        { return 0 }
+func (s *spiSink) GetSpiDefaultChip() int       { return 0 }
+func (s *spiSink) GetSpiDefaultMode() int       { return 0 }
+func (s *spiSink) GetSpiDefaultBits() int       { return 8 }
+func (s *spiSink) GetSpiDefaultMaxSpeed() int64 { return 500000 }
+
+// Frames returns the frames kept, oldest first.
+func (s *spiSink) Frames() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.frames...)
+}
+
+// Last returns the last frame written, or nil.
+func (s *spiSink) Last() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.frames) == 0 {
+		return nil
+	}
+	return s.frames[len(s.frames)-1]
+}
+
+func (s *spiSink) record(w []byte) {
+	frame := append([]byte(nil), w...)
+	s.mu.Lock()
+	s.frames = append(s.frames, frame)
+	if len(s.frames) > s.keep {
+		s.frames = s.frames[len(s.frames)-s.keep:]
+	}
+	s.mu.Unlock()
+
+	if s.onFrame != nil {
+		s.onFrame(frame)
+	}
+}
+
+type spiSinkConnection struct {
+	sink *spiSink
+}
+
+func (c spiSinkConnection) Close() error {
+	return nil
+}
+
+func (c spiSinkConnection) Tx(w, r []byte) error {
+	c.sink.record(w)
+	for i := range r {
+		r[i] = 0
+	}
+	return nil
+}
+
+// decodeAPA102 reads the pixel colors for n pixels back out of an APA102
+// frame. The alpha of each color holds the pixel's 5 bit global brightness.
+// It returns nil if the frame is too short.
+func decodeAPA102(frame []byte, n int) []color.RGBA {
+	if len(frame) < 4*(n+1) {
+		return nil
+	}
+	px := make([]color.RGBA, n)
+	for i := range px {
+		p := frame[4*(i+1):]
+		px[i] = color.RGBA{R: p[3], G: p[2], B: p[1], A: p[0] & 0x1f}
+	}
+	return px
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeartbeat        = 5 * time.Minute
+	defaultMinStateInterval = 2 * time.Second
+)
+
+// stateReport is the document the device publishes on its state topic.
+type stateReport struct {
+	AppliedVersion int64        `json:"applied_version"`
+	Power          string       `json:"power"`
+	Brightness     int          `json:"brightness"`
+	Color          string       `json:"color,omitempty"`
+	Effect         string       `json:"effect,omitempty"`
+	LEDOn          bool         `json:"led_on"`
+	Output         int          `json:"output"`
+	Source         string       `json:"source"`
+	ChangedAt      string       `json:"changed_at,omitempty"`
+	UptimeSeconds  int64        `json:"uptime_s"`
+	BuildVersion   string       `json:"build_version"`
+	LastError      string       `json:"last_error,omitempty"`
+	LastErrorAt    string       `json:"last_error_at,omitempty"`
+	Outbox         *outboxStats `json:"outbox,omitempty"`
+	NextSchedule   string       `json:"next_schedule,omitempty"`
+	NextScheduleAt string       `json:"next_schedule_at,omitempty"`
+	Timestamp      time.Time    `json:"timestamp"`
+}
+
+// publisher is the part of the client used to send messages.
+type publisher interface {
+	Publish(msg, topic string) error
+}
+
+// stateReporter publishes a state report after every change and on a
+// heartbeat. Changes that arrive faster than minInterval are coalesced, so
+// only the latest state is sent once the interval has passed.
+type stateReporter struct {
+	pub         publisher
+	topic       string
+	light       *light
+	clock       clock
+	heartbeat   time.Duration
+	minInterval time.Duration
+
+	started time.Time
+	changed chan struct{}
+
+	// Outbox, when set, is the queue whose metrics are reported.
+	Outbox *outbox
+	// Scheduler, when set, has its next run reported.
+	Scheduler *scheduler
+
+	mu          sync.Mutex
+	lastErr     error
+	lastErrAt   time.Time
+	lastPublish time.Time
+}
+
+func newStateReporter(pub publisher, topic string, l *light, clk clock, heartbeat, minInterval time.Duration) *stateReporter {
+	return &stateReporter{
+		pub:         pub,
+		topic:       topic,
+		light:       l,
+		clock:       clk,
+		heartbeat:   heartbeat,
+		minInterval: minInterval,
+		started:     clk.Now(),
+		changed:     make(chan struct{}, 1),
+	}
+}
+
+// Changed asks for a report to be sent. It never blocks.
+func (r *stateReporter) Changed() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Error records err as the last error and reports it.
+func (r *stateReporter) Error(err error) {
+	r.mu.Lock()
+	r.lastErr, r.lastErrAt = err, r.clock.Now()
+	r.mu.Unlock()
+	r.Changed()
+}
+
+// Run publishes reports until stop is closed.
+func (r *stateReporter) Run(stop <-chan struct{}) {
+	r.publish()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-r.clock.After(r.heartbeat):
+		case <-r.changed:
+			r.mu.Lock()
+			wait := r.lastPublish.Add(r.minInterval).Sub(r.clock.Now())
+			r.mu.Unlock()
+
+			if wait > 0 {
+				select {
+				case <-stop:
+					return
+				case <-r.clock.After(wait):
+				}
+			}
+
+			// Anything that changed while waiting is covered by this
+			// report.
+			select {
+			case <-r.changed:
+			default:
+			}
+		}
+
+		r.publish()
+	}
+}
+
+func (r *stateReporter) report() stateReport {
+	current, applied := r.light.Current()
+	now := r.clock.Now()
+
+	var effect string
+	if current.Effect != nil {
+		effect = current.Effect.Name
+	}
+
+	s := stateReport{
+		AppliedVersion: applied,
+		Power:          current.Power,
+		Brightness:     current.brightness(),
+		Color:          current.Color,
+		Effect:         effect,
+		LEDOn:          r.light.LEDOn(),
+		Output:         r.light.Output(),
+		UptimeSeconds:  int64(now.Sub(r.started) / time.Second),
+		BuildVersion:   version,
+		Timestamp:      now,
+	}
+
+	source, changedAt := r.light.Source()
+	s.Source = source
+	if !changedAt.IsZero() {
+		s.ChangedAt = changedAt.Format(time.RFC3339)
+	}
+
+	if r.Outbox != nil {
+		stats := r.Outbox.Stats()
+		s.Outbox = &stats
+	}
+	if r.Scheduler != nil {
+		if name, at := r.Scheduler.Next(); !at.IsZero() {
+			s.NextSchedule, s.NextScheduleAt = name, at.Format(time.RFC3339)
+		}
+	}
+
+	r.mu.Lock()
+	if r.lastErr != nil {
+		s.LastError = r.lastErr.Error()
+		s.LastErrorAt = r.lastErrAt.Format(time.RFC3339)
+	}
+	r.mu.Unlock()
+
+	return s
+}
+
+func (r *stateReporter) publish() {
+	b, err := json.Marshal(r.report())
+	if err != nil {
+		fmt.Printf("failed to encode state report: %s\n", err)
+		return
+	}
+
+	r.mu.Lock()
+	r.lastPublish = r.clock.Now()
+	r.mu.Unlock()
+
+	if err := r.pub.Publish(string(b), r.topic); err != nil {
+		fmt.Printf("failed to publish state report: %s\n", err)
+	}
+}
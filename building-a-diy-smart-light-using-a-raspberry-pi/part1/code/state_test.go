@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func stateReports(t *testing.T, pub *recordingPublisher) []stateReport {
+	t.Helper()
+	var reports []stateReport
+	for _, m := range pub.Messages() {
+		var s stateReport
+		if err := json.Unmarshal([]byte(m.msg), &s); err != nil {
+			t.Fatalf("malformed state report %q: %s", m.msg, err)
+		}
+		reports = append(reports, s)
+	}
+	return reports
+}
+
+func TestStateReporterTiming(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	clk := newFakeClock(start)
+	l, _ := testLight(clk)
+	pub := &recordingPublisher{}
+	r := newStateReporter(pub, "state", l, clk, time.Minute, 2*time.Second)
+	l.OnChange = r.Changed
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.Run(stop)
+		close(done)
+	}()
+	// published waits for n reports and for waiters timers to be pending,
+	// by which time the reporter is asleep again.
+	published := func(n, waiters int) {
+		t.Helper()
+		eventually(t, "a state report", func() bool { return len(pub.Messages()) >= n })
+		waitForWaiters(t, clk, waiters)
+	}
+
+	// A report goes out on start.
+	published(1, 1)
+
+	// Changes straight after it wait for the minimum interval and are sent
+	// as one report of the latest state.
+	for v := 1; v <= 3; v++ {
+		if err := l.Apply(&lightConfig{Version: int64(v), Power: powerOn}); err != nil {
+			t.Fatal(err)
+		}
+		if v == 1 {
+			waitForWaiters(t, clk, 2)
+		}
+	}
+	r.Error(errors.New("sensor missing"))
+	clk.Advance(time.Second)
+	if n := len(pub.Messages()); n != 1 {
+		t.Fatalf("%d reports inside the minimum interval", n)
+	}
+	clk.Advance(time.Second)
+	published(2, 2)
+
+	// Once the interval has passed a change is sent straight away.
+	clk.Advance(5 * time.Second)
+	if err := l.Toggle(); err != nil {
+		t.Fatal(err)
+	}
+	published(3, 3)
+
+	// With nothing changing a report goes out every heartbeat, counted
+	// from the last one.
+	clk.Advance(time.Minute)
+	published(4, 1)
+	clk.Advance(time.Minute)
+	published(5, 1)
+
+	close(stop)
+	<-done
+
+	reports := stateReports(t, pub)
+	want := []struct {
+		at      time.Duration
+		version int64
+		power   string
+		err     string
+	}{
+		{0, 0, powerOff, ""},
+		{2 * time.Second, 3, powerOn, "sensor missing"},
+		{7 * time.Second, 3, powerOff, "sensor missing"},
+		{67 * time.Second, 3, powerOff, "sensor missing"},
+		{127 * time.Second, 3, powerOff, "sensor missing"},
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("reports are %+v", reports)
+	}
+	for i, w := range want {
+		s := reports[i]
+		if !s.Timestamp.Equal(start.Add(w.at)) || s.AppliedVersion != w.version || s.Power != w.power || s.LastError != w.err {
+			t.Errorf("report %d is %+v, want %+v", i, s, w)
+		}
+		if s.UptimeSeconds != int64(w.at/time.Second) {
+			t.Errorf("report %d has uptime %ds", i, s.UptimeSeconds)
+		}
+	}
+	for _, m := range pub.Messages() {
+		if m.topic != "state" {
+			t.Errorf("report sent to %q", m.topic)
+		}
+	}
+}
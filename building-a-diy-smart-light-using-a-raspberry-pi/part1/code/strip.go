@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStripFPS = 30
+
+	defaultEffectSpeed   = 0.25
+	defaultChaseWidth    = 3
+	defaultTwinkleRate   = 0.2
+	maxEffectSpeed       = 10
+	maxEffectColors      = 16
+	maxChaseWidth        = 1024
+	twinkleDecayPerSec   = 3.0
+	twinkleSeed          = 1
+	stripGlobalIntensity = 31
+)
+
+// effectConfig picks what the strip shows, e.g.
+//
+//	{"name": "chase", "colors": ["#ff0000", "#000020"], "speed": 0.5, "width": 4}
+//
+// Speed is in cycles per second, width is the length of the chase in pixels
+// and density is how often each pixel twinkles per second. Zero or missing
+// values take the effect's defaults.
+type effectConfig struct {
+	Name    string   `json:"name"`
+	Colors  []string `json:"colors,omitempty"`
+	Speed   float64  `json:"speed,omitempty"`
+	Width   int      `json:"width,omitempty"`
+	Density float64  `json:"density,omitempty"`
+}
+
+func (e *effectConfig) validate() []string {
+	var problems []string
+	if _, ok := effects[e.Name]; !ok {
+		problems = append(problems, fmt.Sprintf("effect.name must be one of %s, not %q", effectNames(), e.Name))
+	}
+	if len(e.Colors) > maxEffectColors {
+		problems = append(problems, fmt.Sprintf("effect.colors can have at most %d entries", maxEffectColors))
+	}
+	for _, c := range e.Colors {
+		if !colorPattern.MatchString(c) {
+			problems = append(problems, fmt.Sprintf("effect.colors must look like #rrggbb, not %q", c))
+		}
+	}
+	if e.Speed < 0 || e.Speed > maxEffectSpeed {
+		problems = append(problems, fmt.Sprintf("effect.speed must be between 0 and %d, not %g", maxEffectSpeed, e.Speed))
+	}
+	if e.Width < 0 || e.Width > maxChaseWidth {
+		problems = append(problems, fmt.Sprintf("effect.width must be between 0 and %d, not %d", maxChaseWidth, e.Width))
+	}
+	if e.Density < 0 || e.Density > 1 {
+		problems = append(problems, fmt.Sprintf("effect.density must be between 0 and 1, not %g", e.Density))
+	}
+	return problems
+}
+
+// effectParams are the parsed effect settings with defaults filled in.
+type effectParams struct {
+	colors  []color.RGBA
+	speed   float64
+	width   int
+	density float64
+}
+
+// effect draws frames. Render is given the time since the effect started and
+// must fill every pixel.
+type effect interface {
+	Render(px []color.RGBA, t time.Duration)
+}
+
+var effects = map[string]func(p effectParams) effect{
+	"solid":    func(p effectParams) effect { return solidEffect{p} },
+	"gradient": func(p effectParams) effect { return gradientEffect{p} },
+	"rainbow":  func(p effectParams) effect { return rainbowEffect{p} },
+	"chase":    func(p effectParams) effect { return chaseEffect{p} },
+	"breathe":  func(p effectParams) effect { return breatheEffect{p} },
+	"twinkle": func(p effectParams) effect {
+		return &twinkleEffect{p: p, rand: rand.New(rand.NewSource(twinkleSeed))}
+	},
+}
+
+func effectNames() string {
+	var names []string
+	for name := range effects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+// newEffect builds the effect a config asks for. Without an effect the strip
+// shows the config's color, or white.
+func newEffect(c *lightConfig) effect {
+	e := effectConfig{Name: "solid"}
+	if c.Effect != nil {
+		e = *c.Effect
+	}
+	if len(e.Colors) == 0 {
+		e.Colors = []string{"#ffffff"}
+		if c.Color != "" {
+			e.Colors[0] = c.Color
+		}
+	}
+
+	p := effectParams{speed: e.Speed, width: e.Width, density: e.Density}
+	for _, s := range e.Colors {
+		p.colors = append(p.colors, parseColor(s))
+	}
+	if p.speed == 0 {
+		p.speed = defaultEffectSpeed
+	}
+	if p.width == 0 {
+		p.width = defaultChaseWidth
+	}
+	if p.density == 0 {
+		p.density = defaultTwinkleRate
+	}
+	return effects[e.Name](p)
+}
+
+// parseColor converts a validated #rrggbb string.
+func parseColor(s string) color.RGBA {
+	v, _ := strconv.ParseUint(s[1:], 16, 32)
+	return rgb(byte(v>>16), byte(v>>8), byte(v))
+}
+
+// phase returns how far through its cycle an effect is, from 0 to 1.
+func (p effectParams) phase(t time.Duration) float64 {
+	_, frac := math.Modf(t.Seconds() * p.speed)
+	return frac
+}
+
+func (p effectParams) color(i int) color.RGBA {
+	return p.colors[i%len(p.colors)]
+}
+
+type solidEffect struct{ p effectParams }
+
+func (e solidEffect) Render(px []color.RGBA, t time.Duration) {
+	for i := range px {
+		px[i] = e.p.colors[0]
+	}
+}
+
+// gradientEffect spreads the colors along the strip, scrolling it at speed.
+// A single color fades from it to black.
+type gradientEffect struct{ p effectParams }
+
+func (e gradientEffect) Render(px []color.RGBA, t time.Duration) {
+	stops := append([]color.RGBA(nil), e.p.colors...)
+	if len(stops) == 1 {
+		stops = append(stops, rgb(0, 0, 0))
+	}
+	// The gradient wraps round so it can scroll without a seam.
+	stops = append(stops, stops[0])
+
+	shift := e.p.phase(t)
+	for i := range px {
+		_, pos := math.Modf(float64(i)/float64(len(px)) + shift)
+		pos *= float64(len(stops) - 1)
+		k := int(pos)
+		px[i] = mix(stops[k], stops[k+1], pos-float64(k))
+	}
+}
+
+type rainbowEffect struct{ p effectParams }
+
+func (e rainbowEffect) Render(px []color.RGBA, t time.Duration) {
+	shift := e.p.phase(t)
+	for i := range px {
+		_, hue := math.Modf(float64(i)/float64(len(px)) + shift)
+		px[i] = hueColor(hue)
+	}
+}
+
+// chaseEffect runs a block of width pixels in the first color along a
+// background of the second color, or black, going round the strip at speed.
+type chaseEffect struct{ p effectParams }
+
+func (e chaseEffect) Render(px []color.RGBA, t time.Duration) {
+	background := rgb(0, 0, 0)
+	if len(e.p.colors) > 1 {
+		background = e.p.colors[1]
+	}
+	head := int(e.p.phase(t) * float64(len(px)))
+	for i := range px {
+		px[i] = background
+	}
+	for k := 0; k < e.p.width && k < len(px); k++ {
+		px[(head+k)%len(px)] = e.p.colors[0]
+	}
+}
+
+// breatheEffect pulses the colors in and out, moving to the next color each
+// cycle.
+type breatheEffect struct{ p effectParams }
+
+func (e breatheEffect) Render(px []color.RGBA, t time.Duration) {
+	cycle, frac := math.Modf(t.Seconds() * e.p.speed)
+	level := (1 - math.Cos(2*math.Pi*frac)) / 2
+	c := mix(rgb(0, 0, 0), e.p.color(int(cycle)), level)
+	for i := range px {
+		px[i] = c
+	}
+}
+
+// twinkleEffect lights random pixels in one of the colors and lets them fade
+// away. It uses a fixed seed and steps with the frames it is asked for, so
+// the same frame times always give the same frames.
+type twinkleEffect struct {
+	p      effectParams
+	rand   *rand.Rand
+	last   time.Duration
+	levels []float64
+	colors []color.RGBA
+}
+
+func (e *twinkleEffect) Render(px []color.RGBA, t time.Duration) {
+	if len(e.levels) != len(px) {
+		e.levels = make([]float64, len(px))
+		e.colors = make([]color.RGBA, len(px))
+	}
+
+	dt := (t - e.last).Seconds()
+	e.last = t
+	decay := math.Exp(-twinkleDecayPerSec * dt)
+	for i := range px {
+		e.levels[i] *= decay
+		if e.rand.Float64() < e.p.density*dt {
+			e.levels[i] = 1
+			e.colors[i] = e.p.color(e.rand.Intn(len(e.p.colors)))
+		}
+		px[i] = mix(rgb(0, 0, 0), e.colors[i], e.levels[i])
+	}
+}
+
+// mix blends from a towards b by f, from 0 to 1.
+func mix(a, b color.RGBA, f float64) color.RGBA {
+	blend := func(x, y byte) byte {
+		return byte(math.Round(float64(x) + (float64(y)-float64(x))*f))
+	}
+	return rgb(blend(a.R, b.R), blend(a.G, b.G), blend(a.B, b.B))
+}
+
+// hueColor returns the fully saturated color for a hue from 0 to 1.
+func hueColor(hue float64) color.RGBA {
+	h := hue * 6
+	x := byte(math.Round(255 * (1 - math.Abs(math.Mod(h, 2)-1))))
+	switch int(h) % 6 {
+	case 0:
+		return rgb(255, x, 0)
+	case 1:
+		return rgb(x, 255, 0)
+	case 2:
+		return rgb(0, 255, x)
+	case 3:
+		return rgb(0, x, 255)
+	case 4:
+		return rgb(x, 0, 255)
+	default:
+		return rgb(255, 0, x)
+	}
+}
+
+func rgb(r, g, b byte) color.RGBA {
+	return color.RGBA{R: r, G: g, B: b, A: 0xff}
+}
+
+// pixelStrip is the part of spi.APA102Driver the renderer uses.
+type pixelStrip interface {
+	SetRGBA(i int, c color.RGBA)
+	Draw() error
+}
+
+// stripRenderer draws the current effect onto a strip at a fixed frame rate.
+// It is also the ledOutput for the light, so the fader sets the brightness of
+// the whole strip and fades work the same as for a single LED.
+type stripRenderer struct {
+	strip   pixelStrip
+	fps     int
+	clock   clock
+	onError func(error)
+
+	mu     sync.Mutex
+	effect effect
+	level  byte
+	frame  int64
+	px     []color.RGBA
+	drawn  []color.RGBA
+}
+
+func newStripRenderer(strip pixelStrip, pixels, fps int, clk clock, onError func(error)) *stripRenderer {
+	return &stripRenderer{
+		strip:   strip,
+		fps:     fps,
+		clock:   clk,
+		onError: onError,
+		effect:  solidEffect{effectParams{colors: []color.RGBA{rgb(255, 255, 255)}}},
+		px:      make([]color.RGBA, pixels),
+	}
+}
+
+// SetEffect starts showing e from its first frame.
+func (r *stripRenderer) SetEffect(e effect) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.effect, r.frame = e, 0
+}
+
+// Write sets the brightness of the whole strip from the next frame on.
+func (r *stripRenderer) Write(level byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.level = level
+	return nil
+}
+
+// Step renders and draws the next frame. Frames that look the same as the
+// last one drawn are not sent to the strip again.
+func (r *stripRenderer) Step() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.effect.Render(r.px, r.frameTime())
+	r.frame++
+
+	changed := r.drawn == nil
+	if r.drawn == nil {
+		r.drawn = make([]color.RGBA, len(r.px))
+	}
+	for i, c := range r.px {
+		c = scale(c, r.level)
+		if c != r.drawn[i] {
+			changed = true
+		}
+		r.drawn[i] = c
+		r.strip.SetRGBA(i, c)
+	}
+	if !changed {
+		return nil
+	}
+	return r.strip.Draw()
+}
+
+// frameTime returns how far into the effect the current frame is. Whole
+// seconds are counted separately so the multiplication cannot overflow
+// however long the effect has been running. r.mu must be held.
+func (r *stripRenderer) frameTime() time.Duration {
+	fps := int64(r.fps)
+	return time.Duration(r.frame/fps)*time.Second + time.Duration(r.frame%fps)*time.Second/time.Duration(fps)
+}
+
+// Pixels returns the colors last drawn.
+func (r *stripRenderer) Pixels() []color.RGBA {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]color.RGBA(nil), r.drawn...)
+}
+
+// Run draws frames until stop is closed.
+func (r *stripRenderer) Run(stop <-chan struct{}) {
+	interval := time.Second / time.Duration(r.fps)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-r.clock.After(interval):
+		}
+
+		if err := r.Step(); err != nil {
+			r.onError(fmt.Errorf("led strip: %s", err))
+		}
+	}
+}
+
+// scale dims c by level out of 255. The alpha is left at zero so the driver
+// uses its own global brightness.
+func scale(c color.RGBA, level byte) color.RGBA {
+	s := func(v byte) byte {
+		return byte((int(v)*int(level) + 127) / 255)
+	}
+	return color.RGBA{R: s(c.R), G: s(c.G), B: s(c.B)}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot/drivers/spi"
+)
+
+const (
+	testStripPixels = 6
+	testStripFPS    = 4
+)
+
+// testStrip is a renderer drawing onto an APA102 driver on an spiSink.
+func testStrip(t *testing.T) (*stripRenderer, *spiSink) {
+	t.Helper()
+	sink := newSPISink(1)
+	apa := spi.NewAPA102Driver(sink, testStripPixels, stripGlobalIntensity)
+	if err := apa.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r := newStripRenderer(apa, testStripPixels, testStripFPS, newFakeClock(time.Now()), func(err error) { t.Error(err) })
+	r.Write(255)
+	return r, sink
+}
+
+// snapshot is the pixels of the last frame on the bus as #rrggbb strings.
+func snapshot(t *testing.T, sink *spiSink) string {
+	t.Helper()
+	px := decodeAPA102(sink.Last(), testStripPixels)
+	if px == nil {
+		t.Fatal("no frame was drawn")
+	}
+	var s []string
+	for _, c := range px {
+		if c.A != stripGlobalIntensity {
+			t.Errorf("pixel brightness is %d, want %d", c.A, stripGlobalIntensity)
+		}
+		s = append(s, fmt.Sprintf("%02x%02x%02x", c.R, c.G, c.B))
+	}
+	return strings.Join(s, " ")
+}
+
+func TestStripEffectSnapshots(t *testing.T) {
+	cases := []struct {
+		effect effectConfig
+		// frames are the pixels at 0, 0.25, 0.5, 1 and 2.5 seconds.
+		frames []string
+	}{
+		{
+			effectConfig{Name: "solid", Colors: []string{"#102030"}},
+			[]string{
+				"102030 102030 102030 102030 102030 102030",
+				"102030 102030 102030 102030 102030 102030",
+				"102030 102030 102030 102030 102030 102030",
+				"102030 102030 102030 102030 102030 102030",
+				"102030 102030 102030 102030 102030 102030",
+			},
+		},
+		{
+			effectConfig{Name: "gradient", Colors: []string{"#ff0000", "#0000ff"}, Speed: 0.5},
+			[]string{
+				"ff0000 aa0055 5500aa 0000ff 5500aa aa0055",
+				"bf0040 6a0095 1500ea 4000bf 95006a ea0015",
+				"800080 2b00d4 2a00d5 800080 d4002b d4002b",
+				"0000ff 5500aa aa0055 ff0000 aa0055 5500aa",
+				"800080 2b00d4 2a00d5 800080 d4002b d4002b",
+			},
+		},
+		{
+			effectConfig{Name: "rainbow", Speed: 1},
+			[]string{
+				"ff0000 ffff00 00ff00 00ffff 0000ff ff00ff",
+				"80ff00 00ff80 0080ff 8000ff ff0080 ff8000",
+				"00ffff 0000ff ff00ff ff0000 ffff00 00ff00",
+				"ff0000 ffff00 00ff00 00ffff 0000ff ff00ff",
+				"00ffff 0000ff ff00ff ff0000 ffff00 00ff00",
+			},
+		},
+		{
+			effectConfig{Name: "chase", Colors: []string{"#ffffff", "#000010"}, Speed: 0.5, Width: 2},
+			[]string{
+				"ffffff ffffff 000010 000010 000010 000010",
+				"ffffff ffffff 000010 000010 000010 000010",
+				"000010 ffffff ffffff 000010 000010 000010",
+				"000010 000010 000010 ffffff ffffff 000010",
+				"000010 ffffff ffffff 000010 000010 000010",
+			},
+		},
+		{
+			effectConfig{Name: "breathe", Colors: []string{"#ff0000", "#00ff00"}, Speed: 1},
+			[]string{
+				"000000 000000 000000 000000 000000 000000",
+				"7f0000 7f0000 7f0000 7f0000 7f0000 7f0000",
+				"ff0000 ff0000 ff0000 ff0000 ff0000 ff0000",
+				"000000 000000 000000 000000 000000 000000",
+				"ff0000 ff0000 ff0000 ff0000 ff0000 ff0000",
+			},
+		},
+		{
+			effectConfig{Name: "twinkle", Colors: []string{"#ffffff", "#ff8000"}, Density: 1},
+			[]string{
+				"000000 000000 000000 000000 000000 000000",
+				"ffffff ffffff 000000 000000 ff8000 000000",
+				"787878 787878 000000 000000 ff8000 000000",
+				"1b1b1b 1b1b1b ff8000 000000 391d00 ff8000",
+				"060300 000000 1b1b1b 787878 393939 1b0d00",
+			},
+		},
+	}
+	at := []int{0, 1, 2, 4, 10}
+
+	for _, c := range cases {
+		r, sink := testStrip(t)
+		effect := c.effect
+		r.SetEffect(newEffect(&lightConfig{Effect: &effect}))
+		var got []string
+		frame := 0
+		for _, n := range at {
+			for ; frame <= n; frame++ {
+				if err := r.Step(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got = append(got, snapshot(t, sink))
+		}
+		for i := range got {
+			if got[i] != c.frames[i] {
+				t.Errorf("%s at frame %d drew\n\t%s\nwant\n\t%s", c.effect.Name, at[i], got[i], c.frames[i])
+			}
+		}
+	}
+}
+
+func TestStripBrightnessAndRestart(t *testing.T) {
+	r, sink := testStrip(t)
+	r.SetEffect(newEffect(&lightConfig{Effect: &effectConfig{Name: "chase", Colors: []string{"#ff8040"}, Speed: 1, Width: 1}}))
+	r.Write(128)
+	r.Step()
+	r.Step()
+	if got, want := snapshot(t, sink), "000000 804020 000000 000000 000000 000000"; got != want {
+		t.Errorf("half brightness drew %s, want %s", got, want)
+	}
+
+	// Frames that look the same are not sent again.
+	sent := 0
+	sink.onFrame = func([]byte) { sent++ }
+	r.SetEffect(solidEffect{effectParams{colors: []color.RGBA{rgb(0, 0, 0)}}})
+	r.Step()
+	r.Step()
+	r.Step()
+	if sent != 1 {
+		t.Errorf("%d frames sent for an unchanging effect, want 1", sent)
+	}
+
+	// A new effect starts from its first frame.
+	r.SetEffect(newEffect(&lightConfig{Effect: &effectConfig{Name: "chase", Colors: []string{"#ff8040"}, Speed: 1, Width: 1}}))
+	r.Step()
+	if got, want := snapshot(t, sink), "804020 000000 000000 000000 000000 000000"; got != want {
+		t.Errorf("restarted effect drew %s, want %s", got, want)
+	}
+}
+
+func TestStripFrameTimeDoesNotOverflow(t *testing.T) {
+	r, _ := testStrip(t)
+	// Two hundred years in, where frame*time.Second would overflow.
+	seconds := int64(200 * 365 * 24 * 3600)
+	r.frame = seconds*testStripFPS + 1
+	if got, want := r.frameTime(), time.Duration(seconds)*time.Second+time.Second/testStripFPS; got != want {
+		t.Errorf("frame time is %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsOptions describe how the broker is verified and, for mutual TLS, which
+// certificate the device presents.
+type tlsOptions struct {
+	// caFile is a PEM bundle of trusted roots. When empty the system roots
+	// are used. The file is re-read when it changes, so the bundle can be
+	// replaced without restarting the client.
+	caFile string
+
+	// certFile and keyFile hold the client certificate for mutual TLS. Both
+	// are re-read on every handshake. The key may be encrypted, with the
+	// passphrase in passphraseFile or the environment.
+	certFile       string
+	keyFile        string
+	passphraseFile string
+
+	// pins are base64 encoded SHA-256 hashes of a SubjectPublicKeyInfo. When
+	// set, one certificate in the verified chain must match one of them.
+	pins []string
+}
+
+// newTLSConfig returns a config that verifies the broker's chain and
+// hostname.
+func newTLSConfig(broker string, o tlsOptions) (*tls.Config, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url %q: %s", broker, err)
+	}
+
+	pins := map[string]bool{}
+	for _, p := range o.pins {
+		if b, err := base64.StdEncoding.DecodeString(p); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki pin %q, expected a base64 encoded sha256 hash", p)
+		}
+		pins[p] = true
+	}
+
+	if (o.certFile == "") != (o.keyFile == "") {
+		return nil, fmt.Errorf("mutual tls needs both a client certificate and key")
+	}
+
+	roots := &caBundle{path: o.caFile}
+	if _, err := roots.pool(); err != nil {
+		return nil, err
+	}
+
+	v := &verifier{
+		serverName: u.Hostname(),
+		roots:      roots,
+		pins:       pins,
+	}
+
+	config := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+
+		// The standard verification can only use a fixed root pool. It is
+		// replaced by verifyPeerCertificate, which does the same chain and
+		// hostname checks against the current bundle and then checks pins.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: v.verifyPeerCertificate,
+	}
+
+	if o.certFile != "" {
+		if _, err := loadClientCertificate(o.certFile, o.keyFile, o.passphraseFile); err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := loadClientCertificate(o.certFile, o.keyFile, o.passphraseFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %s", err)
+			}
+			return cert, nil
+		}
+	}
+
+	return config, nil
+}
+
+type verifier struct {
+	serverName string
+	roots      *caBundle
+	pins       map[string]bool
+}
+
+// verifyPeerCertificate checks the chain the broker sent. With
+// InsecureSkipVerify set it is given only the raw certificates.
+func (v *verifier) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("broker presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("broker sent a malformed certificate: %s", err)
+		}
+		certs[i] = cert
+	}
+
+	roots, err := v.roots.pool()
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       v.serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(v.pins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if v.pins[spkiHash(cert)] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate in the broker's chain matches a pinned key")
+}
+
+// spkiHash returns the pin for a certificate's public key.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// caBundle is a root pool loaded from a file, reloaded when the file's
+// modification time changes. A bundle that fails to parse leaves the previous
+// pool in place.
+type caBundle struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	roots   *x509.CertPool
+}
+
+func (b *caBundle) pool() (*x509.CertPool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.path == "" {
+		if b.roots == nil {
+			roots, err := x509.SystemCertPool()
+			if err != nil {
+				return nil, err
+			}
+			b.roots = roots
+		}
+		return b.roots, nil
+	}
+
+	info, err := os.Stat(b.path)
+	if err != nil {
+		if b.roots != nil {
+			return b.roots, nil
+		}
+		return nil, err
+	}
+	if b.roots != nil && info.ModTime().Equal(b.modTime) {
+		return b.roots, nil
+	}
+
+	pem, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		if b.roots != nil {
+			fmt.Printf("ignoring ca bundle %s: no certificates found, keeping the previous bundle\n", b.path)
+			b.modTime = info.ModTime()
+			return b.roots, nil
+		}
+		return nil, fmt.Errorf("no certificates found in ca bundle %s", b.path)
+	}
+
+	b.roots, b.modTime = roots, info.ModTime()
+	return b.roots, nil
+}
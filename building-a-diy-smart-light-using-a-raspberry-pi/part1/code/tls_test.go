@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	now := time.Now()
+	cert, key := issueCert(t, nil, name, now.Add(-time.Hour), now.Add(24*time.Hour), true)
+	return &testCA{cert, key}
+}
+
+// issue makes a certificate signed by the CA.
+func (ca *testCA) issue(t *testing.T, name string, notBefore, notAfter time.Time, isCA bool, hosts ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	return issueCert(t, ca, name, notBefore, notAfter, isCA, hosts...)
+}
+
+// PEM returns the CA certificate as PEM.
+func (ca *testCA) PEM() []byte {
+	return certPEM(ca.cert)
+}
+
+// issueCert makes a certificate signed by parent, or self-signed when parent
+// is nil.
+func issueCert(t *testing.T, parent *testCA, name string, notBefore, notAfter time.Time, isCA bool, hosts ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func certPEM(certs ...*x509.Certificate) []byte {
+	var b []byte
+	for _, c := range certs {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return b
+}
+
+// tlsCert pairs a leaf and the chain above it with the leaf's key.
+func tlsCert(key *ecdsa.PrivateKey, chain ...*x509.Certificate) tls.Certificate {
+	c := tls.Certificate{PrivateKey: key}
+	for _, cert := range chain {
+		c.Certificate = append(c.Certificate, cert.Raw)
+	}
+	return c
+}
+
+// serveTLS completes a handshake with every client using cert and then
+// closes the connection.
+func serveTLS(t *testing.T, cert tls.Certificate) (addr string, stop func()) {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(testWait))
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// handshake dials addr and runs a handshake with config.
+func handshake(addr string, config *tls.Config) error {
+	conn, err := net.DialTimeout("tcp", addr, testWait)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testWait))
+	return tls.Client(conn, config).Handshake()
+}
+
+func writeFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// brokerChain starts a TLS server for "localhost" with a leaf issued by an
+// intermediate of ca, and returns the port and the intermediate.
+func brokerChain(t *testing.T, ca *testCA) (port string, intermediate *x509.Certificate, stop func()) {
+	t.Helper()
+	now := time.Now()
+	icert, ikey := ca.issue(t, "intermediate", now.Add(-time.Hour), now.Add(time.Hour), true)
+	leaf, key := (&testCA{icert, ikey}).issue(t, "localhost", now.Add(-time.Hour), now.Add(time.Hour), false, "localhost")
+	addr, stop := serveTLS(t, tlsCert(key, leaf, icert))
+	_, port, _ = net.SplitHostPort(addr)
+	return port, icert, stop
+}
+
+func TestTLSVerifiesChainAndHostname(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	ca := newTestCA(t, "test root")
+	caFile := filepath.Join(dir, "roots.pem")
+	writeFile(t, caFile, ca.PEM())
+
+	port, _, stop := brokerChain(t, ca)
+	defer stop()
+	addr := "127.0.0.1:" + port
+
+	config, err := newTLSConfig("ssl://localhost:"+port, tlsOptions{caFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(addr, config); err != nil {
+		t.Fatalf("handshake with a chain to the configured root failed: %s", err)
+	}
+
+	// The broker's certificate does not name this host.
+	config, err = newTLSConfig("ssl://broker.example:"+port, tlsOptions{caFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(addr, config); err == nil {
+		t.Error("handshake succeeded for a hostname the certificate does not name")
+	}
+
+	other := filepath.Join(dir, "other.pem")
+	writeFile(t, other, newTestCA(t, "other root").PEM())
+	config, err = newTLSConfig("ssl://localhost:"+port, tlsOptions{caFile: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(addr, config); err == nil {
+		t.Error("handshake succeeded against an untrusted root")
+	}
+}
+
+func TestTLSPins(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	ca := newTestCA(t, "test root")
+	caFile := filepath.Join(dir, "roots.pem")
+	writeFile(t, caFile, ca.PEM())
+
+	port, intermediate, stop := brokerChain(t, ca)
+	defer stop()
+	addr := "127.0.0.1:" + port
+	unrelated, _ := issueCert(t, nil, "unrelated", time.Now(), time.Now().Add(time.Hour), false)
+
+	cases := []struct {
+		name string
+		pins []string
+		ok   bool
+	}{
+		{"intermediate", []string{spkiHash(intermediate)}, true},
+		{"root among others", []string{spkiHash(unrelated), spkiHash(ca.cert)}, true},
+		{"mismatch", []string{spkiHash(unrelated)}, false},
+	}
+	for _, tc := range cases {
+		config, err := newTLSConfig("ssl://localhost:"+port, tlsOptions{caFile: caFile, pins: tc.pins})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = handshake(addr, config)
+		switch {
+		case tc.ok && err != nil:
+			t.Errorf("%s: handshake failed: %s", tc.name, err)
+		case !tc.ok && (err == nil || !strings.Contains(err.Error(), "pinned")):
+			t.Errorf("%s: handshake gave %v, want a pin mismatch", tc.name, err)
+		}
+	}
+
+	if _, err := newTLSConfig("ssl://localhost:8883", tlsOptions{pins: []string{"not-a-pin"}}); err == nil {
+		t.Error("a malformed pin was accepted")
+	}
+}
+
+func TestTLSReloadsCABundle(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	oldCA, newCA := newTestCA(t, "old root"), newTestCA(t, "new root")
+	caFile := filepath.Join(dir, "roots.pem")
+	writeFile(t, caFile, oldCA.PEM())
+
+	port, _, stop := brokerChain(t, newCA)
+	defer stop()
+	addr := "127.0.0.1:" + port
+
+	config, err := newTLSConfig("ssl://localhost:"+port, tlsOptions{caFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(addr, config); err == nil {
+		t.Fatal("handshake succeeded before the new root was installed")
+	}
+
+	writeFile(t, caFile, append(oldCA.PEM(), newCA.PEM()...))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(addr, config); err != nil {
+		t.Fatalf("handshake failed after the bundle gained the new root: %s", err)
+	}
+
+	// A bundle with no certificates keeps the last good one.
+	writeFile(t, caFile, []byte("not a certificate\n"))
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(caFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(addr, config); err != nil {
+		t.Errorf("handshake failed after a broken bundle was written: %s", err)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	defaultUpdateDir      = "update"
+	defaultUpdateDeadline = 2 * time.Minute
+	maxUpdateSize         = 64 << 20
+	updateDownloadTimeout = 10 * time.Minute
+)
+
+// Update states reported in update events.
+const (
+	updateDownloading = "downloading"
+	updateInstalling  = "installing"
+	updateSucceeded   = "succeeded"
+	updateFailed      = "failed"
+	updateRolledBack  = "rolled_back"
+)
+
+// updateDirective asks the device to run another build, e.g.
+//
+//	{"url": "https://example.com/iot-client-1.4.0", "version": "1.4.0", "signature": "<base64>"}
+//
+// The signature is ed25519 over updateMessage(version, sha256 of the
+// binary), so a signed binary can't be offered under another version.
+type updateDirective struct {
+	URL       string `json:"url"`
+	Version   string `json:"version"`
+	Signature string `json:"signature"`
+}
+
+func (d *updateDirective) validate() []string {
+	var problems []string
+	if u, err := url.Parse(d.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("update.url must be an http or https url, not %q", d.URL))
+	}
+	if d.Version == "" {
+		problems = append(problems, "update.version is required")
+	}
+	if sig, err := base64.StdEncoding.DecodeString(d.Signature); err != nil || len(sig) != ed25519.SignatureSize {
+		problems = append(problems, "update.signature must be a base64 ed25519 signature")
+	}
+	return problems
+}
+
+// updateMessage is what the release key signs:
+//
+//	iot-client update <version> <sha256 hex>
+//
+// With the key in PEM form it can be made with
+//
+//	printf 'iot-client update %s %s' "$VERSION" "$(sha256sum iot-client | cut -d' ' -f1)" > msg
+//	openssl pkeyutl -sign -inkey release.pem -rawin -in msg | base64 -w0
+func updateMessage(version string, digest []byte) []byte {
+	return []byte(fmt.Sprintf("iot-client update %s %s", version, hex.EncodeToString(digest)))
+}
+
+// updateEvent is published on the events topic as an update progresses.
+type updateEvent struct {
+	Type      string    `json:"type"`
+	Version   string    `json:"version"`
+	From      string    `json:"from,omitempty"`
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// updateState is kept in the update directory across the restart.
+type updateState struct {
+	// Pending is the update on trial: the new binary must reach the broker
+	// before the deadline or the previous one is put back.
+	Pending *pendingUpdate `json:"pending,omitempty"`
+	// Failed lists versions that were rolled back, so a retained directive
+	// does not install them again.
+	Failed []string `json:"failed,omitempty"`
+	// Unreported is the outcome of the last update, published once
+	// connected.
+	Unreported *updateEvent `json:"unreported,omitempty"`
+}
+
+// pendingUpdate is an update swapped in but not yet confirmed. The deadline
+// is set when the new binary first starts, and kept if it starts again.
+type pendingUpdate struct {
+	Version  string    `json:"version"`
+	From     string    `json:"from"`
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+// execer replaces the running process with another program.
+type execer interface {
+	Exec(path string, args, env []string) error
+}
+
+type realExec struct{}
+
+func (realExec) Exec(path string, args, env []string) error {
+	return syscall.Exec(path, args, env)
+}
+
+// updater installs signed builds of the client. A build is downloaded next
+// to the running binary, checked against the release key, and swapped in
+// with a rename, keeping the old binary as <binary>.previous. The process
+// then restarts into it. The new build must connect to the broker before the
+// deadline, or it puts the previous binary back and restarts into that.
+type updater struct {
+	publicKey ed25519.PublicKey
+	dir       string
+	binary    string
+	deadline  time.Duration
+	http      *http.Client
+	exec      execer
+	clock     clock
+
+	// Restart is called when the binary has been replaced. It should shut
+	// down cleanly and then call Exec; main provides it.
+	Restart func()
+
+	mu        sync.Mutex
+	state     updateState
+	busy      bool
+	tried     map[updateDirective]bool
+	confirmed chan struct{}
+}
+
+func newUpdater(publicKey ed25519.PublicKey, dir, binary string, deadline time.Duration, ex execer, clk clock) *updater {
+	return &updater{
+		publicKey: publicKey,
+		dir:       dir,
+		binary:    binary,
+		deadline:  deadline,
+		http:      &http.Client{Timeout: updateDownloadTimeout},
+		exec:      ex,
+		clock:     clk,
+		tried:     map[updateDirective]bool{},
+		confirmed: make(chan struct{}),
+	}
+}
+
+func (u *updater) statePath() string {
+	return filepath.Join(u.dir, "update.json")
+}
+
+func (u *updater) backupPath() string {
+	return u.binary + ".previous"
+}
+
+// Load reads the state left by an earlier run. If this run is an update on
+// trial it watches the deadline, rolling back straight away if it has already
+// passed, as when the new binary keeps crashing.
+func (u *updater) Load() error {
+	if err := os.MkdirAll(u.dir, 0700); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(u.statePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &u.state); err != nil {
+			return fmt.Errorf("%s: %s", u.statePath(), err)
+		}
+	}
+
+	p := u.state.Pending
+	if p == nil {
+		return nil
+	}
+	switch version {
+	case p.Version:
+	case p.From:
+		// The swap never happened.
+		u.state.Pending = nil
+		u.state.Failed = append(u.state.Failed, p.Version)
+		u.state.Unreported = &updateEvent{Type: "update", Version: p.Version, From: p.From, State: updateFailed, Error: "stopped before the new binary was swapped in", Timestamp: u.clock.Now()}
+		return u.save()
+	default:
+		// Installing it again would only start this build again.
+		go u.rollback(fmt.Errorf("the new binary is version %s, not %s", version, p.Version))
+		return nil
+	}
+
+	if p.Deadline.IsZero() {
+		p.Deadline = u.clock.Now().Add(u.deadline)
+		if err := u.save(); err != nil {
+			return err
+		}
+	}
+	wait := p.Deadline.Sub(u.clock.Now())
+	fmt.Printf("update: running %s on trial, rolling back to %s unless the broker is reached within %s\n", p.Version, p.From, wait.Round(time.Second))
+	go func() {
+		select {
+		case <-u.confirmed:
+		case <-u.clock.After(wait):
+			u.rollback(fmt.Errorf("%s did not reach the broker within %s", p.Version, u.deadline))
+		}
+	}()
+	return nil
+}
+
+// Connected confirms an update on trial and publishes the outcome of the
+// last update. Each light calls it when it connects.
+func (u *updater) Connected(pub publisher, topic string) {
+	u.mu.Lock()
+	if p := u.state.Pending; p != nil && p.Version == version {
+		u.state.Pending = nil
+		u.state.Unreported = &updateEvent{Type: "update", Version: p.Version, From: p.From, State: updateSucceeded, Timestamp: u.clock.Now()}
+		close(u.confirmed)
+		os.Remove(u.backupPath())
+		fmt.Printf("update: %s confirmed\n", p.Version)
+	}
+	event := u.state.Unreported
+	if event == nil {
+		u.mu.Unlock()
+		return
+	}
+	u.state.Unreported = nil
+	err := u.save()
+	u.mu.Unlock()
+
+	if err != nil {
+		fmt.Printf("update: %s\n", err)
+	}
+	publishUpdateEvent(pub, topic, *event)
+}
+
+// Start installs the build d describes in the background, reporting
+// progress on topic. Directives for the running version or a rolled back
+// one, directives that already failed to install and directives arriving
+// while another update runs are ignored.
+func (u *updater) Start(d updateDirective, pub publisher, topic string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if d.Version == version || u.busy || u.state.Pending != nil || u.tried[d] {
+		return
+	}
+	for _, v := range u.state.Failed {
+		if v == d.Version {
+			return
+		}
+	}
+	u.busy = true
+
+	go func() {
+		report := func(state string, err error) {
+			e := updateEvent{Type: "update", Version: d.Version, From: version, State: state, Timestamp: u.clock.Now()}
+			if err != nil {
+				e.Error = err.Error()
+			}
+			publishUpdateEvent(pub, topic, e)
+		}
+
+		report(updateDownloading, nil)
+		err := u.install(d)
+		if err == nil {
+			report(updateInstalling, nil)
+			u.Restart()
+			return
+		}
+
+		fmt.Printf("update: %s: %s\n", d.Version, err)
+		u.mu.Lock()
+		u.busy = false
+		u.tried[d] = true
+		u.mu.Unlock()
+		report(updateFailed, err)
+	}()
+}
+
+// install downloads and verifies the build and swaps it in for the running
+// binary.
+func (u *updater) install(d updateDirective) error {
+	staged := u.binary + ".new"
+	defer os.Remove(staged)
+
+	digest, err := u.download(d.URL, staged)
+	if err != nil {
+		return err
+	}
+	sig, _ := base64.StdEncoding.DecodeString(d.Signature)
+	if !ed25519.Verify(u.publicKey, updateMessage(d.Version, digest), sig) {
+		return errors.New("signature does not match the release key")
+	}
+
+	// A hard link keeps the running binary as the backup without copying
+	// it, and leaves the binary in place until the rename replaces it.
+	os.Remove(u.backupPath())
+	if err := os.Link(u.binary, u.backupPath()); err != nil {
+		return fmt.Errorf("keeping the previous binary: %s", err)
+	}
+
+	u.mu.Lock()
+	u.state.Pending = &pendingUpdate{Version: d.Version, From: version}
+	err = u.save()
+	u.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(staged, u.binary); err != nil {
+		u.mu.Lock()
+		u.state.Pending = nil
+		u.save()
+		u.mu.Unlock()
+		return fmt.Errorf("swapping in the new binary: %s", err)
+	}
+	return nil
+}
+
+// download fetches url into path, made executable and synced, and returns
+// its sha256.
+func (u *updater) download(url, path string) ([]byte, error) {
+	resp, err := u.http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, maxUpdateSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %s", url, err)
+	}
+	if n > maxUpdateSize {
+		return nil, fmt.Errorf("downloading %s: larger than %d bytes", url, maxUpdateSize)
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), f.Close()
+}
+
+// rollback puts the previous binary back and restarts into it.
+func (u *updater) rollback(reason error) {
+	u.mu.Lock()
+	if u.state.Pending == nil {
+		// Confirmed just in time.
+		u.mu.Unlock()
+		return
+	}
+	err := u.restore(reason)
+	u.mu.Unlock()
+	if err != nil {
+		fmt.Printf("update: cannot roll back: %s\n", err)
+		return
+	}
+	u.Restart()
+}
+
+// Exec replaces the process with the binary, passing on args and env. If a
+// newly installed binary cannot be started at all, for example because it
+// was built for another architecture, the previous one is put back and
+// started instead.
+func (u *updater) Exec(args, env []string) error {
+	err := u.exec.Exec(u.binary, args, env)
+	if err == nil {
+		return nil
+	}
+
+	u.mu.Lock()
+	restoreErr := u.restore(fmt.Errorf("starting the new binary: %s", err))
+	u.mu.Unlock()
+	if restoreErr != nil {
+		return err
+	}
+	return u.exec.Exec(u.binary, args, env)
+}
+
+// restore moves the previous binary back in place of a pending update and
+// records the update as rolled back. u.mu must be held.
+func (u *updater) restore(reason error) error {
+	p := u.state.Pending
+	if p == nil {
+		return errors.New("no update is pending")
+	}
+	fmt.Printf("update: rolling back to %s: %s\n", p.From, reason)
+
+	if err := os.Rename(u.backupPath(), u.binary); err != nil {
+		return err
+	}
+	u.state.Pending = nil
+	u.state.Failed = append(u.state.Failed, p.Version)
+	u.state.Unreported = &updateEvent{Type: "update", Version: p.Version, From: p.From, State: updateRolledBack, Error: reason.Error(), Timestamp: u.clock.Now()}
+	return u.save()
+}
+
+// save writes the state. u.mu must be held.
+func (u *updater) save() error {
+	b, err := json.MarshalIndent(u.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(u.statePath(), b, 0600)
+}
+
+func publishUpdateEvent(pub publisher, topic string, e updateEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		fmt.Printf("update: failed to encode event: %s\n", err)
+		return
+	}
+	if err := pub.Publish(string(b), topic); err != nil {
+		fmt.Printf("update: failed to publish event: %s\n", err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// fakeExec records the programs it is asked to run, failing with errs in
+// turn.
+type fakeExec struct {
+	mu    sync.Mutex
+	paths []string
+	errs  []error
+}
+
+func (e *fakeExec) Exec(path string, args, env []string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.paths = append(e.paths, path)
+	if len(e.errs) == 0 {
+		return nil
+	}
+	err := e.errs[0]
+	e.errs = e.errs[1:]
+	return err
+}
+
+// buildServer serves builds by path and counts the requests for each.
+type buildServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func serveBuilds(builds map[string]string) *buildServer {
+	s := &buildServer{requests: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		s.mu.Unlock()
+		b, ok := builds[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(b))
+	}))
+	return s
+}
+
+func (s *buildServer) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// signUpdate makes the directive for build as the release key would.
+func signUpdate(key ed25519.PrivateKey, url, version, build string) updateDirective {
+	digest := sha256.Sum256([]byte(build))
+	sig := ed25519.Sign(key, updateMessage(version, digest[:]))
+	return updateDirective{URL: url, Version: version, Signature: base64.StdEncoding.EncodeToString(sig)}
+}
+
+// testUpdater makes an updater for the binary in dir, holding "old build"
+// unless it is there already. Its Restart sends on the returned channel.
+func testUpdater(t *testing.T, dir string, clk clock) (*updater, ed25519.PrivateKey, *fakeExec, chan struct{}) {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "iot-client")
+	if _, err := os.Stat(binary); os.IsNotExist(err) {
+		writeFile(t, binary, []byte("old build"))
+	}
+	ex := &fakeExec{}
+	u := newUpdater(pub, filepath.Join(dir, "update"), binary, time.Minute, ex, clk)
+	restarts := make(chan struct{}, 1)
+	u.Restart = func() { restarts <- struct{}{} }
+	if err := u.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return u, key, ex, restarts
+}
+
+// runningVersion pretends this build is v until the returned func is called.
+func runningVersion(v string) func() {
+	old := version
+	version = v
+	return func() { version = old }
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func updateStates(t *testing.T, p *recordingPublisher) []string {
+	t.Helper()
+	var states []string
+	for _, m := range p.Messages() {
+		var e updateEvent
+		if err := json.Unmarshal([]byte(m.msg), &e); err != nil {
+			t.Fatalf("malformed update event %q: %s", m.msg, err)
+		}
+		states = append(states, e.State)
+	}
+	return states
+}
+
+// pendingOnDisk sets dir up as the restart into a new build leaves it: the
+// new build in place, the old one kept and the update on trial.
+func pendingOnDisk(t *testing.T, dir string) {
+	t.Helper()
+	writeFile(t, filepath.Join(dir, "iot-client"), []byte("new build"))
+	writeFile(t, filepath.Join(dir, "iot-client.previous"), []byte("old build"))
+	if err := os.MkdirAll(filepath.Join(dir, "update"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "update", "update.json"), []byte(`{"pending": {"version": "1.4.0", "from": "1.3.0"}}`))
+}
+
+func TestUpdateInstallsSignedBuild(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s := serveBuilds(map[string]string{"/1.4.0": "new build"})
+	defer s.Close()
+
+	u, key, ex, restarts := testUpdater(t, dir, realClock{})
+	events := &recordingPublisher{}
+	u.Start(signUpdate(key, s.URL+"/1.4.0", "1.4.0", "new build"), events, "events")
+	select {
+	case <-restarts:
+	case <-time.After(testWait):
+		t.Fatal("no restart after the update was installed")
+	}
+
+	if got := updateStates(t, events); strings.Join(got, " ") != "downloading installing" {
+		t.Errorf("update events are %v", got)
+	}
+	if got := readFile(t, u.binary); got != "new build" {
+		t.Errorf("binary holds %q", got)
+	}
+	if got := readFile(t, u.backupPath()); got != "old build" {
+		t.Errorf("backup holds %q", got)
+	}
+	var state updateState
+	if err := json.Unmarshal([]byte(readFile(t, u.statePath())), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Pending == nil || state.Pending.Version != "1.4.0" || state.Pending.From != version {
+		t.Errorf("saved state is %+v", state)
+	}
+
+	// Anything else waits for the restart.
+	u.Start(signUpdate(key, s.URL+"/1.4.0", "1.5.0", "new build"), events, "events")
+	if err := u.Exec([]string{"iot-client"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(ex.paths) != 1 || ex.paths[0] != u.binary {
+		t.Errorf("exec ran %v", ex.paths)
+	}
+	if n := len(events.Messages()); n != 2 {
+		t.Errorf("%d update events, want 2", n)
+	}
+}
+
+func TestUpdateRejectsBadBuilds(t *testing.T) {
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := serveBuilds(map[string]string{"/1.4.0": "new build"})
+	defer s.Close()
+
+	cases := []struct {
+		name string
+		d    func(key ed25519.PrivateKey) updateDirective
+		err  string
+	}{
+		{"another key", func(ed25519.PrivateKey) updateDirective {
+			return signUpdate(otherKey, s.URL+"/1.4.0", "1.4.0", "new build")
+		}, "release key"},
+		{"another version", func(key ed25519.PrivateKey) updateDirective {
+			d := signUpdate(key, s.URL+"/1.4.0", "1.3.9", "new build")
+			d.Version = "1.4.0"
+			return d
+		}, "release key"},
+		{"another build", func(key ed25519.PrivateKey) updateDirective {
+			return signUpdate(key, s.URL+"/1.4.0", "1.4.0", "other build")
+		}, "release key"},
+		{"missing", func(key ed25519.PrivateKey) updateDirective {
+			return signUpdate(key, s.URL+"/1.5.0", "1.4.0", "new build")
+		}, "404"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+			u, key, _, restarts := testUpdater(t, dir, realClock{})
+			events := &recordingPublisher{}
+			d := c.d(key)
+
+			u.Start(d, events, "events")
+			eventually(t, "the update to fail", func() bool { return len(events.Messages()) == 2 })
+			var e updateEvent
+			json.Unmarshal([]byte(events.Messages()[1].msg), &e)
+			if e.State != updateFailed || !strings.Contains(e.Error, c.err) {
+				t.Errorf("update ended with %+v", e)
+			}
+			if got := readFile(t, u.binary); got != "old build" {
+				t.Errorf("binary holds %q", got)
+			}
+			if _, err := os.Stat(u.backupPath()); !os.IsNotExist(err) {
+				t.Errorf("backup left behind: %v", err)
+			}
+			select {
+			case <-restarts:
+				t.Error("restarted after a failed update")
+			default:
+			}
+
+			// The same directive, still retained, is not tried again.
+			u.Start(d, events, "events")
+			time.Sleep(20 * time.Millisecond)
+			if n := len(events.Messages()); n != 2 {
+				t.Errorf("%d update events after retrying, want 2", n)
+			}
+		})
+	}
+}
+
+func TestUpdateRollsBackUnconfirmedBuild(t *testing.T) {
+	defer runningVersion("1.4.0")()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pendingOnDisk(t, dir)
+
+	clk := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	u, key, _, restarts := testUpdater(t, dir, clk)
+	if got := readFile(t, u.binary); got != "new build" {
+		t.Fatalf("binary holds %q", got)
+	}
+	waitForWaiters(t, clk, 1)
+	clk.Advance(time.Minute)
+	select {
+	case <-restarts:
+	case <-time.After(testWait):
+		t.Fatal("no restart at the deadline")
+	}
+	if got := readFile(t, u.binary); got != "old build" {
+		t.Errorf("binary holds %q after the rollback", got)
+	}
+
+	// The old build reports the rollback once connected, and won't install
+	// the rolled back version again.
+	defer runningVersion("1.3.0")()
+	u2 := newUpdater(u.publicKey, u.dir, u.binary, time.Minute, &fakeExec{}, clk)
+	if err := u2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	events := &recordingPublisher{}
+	u2.Connected(events, "events")
+	u2.Connected(events, "events")
+	if got := updateStates(t, events); len(got) != 1 || got[0] != updateRolledBack {
+		t.Errorf("update events are %v", got)
+	}
+	u2.Start(signUpdate(key, "http://127.0.0.1:1/1.4.0", "1.4.0", "new build"), events, "events")
+	time.Sleep(20 * time.Millisecond)
+	if n := len(events.Messages()); n != 1 {
+		t.Errorf("rolled back version was tried again")
+	}
+}
+
+func TestUpdateConfirmedOnConnect(t *testing.T) {
+	defer runningVersion("1.4.0")()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	pendingOnDisk(t, dir)
+
+	clk := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	u, _, _, restarts := testUpdater(t, dir, clk)
+	waitForWaiters(t, clk, 1)
+	events := &recordingPublisher{}
+	u.Connected(events, "events")
+	if got := updateStates(t, events); len(got) != 1 || got[0] != updateSucceeded {
+		t.Errorf("update events are %v", got)
+	}
+
+	clk.Advance(time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-restarts:
+		t.Error("rolled back a confirmed update")
+	default:
+	}
+	if got := readFile(t, u.binary); got != "new build" {
+		t.Errorf("binary holds %q", got)
+	}
+	if _, err := os.Stat(u.backupPath()); !os.IsNotExist(err) {
+		t.Errorf("backup kept after confirming: %v", err)
+	}
+}
+
+func TestUpdateExecFallsBackToPreviousBuild(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer runningVersion("1.3.0")()
+	s := serveBuilds(map[string]string{"/1.4.0": "new build"})
+	defer s.Close()
+
+	u, key, ex, restarts := testUpdater(t, dir, realClock{})
+	ex.errs = []error{fmt.Errorf("exec format error")}
+	u.Start(signUpdate(key, s.URL+"/1.4.0", "1.4.0", "new build"), &recordingPublisher{}, "events")
+	<-restarts
+
+	if err := u.Exec([]string{"iot-client"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(ex.paths) != 2 {
+		t.Errorf("exec ran %v", ex.paths)
+	}
+	if got := readFile(t, u.binary); got != "old build" {
+		t.Errorf("binary holds %q", got)
+	}
+	u.mu.Lock()
+	state := u.state
+	u.mu.Unlock()
+	if state.Pending != nil || len(state.Failed) != 1 || state.Unreported == nil || state.Unreported.State != updateRolledBack {
+		t.Errorf("state is %+v", state)
+	}
+}
+
+func TestUpdateOnlyFromAcceptedConfigs(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	b := startTestBroker(t)
+	defer b.Close()
+	s := serveBuilds(map[string]string{"/stale": "new build", "/held": "new build", "/1.4.0": "new build"})
+	defer s.Close()
+	states := watchTopic(t, b, "/devices/lamp/state")
+
+	u, key, _, restarts := testUpdater(t, dir, realClock{})
+	const window = 500 * time.Millisecond
+	d, err := startDevice(simConfig(t, b, dir, "lamp", "-button.pin", "16", "-conflict.window", window.String()), &shared{updater: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	waitForState(t, states, "the light off", func(s stateReport) bool { return s.Power == powerOff })
+
+	config := func(v int, path string) []byte {
+		c := map[string]interface{}{
+			"version": v,
+			"power":   "on",
+			"update":  signUpdate(key, s.URL+path, "1.4.0", "new build"),
+		}
+		b, _ := json.Marshal(c)
+		return b
+	}
+	b.Publish("/devices/lamp/config", []byte(`{"version": 3, "power": "off"}`), false)
+	waitForState(t, states, "version 3 applied", func(s stateReport) bool { return s.AppliedVersion == 3 })
+
+	// Stale.
+	b.Publish("/devices/lamp/config", config(2, "/stale"), false)
+	// Held off by the button press.
+	sim := simHardware(t, d)
+	sim.Set("16", 1)
+	waitForState(t, states, "the button press", func(s stateReport) bool { return s.Source == sourceLocal })
+	sim.Set("16", 0)
+	b.Publish("/devices/lamp/config", config(4, "/held"), false)
+	// Accepted once the override window has passed.
+	time.Sleep(window)
+	b.Publish("/devices/lamp/config", config(5, "/1.4.0"), false)
+
+	select {
+	case <-restarts:
+	case <-time.After(testWait):
+		t.Fatal("the accepted config did not install its update")
+	}
+	if s.Requests("/stale") != 0 || s.Requests("/held") != 0 || s.Requests("/1.4.0") != 1 {
+		t.Errorf("builds downloaded: %v", s.requests)
+	}
+}
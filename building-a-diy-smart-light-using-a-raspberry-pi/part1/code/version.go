@@ -0,0 +1,5 @@
+package main
+
+// version is the build version reported by the device. Release builds set it
+// with -ldflags "-X main.version=<version>".
+var version = "dev"